@@ -0,0 +1,48 @@
+// Package channel runs the proxy of the channel inside a Go program, the
+// pkg packages have the client, the proxy and the protocol
+package channel
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+
+	"github.com/dworld/channel/pkg/proxy"
+)
+
+// Listen runs cfg until ctx is done or the listener is closed, and returns a
+// listener at addr of the client whose Accept yields the connections the
+// client accepts there, the client needs addr in its AllowListen. Proxy.Listen
+// serves more listeners on a proxy run apart
+func Listen(ctx context.Context, cfg *proxy.Proxy, addr string) (net.Listener, error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	go func() {
+		err := cfg.Run(ctx)
+		if ctx.Err() == nil {
+			log.Printf("Run: %s\n", err)
+		}
+		cancel(err)
+	}()
+	ln, err := cfg.Listen(ctx, addr)
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			err = context.Cause(ctx)
+		}
+		cancel(nil)
+		return nil, err
+	}
+	return runListener{Listener: ln, cancel: cancel}, nil
+}
+
+// runListener stops the proxy it runs once closed
+type runListener struct {
+	*proxy.Listener
+	cancel context.CancelCauseFunc
+}
+
+func (ln runListener) Close() error {
+	err := ln.Listener.Close()
+	ln.cancel(nil)
+	return err
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// serveAdmin serves the admin endpoints at Admin, the metrics are at
+// /debug/vars, the status at /status, the streams being piped at /streams,
+// the verify of the channel at /verify, the quotas of a relay at /quotas and
+// the probes at /healthz and /readyz
+func serveAdmin() {
+	http.HandleFunc("/status", handleStatus)
+	http.HandleFunc("/streams", handleStreams)
+	http.HandleFunc("/verify", handleVerify)
+	http.HandleFunc("/quotas", handleQuotas)
+	http.HandleFunc("/exposed", handleExposed)
+	http.HandleFunc("/healthz", handleProbe(func() error { return running.Healthy() }))
+	http.HandleFunc("/readyz", handleProbe(func() error { return running.Ready() }))
+	log.Printf("Listen ADMIN at %s\n", Admin)
+	if err := http.ListenAndServe(Admin, nil); err != nil {
+		log.Printf("ListenAndServe: %s\n", err)
+	}
+}
+
+// handleProbe serves the probe of check, healthz whether the listeners are
+// up and readyz whether the control channel is established too, ok or 503
+// with the reason
+func handleProbe(check func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := check(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "%s\n", err)
+			return
+		}
+		fmt.Fprintf(w, "ok\n")
+	}
+}
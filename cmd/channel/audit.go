@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/dworld/channel/pkg/proxy"
+)
+
+// openAudit opens the audit log of the proxy, nil without -audit-log
+func openAudit() (*proxy.AuditLog, error) {
+	if AuditLog == "" {
+		return nil, nil
+	}
+	key, err := readAuditKey(AuditKey)
+	if err != nil {
+		return nil, err
+	}
+	return proxy.OpenAuditLog(AuditLog, AuditHash, key)
+}
+
+// readAuditKey is the key in file, nil when file is empty
+func readAuditKey(file string) ([]byte, error) {
+	if file == "" {
+		return nil, nil
+	}
+	key, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	key = bytes.TrimSpace(key)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("audit key %s is empty", file)
+	}
+	return key, nil
+}
+
+// runAudit checks the chain and the signatures of an audit log, channel
+// audit [-key file] audit.log
+func runAudit(args []string) error {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	keyFile := flags.String("key", "", "the file of the key the lines are signed with")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: channel audit [-key file] audit.log")
+	}
+	key, err := readAuditKey(*keyFile)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := proxy.VerifyAudit(f, key)
+	if err != nil {
+		return fmt.Errorf("%s: %d lines fine, %s", flags.Arg(0), n, err)
+	}
+	fmt.Printf("%s: %d lines fine\n", flags.Arg(0), n)
+	return nil
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dworld/channel/pkg/client"
+	"github.com/dworld/channel/pkg/protocol"
+	"github.com/dworld/channel/pkg/relay"
+)
+
+// Config is the file of -config, it defines the tunnels of the client, with
+// the token, the listen patterns and the direct rules in place of the flags
+// when set, or the quotas of the clients of a relay. They're reloaded on
+// SIGHUP
+type Config struct {
+	Tunnels     []TunnelConfig `json:"tunnels"`
+	Token       string         `json:"token"`
+	AllowListen []string       `json:"allow_listen"`
+	Direct      []string       `json:"direct"`
+	Quotas      []relay.Quota  `json:"quotas"`
+}
+
+// TunnelConfig is a tunnel of the config, the fields expand ${VAR} and
+// ${VAR:-default} from the environment and the empty ones take the flags
+type TunnelConfig struct {
+	Label        string   `json:"label"`
+	LAddr        string   `json:"laddr"`
+	Mode         string   `json:"mode"`
+	RAddr        string   `json:"raddr"`
+	Agent        string   `json:"agent"`
+	E2EKey       string   `json:"e2e_key"`
+	Hops         []string `json:"hops"`
+	Protocol     string   `json:"protocol"`
+	Reset        string   `json:"reset"`
+	ResetDelay   string   `json:"reset_delay"`
+	Compress     string   `json:"compress"`
+	Routes       []string `json:"routes"`
+	SniffTimeout string   `json:"sniff_timeout"`
+	Flush        string   `json:"flush"`
+	NoDelay      string   `json:"nodelay"`
+	Preset       string   `json:"preset"`
+	MaxStreams   string   `json:"max_streams"`
+	ACMEHosts    []string `json:"acme_hosts"`
+	Resolve      string   `json:"resolve"`
+	TLS          string   `json:"tls"`
+	SNI          string   `json:"sni"`
+}
+
+// loadConfig reads the tunnels of file, defaults is the tunnel of the flags
+func loadConfig(file string, defaults client.Tunnel) ([]*client.Tunnel, *Config, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	var config Config
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, nil, fmt.Errorf("config %s: %s", file, err)
+	}
+	if len(config.Tunnels) == 0 {
+		return nil, nil, fmt.Errorf("config %s: no tunnels", file)
+	}
+	if config.Token != "" {
+		if config.Token, err = expandString(config.Token); err != nil {
+			return nil, nil, fmt.Errorf("config %s: token: %s", file, err)
+		}
+		if config.Token == "" {
+			return nil, nil, fmt.Errorf("config %s: empty token", file)
+		}
+	}
+	var tunnels []*client.Tunnel
+	for i, tc := range config.Tunnels {
+		name := tc.Label
+		if name == "" {
+			name = fmt.Sprint(i)
+		}
+		tunnel, err := tc.tunnel(defaults)
+		if err != nil {
+			return nil, nil, fmt.Errorf("config %s: tunnel %s: %s", file, name, err)
+		}
+		tunnels = append(tunnels, tunnel)
+	}
+	return tunnels, &config, nil
+}
+
+// loadQuotas reads the quotas of the clients of a relay from file
+func loadQuotas(file string) ([]relay.Quota, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("config %s: %s", file, err)
+	}
+	if err := relay.ValidateQuotas(config.Quotas); err != nil {
+		return nil, fmt.Errorf("config %s: %s", file, err)
+	}
+	return config.Quotas, nil
+}
+
+// reloadQuotas reloads the quotas of ConfigFile into r on each SIGHUP, a
+// config which fails to load is logged and the relay keeps the quotas before
+func reloadQuotas(r *relay.Relay) {
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	for range hups {
+		done := sdReloading()
+		quotas, err := loadQuotas(ConfigFile)
+		if err == nil {
+			err = r.SetQuotas(quotas)
+		}
+		done()
+		if err != nil {
+			log.Printf("Reload %s: %s\n", ConfigFile, err)
+			continue
+		}
+		log.Printf("Reloaded %s\n", ConfigFile)
+	}
+}
+
+// credentials are the token and the listen patterns of the config, those of
+// the flags when it leaves them out
+func (config *Config) credentials() (string, []string) {
+	token, allowListen := Token, splitList(AllowListen)
+	if config.Token != "" {
+		token = config.Token
+	}
+	if config.AllowListen != nil {
+		allowListen = config.AllowListen
+	}
+	return token, allowListen
+}
+
+// directRules are the direct rules of the config, those of the flags when it
+// leaves them out
+func (config *Config) directRules() ([]client.DirectRule, error) {
+	if config.Direct == nil {
+		return Direct, nil
+	}
+	rules := []client.DirectRule{}
+	for _, s := range config.Direct {
+		s, err := expandString(s)
+		if err != nil {
+			return nil, fmt.Errorf("config %s: direct: %s", ConfigFile, err)
+		}
+		rule, err := client.ParseDirectRule(s)
+		if err != nil {
+			return nil, fmt.Errorf("config %s: %s", ConfigFile, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// reloadConfigs reloads ConfigFile into c on each SIGHUP, defaults is the
+// tunnel of the flags. A config which fails to load or apply is logged and
+// the client keeps the one before
+func reloadConfigs(c *client.Client, defaults client.Tunnel) {
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	for range hups {
+		done := sdReloading()
+		err := reloadConfig(c, defaults)
+		done()
+		if err != nil {
+			log.Printf("Reload %s: %s\n", ConfigFile, err)
+			continue
+		}
+		log.Printf("Reloaded %s\n", ConfigFile)
+	}
+}
+
+func reloadConfig(c *client.Client, defaults client.Tunnel) error {
+	tunnels, config, err := loadConfig(ConfigFile, defaults)
+	if err != nil {
+		return err
+	}
+	tunnels = withDNS(tunnels, defaults)
+	token, allowListen := config.credentials()
+	auth, err := newAuth(token)
+	if err != nil {
+		return err
+	}
+	direct, err := config.directRules()
+	if err != nil {
+		return err
+	}
+	return c.Reload(client.Update{Tunnels: tunnels, Auth: auth, Token: token, AllowListen: allowListen, Direct: direct})
+}
+
+// withDNS adds the dns tunnel of -dns to tunnels, it takes the options of
+// defaults, the tunnel of the flags
+func withDNS(tunnels []*client.Tunnel, defaults client.Tunnel) []*client.Tunnel {
+	if DNS == "" {
+		return tunnels
+	}
+	tunnel := defaults
+	tunnel.Label, tunnel.LAddr, tunnel.Mode, tunnel.RAddr = "dns", DNS, client.ModeDNS, DNSUpstream
+	tunnel.Protocol, tunnel.Routes, tunnel.ACME = "", nil, nil
+	return append(tunnels, &tunnel)
+}
+
+func (tc TunnelConfig) tunnel(defaults client.Tunnel) (*client.Tunnel, error) {
+	tc, err := tc.expand()
+	if err != nil {
+		return nil, err
+	}
+	tunnel := defaults
+	tunnel.Label = tc.Label
+	for _, f := range []struct {
+		value string
+		field *string
+	}{
+		{tc.LAddr, &tunnel.LAddr},
+		{tc.Mode, &tunnel.Mode},
+		{tc.RAddr, &tunnel.RAddr},
+		{tc.Agent, &tunnel.Agent},
+		{tc.E2EKey, &tunnel.E2EKey},
+		{tc.Protocol, &tunnel.Protocol},
+		{tc.Reset, &tunnel.Reset},
+		{tc.Preset, &tunnel.Preset},
+		{tc.Resolve, &tunnel.Resolve},
+		{tc.TLS, &tunnel.TLS},
+		{tc.SNI, &tunnel.SNI},
+	} {
+		if f.value != "" {
+			*f.field = f.value
+		}
+	}
+	for _, f := range []struct {
+		value string
+		field *time.Duration
+	}{
+		{tc.ResetDelay, &tunnel.ResetDelay},
+		{tc.SniffTimeout, &tunnel.SniffTimeout},
+	} {
+		if f.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(f.value)
+		if err != nil {
+			return nil, err
+		}
+		*f.field = d
+	}
+	if tc.Compress != "" {
+		codecs, err := protocol.ParseCodecs(tc.Compress)
+		if err != nil {
+			return nil, err
+		}
+		tunnel.Compress = codecs
+	}
+	if tc.Flush != "" {
+		flush, err := protocol.ParseFlushPolicy(tc.Flush)
+		if err != nil {
+			return nil, err
+		}
+		tunnel.Flush = flush
+	}
+	if tc.MaxStreams != "" {
+		n, err := strconv.Atoi(tc.MaxStreams)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid max_streams, %s", tc.MaxStreams)
+		}
+		tunnel.MaxStreams = n
+	}
+	if tc.NoDelay != "" {
+		noDelay, err := protocol.ParseNoDelay(tc.NoDelay)
+		if err != nil {
+			return nil, err
+		}
+		tunnel.NoDelay = noDelay
+	}
+	if tc.Hops != nil {
+		tunnel.Hops = tc.Hops
+	}
+	if tc.ACMEHosts != nil {
+		tunnel.ACME = tc.ACMEHosts
+	}
+	if tc.Routes != nil {
+		tunnel.Routes = nil
+		for _, s := range tc.Routes {
+			route, err := client.ParseRoute(s)
+			if err != nil {
+				return nil, err
+			}
+			tunnel.Routes = append(tunnel.Routes, route)
+		}
+	}
+	return &tunnel, nil
+}
+
+// expandEnv expands ${VAR} and ${VAR:-default} of s from the environment,
+// the variables unset or empty without a default are added to missing. $$ is
+// a $ and any other $ is kept as is
+func expandEnv(s string, missing *[]string) string {
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(s, '$')
+		if i < 0 || i == len(s)-1 {
+			b.WriteString(s)
+			return b.String()
+		}
+		b.WriteString(s[:i])
+		s = s[i+1:]
+		switch s[0] {
+		case '$':
+			b.WriteByte('$')
+			s = s[1:]
+		case '{':
+			end := strings.IndexByte(s, '}')
+			if end < 0 {
+				b.WriteByte('$')
+				continue
+			}
+			b.WriteString(lookupEnv(s[1:end], missing))
+			s = s[end+1:]
+		default:
+			b.WriteByte('$')
+		}
+	}
+}
+
+// lookupEnv is the value of VAR or VAR:-default
+func lookupEnv(name string, missing *[]string) string {
+	name, def, hasDef := strings.Cut(name, ":-")
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	if !hasDef {
+		*missing = append(*missing, name)
+	}
+	return def
+}
+
+// missingError is the error of the variables expandEnv missed, nil when
+// none
+func missingError(missing []string) error {
+	if len(missing) > 0 {
+		return fmt.Errorf("environment variables not set, %s", strings.Join(missing, ","))
+	}
+	return nil
+}
+
+// expandString is s expanded as the fields of the tunnels
+func expandString(s string) (string, error) {
+	var missing []string
+	s = expandEnv(s, &missing)
+	return s, missingError(missing)
+}
+
+// expand expands the environment variables of the fields, the variables
+// unset or empty without a default are an error
+func (tc TunnelConfig) expand() (TunnelConfig, error) {
+	var missing []string
+	expand := func(s string) string {
+		return expandEnv(s, &missing)
+	}
+	for _, field := range []*string{&tc.Label, &tc.LAddr, &tc.Mode, &tc.RAddr, &tc.Agent, &tc.E2EKey, &tc.Protocol, &tc.Reset,
+		&tc.ResetDelay, &tc.Compress, &tc.SniffTimeout, &tc.Flush,
+		&tc.NoDelay, &tc.Preset, &tc.MaxStreams, &tc.Resolve, &tc.TLS, &tc.SNI} {
+		*field = expand(*field)
+	}
+	for _, list := range []*[]string{&tc.Routes, &tc.Hops, &tc.ACMEHosts} {
+		if *list == nil {
+			continue
+		}
+		expanded := make([]string, len(*list))
+		for i, s := range *list {
+			expanded[i] = expand(s)
+		}
+		*list = expanded
+	}
+	return tc, missingError(missing)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("CHANNEL_HOST", "db")
+	t.Setenv("CHANNEL_EMPTY", "")
+	for _, tc := range []struct {
+		in, want string
+		missing  []string
+	}{
+		{"${CHANNEL_HOST}:5432", "db:5432", nil},
+		{"${CHANNEL_UNSET:-local}", "local", nil},
+		{"${CHANNEL_EMPTY:-local}", "local", nil},
+		{"${CHANNEL_UNSET:-}", "", nil},
+		{"${CHANNEL_UNSET}", "", []string{"CHANNEL_UNSET"}},
+		{"${CHANNEL_EMPTY}", "", []string{"CHANNEL_EMPTY"}},
+		{"s3cr$t", "s3cr$t", nil},
+		{"$CHANNEL_HOST", "$CHANNEL_HOST", nil},
+		{"$1", "$1", nil},
+		{"pa$$word", "pa$word", nil},
+		{"$${CHANNEL_HOST}", "${CHANNEL_HOST}", nil},
+		{"$$$", "$$", nil},
+		{"end$", "end$", nil},
+		{"${CHANNEL_HOST", "${CHANNEL_HOST", nil},
+		{"${CHANNEL_HOST}-${CHANNEL_UNSET}", "db-", []string{"CHANNEL_UNSET"}},
+	} {
+		var missing []string
+		if got := expandEnv(tc.in, &missing); got != tc.want {
+			t.Errorf("expandEnv(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+		if !reflect.DeepEqual(missing, tc.missing) {
+			t.Errorf("expandEnv(%q) missed %v, want %v", tc.in, missing, tc.missing)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/dworld/channel/pkg/protocol"
+)
+
+// conformanceCheck exercises one behavior of the peer, it returns
+// errSkipCheck when the behavior doesn't apply
+type conformanceCheck struct {
+	name string
+	run  func() error
+}
+
+var errSkipCheck = errors.New("skipped")
+
+// conformanceReplyTimeout is how long a check waits for a reply
+const conformanceReplyTimeout = 5 * time.Second
+
+// runConformance is the conformance subcommand, it plays the proxy against
+// the paddr of a client at -target and reports the deviations, the client
+// loses its control connection to the checks so it mustn't be in use
+func runConformance(args []string) int {
+	var target string
+	flag.StringVar(&target, "target", "", "the paddr of the client to check")
+	flag.CommandLine.Parse(args)
+	if target == "" {
+		log.Printf("conformance needs -target\n")
+		return 2
+	}
+	Mode, PAddr = "proxy", target
+	channel = newChannel(PAddr)
+	if err := channel.Init(false); err != nil {
+		log.Printf("%s\n", err)
+		return 2
+	}
+	failed := 0
+	for _, check := range conformanceChecks {
+		err := check.run()
+		switch err {
+		case nil:
+			fmt.Printf("PASS %s\n", check.name)
+		case errSkipCheck:
+			fmt.Printf("SKIP %s\n", check.name)
+		default:
+			failed++
+			fmt.Printf("FAIL %s: %s\n", check.name, err)
+		}
+	}
+	if failed > 0 {
+		fmt.Printf("%d of %d checks deviate\n", failed, len(conformanceChecks))
+		return 1
+	}
+	return 0
+}
+
+var conformanceChecks = []conformanceCheck{
+	{"handshake", checkHandshake},
+	{"mux-handshake", checkMuxHandshake},
+	{"malformed-frame", checkMalformedFrame},
+	{"invalid-conn-id", func() error { return checkNack("garbage\n") }},
+	{"zero-conn-id", func() error { return checkNack("0\n") }},
+	{"duplicated-conn-id", checkDuplicatedConnID},
+	{"line-limit", checkLineLimit},
+	{"handshake-timeout", checkHandshakeTimeout},
+	{"auth-failure", checkAuthFailure},
+}
+
+// readReply reads a line from conn within conformanceReplyTimeout
+func readReply(conn net.Conn, r *bufio.Reader) (string, error) {
+	conn.SetReadDeadline(time.Now().Add(conformanceReplyTimeout))
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("no reply, %s", err)
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// expectClosed waits for the peer to close conn without replying
+func expectClosed(conn net.Conn, timeout time.Duration) error {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	var netErr net.Error
+	switch {
+	case n > 0:
+		return fmt.Errorf("replied %s instead of closing", protocol.HexPrefix(buf[:n]))
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return fmt.Errorf("still open after %s", timeout)
+	}
+	return nil
+}
+
+func sendHello(conn net.Conn, mux bool) error {
+	hello := protocol.LocalCapabilities().Options()
+	if mux {
+		hello["mux"] = "1"
+	}
+	_, err := io.WriteString(conn, protocol.FormatLine("ctrl", hello))
+	return err
+}
+
+func checkHandshake() error {
+	conn, err := channel.Dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := sendHello(conn, false); err != nil {
+		return err
+	}
+	line, err := readReply(conn, bufio.NewReader(conn))
+	if err != nil {
+		return err
+	}
+	if head, _ := protocol.ParseLine(line); head != "caps" {
+		return fmt.Errorf("replied %q instead of caps", line)
+	}
+	return nil
+}
+
+// readMuxFrame reads a frame header and payload from a mux session
+func readMuxFrame(conn net.Conn) (byte, uint32, []byte, error) {
+	conn.SetReadDeadline(time.Now().Add(conformanceReplyTimeout))
+	header := make([]byte, protocol.MuxHeaderSize)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return 0, 0, nil, fmt.Errorf("no frame, %s", err)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[5:]))
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return 0, 0, nil, fmt.Errorf("short frame, %s", err)
+	}
+	return header[0], binary.BigEndian.Uint32(header[1:]), payload, nil
+}
+
+func muxFrameBytes(typ byte, stream uint32, payload []byte) []byte {
+	frame := make([]byte, protocol.MuxHeaderSize, protocol.MuxHeaderSize+len(payload))
+	frame[0] = typ
+	binary.BigEndian.PutUint32(frame[1:], stream)
+	binary.BigEndian.PutUint16(frame[5:], uint16(len(payload)))
+	return append(frame, payload...)
+}
+
+func muxHello() (net.Conn, error) {
+	conn, err := channel.Dial()
+	if err != nil {
+		return nil, err
+	}
+	if err := sendHello(conn, true); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	typ, stream, payload, err := readMuxFrame(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if typ != protocol.MuxData || stream != 0 || !strings.HasPrefix(string(payload), "caps") {
+		conn.Close()
+		return nil, fmt.Errorf("replied frame type %d stream %d %s instead of caps on the control stream", typ, stream, protocol.HexPrefix(payload))
+	}
+	return conn, nil
+}
+
+func checkMuxHandshake() error {
+	conn, err := muxHello()
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func checkMalformedFrame() error {
+	conn, err := muxHello()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Write(muxFrameBytes(0x7f, 1, []byte("bogus"))); err != nil {
+		return err
+	}
+	return expectClosed(conn, conformanceReplyTimeout)
+}
+
+func checkNack(line string) error {
+	conn, err := channel.Dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, line); err != nil {
+		return err
+	}
+	reply, err := readReply(conn, bufio.NewReader(conn))
+	if err != nil {
+		return err
+	}
+	if reply != "nack" {
+		return fmt.Errorf("replied %q to %q instead of nack", reply, strings.TrimSpace(line))
+	}
+	return nil
+}
+
+func checkDuplicatedConnID() error {
+	// a conn id the client never handed out, far above the ones in use
+	var raw [2]byte
+	rand.Read(raw[:])
+	id := fmt.Sprintf("%d\n", 1<<30+int(binary.BigEndian.Uint16(raw[:])))
+	conn, err := channel.Dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, id); err != nil {
+		return err
+	}
+	reply, err := readReply(conn, bufio.NewReader(conn))
+	if err != nil {
+		return err
+	}
+	if reply != "ok" {
+		return fmt.Errorf("replied %q to the first use instead of ok", reply)
+	}
+	return checkNack(id)
+}
+
+func checkLineLimit() error {
+	conn, err := channel.Dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(strings.Repeat("1", 64*1024))); err != nil {
+		return err
+	}
+	return expectClosed(conn, conformanceReplyTimeout)
+}
+
+func checkHandshakeTimeout() error {
+	conn, err := channel.Dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return expectClosed(conn, HandshakeTimeout+conformanceReplyTimeout)
+}
+
+// checkAuthFailure sends garbage in place of the psk or noise encryption,
+// the peer must close without replying anything
+func checkAuthFailure() error {
+	if !channel.Encrypted() {
+		return errSkipCheck
+	}
+	conn, err := channel.DialObfuscated()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	garbage := make([]byte, 256)
+	rand.Read(garbage)
+	if _, err := conn.Write(garbage); err != nil {
+		return err
+	}
+	return expectClosed(conn, HandshakeTimeout+conformanceReplyTimeout)
+}
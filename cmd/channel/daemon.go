@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// daemonEnv marks the process -daemon started in background
+const daemonEnv = "CHANNEL_DAEMON"
+
+// daemonize starts the program again in background detached from the
+// terminal, with the same flags, and exits once it's started, in the
+// background process it returns at once
+func daemonize() error {
+	if os.Getenv(daemonEnv) != "" {
+		return nil
+	}
+	// a daemon running already is told here, the background one can only
+	// log it
+	if err := checkPidFile(PidFile); err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	null, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer null.Close()
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = null, null, null
+	cmd.SysProcAttr = detachedProcess()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	fmt.Printf("channel started in background, pid %d\n", cmd.Process.Pid)
+	os.Exit(0)
+	return nil
+}
+
+// checkPidFile fails when the process of the pid file is running, a pid file
+// left by a process gone is fine
+func checkPidFile(file string) error {
+	if file == "" {
+		return nil
+	}
+	pid, err := readPidFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if processAlive(pid) {
+		return fmt.Errorf("already running, pid %d of %s", pid, file)
+	}
+	return nil
+}
+
+// writePidFile writes the pid of the process to file, unless another
+// running process wrote it
+func writePidFile(file string) error {
+	if err := checkPidFile(file); err != nil {
+		return err
+	}
+	return os.WriteFile(file, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// removePidFile removes file if it's still of the process
+func removePidFile(file string) {
+	if pid, err := readPidFile(file); err == nil && pid == os.Getpid() {
+		os.Remove(file)
+	}
+}
+
+func readPidFile(file string) (int, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("invalid pid file %s", file)
+	}
+	return pid, nil
+}
+
+// stopContext is done on SIGINT and SIGTERM, so Run returns and the pid
+// file is removed
+func stopContext() context.Context {
+	ctx, _ := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	return ctx
+}
+
+// ignoreHangups logs the SIGHUPs of a process with no config to reload
+// rather than be stopped by them
+func ignoreHangups() {
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	for range hups {
+		log.Printf("SIGHUP: nothing to reload without -config\n")
+	}
+}
+
+// runSignal is the stop and reload subcommands, they signal the process of
+// a pid file, stop waits it to exit
+func runSignal(name string, args []string) error {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	file := flags.String("pidfile", "", "the pid file of the process")
+	timeout := flags.Duration("timeout", 10*time.Second, "how long stop waits the process to exit")
+	flags.Parse(args)
+	if *file == "" {
+		return errors.New("-pidfile is needed")
+	}
+	pid, err := readPidFile(*file)
+	if err != nil {
+		return err
+	}
+	if !processAlive(pid) {
+		return fmt.Errorf("not running, pid %d of %s", pid, *file)
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	if name == "reload" {
+		return proc.Signal(syscall.SIGHUP)
+	}
+	if err := proc.Signal(syscall.SIGTERM); err != nil {
+		return err
+	}
+	for deadline := time.Now().Add(*timeout); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		// the pid file is removed on the way out, before the exit is reaped
+		if now, err := readPidFile(*file); err != nil || now != pid || !processAlive(pid) {
+			log.Printf("Stopped %d\n", pid)
+			return nil
+		}
+	}
+	return fmt.Errorf("pid %d still running after %s", pid, *timeout)
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/dworld/channel/pkg/client"
+)
+
+// handleExposed serves the registry of the HTTP servers the proxies exposed
+// at the reverse tunnels of the client
+func handleExposed(w http.ResponseWriter, r *http.Request) {
+	c, ok := running.(*client.Client)
+	if !ok {
+		http.Error(w, "exposed servers need the client mode", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(c.ExposedHosts())
+}
@@ -0,0 +1,22 @@
+//go:build kcp
+// +build kcp
+
+package main
+
+import (
+	"flag"
+
+	"github.com/dworld/channel/pkg/transport"
+)
+
+func init() {
+	kcp := &transport.KCPOptions
+	flag.IntVar(&kcp.DataShards, "kcp-datashard", kcp.DataShards, "the FEC data shards of kcp, 0 disables FEC")
+	flag.IntVar(&kcp.ParityShards, "kcp-parityshard", kcp.ParityShards, "the FEC parity shards of kcp")
+	flag.IntVar(&kcp.SendWindow, "kcp-sndwnd", kcp.SendWindow, "the send window of kcp in packets")
+	flag.IntVar(&kcp.RecvWindow, "kcp-rcvwnd", kcp.RecvWindow, "the receive window of kcp in packets")
+	flag.IntVar(&kcp.MTU, "kcp-mtu", kcp.MTU, "the MTU of kcp packets")
+	flag.BoolVar(&kcp.NoDelay, "kcp-nodelay", kcp.NoDelay, "retransmit early and don't back off, for lossy links")
+	flag.IntVar(&kcp.Interval, "kcp-interval", kcp.Interval, "the internal update interval of kcp in milliseconds")
+	flag.IntVar(&kcp.Resend, "kcp-resend", kcp.Resend, "resend after this many duplicated acks, 0 waits the timeout")
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTime is the time of the rotation in the names of the backups,
+// file-20060102T150405.000.log, a sequence follows it when the millisecond
+// has a backup already, file-20060102T150405.000.1.log
+const backupTime = "20060102T150405.000"
+
+// rotatingLog is the file of -log-file, renamed to a backup once it's past
+// maxSize and written anew. The backups past maxAge or maxBackups are
+// removed and the others gzipped with compress
+type rotatingLog struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	compress   bool
+
+	lock sync.Mutex
+	f    *os.File
+	size int64
+	// cleanups wakes the goroutine compressing and removing the backups,
+	// one rotation at a time
+	cleanups chan struct{}
+}
+
+// openLog opens path to append the logs to, maxSize 0 never rotates it,
+// maxAge and maxBackups 0 keep the backups
+func openLog(path string, maxSize int64, maxAge time.Duration, maxBackups int, compress bool) (*rotatingLog, error) {
+	l := &rotatingLog{
+		path:       path,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+		compress:   compress,
+		cleanups:   make(chan struct{}, 1),
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	go l.cleanupLoop()
+	// the backups left by the process before
+	l.cleanups <- struct{}{}
+	return l, nil
+}
+
+func (l *rotatingLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size = f, info.Size()
+	return nil
+}
+
+func (l *rotatingLog) Write(p []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(p)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			// the logs go on to the file as it is
+			fmt.Fprintf(os.Stderr, "rotate %s: %s\n", l.path, err)
+		}
+	}
+	n, err := l.f.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// rotate renames the file to a backup and opens it anew
+func (l *rotatingLog) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(l.path, l.backupName(time.Now())); err != nil {
+		if oerr := l.open(); oerr != nil {
+			return oerr
+		}
+		return err
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+	select {
+	case l.cleanups <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// backupName is the name of the backup rotated at t, one no backup has
+func (l *rotatingLog) backupName(t time.Time) string {
+	ext := filepath.Ext(l.path)
+	base := strings.TrimSuffix(l.path, ext) + "-" + t.Format(backupTime)
+	name := base + ext
+	for seq := 1; exists(name) || exists(name+".gz"); seq++ {
+		name = fmt.Sprintf("%s.%d%s", base, seq, ext)
+	}
+	return name
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// logBackup is a backup of the log and when it was rotated, seq orders the
+// backups of the same millisecond
+type logBackup struct {
+	path string
+	time time.Time
+	seq  int
+}
+
+// backups lists the backups of the log, the newest first
+func (l *rotatingLog) backups() ([]logBackup, error) {
+	dir := filepath.Dir(l.path)
+	ext := filepath.Ext(l.path)
+	prefix := strings.TrimSuffix(filepath.Base(l.path), ext) + "-"
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var list []logBackup
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimSuffix(name[len(prefix):], ".gz"), ext)
+		seq := 0
+		if len(stamp) > len(backupTime) && stamp[len(backupTime)] == '.' {
+			if seq, err = strconv.Atoi(stamp[len(backupTime)+1:]); err != nil {
+				continue
+			}
+			stamp = stamp[:len(backupTime)]
+		}
+		t, err := time.ParseInLocation(backupTime, stamp, time.Local)
+		if err != nil {
+			continue
+		}
+		list = append(list, logBackup{path: filepath.Join(dir, name), time: t, seq: seq})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].time.Equal(list[j].time) {
+			return list[i].time.After(list[j].time)
+		}
+		return list[i].seq > list[j].seq
+	})
+	return list, nil
+}
+
+func (l *rotatingLog) cleanupLoop() {
+	for range l.cleanups {
+		if err := l.cleanup(); err != nil {
+			fmt.Fprintf(os.Stderr, "clean up the backups of %s: %s\n", l.path, err)
+		}
+	}
+}
+
+// cleanup removes the backups too old or too many and compresses the others
+func (l *rotatingLog) cleanup() error {
+	list, err := l.backups()
+	if err != nil {
+		return err
+	}
+	for i, backup := range list {
+		if l.maxBackups > 0 && i >= l.maxBackups || l.maxAge > 0 && time.Since(backup.time) > l.maxAge {
+			if err := os.Remove(backup.path); err != nil {
+				return err
+			}
+			continue
+		}
+		if l.compress && !strings.HasSuffix(backup.path, ".gz") {
+			if err := gzipFile(backup.path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// gzipFile compresses path to path.gz and removes it
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	// written aside first so a backup is never half compressed
+	tmp := path + ".gz.tmp"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path+".gz")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	src.Close()
+	return os.Remove(path)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testLog is a log of dir rotated past maxSize, its backups cleaned up by
+// the test rather than by the goroutine of openLog
+func testLog(t *testing.T, maxSize int64, maxAge time.Duration, maxBackups int, compress bool) *rotatingLog {
+	t.Helper()
+	l := &rotatingLog{
+		path:       filepath.Join(t.TempDir(), "channel.log"),
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+		compress:   compress,
+		cleanups:   make(chan struct{}, 1),
+	}
+	if err := l.open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.f.Close() })
+	return l
+}
+
+// backupFiles is the names of the files of the log dir but the log
+func backupFiles(t *testing.T, l *rotatingLog) []string {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Dir(l.path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if name := entry.Name(); name != filepath.Base(l.path) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestLogBackupNameSameMillisecond(t *testing.T) {
+	l := testLog(t, 0, 0, 0, false)
+	now := time.Date(2026, 1, 2, 3, 4, 5, 6e6, time.Local)
+	want := []string{
+		"channel-20260102T030405.006.log",
+		"channel-20260102T030405.006.1.log",
+		"channel-20260102T030405.006.2.log",
+	}
+	for i, w := range want {
+		name := l.backupName(now)
+		if got := filepath.Base(name); got != w {
+			t.Fatalf("backup %d named %s, want %s", i, got, w)
+		}
+		if err := os.WriteFile(name, []byte{byte(i)}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a compressed backup takes its name as well
+	if err := os.Rename(filepath.Join(filepath.Dir(l.path), want[2]), filepath.Join(filepath.Dir(l.path), want[2]+".gz")); err != nil {
+		t.Fatal(err)
+	}
+	if got := filepath.Base(l.backupName(now)); got == want[2] {
+		t.Errorf("backup named %s over its gzip", got)
+	}
+	list, err := l.backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 || list[0].seq != 2 || list[2].seq != 0 {
+		t.Errorf("backups %+v, want the sequence 2, 1, 0", list)
+	}
+}
+
+func TestLogRotate(t *testing.T) {
+	old := time.Now().Add(-48 * time.Hour)
+	for _, tc := range []struct {
+		name       string
+		maxAge     time.Duration
+		maxBackups int
+		compress   bool
+		writes     int
+		stale      bool
+		want       int
+		gz         bool
+	}{
+		{"keeps all", 0, 0, false, 5, false, 4, false},
+		{"max backups", 0, 2, false, 5, false, 2, false},
+		{"max age", 24 * time.Hour, 0, false, 3, true, 2, false},
+		{"compress", 0, 0, true, 3, false, 2, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l := testLog(t, 10, tc.maxAge, tc.maxBackups, tc.compress)
+			if tc.stale {
+				stale := strings.TrimSuffix(l.path, ".log") + "-" + old.Format(backupTime) + ".log"
+				if err := os.WriteFile(stale, []byte("stale\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// each write is past maxSize with the one before
+			for i := 0; i < tc.writes; i++ {
+				if _, err := l.Write([]byte("0123456\n")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := l.cleanup(); err != nil {
+				t.Fatal(err)
+			}
+			names := backupFiles(t, l)
+			if len(names) != tc.want {
+				t.Fatalf("backups %v, want %d", names, tc.want)
+			}
+			for _, name := range names {
+				if strings.HasSuffix(name, ".gz") != tc.gz {
+					t.Errorf("backup %s, gzipped %v", name, tc.gz)
+				}
+				if strings.Contains(name, old.Format(backupTime)) {
+					t.Errorf("backup %s past max age kept", name)
+				}
+			}
+			data, err := os.ReadFile(l.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "0123456\n" {
+				t.Errorf("log has %q after the rotation", data)
+			}
+		})
+	}
+}
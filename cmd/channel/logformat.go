@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+)
+
+// log formats of -log-format
+const (
+	LogText = "text"
+	LogJSON = "json"
+)
+
+// logEntry is a line of the json log format
+type logEntry struct {
+	Time string `json:"time"`
+	Mode string `json:"mode"`
+	Msg  string `json:"msg"`
+}
+
+// jsonLog writes each log to w as a JSON line of its time, the mode and the
+// message, the logger writes them one at a time
+type jsonLog struct {
+	w io.Writer
+}
+
+func (l jsonLog) Write(p []byte) (int, error) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(logEntry{
+		Time: time.Now().Format(time.RFC3339Nano),
+		Mode: Mode,
+		Msg:  strings.TrimSuffix(string(p), "\n"),
+	})
+	if err != nil {
+		return 0, err
+	}
+	if _, err := l.w.Write(b.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
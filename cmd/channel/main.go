@@ -0,0 +1,1001 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dworld/channel/pkg/client"
+	"github.com/dworld/channel/pkg/protocol"
+	"github.com/dworld/channel/pkg/proxy"
+	"github.com/dworld/channel/pkg/relay"
+	"github.com/dworld/channel/pkg/transport"
+)
+
+var (
+	// Mode is the server work mode, client, proxy, relay or stdio
+	Mode string
+	// Target is where the stdio mode forwards stdin and stdout
+	Target string
+	// Name names the proxy to the client or relay, or a client to a relay
+	Name string
+	// Agent is the name of the proxy the tunnel of the flags goes through
+	Agent string
+	// Balance spreads the streams of the tunnels without an agent across the
+	// proxies connected
+	Balance string
+	// E2E is the noise public key of the agent sealing the streams of the
+	// tunnel of the flags end to end
+	E2E string
+	// Hops is the comma separated key@host:port hops the streams of the
+	// tunnel of the flags are chained through after the agent
+	Hops string
+	// HopListen is where the proxy serves as a hop of the chains
+	HopListen string
+	// Expose is the comma separated name=host:port of the HTTP servers the
+	// proxy exposes at the reverse tunnels of the client
+	Expose string
+	// ExposeDomain is the domain the client exposes them under
+	ExposeDomain string
+	// E2EKey is the file of the static key of the end to end streams
+	E2EKey string
+	// E2EPeers is the comma separated public keys of the clients the proxy
+	// accepts end to end streams of
+	E2EPeers string
+	// Relay makes the client dial PAddr, a relay, for its tunnels
+	Relay bool
+	// Exec is the command line of the proxy the client runs as its child,
+	// over its stdin and stdout
+	Exec string
+	// RelayAllow is the comma separated client=agent patterns of the pairs
+	// a relay brokers
+	RelayAllow string
+	// LAddr is the local address
+	LAddr string
+	// PAddr is the proxy address, the proxy takes a comma separated list of
+	// them to fail over to in turn
+	PAddr string
+	// FailoverTimeout is how long the proxy dials a paddr again before
+	// failing over to the next
+	FailoverTimeout time.Duration
+	// TunnelMode is what LAddr serves, forward to RAddr, socks5 or http
+	TunnelMode string
+	// RAddr is the real address
+	RAddr string
+	// Protocol is the backend protocol of RAddr, used to reply protocol errors
+	Protocol string
+	// Routes route the connections at LAddr by their first bytes
+	Routes routeFlags
+	// Direct is the destinations the client dials itself
+	Direct directFlags
+	// TunnelPrivate tunnels the private destinations in spite of -direct
+	TunnelPrivate bool
+	// Resolvers is the comma separated DNS servers resolving the remotes
+	Resolvers string
+	// ResolveTimeout is how long a DNS server has to answer
+	ResolveTimeout time.Duration
+	// ResolveCache is how long the answers are reused
+	ResolveCache time.Duration
+	// SniffTimeout is how long the routes wait for the first bytes
+	SniffTimeout time.Duration
+	// Flush is the flush policy of the streams of the tunnel
+	Flush string
+	// NoDelay turns Nagle's algorithm off or on for the tunnel, true or false
+	NoDelay string
+	// Preset is the latency or throughput preset of the tunnel
+	Preset string
+	// TunnelMaxStreams caps the streams of the tunnel open at once
+	TunnelMaxStreams int
+	// Resolve is where the tunnel resolves the host names of the remotes
+	Resolve string
+	// AllowExec is the command lines the exec targets may run on the proxy
+	AllowExec string
+	// OriginTLS wraps the connections of the tunnel to the remotes in TLS,
+	// verify or insecure
+	OriginTLS string
+	// OriginSNI is the server name of the TLS of OriginTLS
+	OriginSNI string
+	// OriginCA is the CA file verifying the remotes of OriginTLS
+	OriginCA string
+	// DNS is the address the client forwards the DNS queries from, over UDP
+	// and TCP, to DNSUpstream through the proxy
+	DNS string
+	// DNSUpstream is the resolver the proxy asks the queries of DNS
+	DNSUpstream string
+	// ACMEHosts is the comma separated host names the tunnel terminates the
+	// TLS of with the certificates of ACME
+	ACMEHosts string
+	// Reset is how a failed tunnel connection ends, rst, fin or delay
+	Reset string
+	// ResetDelay is the wait before FIN when Reset is delay
+	ResetDelay time.Duration
+	// BufSize is the size of the buffers used to copy streams
+	BufSize int
+	// Transport is the transport of the channel, tcp, tls, websocket, http2,
+	// kcp or quic
+	Transport string
+	// Obfs is the obfuscator of the channel
+	Obfs string
+	// ObfsHost is the host the http obfuscator pretends to talk to
+	ObfsHost string
+	// NoiseKey is the file of the noise static private key
+	NoiseKey string
+	// NoisePeers is the comma separated noise static public keys of the peers
+	NoisePeers string
+	// Crypt is the lightweight encryption of the channel, psk
+	Crypt string
+	// Key is the pre-shared key of the psk crypt
+	Key string
+	// Upstream is the socks5 server the proxy dials the remotes through
+	Upstream string
+	// BindAddr and BindInterface are the local IP and the interface the
+	// outbound connections of the proxy originate from
+	BindAddr      string
+	BindInterface string
+	// TLSCert and TLSKey are the certificate of the tls transport
+	TLSCert string
+	TLSKey  string
+	// TLSCA is the CA verifying the peers of the tls transport
+	TLSCA string
+	// Auth is the authenticator of the proxies on the client, token or mtls
+	Auth string
+	// Token answers the challenges on the proxy and is checked by the token
+	// auth
+	Token string
+	// AuthSkew is how far the timestamps of the answers to the challenges
+	// of the token auth may be off the clock
+	AuthSkew time.Duration
+	// AuthPlain accepts the token sent without a challenge
+	AuthPlain bool
+	// AuthNames is the comma separated certificate name patterns of the
+	// mtls auth
+	AuthNames string
+	// HTTPProxy is the HTTP proxy the proxy connects to PAddr through
+	HTTPProxy string
+	// BreakerFailures is the dial failures in a row which open the circuit
+	// of a remote
+	BreakerFailures int
+	// BreakerCooldown is how long a circuit is open before a probe dial
+	BreakerCooldown time.Duration
+	// BackendAttempts is the backends of a raddr list a stream dials before
+	// it fails
+	BackendAttempts int
+	// BackendTimeout bounds the dials of the backends of a stream
+	BackendTimeout time.Duration
+	// HealthCheck is how the proxy checks the backends of the raddr lists
+	HealthCheck string
+	// HealthInterval is how often the backends are checked
+	HealthInterval time.Duration
+	// HealthFall is the failed checks in a row a backend is down after
+	HealthFall int
+	// HealthRise is the passed checks in a row a backend is up after
+	HealthRise int
+	// DialFailTTL is how long a failed dial to a remote is replayed to the
+	// next dials of it
+	DialFailTTL time.Duration
+	// Strict refuses to run a plaintext channel without auth off loopback
+	Strict bool
+	// Mux carries the streams on the control connection of the proxy
+	Mux bool
+	// PoolSize is the number of idle data connections kept by the proxy
+	PoolSize int
+	// PoolLifetime is how long an idle pooled data connection is kept
+	PoolLifetime time.Duration
+	// PoolJitter is the random fraction the pool lifetimes are cut by
+	PoolJitter float64
+	// AckDelay is how long control messages are batched
+	AckDelay time.Duration
+	// FlushDelay is how long small writes to the channel are coalesced
+	FlushDelay time.Duration
+	// IdleTimeout closes the streams idle both ways for so long
+	IdleTimeout time.Duration
+	// MaxStreams caps the streams of the client or the proxy open at once
+	MaxStreams int
+	// StreamsWait is how long a stream past the caps waits before it's
+	// refused
+	StreamsWait time.Duration
+	// BanThreshold, BanWindow and BanDuration ban the IPs failing the
+	// handshake or the auth at the channel of the client or relay
+	BanThreshold int
+	BanWindow    time.Duration
+	BanDuration  time.Duration
+	// AcceptRate and AcceptBurst cap the connections accepted from each IP
+	// at the channel and the tunnels of the client or relay
+	AcceptRate  float64
+	AcceptBurst int
+	// ACMEDir, ACMEEmail, ACMEDirectory and ACMEHTTP are the ACME of the
+	// client, enabled by ACMEDir
+	ACMEDir       string
+	ACMEEmail     string
+	ACMEDirectory string
+	ACMEHTTP      string
+	// Admin is the address of the admin endpoints
+	Admin string
+	// HandshakeTimeout is how long a connection to PAddr has to identify itself
+	HandshakeTimeout time.Duration
+	// KeepAliveIdle, KeepAliveInterval and KeepAliveCount tune the TCP
+	// keepalive of the channel connections, a dead peer is told after idle
+	// and count intervals
+	KeepAliveIdle     time.Duration
+	KeepAliveInterval time.Duration
+	KeepAliveCount    int
+	// Compress is the comma separated codecs offered and accepted for streams
+	Compress string
+	// AllowListen is the comma separated address patterns the proxy may ask
+	// the client to listen
+	AllowListen string
+	// AdmitRate is the control connections of the agents the client or
+	// relay admits a second, all when 0
+	AdmitRate float64
+	// AdmitBurst is how many control connections are admitted at once
+	AdmitBurst int
+	// ConfigFile is the JSON file defining the tunnels of the client
+	ConfigFile string
+	// STUN is the comma separated STUN servers finding the public address
+	STUN string
+	// STUNInterval is how often the public address is found again
+	STUNInterval time.Duration
+	// StatusFile is where the status is written every StatusInterval
+	StatusFile string
+	// StatusInterval is how often StatusFile is written
+	StatusInterval time.Duration
+	// AccessLog is the file a JSON line is appended to for each closed
+	// stream, - for stdout
+	AccessLog string
+	// LogFile is the file the logs are appended to in place of stderr
+	LogFile string
+	// LogMaxSize is the size in megabytes LogFile is rotated at, never when 0
+	LogMaxSize int
+	// LogMaxAge is how long the rotated logs are kept, always when 0
+	LogMaxAge time.Duration
+	// LogMaxBackups is how many rotated logs are kept, all when 0
+	LogMaxBackups int
+	// LogCompress gzips the rotated logs
+	LogCompress bool
+	// LogFormat is how the logs are written, text or json
+	LogFormat string
+	// AuditLog is the file a line is appended to for each destination the
+	// proxy dials
+	AuditLog string
+	// AuditHash chains the lines of AuditLog with their hashes
+	AuditHash bool
+	// AuditKey is the file of the key the lines of AuditLog are signed with
+	AuditKey string
+	// Daemon runs the program in background
+	Daemon bool
+	// PidFile is where the pid of the process is written
+	PidFile string
+	// ServeAddr is where the client listens for channel serve-dir
+	ServeAddr string
+	// ServeDir is the directory or file channel serve-dir serves
+	ServeDir string
+	// DebugInvariants is how often the accounting is cross-checked, never
+	// when 0
+	DebugInvariants time.Duration
+
+	showHelp    bool
+	noiseGenKey bool
+)
+
+var (
+	channel      *transport.Channel
+	streamCodecs []string
+	tunnels      []*client.Tunnel
+	// running is the client or proxy of the mode
+	running interface {
+		Run(ctx context.Context) error
+		Control() protocol.ControlInfo
+		LastErrors() []protocol.ErrorEntry
+		Healthy() error
+		Ready() error
+	}
+)
+
+func init() {
+	flag.StringVar(&LAddr, "laddr", "127.0.0.1:7001", "the local address, or unix:///path")
+	flag.StringVar(&PAddr, "paddr", "127.0.0.1:7002", "the proxy address, standby clients comma separated on the proxy")
+	flag.DurationVar(&FailoverTimeout, "failover-timeout", 30*time.Second, "how long the proxy redials a paddr before the next")
+	flag.StringVar(&RAddr, "raddr", "www.qq.com:80", "the real address, a backend list, unix:///path or exec:command")
+	flag.StringVar(&Agent, "agent", "", "the name of the proxy the streams of laddr go through")
+	flag.StringVar(&Balance, "balance", "", "spread the streams across the proxies, round-robin or least-conn")
+	flag.StringVar(&E2E, "e2e", "", "the noise public key of the agent sealing the streams end to end")
+	flag.StringVar(&Hops, "hops", "", "the comma separated key@host:port hops after the agent")
+	flag.StringVar(&HopListen, "hop-listen", "", "where the proxy serves as a hop, needs -e2e-key")
+	flag.StringVar(&Expose, "expose", "", "the comma separated name=host:port HTTP servers the proxy exposes")
+	flag.StringVar(&ExposeDomain, "expose-domain", "", "the domain the exposed HTTP servers are served under")
+	flag.StringVar(&E2EKey, "e2e-key", "", "the file of the noise static key of the end to end streams")
+	flag.StringVar(&E2EPeers, "e2e-peers", "", "the comma separated client keys of the e2e streams, any when empty")
+	flag.StringVar(&TunnelMode, "tunnel-mode", client.ModeForward, "what laddr serves, socks5, http, sni, reverse, transparent, tproxy or dns, forwards when empty")
+	flag.StringVar(&Mode, "mode", "client", "worker mode, client, proxy, relay or stdio")
+	flag.StringVar(&Target, "target", "", "the host:port the stdio mode forwards stdin and stdout to")
+	flag.StringVar(&Name, "name", "", "the name of the proxy or of the relay client, the host name by default")
+	flag.BoolVar(&Relay, "relay", false, "dial paddr, a relay, instead of listening it for the proxy, set on the client")
+	flag.StringVar(&Exec, "exec", "", "the command line of a proxy the client runs as its child")
+	flag.StringVar(&RelayAllow, "relay-allow", "", "the comma separated client=proxy pairs a relay brokers, any when empty")
+	flag.StringVar(&Protocol, "protocol", "", "the backend protocol of raddr, mysql or redis")
+	flag.Var(&Direct, "direct", "dial the matching destinations from the client, domain:, cidr: or port:, repeatable")
+	flag.BoolVar(&TunnelPrivate, "tunnel-private", false, "send the private destinations through the proxy with -direct")
+	flag.StringVar(&Resolvers, "resolver", "", "the comma separated DNS servers, host:port, tls://, https:// or system")
+	flag.DurationVar(&ResolveTimeout, "resolve-timeout", protocol.DefaultResolveTimeout, "how long a DNS server of -resolver has to answer")
+	flag.DurationVar(&ResolveCache, "resolve-cache", time.Minute, "how long the answers of -resolver are reused, 0 asks each time")
+	flag.Var(&Routes, "route", "route by the first bytes, sni:name=raddr, host:name=raddr or ssh=raddr, repeatable")
+	flag.DurationVar(&SniffTimeout, "sniff-timeout", time.Second, "how long the routes wait for the first bytes")
+	flag.StringVar(&Flush, "flush", "", "when the writes of the tunnel are sent, immediate, coalesce[:delay] or size:bytes[:delay]")
+	flag.StringVar(&NoDelay, "nodelay", "", "true or false, turn Nagle's algorithm off or on for the tunnel")
+	flag.StringVar(&Preset, "preset", "", "latency or throughput, a preset of -nodelay and -flush")
+	flag.StringVar(&Resolve, "resolve", client.ResolveProxy, "where the host names of the remotes are resolved, proxy or client")
+	flag.StringVar(&AllowExec, "allow-exec", "", "the comma separated full command lines exec:command may run, * any")
+	flag.StringVar(&OriginTLS, "origin-tls", "", "originate TLS to raddr, verify or insecure, none when empty")
+	flag.StringVar(&OriginSNI, "origin-sni", "", "the server name of the TLS of -origin-tls, the host of the remote when empty")
+	flag.StringVar(&OriginCA, "origin-ca", "", "the CA file verifying the remotes of -origin-tls, the system roots when empty")
+	flag.StringVar(&DNS, "dns", "", "the address the client answers DNS queries at through the proxy")
+	flag.StringVar(&DNSUpstream, "dns-upstream", "1.1.1.1:53", "the resolver the proxy asks the queries of -dns, over TCP")
+	flag.IntVar(&TunnelMaxStreams, "max-tunnel-streams", 0, "the streams of the tunnel open at once, no cap when 0")
+	flag.StringVar(&ACMEHosts, "acme-hosts", "", "the comma separated host names laddr terminates TLS of with ACME")
+	flag.StringVar(&Reset, "reset", client.ResetFIN, "how a failed tunnel connection ends, rst, fin or delay")
+	flag.DurationVar(&ResetDelay, "reset-delay", time.Second, "the wait before FIN when reset is delay")
+	flag.IntVar(&BufSize, "bufsize", protocol.DefaultBufSize, "the buffer size used to copy streams")
+	flag.StringVar(&Transport, "transport", transport.TCP, "the transport of the channel, tcp, tls, websocket, http2, stdio, kcp or quic")
+	flag.StringVar(&Obfs, "obfs", "", "the obfuscator of the channel, http")
+	flag.StringVar(&ObfsHost, "obfs-host", "www.bing.com", "the host the http obfuscator pretends to talk to")
+	flag.StringVar(&NoiseKey, "noise-key", "", "the file of the noise static private key, encrypts the channel with Noise_IK")
+	flag.StringVar(&NoisePeers, "noise-peers", "", "the comma separated noise public keys of the peers allowed")
+	flag.StringVar(&Crypt, "crypt", "", "the lightweight encryption of the channel, psk")
+	flag.StringVar(&Key, "key", "", "the pre-shared key of the psk crypt")
+	flag.StringVar(&TLSCert, "tls-cert", "", "the certificate file of the tls transport, reloaded once renewed")
+	flag.StringVar(&TLSKey, "tls-key", "", "the key file of the tls-cert")
+	flag.StringVar(&TLSCA, "tls-ca", "", "the CA file verifying the peers of the tls transport")
+	flag.StringVar(&Auth, "auth", "", "how the client or relay authenticates the proxies, token or mtls")
+	flag.StringVar(&Token, "token", "", "the token of the token auth")
+	flag.DurationVar(&AuthSkew, "auth-skew", protocol.DefaultSkew, "how far the clock of a proxy may be off for the token auth")
+	flag.BoolVar(&AuthPlain, "auth-plain", false, "the token auth also accepts the plain token, replayable")
+	flag.StringVar(&AuthNames, "auth-names", "", "the comma separated certificate names of the mtls auth, any when empty")
+	flag.StringVar(&Upstream, "upstream", "", "the socks5 server the proxy dials through, socks5://[user:password@]host:port")
+	flag.StringVar(&BindAddr, "bind-addr", "", "the local IP the proxy dials from")
+	flag.StringVar(&BindInterface, "bind-interface", "", "the interface the dials of the proxy are bound to, linux only")
+	flag.StringVar(&HTTPProxy, "http-proxy", "", "the HTTP CONNECT proxy to paddr, HTTPS_PROXY by default")
+	flag.DurationVar(&DialFailTTL, "dial-fail-ttl", 3*time.Second, "how long a failed dial is replayed to the next dials, 0 disables")
+	flag.IntVar(&BreakerFailures, "breaker-failures", 0, "the dial failures in a row opening the circuit of a remote, off when 0")
+	flag.DurationVar(&BreakerCooldown, "breaker-cooldown", 30*time.Second, "how long an open circuit fails the dials fast before a probe dial")
+	flag.IntVar(&BackendAttempts, "backend-attempts", 3, "the backends of a raddr list dialed for a stream, 1 retries none")
+	flag.DurationVar(&BackendTimeout, "backend-timeout", 10*time.Second, "how long the backends of a stream are dialed for")
+	flag.StringVar(&HealthCheck, "health-check", "", "how the backends are checked, tcp or an HTTP path, none when empty")
+	flag.DurationVar(&HealthInterval, "health-interval", 10*time.Second, "how often the backends are checked, the timeout of a check too")
+	flag.IntVar(&HealthFall, "health-fall", 3, "the failed checks in a row a backend is down after")
+	flag.IntVar(&HealthRise, "health-rise", 2, "the passed checks in a row a backend down is up after")
+	flag.BoolVar(&noiseGenKey, "noise-genkey", false, "print a new noise key pair")
+	flag.BoolVar(&Strict, "strict", false, "refuse to run a plaintext channel without auth on a non-loopback paddr")
+	flag.BoolVar(&Mux, "mux", false, "carry the streams on the control connection, set on the proxy")
+	flag.IntVar(&PoolSize, "pool", 0, "the number of idle data connections kept by the proxy")
+	flag.DurationVar(&PoolLifetime, "pool-lifetime", 0, "how long an idle data connection of the pool is kept, 0 until used")
+	flag.Float64Var(&PoolJitter, "pool-jitter", 0.2, "the random fraction cut from -pool-lifetime, negative for none")
+	flag.DurationVar(&AckDelay, "ack-delay", 0, "how long control messages are batched, 0 writes at once")
+	flag.DurationVar(&FlushDelay, "flush-delay", 0, "how long small writes to the channel are coalesced, 0 writes at once")
+	flag.DurationVar(&IdleTimeout, "idle-timeout", 0, "close the streams no byte moved on either way for so long, 0 never does")
+	flag.IntVar(&MaxStreams, "max-streams", 0, "the streams of the client or the proxy open at once, no cap when 0")
+	flag.DurationVar(&StreamsWait, "streams-wait", 0, "how long a stream past the caps waits a slot, 0 refuses it at once")
+	flag.IntVar(&BanThreshold, "ban-threshold", 0, "the failed handshakes of an IP within -ban-window banning it, none when 0")
+	flag.DurationVar(&BanWindow, "ban-window", time.Minute, "the window the failures of -ban-threshold are counted over")
+	flag.DurationVar(&BanDuration, "ban-duration", 10*time.Minute, "how long an IP past -ban-threshold is banned")
+	flag.Float64Var(&AcceptRate, "accept-rate", 0, "the connections accepted a second from each IP, no cap when 0")
+	flag.IntVar(&AcceptBurst, "accept-burst", 20, "the connections an IP may open at once past -accept-rate")
+	flag.StringVar(&ACMEDir, "acme-dir", "", "the directory caching the ACME account and certificates, needs the acme tag")
+	flag.StringVar(&ACMEEmail, "acme-email", "", "the contact of the ACME account")
+	flag.StringVar(&ACMEDirectory, "acme-directory", "", "the directory URL of the ACME CA, Let's Encrypt when empty")
+	flag.StringVar(&ACMEHTTP, "acme-http", "", "the address the HTTP-01 challenges are answered at, e.g. :80")
+	flag.StringVar(&Admin, "admin", "", "the address of the admin endpoints")
+	flag.Float64Var(&AdmitRate, "admit-rate", 0, "the control connections admitted a second, all when 0")
+	flag.IntVar(&AdmitBurst, "admit-burst", 20, "how many control connections are admitted at once with -admit-rate")
+	flag.DurationVar(&HandshakeTimeout, "handshake-timeout", 10*time.Second, "how long a connection to paddr has to identify itself")
+	flag.DurationVar(&KeepAliveIdle, "keepalive-idle", 0, "how long a channel connection is idle before the keepalive probes")
+	flag.DurationVar(&KeepAliveInterval, "keepalive-interval", 0, "the interval of the TCP keepalive probes of the channel connections, 15s when 0")
+	flag.IntVar(&KeepAliveCount, "keepalive-count", 0, "how many TCP keepalive probes unanswered close a channel connection, 9 when 0")
+	flag.StringVar(&Compress, "compress", "", "the comma separated codecs of the streams, flate, snappy or zstd")
+	flag.StringVar(&AllowListen, "allow-listen", "", "the comma separated addresses the proxy may ask the client to listen at")
+	flag.StringVar(&ConfigFile, "config", "", "the JSON config file of the client or relay, reloaded on SIGHUP")
+	flag.StringVar(&STUN, "stun", "", "the comma separated STUN servers finding the public address")
+	flag.DurationVar(&STUNInterval, "stun-interval", 10*time.Minute, "how often the public address is found again")
+	flag.StringVar(&StatusFile, "status-file", "", "the file the JSON status is written to")
+	flag.DurationVar(&StatusInterval, "status-interval", 5*time.Second, "how often the status file is written")
+	flag.StringVar(&AccessLog, "access-log", "", "the JSON lines file of the closed streams, - for stdout")
+	flag.StringVar(&AuditLog, "audit-log", "", "the JSON lines file of the destinations the proxy dials")
+	flag.StringVar(&LogFile, "log-file", "", "the file the logs are appended to instead of stderr")
+	flag.IntVar(&LogMaxSize, "log-max-size", 100, "the megabytes the log file is rotated at, never when 0")
+	flag.DurationVar(&LogMaxAge, "log-max-age", 0, "how long the rotated log files are kept, forever when 0")
+	flag.IntVar(&LogMaxBackups, "log-max-backups", 0, "how many rotated log files are kept, all when 0")
+	flag.BoolVar(&LogCompress, "log-compress", false, "gzip the rotated log files")
+	flag.StringVar(&LogFormat, "log-format", LogText, "how the logs are written, text or json")
+	flag.BoolVar(&Daemon, "daemon", false, "run in background detached from the terminal")
+	flag.StringVar(&PidFile, "pidfile", "", "the file the pid is written to, for channel stop and reload")
+	flag.DurationVar(&DebugInvariants, "debug-invariants", 0, "how often the streams and sessions are cross-checked, never when 0")
+	flag.StringVar(&ServeAddr, "serve-addr", ":8000", "where channel serve-dir asks the client to listen")
+	flag.BoolVar(&AuditHash, "audit-hash", false, "chain the lines of -audit-log with their hashes")
+	flag.StringVar(&AuditKey, "audit-key", "", "the key file signing the lines of -audit-log, implies -audit-hash")
+	flag.BoolVar(&showHelp, "help", false, "show this help")
+}
+
+// newChannel is the channel of the flags at addr
+func newChannel(addr string) *transport.Channel {
+	return &transport.Channel{
+		Addr:             addr,
+		Transport:        Transport,
+		Obfs:             Obfs,
+		ObfsHost:         ObfsHost,
+		Crypt:            Crypt,
+		Key:              Key,
+		NoiseKey:         NoiseKey,
+		NoisePeers:       NoisePeers,
+		TLSCert:          TLSCert,
+		TLSKey:           TLSKey,
+		TLSCA:            TLSCA,
+		HTTPProxy:        HTTPProxy,
+		HandshakeTimeout: HandshakeTimeout,
+		KeepAlive: net.KeepAliveConfig{
+			Enable:   KeepAliveIdle > 0 || KeepAliveInterval > 0 || KeepAliveCount > 0,
+			Idle:     KeepAliveIdle,
+			Interval: KeepAliveInterval,
+			Count:    KeepAliveCount,
+		},
+	}
+}
+
+// newAuth is the authenticator of the flags
+func newAuth(token string) (protocol.Authenticator, error) {
+	switch Auth {
+	case "":
+		return nil, nil
+	case "token":
+		if token == "" {
+			return nil, errors.New("token auth needs -token")
+		}
+		return protocol.TokenAuth{Token: token, Skew: AuthSkew, Plain: AuthPlain}, nil
+	case "mtls":
+		if Transport != transport.TLS && Transport != "quic" || TLSCA == "" {
+			return nil, errors.New("mtls auth needs the tls or quic transport and -tls-ca")
+		}
+		return protocol.MTLSAuth{Names: splitList(AuthNames)}, nil
+	}
+	return nil, fmt.Errorf("invalid auth, %s", Auth)
+}
+
+// loadCAs is the pool of the certificates of file, nil when it's empty
+func loadCAs(file string) (*x509.CertPool, error) {
+	if file == "" {
+		return nil, nil
+	}
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate in %s", file)
+	}
+	return pool, nil
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "status" {
+		if err := runStatus(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		code, err := runVerify(os.Args[2:])
+		if err != nil {
+			log.Print(err)
+		}
+		os.Exit(code)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "top" {
+		if err := runTop(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		if err := runAudit(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "testserver" {
+		if err := runTestServer(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "version" {
+		if err := runVersion(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "service" {
+		if err := runService(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && (os.Args[1] == "stop" || os.Args[1] == "reload") {
+		if err := runSignal(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "conformance" {
+		os.Exit(runConformance(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "serve-dir" {
+		// a proxy serving the path over http, channel serve-dir [flags] path
+		flag.CommandLine.Parse(os.Args[2:])
+		if flag.NArg() != 1 {
+			log.Fatal("usage: channel serve-dir [flags] path")
+			return
+		}
+		ServeDir, Mode = flag.Arg(0), "proxy"
+		if _, err := os.Stat(ServeDir); err != nil {
+			log.Fatal(err)
+			return
+		}
+	} else {
+		flag.Parse()
+	}
+	if showHelp {
+		flag.Usage()
+		return
+	}
+	if noiseGenKey {
+		private, public, err := transport.GenNoiseKey()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("private: %s\npublic: %s\n", private, public)
+		return
+	}
+	if LogFile != "" {
+		if LogMaxSize < 0 || LogMaxBackups < 0 {
+			log.Fatal("invalid log-max-size or log-max-backups")
+			return
+		}
+		w, err := openLog(LogFile, int64(LogMaxSize)<<20, LogMaxAge, LogMaxBackups, LogCompress)
+		if err != nil {
+			log.Fatal(err)
+			return
+		}
+		log.SetOutput(w)
+	}
+	switch LogFormat {
+	case LogText:
+	case LogJSON:
+		log.SetFlags(0)
+		log.SetOutput(jsonLog{w: log.Writer()})
+	default:
+		log.Fatalf("invalid log-format, %s", LogFormat)
+		return
+	}
+	log.Printf("%s\n", protocol.BuildInfo())
+	if Mode == "stdio" {
+		if Target == "" {
+			log.Fatal("the stdio mode needs -target")
+			return
+		}
+		if AccessLog == "-" {
+			log.Fatal("the stdio mode writes the stream to stdout, not the access log")
+			return
+		}
+	}
+	if Mode != "client" && Mode != "proxy" && Mode != "relay" && Mode != "stdio" {
+		log.Fatalf("invlaid mode, %s", Mode)
+		return
+	}
+	if BufSize <= 0 {
+		log.Fatalf("invalid bufsize, %d", BufSize)
+		return
+	}
+	if IdleTimeout < 0 {
+		log.Fatalf("invalid idle-timeout, %s", IdleTimeout)
+		return
+	}
+	if StatusInterval <= 0 {
+		log.Fatalf("invalid status-interval, %s", StatusInterval)
+		return
+	}
+	if STUNInterval <= 0 {
+		log.Fatalf("invalid stun-interval, %s", STUNInterval)
+		return
+	}
+	if Transport == transport.Stdio && AccessLog == "-" {
+		log.Fatal("the stdout of the stdio transport is the channel, give -access-log a file")
+		return
+	}
+	paddrs := splitList(PAddr)
+	if len(paddrs) == 0 {
+		log.Fatalf("invalid paddr, %s", PAddr)
+		return
+	}
+	if len(paddrs) > 1 && Mode != "proxy" {
+		log.Fatalf("a paddr list is for the proxy, %s", PAddr)
+		return
+	}
+	bind, err := transport.ParseBind(BindAddr, BindInterface)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	if bind != nil && Mode != "proxy" {
+		log.Fatalf("-bind-addr and -bind-interface are of the proxy, not %s", Mode)
+		return
+	}
+	var backups []*transport.Channel
+	for i, addr := range paddrs {
+		ch := newChannel(addr)
+		ch.Bind = bind
+		if err := ch.Init(Mode == "relay" || (Mode == "client" || Mode == "stdio") && !Relay); err != nil {
+			log.Fatal(err)
+			return
+		}
+		if err := checkStrict(ch); err != nil {
+			log.Fatal(err)
+			return
+		}
+		if i == 0 {
+			channel = ch
+		} else {
+			backups = append(backups, ch)
+		}
+	}
+	streamCodecs, err = protocol.ParseCodecs(Compress)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	var resolver *protocol.Resolver
+	if Resolvers != "" {
+		resolver = &protocol.Resolver{Servers: splitList(Resolvers), Timeout: ResolveTimeout, CacheTTL: ResolveCache, Bind: bind}
+		if err := resolver.Init(); err != nil {
+			log.Fatal(err)
+			return
+		}
+	}
+	originCAs, err := loadCAs(OriginCA)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	if Name == "" && Relay {
+		Name, _ = os.Hostname()
+	}
+	auth, err := newAuth(Token)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	var e2e *transport.E2EKeys
+	if E2EKey != "" {
+		if e2e, err = transport.LoadE2EKeys(E2EKey, E2EPeers); err != nil {
+			log.Fatal(err)
+			return
+		}
+	}
+	var admission *protocol.Admission
+	if AdmitRate > 0 {
+		admission = &protocol.Admission{Rate: AdmitRate, Burst: AdmitBurst}
+	}
+	var bans *protocol.Bans
+	if BanThreshold > 0 {
+		bans = &protocol.Bans{Threshold: BanThreshold, Window: BanWindow, Duration: BanDuration}
+	}
+	var acceptRate *protocol.AcceptRate
+	if AcceptRate > 0 {
+		acceptRate = &protocol.AcceptRate{Rate: AcceptRate, Burst: AcceptBurst}
+	}
+	opts := protocol.Options{BufSize: BufSize, AckDelay: AckDelay, FlushDelay: FlushDelay, IdleTimeout: IdleTimeout}
+	hooks, err := newHooks()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	// run is of running unless the mode runs it another way
+	var run func(ctx context.Context) error
+	switch Mode {
+	case "relay":
+		var rules []relay.Rule
+		for _, s := range splitList(RelayAllow) {
+			rule, err := relay.ParseRule(s)
+			if err != nil {
+				log.Fatal(err)
+				return
+			}
+			rules = append(rules, rule)
+		}
+		var quotas []relay.Quota
+		if ConfigFile != "" {
+			if quotas, err = loadQuotas(ConfigFile); err != nil {
+				log.Fatal(err)
+				return
+			}
+		}
+		r := &relay.Relay{
+			Channel:          channel,
+			Allow:            rules,
+			Auth:             auth,
+			Admission:        admission,
+			Bans:             bans,
+			AcceptRate:       acceptRate,
+			HandshakeTimeout: HandshakeTimeout,
+			Compress:         streamCodecs,
+			Hooks:            hooks,
+			Quotas:           quotas,
+			Options:          opts,
+		}
+		if ConfigFile != "" {
+			go reloadQuotas(r)
+		}
+		running = r
+	case "client", "stdio":
+		flush, err := protocol.ParseFlushPolicy(Flush)
+		if err != nil {
+			log.Fatal(err)
+			return
+		}
+		noDelay, err := protocol.ParseNoDelay(NoDelay)
+		if err != nil {
+			log.Fatal(err)
+			return
+		}
+		tunnel := client.Tunnel{
+			LAddr:        LAddr,
+			Mode:         TunnelMode,
+			RAddr:        RAddr,
+			Agent:        Agent,
+			E2EKey:       E2E,
+			Hops:         splitList(Hops),
+			Protocol:     Protocol,
+			Reset:        Reset,
+			ResetDelay:   ResetDelay,
+			Compress:     streamCodecs,
+			Routes:       Routes,
+			SniffTimeout: SniffTimeout,
+			Flush:        flush,
+			NoDelay:      noDelay,
+			Preset:       Preset,
+			MaxStreams:   TunnelMaxStreams,
+			Resolve:      Resolve,
+			TLS:          OriginTLS,
+			SNI:          OriginSNI,
+			ACME:         splitList(ACMEHosts),
+		}
+		tunnels = withDNS([]*client.Tunnel{&tunnel}, tunnel)
+		token, allowListen := Token, splitList(AllowListen)
+		direct := []client.DirectRule(Direct)
+		if ConfigFile != "" {
+			var config *Config
+			tunnels, config, err = loadConfig(ConfigFile, tunnel)
+			if err != nil {
+				log.Fatal(err)
+				return
+			}
+			tunnels = withDNS(tunnels, tunnel)
+			token, allowListen = config.credentials()
+			if auth, err = newAuth(token); err != nil {
+				log.Fatal(err)
+				return
+			}
+			if direct, err = config.directRules(); err != nil {
+				log.Fatal(err)
+				return
+			}
+		}
+		c := &client.Client{
+			Channel:          channel,
+			Relay:            Relay,
+			Exec:             strings.Fields(Exec),
+			Name:             Name,
+			Token:            token,
+			Auth:             auth,
+			Admission:        admission,
+			Bans:             bans,
+			AcceptRate:       acceptRate,
+			E2E:              e2e,
+			Balance:          Balance,
+			Tunnels:          tunnels,
+			HandshakeTimeout: HandshakeTimeout,
+			AllowListen:      allowListen,
+			Hooks:            hooks,
+			MaxStreams:       MaxStreams,
+			StreamsWait:      StreamsWait,
+			ExposeDomain:     strings.ToLower(strings.Trim(ExposeDomain, ".")),
+			Direct:           direct,
+			TunnelPrivate:    TunnelPrivate,
+			Resolver:         resolver,
+			OriginCAs:        originCAs,
+			Options:          opts,
+		}
+		if ACMEDir != "" {
+			c.ACME = &client.ACME{Dir: ACMEDir, Email: ACMEEmail, DirectoryURL: ACMEDirectory, HTTPAddr: ACMEHTTP}
+		}
+		running = c
+		if Mode == "stdio" {
+			// the one stream of stdin and stdout, no tunnel listens
+			c.Tunnels = nil
+			tunnel.Label, tunnel.RAddr = Mode, Target
+			run = func(ctx context.Context) error {
+				return c.RunStdio(ctx, &tunnel, transport.NewPipeConn(os.Stdin, os.Stdout, Mode))
+			}
+			break
+		}
+		if ConfigFile != "" {
+			go reloadConfigs(c, tunnel)
+		}
+	default:
+		audit, err := openAudit()
+		if err != nil {
+			log.Fatal(err)
+			return
+		}
+		running = &proxy.Proxy{
+			Channel:          channel,
+			Backups:          backups,
+			FailoverTimeout:  FailoverTimeout,
+			Name:             Name,
+			Token:            Token,
+			E2E:              e2e,
+			HopListen:        HopListen,
+			Expose:           splitList(Expose),
+			Mux:              Mux,
+			PoolSize:         PoolSize,
+			PoolLifetime:     PoolLifetime,
+			PoolJitter:       PoolJitter,
+			Compress:         streamCodecs,
+			Upstream:         Upstream,
+			Resolver:         resolver,
+			Bind:             bind,
+			OriginCAs:        originCAs,
+			AllowExec:        splitList(AllowExec),
+			DialFailTTL:      DialFailTTL,
+			BreakerFailures:  BreakerFailures,
+			BreakerCooldown:  BreakerCooldown,
+			BackendAttempts:  BackendAttempts,
+			BackendTimeout:   BackendTimeout,
+			HealthCheck:      HealthCheck,
+			HealthInterval:   HealthInterval,
+			HealthFall:       HealthFall,
+			HealthRise:       HealthRise,
+			HandshakeTimeout: HandshakeTimeout,
+			Hooks:            hooks,
+			Audit:            audit,
+			MaxStreams:       MaxStreams,
+			StreamsWait:      StreamsWait,
+			Options:          opts,
+		}
+	}
+	if Daemon {
+		if err := daemonize(); err != nil {
+			log.Fatal(err)
+			return
+		}
+	}
+	ctx := context.Background()
+	if PidFile != "" {
+		if err := writePidFile(PidFile); err != nil {
+			log.Fatal(err)
+			return
+		}
+		defer removePidFile(PidFile)
+	}
+	if PidFile != "" || underSystemd() {
+		// systemd stops with SIGTERM, it's a graceful stop
+		ctx = stopContext()
+		if ConfigFile == "" || Mode != "client" && Mode != "relay" {
+			go ignoreHangups()
+		}
+	}
+	if underSystemd() {
+		go notifySystemd(ctx)
+	}
+	if Admin != "" {
+		go serveAdmin()
+	}
+	if StatusFile != "" {
+		go writeStatusFiles()
+	}
+	if ServeDir != "" {
+		go serveDir(running.(*proxy.Proxy))
+	}
+	if DebugInvariants > 0 {
+		invariants := protocol.Invariants()
+		if r, ok := running.(interface{ Invariants() []protocol.Invariant }); ok {
+			invariants = append(invariants, r.Invariants()...)
+		}
+		go protocol.WatchInvariants(ctx, DebugInvariants, invariants)
+	}
+	if STUN != "" {
+		discoverNAT()
+		go discoverNATs()
+	}
+	if run == nil {
+		run = running.Run
+	}
+	if err := serveRun(ctx, run); err != nil && ctx.Err() == nil {
+		removePidFile(PidFile)
+		log.Fatal(err)
+	}
+}
+
+// newHooks are the hooks of the mode, writing the access log
+func newHooks() (protocol.Hooks, error) {
+	var hooks protocol.Hooks
+	if AccessLog == "" {
+		return hooks, nil
+	}
+	w := os.Stdout
+	if AccessLog != "-" {
+		f, err := os.OpenFile(AccessLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return hooks, err
+		}
+		w = f
+	}
+	hooks.OnStreamClose = protocol.NewAccessLog(w, Mode != "client" && Mode != "stdio").StreamClose
+	return hooks, nil
+}
+
+// routeFlags collects the repeated -route flags
+type routeFlags []client.Route
+
+func (routes *routeFlags) String() string {
+	var list []string
+	for _, route := range *routes {
+		list = append(list, route.String())
+	}
+	return strings.Join(list, ",")
+}
+
+func (routes *routeFlags) Set(s string) error {
+	route, err := client.ParseRoute(s)
+	if err != nil {
+		return err
+	}
+	*routes = append(*routes, route)
+	return nil
+}
+
+// directFlags collects the repeated -direct flags
+type directFlags []client.DirectRule
+
+func (rules *directFlags) String() string {
+	var list []string
+	for _, rule := range *rules {
+		list = append(list, rule.String())
+	}
+	return strings.Join(list, " ")
+}
+
+func (rules *directFlags) Set(s string) error {
+	rule, err := client.ParseDirectRule(s)
+	if err != nil {
+		return err
+	}
+	*rules = append(*rules, rule)
+	return nil
+}
+
+// splitList splits a comma separated list, empty items are dropped
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/dworld/channel/pkg/relay"
+)
+
+// quotasStatus is served at /quotas, the quotas of the relay and what the
+// clients use of them
+type quotasStatus struct {
+	Quotas []relay.Quota       `json:"quotas"`
+	Usage  []relay.ClientUsage `json:"usage"`
+}
+
+// handleQuotas serves the quotas of the relay, a PUT of a JSON list of
+// quotas replaces them until the next reload of the config
+func handleQuotas(w http.ResponseWriter, r *http.Request) {
+	rl, ok := running.(*relay.Relay)
+	if !ok {
+		http.Error(w, "quotas need the relay mode", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var quotas []relay.Quota
+		if err := json.NewDecoder(r.Body).Decode(&quotas); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := rl.SetQuotas(quotas); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "GET or PUT", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(quotasStatus{Quotas: rl.CurrentQuotas(), Usage: rl.Usage()})
+}
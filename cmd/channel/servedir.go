@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dworld/channel/pkg/proxy"
+)
+
+// serveDir serves ServeDir over http on a listener of the client at
+// ServeAddr, the listing and the files of a directory or a single file
+func serveDir(p *proxy.Proxy) {
+	ln, err := p.Listen(context.Background(), ServeAddr)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	log.Printf("Serve %s at %s\n", ServeDir, ln.Addr())
+	server := &http.Server{
+		Handler:           logRequests(dirHandler(ServeDir)),
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	log.Fatal(server.Serve(ln))
+}
+
+// dirHandler serves the directory path, or the file path at / and at its
+// name
+func dirHandler(path string) http.Handler {
+	if info, err := os.Stat(path); err == nil && !info.IsDir() {
+		name := "/" + filepath.Base(path)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/" && r.URL.Path != name {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(path)}))
+			http.ServeFile(w, r, path)
+		})
+	}
+	return http.FileServer(http.Dir(path))
+}
+
+// logRequests logs the requests to h
+func logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("%s %s from %s\n", r.Method, r.URL.Path, r.RemoteAddr)
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// runService is the service subcommand, of Windows only
+func runService(args []string) error {
+	return errors.New("services are of windows, run with -daemon or under systemd")
+}
+
+// serveRun is run, the process is never a Windows service
+func serveRun(ctx context.Context, run func(ctx context.Context) error) error {
+	return run(ctx)
+}
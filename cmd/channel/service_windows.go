@@ -0,0 +1,173 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceName is the name the service is run by, the service manager
+// ignores it for the services of their own process
+const serviceName = "channel"
+
+// runService is the service subcommand, it installs the Windows service
+// running channel with the flags after --, and uninstalls, starts and stops
+// it
+func runService(args []string) error {
+	flags := flag.NewFlagSet("service", flag.ExitOnError)
+	name := flags.String("name", serviceName, "the name of the service")
+	display := flags.String("display", "", "the display name of the service installed, channel name when empty")
+	timeout := flags.Duration("timeout", 20*time.Second, "how long stop waits the service to stop")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: channel service install|uninstall|start|stop [flags] [-- channel flags]\n")
+		fmt.Fprintf(flags.Output(), "the service runs in the system directory, give the files of the channel flags by absolute paths, and -log-file as its logs go nowhere else\n")
+		flags.PrintDefaults()
+	}
+	if len(args) == 0 {
+		flags.Usage()
+		return errors.New("no service action")
+	}
+	action := args[0]
+	flags.Parse(args[1:])
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if action == "install" {
+		// the flags fail now rather than once the service starts
+		flag.CommandLine.Parse(flags.Args())
+		if *display == "" {
+			*display = "channel " + *name
+		}
+		return installService(m, *name, *display, flags.Args())
+	}
+	s, err := m.OpenService(*name)
+	if err != nil {
+		return fmt.Errorf("service %s: %s", *name, err)
+	}
+	defer s.Close()
+	switch action {
+	case "uninstall":
+		if err := s.Delete(); err != nil {
+			return err
+		}
+		log.Printf("Uninstalled service %s\n", *name)
+		return nil
+	case "start":
+		if err := s.Start(); err != nil {
+			return err
+		}
+		log.Printf("Started service %s\n", *name)
+		return nil
+	case "stop":
+		return stopService(s, *timeout)
+	}
+	return fmt.Errorf("invalid service action, %s", action)
+}
+
+// installService installs the service name starting at boot the executable
+// with args, restarted when it fails
+func installService(m *mgr.Mgr, name, display string, args []string) error {
+	if s, err := m.OpenService(name); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s exists already", name)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	s, err := m.CreateService(name, exe, mgr.Config{
+		DisplayName: display,
+		Description: "channel tunnels",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	err = s.SetRecoveryActions([]mgr.RecoveryAction{{Type: mgr.ServiceRestart, Delay: 5 * time.Second}}, uint32((24 * time.Hour).Seconds()))
+	if err != nil {
+		log.Printf("SetRecoveryActions: %s\n", err)
+	}
+	log.Printf("Installed service %s, %s %v\n", name, exe, args)
+	return nil
+}
+
+// stopService asks the service s to stop and waits until it stopped
+func stopService(s *mgr.Service, timeout time.Duration) error {
+	status, err := s.Control(svc.Stop)
+	if err != nil {
+		return err
+	}
+	for deadline := time.Now().Add(timeout); status.State != svc.Stopped; {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("service %s still stopping after %s", s.Name, timeout)
+		}
+		time.Sleep(300 * time.Millisecond)
+		if status, err = s.Query(); err != nil {
+			return err
+		}
+	}
+	log.Printf("Stopped service %s\n", s.Name)
+	return nil
+}
+
+// serveRun is run under the service manager when the process is a service,
+// the service stopping is ctx being done, and run itself otherwise
+func serveRun(ctx context.Context, run func(ctx context.Context) error) error {
+	inService, err := svc.IsWindowsService()
+	if err != nil || !inService {
+		return run(ctx)
+	}
+	s := &service{ctx: ctx, run: run}
+	if err := svc.Run(serviceName, s); err != nil {
+		return err
+	}
+	return s.err
+}
+
+// service is the control handler of the service running run
+type service struct {
+	ctx context.Context
+	run func(ctx context.Context) error
+	// err is of run failing on its own, nil once the service was stopped
+	err error
+}
+
+func (s *service) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- s.run(ctx) }()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case s.err = <-done:
+			// a service specific exit code tells the manager it failed, it
+			// restarts it
+			return true, 1
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				cancel()
+				<-done
+				return false, 0
+			}
+		}
+	}
+}
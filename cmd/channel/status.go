@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dworld/channel/pkg/client"
+	"github.com/dworld/channel/pkg/protocol"
+	"github.com/dworld/channel/pkg/relay"
+)
+
+// Status is served at /status of the admin endpoints
+type Status struct {
+	Mode         string                 `json:"mode"`
+	Transport    string                 `json:"transport"`
+	Compress     []string               `json:"compress"`
+	Mux          bool                   `json:"mux"`
+	Balance      string                 `json:"balance,omitempty"`
+	Noise        bool                   `json:"noise"`
+	Control      string                 `json:"control"`
+	Since        *time.Time             `json:"since,omitempty"`
+	Capabilities protocol.Capabilities  `json:"capabilities"`
+	Peer         *protocol.Capabilities `json:"peer"`
+	Tunnels      []TunnelStatus         `json:"tunnels,omitempty"`
+	Agents       []string               `json:"agents,omitempty"`
+	Clients      []string               `json:"clients,omitempty"`
+	Streams      protocol.StreamCounts  `json:"streams"`
+	Errors       []protocol.ErrorEntry  `json:"errors"`
+}
+
+// TunnelStatus is a tunnel of the client
+type TunnelStatus struct {
+	Label  string `json:"label,omitempty"`
+	LAddr  string `json:"laddr"`
+	Mode   string `json:"mode,omitempty"`
+	RAddr  string `json:"raddr"`
+	Agent  string `json:"agent,omitempty"`
+	Routes string `json:"routes,omitempty"`
+}
+
+func currentStatus() Status {
+	st := Status{
+		Mode:         Mode,
+		Transport:    Transport,
+		Compress:     streamCodecs,
+		Mux:          Mux,
+		Balance:      Balance,
+		Noise:        NoiseKey != "",
+		Capabilities: protocol.LocalCapabilities(),
+		Streams:      protocol.Streams(),
+		Errors:       running.LastErrors(),
+	}
+	served := tunnels
+	if c, ok := running.(*client.Client); ok {
+		served = c.ServedTunnels()
+	}
+	for _, tunnel := range served {
+		routes := routeFlags(tunnel.Routes)
+		st.Tunnels = append(st.Tunnels, TunnelStatus{
+			Label:  tunnel.Label,
+			LAddr:  tunnel.LAddr,
+			Mode:   tunnel.Mode,
+			RAddr:  tunnel.RAddr,
+			Agent:  tunnel.Agent,
+			Routes: routes.String(),
+		})
+	}
+	if r, ok := running.(interface{ Agents() []string }); ok {
+		st.Agents = r.Agents()
+	}
+	if r, ok := running.(*relay.Relay); ok {
+		st.Clients = r.Clients()
+	}
+	if info := running.Control(); info.Addr != "" {
+		st.Control = info.Addr
+		st.Since = &info.Since
+		st.Peer = info.Peer
+	}
+	return st
+}
+
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(currentStatus())
+}
+
+// writeStatusFiles writes the status to StatusFile every StatusInterval
+func writeStatusFiles() {
+	for {
+		if err := writeStatusFile(); err != nil {
+			log.Printf("write status file: %s\n", err)
+		}
+		time.Sleep(StatusInterval)
+	}
+}
+
+// writeStatusFile replaces StatusFile by a rename so readers never see it
+// half written
+func writeStatusFile() error {
+	b, err := json.MarshalIndent(currentStatus(), "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(StatusFile), filepath.Base(StatusFile)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), StatusFile)
+}
+
+// runStatus is the status subcommand, it prints the status of a running
+// instance from its admin endpoints
+func runStatus(args []string) error {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	admin := flags.String("admin", "127.0.0.1:7003", "the admin address of the instance")
+	flags.Parse(args)
+	rsp, err := http.Get("http://" + *admin + "/status")
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	var st Status
+	if err := json.NewDecoder(rsp.Body).Decode(&st); err != nil {
+		return err
+	}
+	printStatus(os.Stdout, st)
+	return nil
+}
+
+func printStatus(w *os.File, st Status) {
+	fmt.Fprintf(w, "mode:       %s\n", st.Mode)
+	fmt.Fprintf(w, "transport:  %s\n", st.Transport)
+	fmt.Fprintf(w, "mux:        %v\n", st.Mux)
+	fmt.Fprintf(w, "noise:      %v\n", st.Noise)
+	if st.Mode == "relay" || len(st.Agents) > 0 {
+		fmt.Fprintf(w, "agents:     %s\n", listOrNone(st.Agents))
+	}
+	if st.Balance != "" {
+		fmt.Fprintf(w, "balance:    %s\n", st.Balance)
+	}
+	switch {
+	case st.Mode == "relay":
+		fmt.Fprintf(w, "clients:    %s\n", listOrNone(st.Clients))
+	case st.Control == "":
+		fmt.Fprintf(w, "control:    not connected\n")
+	default:
+		fmt.Fprintf(w, "control:    %s since %s\n", st.Control, st.Since.Format(time.RFC3339))
+	}
+	fmt.Fprintf(w, "streams:    %d open, %d total\n", st.Streams.Open, st.Streams.Total)
+	for _, e := range st.Errors {
+		fmt.Fprintf(w, "error:      %s %s: %s\n", e.Time.Format(time.RFC3339), e.Op, e.Error)
+	}
+	fmt.Fprintf(w, "built with:\n")
+	printCapabilities(w, st.Capabilities)
+	if st.Peer == nil {
+		fmt.Fprintf(w, "peer:       unknown\n")
+		return
+	}
+	fmt.Fprintf(w, "peer built with:\n")
+	printCapabilities(w, *st.Peer)
+	fmt.Fprintf(w, "compress:   configured %s, peer supports %s\n",
+		listOrNone(st.Compress), listOrNone(common(st.Compress, st.Peer.Codecs)))
+}
+
+func printCapabilities(w *os.File, caps protocol.Capabilities) {
+	fmt.Fprintf(w, "  transports: %s\n", listOrNone(caps.Transports))
+	fmt.Fprintf(w, "  codecs:     %s\n", listOrNone(caps.Codecs))
+	fmt.Fprintf(w, "  obfs:       %s\n", listOrNone(caps.Obfs))
+	fmt.Fprintf(w, "  features:   %s\n", listOrNone(caps.Features))
+	fmt.Fprintf(w, "  frames:     %s\n", listOrNone(caps.Frames))
+	if caps.Public != "" {
+		fmt.Fprintf(w, "  public:     %s, %s nat\n", caps.Public, caps.NAT)
+	}
+}
+
+func listOrNone(list []string) string {
+	if len(list) == 0 {
+		return "none"
+	}
+	return strings.Join(list, ",")
+}
+
+// common returns the items of a also in b
+func common(a, b []string) []string {
+	var r []string
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				r = append(r, x)
+				break
+			}
+		}
+	}
+	return r
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/dworld/channel/pkg/transport"
+)
+
+// channelHost is the host of addr, which may be a URL
+func channelHost(addr string) string {
+	if strings.Contains(addr, "://") {
+		if u, err := url.Parse(addr); err == nil {
+			return u.Hostname()
+		}
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// checkStrict refuses a plaintext channel without auth on a non-loopback
+// paddr with Strict, whoever reaches it could take over the tunnel, and warns
+// otherwise
+func checkStrict(ch *transport.Channel) error {
+	host := channelHost(ch.Addr)
+	if isLoopback(host) || ch.Secured() {
+		return nil
+	}
+	msg := fmt.Sprintf("the channel at %s is plaintext without auth, set -noise-key, -crypt psk or a wss:// or https:// paddr", ch.Addr)
+	if Strict {
+		return fmt.Errorf("strict: %s", msg)
+	}
+	log.Printf("WARNING: %s, -strict refuses to start like this\n", msg)
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/dworld/channel/pkg/protocol"
+	"github.com/dworld/channel/pkg/transport"
+)
+
+// stunTimeout bounds the wait for each STUN server
+const stunTimeout = 3 * time.Second
+
+// discoverNAT finds the public address with the STUN servers, the former one
+// is kept when none answers
+func discoverNAT() {
+	info, err := transport.DiscoverNAT(splitList(STUN), stunTimeout)
+	if err != nil {
+		log.Printf("DiscoverNAT: %s\n", err)
+		return
+	}
+	log.Printf("public address %s, %s nat\n", info.Public, info.NAT)
+	protocol.SetNAT(info)
+}
+
+// discoverNATs finds the public address again every STUNInterval
+func discoverNATs() {
+	for range time.Tick(STUNInterval) {
+		discoverNAT()
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// readyPoll is how often the readiness is checked until it's told to systemd
+const readyPoll = 100 * time.Millisecond
+
+// sdReady is set once systemd was told the process is ready
+var sdReady atomic.Bool
+
+// underSystemd tells whether systemd waits the notifications of the process,
+// as of a Type=notify unit
+func underSystemd() bool {
+	return os.Getenv("NOTIFY_SOCKET") != ""
+}
+
+// sdNotify sends state to the notify socket of systemd, see sd_notify(3)
+func sdNotify(state string) error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return nil
+	}
+	if name[0] == '@' {
+		// an abstract socket
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval is the WatchdogSec of the unit, 0 when the watchdog is off
+// or meant for another process
+func watchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// notifySystemd tells systemd the process is ready once the listeners are
+// bound and the control connection is up, then pings the watchdog while it's
+// healthy, so systemd restarts a process stuck unhealthy, and tells it
+// stopping once ctx is done
+func notifySystemd(ctx context.Context) {
+	notify := func(state string) {
+		if err := sdNotify(state); err != nil {
+			log.Printf("sd_notify: %s\n", err)
+		}
+	}
+	ticker := time.NewTicker(readyPoll)
+	for running.Ready() != nil {
+		select {
+		case <-ctx.Done():
+			ticker.Stop()
+			notify("STOPPING=1")
+			return
+		case <-ticker.C:
+		}
+	}
+	ticker.Stop()
+	notify("READY=1\nSTATUS=ready\nMAINPID=" + strconv.Itoa(os.Getpid()))
+	sdReady.Store(true)
+	var pings <-chan time.Time
+	if interval := watchdogInterval(); interval > 0 {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		pings = ticker.C
+	}
+	healthy := true
+	for {
+		select {
+		case <-ctx.Done():
+			notify("STOPPING=1")
+			return
+		case <-pings:
+		}
+		// no ping while unhealthy, the watchdog fires once they're missed
+		// for WatchdogSec
+		if err := running.Healthy(); err != nil {
+			if healthy {
+				notify("STATUS=unhealthy: " + err.Error())
+			}
+			healthy = false
+			continue
+		}
+		if !healthy {
+			notify("STATUS=ready")
+		}
+		healthy = true
+		notify("WATCHDOG=1")
+	}
+}
+
+// sdReloading tells systemd a reload is under way and returns the func which
+// tells it's done, systemd is told nothing before the process was ready
+func sdReloading() func() {
+	if !sdReady.Load() {
+		return func() {}
+	}
+	sdNotify("RELOADING=1")
+	return func() { sdNotify("READY=1") }
+}
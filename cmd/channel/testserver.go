@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"syscall"
+	"time"
+)
+
+// chargenLine is the width of the chargen lines, with the CRLF
+const chargenLine = 74
+
+// testService serves a connection of the testserver and returns the bytes
+// it read and wrote
+type testService func(conn net.Conn) (int64, int64, error)
+
+// runTestServer is the testserver subcommand, it serves echo, chargen and
+// sink on the addresses given, to check the forwarding of a tunnel and
+// measure its throughput without other tools
+func runTestServer(args []string) error {
+	flags := flag.NewFlagSet("testserver", flag.ExitOnError)
+	echo := flags.String("echo", "127.0.0.1:7007", "where the echo service listens, it sends back what it reads, none when empty")
+	chargen := flags.String("chargen", "127.0.0.1:7019", "where the chargen service listens, it sends lines of characters until the connection closes, none when empty")
+	sink := flags.String("sink", "127.0.0.1:7009", "where the sink service listens, it reads and discards, none when empty")
+	flags.Parse(args)
+
+	errc := make(chan error, 3)
+	n := 0
+	for _, s := range []struct {
+		name    string
+		addr    string
+		service testService
+	}{
+		{"echo", *echo, serveEcho},
+		{"chargen", *chargen, serveChargen},
+		{"sink", *sink, serveSink},
+	} {
+		if s.addr == "" {
+			continue
+		}
+		ln, err := net.Listen("tcp", s.addr)
+		if err != nil {
+			return err
+		}
+		log.Printf("Listen %s at %s\n", s.name, ln.Addr())
+		n++
+		name, service := s.name, s.service
+		go func() { errc <- acceptTests(ln, name, service) }()
+	}
+	if n == 0 {
+		return errors.New("no service to serve, give -echo, -chargen or -sink")
+	}
+	return <-errc
+}
+
+// acceptTests serves the connections of ln with service, and logs what it
+// read and wrote of them and how fast once closed
+func acceptTests(ln net.Listener, name string, service testService) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			start := time.Now()
+			in, out, err := service(conn)
+			elapsed := time.Since(start)
+			secs := elapsed.Seconds()
+			if secs <= 0 {
+				secs = 1
+			}
+			msg := fmt.Sprintf("%s %v: read %s wrote %s in %s, %s/s read %s/s written", name, conn.RemoteAddr(),
+				formatBytes(float64(in)), formatBytes(float64(out)), elapsed.Round(time.Millisecond),
+				formatBytes(float64(in)/secs), formatBytes(float64(out)/secs))
+			// the peer going away is how chargen ends
+			if err != nil && !errors.Is(err, syscall.ECONNRESET) && !errors.Is(err, syscall.EPIPE) {
+				msg += ", " + err.Error()
+			}
+			log.Println(msg)
+		}()
+	}
+}
+
+// serveEcho sends back what conn sends
+func serveEcho(conn net.Conn) (int64, int64, error) {
+	n, err := io.Copy(conn, conn)
+	return n, n, err
+}
+
+// serveSink reads conn to its end
+func serveSink(conn net.Conn) (int64, int64, error) {
+	n, err := io.Copy(io.Discard, conn)
+	return n, 0, err
+}
+
+// serveChargen writes the rotating lines of printable characters of RFC 864
+// until conn is closed, what it sends is discarded
+func serveChargen(conn net.Conn) (int64, int64, error) {
+	go io.Copy(io.Discard, conn)
+	const printable = 95
+	var pattern []byte
+	for i := 0; i < printable; i++ {
+		for j := 0; j < chargenLine-2; j++ {
+			pattern = append(pattern, byte(' '+(i+j)%printable))
+		}
+		pattern = append(pattern, '\r', '\n')
+	}
+	var out int64
+	for {
+		n, err := conn.Write(pattern)
+		out += int64(n)
+		if err != nil {
+			return 0, out, err
+		}
+	}
+}
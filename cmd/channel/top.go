@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dworld/channel/pkg/protocol"
+)
+
+// handleStreams serves the streams being piped, for top
+func handleStreams(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(protocol.LiveStreams())
+}
+
+// topSample is what top got from the admin endpoints once
+type topSample struct {
+	at      time.Time
+	status  Status
+	streams []protocol.LiveStream
+}
+
+// runTop is the top subcommand, it shows the tunnels, the streams with their
+// throughput, the bandwidth and the last errors of a running instance from
+// its admin endpoints, until interrupted
+func runTop(args []string) error {
+	flags := flag.NewFlagSet("top", flag.ExitOnError)
+	admin := flags.String("admin", "127.0.0.1:7003", "the admin address of the instance")
+	interval := flags.Duration("interval", time.Second, "how often the screen is refreshed")
+	rows := flags.Int("streams", 20, "how many streams are shown, the busiest first")
+	flags.Parse(args)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	// the alternate screen and the cursor are given back on the way out
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer fmt.Print("\x1b[?25h\x1b[?1049l")
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	var last *topSample
+	for {
+		sample, err := fetchTop(*admin)
+		var b strings.Builder
+		if err != nil {
+			fmt.Fprintf(&b, "channel top %s  %s\n\n%s\n", *admin, time.Now().Format("15:04:05"), err)
+		} else {
+			drawTop(&b, *admin, sample, last, *rows)
+			last = sample
+		}
+		fmt.Print("\x1b[H\x1b[2J" + b.String())
+		select {
+		case <-sigs:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func fetchTop(admin string) (*topSample, error) {
+	sample := &topSample{at: time.Now()}
+	if err := getJSON("http://"+admin+"/status", &sample.status); err != nil {
+		return nil, err
+	}
+	if err := getJSON("http://"+admin+"/streams", &sample.streams); err != nil {
+		return nil, err
+	}
+	return sample, nil
+}
+
+func getJSON(url string, v interface{}) error {
+	client := http.Client{Timeout: 5 * time.Second}
+	rsp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, rsp.Status)
+	}
+	return json.NewDecoder(rsp.Body).Decode(v)
+}
+
+// topRate is the throughput of a stream between two samples
+type topRate struct {
+	stream  protocol.LiveStream
+	in, out float64
+}
+
+func drawTop(b *strings.Builder, admin string, sample, last *topSample, rows int) {
+	st := sample.status
+	control := "not connected"
+	if st.Mode == "relay" {
+		control = fmt.Sprintf("%d agents, %d clients", len(st.Agents), len(st.Clients))
+	} else if st.Control != "" {
+		control = fmt.Sprintf("%s since %s", st.Control, st.Since.Format(time.RFC3339))
+	}
+	fmt.Fprintf(b, "channel top %s  %s  %s\n", admin, st.Mode, sample.at.Format("15:04:05"))
+	fmt.Fprintf(b, "control:   %s\n", control)
+
+	var inRate, outRate float64
+	rates := make([]topRate, 0, len(sample.streams))
+	if last != nil {
+		secs := sample.at.Sub(last.at).Seconds()
+		inRate = float64(st.Streams.In-last.status.Streams.In) / secs
+		outRate = float64(st.Streams.Out-last.status.Streams.Out) / secs
+		before := map[uint64]protocol.LiveStream{}
+		for _, s := range last.streams {
+			before[s.ID] = s
+		}
+		for _, s := range sample.streams {
+			prev := before[s.ID]
+			rates = append(rates, topRate{stream: s, in: float64(s.In-prev.In) / secs, out: float64(s.Out-prev.Out) / secs})
+		}
+	} else {
+		for _, s := range sample.streams {
+			rates = append(rates, topRate{stream: s})
+		}
+	}
+	fmt.Fprintf(b, "streams:   %d open, %d total\n", st.Streams.Open, st.Streams.Total)
+	fmt.Fprintf(b, "bandwidth: in %s/s, out %s/s, %s in and %s out so far\n\n",
+		formatBytes(inRate), formatBytes(outRate), formatBytes(float64(st.Streams.In)), formatBytes(float64(st.Streams.Out)))
+
+	if len(st.Tunnels) > 0 {
+		fmt.Fprintf(b, "%-12s %-22s %-8s %-28s %s\n", "TUNNEL", "LADDR", "MODE", "RADDR", "AGENT")
+		for _, t := range st.Tunnels {
+			mode := t.Mode
+			if mode == "" {
+				mode = "forward"
+			}
+			fmt.Fprintf(b, "%-12s %-22s %-8s %-28s %s\n", clip(t.Label, 12), clip(t.LAddr, 22), mode, clip(t.RAddr, 28), t.Agent)
+		}
+		fmt.Fprintf(b, "\n")
+	}
+
+	sort.SliceStable(rates, func(i, j int) bool { return rates[i].in+rates[i].out > rates[j].in+rates[j].out })
+	fmt.Fprintf(b, "%-6s %-12s %-22s %-28s %-8s %10s %10s %10s %10s\n", "ID", "TUNNEL", "FROM", "ADDR", "AGE", "IN/S", "OUT/S", "IN", "OUT")
+	for i, r := range rates {
+		if i == rows {
+			fmt.Fprintf(b, "... %d more\n", len(rates)-rows)
+			break
+		}
+		s := r.stream
+		fmt.Fprintf(b, "%-6d %-12s %-22s %-28s %-8s %10s %10s %10s %10s\n", s.ID, clip(s.Tunnel, 12), clip(s.From, 22), clip(s.Addr, 28),
+			sample.at.Sub(s.Since).Round(time.Second), formatBytes(r.in), formatBytes(r.out), formatBytes(float64(s.In)), formatBytes(float64(s.Out)))
+	}
+
+	if len(st.Errors) > 0 {
+		fmt.Fprintf(b, "\nRECENT ERRORS\n")
+		errs := st.Errors
+		if len(errs) > 5 {
+			errs = errs[len(errs)-5:]
+		}
+		for _, e := range errs {
+			fmt.Fprintf(b, "%s %s: %s\n", e.Time.Format("15:04:05"), e.Op, e.Error)
+		}
+	}
+}
+
+// formatBytes is n in B, KB, MB or GB
+func formatBytes(n float64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fGB", n/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", n/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKB", n/(1<<10))
+	}
+	return fmt.Sprintf("%.0fB", n)
+}
+
+// clip cuts s to n characters
+func clip(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-1] + "~"
+}
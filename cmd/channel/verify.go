@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/dworld/channel/pkg/client"
+	"github.com/dworld/channel/pkg/protocol"
+)
+
+// defaultVerifySize is the pattern size of a verify without size
+const defaultVerifySize = 64 << 10
+
+// handleVerify runs a verify stream of the client with the agent and size of
+// the query and serves its report
+func handleVerify(w http.ResponseWriter, r *http.Request) {
+	c, ok := running.(*client.Client)
+	if !ok {
+		http.Error(w, "verify needs the client mode", http.StatusNotFound)
+		return
+	}
+	size := defaultVerifySize
+	if s := r.FormValue("size"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			http.Error(w, "invalid size, "+s, http.StatusBadRequest)
+			return
+		}
+		size = n
+	}
+	report, err := c.Verify(r.Context(), r.FormValue("agent"), size)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+}
+
+// runVerify is the verify subcommand, it has a running client exchange the
+// verify pattern with its proxy and prints where the channel changed it, the
+// exit status is 1 when it did
+func runVerify(args []string) (int, error) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	admin := flags.String("admin", "127.0.0.1:7003", "the admin address of the client")
+	agent := flags.String("agent", "", "the name of the proxy to verify, the unnamed one when empty")
+	size := flags.Int("size", defaultVerifySize, "the bytes sent each way")
+	flags.Parse(args)
+	query := url.Values{"agent": {*agent}, "size": {strconv.Itoa(*size)}}
+	rsp, err := http.Get("http://" + *admin + "/verify?" + query.Encode())
+	if err != nil {
+		return 2, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(rsp.Body)
+		return 2, fmt.Errorf("verify: %s", msg)
+	}
+	var report client.VerifyReport
+	if err := json.NewDecoder(rsp.Body).Decode(&report); err != nil {
+		return 2, err
+	}
+	printVerify(os.Stdout, "upstream", report.Size, report.Upstream)
+	printVerify(os.Stdout, "downstream", report.Size, report.Downstream)
+	if report.Upstream.Offset >= 0 || report.Downstream.Offset >= 0 {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func printVerify(w *os.File, direction string, size int, r protocol.VerifyResult) {
+	if r.Offset < 0 {
+		fmt.Fprintf(w, "%-11s ok, %d bytes untouched\n", direction+":", size)
+		return
+	}
+	fmt.Fprintf(w, "%-11s received %d of %d bytes, first difference at offset %d in the %s section\n",
+		direction+":", r.Received, size, r.Offset, r.Section)
+	fmt.Fprintf(w, "  want:    %s\n", r.Want)
+	fmt.Fprintf(w, "  got:     %s\n", r.Got)
+	fmt.Fprintf(w, "  suspect: %s\n", r.Suspect)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/dworld/channel/pkg/protocol"
+)
+
+// runVersion is the version subcommand, it prints the version, commit,
+// build date and Go version of the binary
+func runVersion(args []string) error {
+	flags := flag.NewFlagSet("version", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the build as JSON")
+	flags.Parse(args)
+	build := protocol.BuildInfo()
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(build)
+	}
+	fmt.Println(build)
+	return nil
+}
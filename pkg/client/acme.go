@@ -0,0 +1,109 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// acmeALPN is the protocol of the TLS-ALPN-01 challenges, RFC 8737
+const acmeALPN = "acme-tls/1"
+
+var (
+	errNoACME        = errors.New("acme hosts need the acme config of the client")
+	errACMEChallenge = errors.New("tls-alpn-01 challenge")
+)
+
+// ACME fetches the certificates of the tunnels with ACME hosts from an ACME
+// CA, they're cached in Dir and renewed before they expire. The CA checks
+// the hosts with the TLS-ALPN-01 challenges at the tunnels, or the HTTP-01
+// ones at HTTPAddr
+type ACME struct {
+	// Dir caches the account key and the certificates
+	Dir string
+	// Email is the contact of the account, told of the problems with the
+	// certificates
+	Email string
+	// DirectoryURL is the directory of the CA, Let's Encrypt when empty
+	DirectoryURL string
+	// HTTPAddr is the address the HTTP-01 challenges are answered at, the
+	// other requests are redirected to https, none when empty
+	HTTPAddr string
+}
+
+// acmeManager fetches, caches and renews the certificates, autocert when
+// built with the acme tag
+type acmeManager interface {
+	GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+	HTTPHandler(fallback http.Handler) http.Handler
+}
+
+// serveACME answers the HTTP-01 challenges at HTTPAddr until ctx is done
+func (client *Client) serveACME(ctx context.Context) error {
+	addr := client.ACME.HTTPAddr
+	log.Printf("Listen ACME at %s\n", addr)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	client.listening.Up(addr)
+	defer client.listening.Done(addr)
+	server := &http.Server{Handler: client.acme.HTTPHandler(nil), ReadHeaderTimeout: client.HandshakeTimeout}
+	stop := context.AfterFunc(ctx, func() { server.Close() })
+	defer stop()
+	err = server.Serve(ln)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// acmeHost tells whether host is one of the ACME hosts of tunnel
+func (tunnel *Tunnel) acmeHost(host string) bool {
+	for _, h := range tunnel.ACME {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// acmeConfig is the TLS config of the connections to the tunnel got from
+// tunnel, with the certificates of its ACME hosts
+func (client *Client) acmeConfig(tunnel func() *Tunnel) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// no h2, the streams carry the plain connections to backends which
+		// may not speak it
+		NextProtos: []string{"http/1.1", acmeALPN},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if !tunnel().acmeHost(hello.ServerName) {
+				return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+			}
+			return client.acme.GetCertificate(hello)
+		},
+	}
+}
+
+// terminateTLS terminates the TLS of a connection to tunnel with the
+// certificate of the ACME host it asks for, answering the TLS-ALPN-01
+// challenges of the CA, which get errACMEChallenge
+func (client *Client) terminateTLS(tunnel *Tunnel, conn net.Conn) (net.Conn, error) {
+	tlsConn := tls.Server(conn, client.acmeConfig(func() *Tunnel { return tunnel }))
+	tlsConn.SetDeadline(time.Now().Add(client.HandshakeTimeout))
+	err := tlsConn.Handshake()
+	tlsConn.SetDeadline(time.Time{})
+	if err != nil {
+		return conn, err
+	}
+	if tlsConn.ConnectionState().NegotiatedProtocol == acmeALPN {
+		return tlsConn, errACMEChallenge
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,21 @@
+//go:build acme
+// +build acme
+
+package client
+
+import (
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func (a *ACME) manager() (acmeManager, error) {
+	m := &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		Cache:  autocert.DirCache(a.Dir),
+		Email:  a.Email,
+	}
+	if a.DirectoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: a.DirectoryURL}
+	}
+	return m, nil
+}
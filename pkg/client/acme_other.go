@@ -0,0 +1,10 @@
+//go:build !acme
+// +build !acme
+
+package client
+
+import "errors"
+
+func (a *ACME) manager() (acmeManager, error) {
+	return nil, errors.New("acme needs a build with the acme tag")
+}
@@ -0,0 +1,176 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dworld/channel/pkg/protocol"
+)
+
+// The strategies of Balance
+const (
+	// BalanceRoundRobin dials through the agents in turn
+	BalanceRoundRobin = "round-robin"
+	// BalanceLeastConn dials through the agent with the fewest open streams
+	BalanceLeastConn = "least-conn"
+)
+
+// balanceCooldown is how long an agent failing a dial on its channel is left
+// out of the balancing
+const balanceCooldown = 10 * time.Second
+
+// balancer keeps the load and the health of the agents balanced across
+type balancer struct {
+	sync.Mutex
+	next   int
+	agents map[string]*agentLoad
+}
+
+type agentLoad struct {
+	active int
+	failed time.Time
+}
+
+func validateBalance(strategy string) error {
+	switch strategy {
+	case "", BalanceRoundRobin, BalanceLeastConn:
+		return nil
+	}
+	return fmt.Errorf("invalid balance, %s", strategy)
+}
+
+// load is the load of agent, b is locked
+func (b *balancer) load(agent string) *agentLoad {
+	if b.agents == nil {
+		b.agents = map[string]*agentLoad{}
+	}
+	l := b.agents[agent]
+	if l == nil {
+		l = &agentLoad{}
+		b.agents[agent] = l
+	}
+	return l
+}
+
+// pick picks one of the agents connected by strategy, those which failed
+// lately are left out unless all did
+func (b *balancer) pick(strategy string, agents []string) string {
+	b.Lock()
+	defer b.Unlock()
+	var healthy []string
+	for _, agent := range agents {
+		if time.Since(b.load(agent).failed) >= balanceCooldown {
+			healthy = append(healthy, agent)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = agents
+	}
+	start := b.next % len(healthy)
+	b.next++
+	if strategy != BalanceLeastConn {
+		return healthy[start]
+	}
+	// the ties go round robin too
+	best := healthy[start]
+	for i := 1; i < len(healthy); i++ {
+		agent := healthy[(start+i)%len(healthy)]
+		if b.load(agent).active < b.load(best).active {
+			best = agent
+		}
+	}
+	return best
+}
+
+// opened records the result of a dial through agent, the failures of the
+// channel and the agent put it in cooldown, those of the remote don't
+func (b *balancer) opened(agent string, err error) {
+	b.Lock()
+	defer b.Unlock()
+	l := b.load(agent)
+	var de *protocol.DialError
+	switch {
+	case err == nil:
+		l.active++
+		l.failed = time.Time{}
+	case !errors.As(err, &de) || de.Hop == protocol.HopChannel:
+		l.failed = time.Now()
+	}
+}
+
+func (b *balancer) closed(agent string) {
+	b.Lock()
+	defer b.Unlock()
+	b.load(agent).active--
+}
+
+// balancedConn is a stream counted to the load of its agent until closed
+type balancedConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *balancedConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
+
+func (c *balancedConn) String() string {
+	return fmt.Sprint(c.Conn)
+}
+
+// NetConn is the wrapped connection
+func (c *balancedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// connectedAgents is the names of the proxies connected, the unnamed one is
+// ""
+func (client *Client) connectedAgents() []string {
+	agents := client.Agents()
+	if client.dialer.Connected() {
+		agents = append([]string{""}, agents...)
+	}
+	return agents
+}
+
+// dialAgent dials addr through agent, or through an agent Balance picks when
+// empty and Balance is set, it returns the agent dialed and the release of
+// the stream from its load, once closed
+func (client *Client) dialAgent(ctx context.Context, agent, addr string, opts map[string]string) (string, net.Conn, func(), error) {
+	if agent != "" || client.Balance == "" || client.Relay {
+		conn, err := client.dialerFor(agent).dial(ctx, addr, opts)
+		return agent, conn, func() {}, err
+	}
+	agents := client.connectedAgents()
+	if len(agents) == 0 {
+		return "", nil, nil, errNotConnected
+	}
+	agent = client.balance.pick(client.Balance, agents)
+	conn, err := client.dialerFor(agent).dial(ctx, addr, opts)
+	client.balance.opened(agent, err)
+	if err != nil {
+		return agent, nil, nil, err
+	}
+	var once sync.Once
+	return agent, conn, func() { once.Do(func() { client.balance.closed(agent) }) }, nil
+}
+
+// DialContext dials addr through the proxies connected as Balance spreads
+// the dials, through the unnamed one without Balance
+func (client *Client) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	_, conn, release, err := client.dialAgent(ctx, "", addr, nil)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	return &balancedConn{Conn: conn, release: release}, nil
+}
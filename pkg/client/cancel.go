@@ -0,0 +1,42 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"time"
+
+	"github.com/dworld/channel/pkg/protocol"
+)
+
+// dialsAbandoned counts the dials given up before the proxy replied, those
+// of proxies with the cancel feature are cancelled there too
+var dialsAbandoned = protocol.NewCounter("dials_abandoned")
+
+// watchClose is ctx cancelled once the client of conn closes it, for the dial
+// of its stream, the bytes the client sends meanwhile end the watch. The
+// returned stop ends it and gives the connection to pipe, which replays
+// those bytes
+func watchClose(ctx context.Context, conn net.Conn) (context.Context, func() net.Conn) {
+	ctx, cancel := context.WithCancel(ctx)
+	r := bufio.NewReader(conn)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := r.Peek(1); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			cancel()
+		}
+	}()
+	return ctx, func() net.Conn {
+		conn.SetReadDeadline(time.Unix(1, 0))
+		<-done
+		conn.SetReadDeadline(time.Time{})
+		cancel()
+		if r.Buffered() == 0 {
+			return conn
+		}
+		return &peekConn{Conn: conn, r: r}
+	}
+}
@@ -0,0 +1,1112 @@
+// Package client is the side of the channel which listens the tunnels and
+// the connections of the proxy, it dials the remotes through the proxy
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dworld/channel/pkg/protocol"
+	"github.com/dworld/channel/pkg/transport"
+)
+
+// badConnIDs counts the connections to the channel rejected for their conn id
+// line
+var badConnIDs = protocol.NewCounter("bad_conn_ids")
+
+// authFailures counts the connections to the channel the authenticator refused
+var authFailures = protocol.NewCounter("auth_failures")
+
+// Client serves Tunnels through the proxy connected to Channel
+type Client struct {
+	// Channel is where the proxy connects to, or the relay dialed when Relay
+	Channel *transport.Channel
+	// Relay dials the relay at Channel which is the proxy of the tunnels, the
+	// remotes are agent/host:port to name the agent dialing them
+	Relay bool
+	// Exec is the command of a proxy the client runs as its child in place of
+	// listening Channel, the proxy of the stdio transport whose channel is
+	// its stdin and stdout, it's run again whenever it exits
+	Exec []string
+	// Name names the client to the relay
+	Name string
+	// Token answers the challenge of the relay for its TokenAuth
+	Token string
+	// Auth validates the connections of the proxies, any is accepted when nil
+	Auth protocol.Authenticator
+	// E2E is the static key of the client for the tunnels with an E2EKey
+	E2E *transport.E2EKeys
+	// Tunnels are forwarded through the proxy
+	Tunnels []*Tunnel
+	// HandshakeTimeout is how long a connection to the channel has to
+	// identify itself
+	HandshakeTimeout time.Duration
+	// Balance spreads the streams of the tunnels without an agent across
+	// all the proxies connected, BalanceRoundRobin or BalanceLeastConn, the
+	// unnamed proxy takes them all when empty, the e2e tunnels need the same
+	// key on all of them
+	Balance string
+	// Admission admits the control connections of the proxies, all when nil
+	Admission *protocol.Admission
+	// Bans bans the IPs failing the handshake or the auth at the channel,
+	// none when nil
+	Bans *protocol.Bans
+	// AcceptRate caps the connections accepted from each IP at the channel
+	// and the tunnels, none when nil
+	AcceptRate *protocol.AcceptRate
+	// AllowListen is the address patterns the proxy may ask to listen, none
+	// when empty
+	AllowListen []string
+	// Hooks are called on the streams, the control connections and the
+	// failed dials
+	Hooks protocol.Hooks
+	// MaxStreams caps the streams of all the tunnels open at once, none
+	// when 0
+	MaxStreams int
+	// StreamsWait is how long a stream past the caps waits for another to
+	// close before it's refused, it's refused at once when 0
+	StreamsWait time.Duration
+	// ACME fetches the certificates of the ACME hosts of the tunnels
+	ACME *ACME
+	// ExposeDomain is the domain the proxies expose their HTTP servers
+	// under, name.ExposeDomain at the reverse tunnels, none when empty
+	ExposeDomain string
+	// Direct is the destinations of the tunnels the client dials itself, the
+	// others go through the proxies, with the loopback, link local and
+	// private IPs unless TunnelPrivate
+	Direct []DirectRule
+	// TunnelPrivate sends the private destinations through the proxies as
+	// well once Direct is set, they're dialed direct otherwise
+	TunnelPrivate bool
+	// Resolver resolves the destinations the client dials itself and those
+	// of the tunnels resolving on the client, the system resolver when nil
+	Resolver *protocol.Resolver
+	// OriginCAs verify the remotes the tunnels originate TLS to when they're
+	// dialed direct, the system roots when nil
+	OriginCAs *x509.CertPool
+	protocol.Options
+
+	// streams counts the streams of all the tunnels for MaxStreams
+	streams protocol.Limiter
+	// acme is the manager of the certificates of ACME
+	acme acmeManager
+
+	lock    sync.Mutex
+	ctx     context.Context
+	dialer  *Dialer
+	dialers map[string]*Dialer
+	balance balancer
+	control protocol.ControlState
+	errors  protocol.ErrorLog
+	// listening tracks the listener of the channel and of the tunnels
+	listening protocol.Listeners
+	// lost gets the control connections to the relay once failed
+	lost chan net.Conn
+
+	// slots are the tunnels served, by LAddr
+	slots map[string]*tunnelSlot
+
+	listenersLock sync.Mutex
+	listeners     map[string]*remoteListener
+	// exposed is the registry of the names the proxies exposed, by name,
+	// under listenersLock
+	exposed map[string]*exposed
+}
+
+// Run serves until ctx is done or a listener fails
+func (client *Client) Run(ctx context.Context) error {
+	client.Options = client.Options.WithDefaults()
+	if client.HandshakeTimeout <= 0 {
+		client.HandshakeTimeout = 10 * time.Second
+	}
+	if err := client.Channel.Init(!client.Relay); err != nil {
+		return err
+	}
+	if err := validateBalance(client.Balance); err != nil {
+		return err
+	}
+	for _, tunnel := range client.Tunnels {
+		if err := client.validateTunnel(tunnel); err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	client.dialer = client.agentDialer("")
+	client.dialer.control = &client.control
+	if !client.Relay && len(client.Exec) == 0 {
+		client.listening.Expect(client.Channel.Addr)
+	}
+	for _, tunnel := range client.Tunnels {
+		client.listening.Expect(tunnel.LAddr)
+	}
+	if client.ACME != nil {
+		m, err := client.ACME.manager()
+		if err != nil {
+			return err
+		}
+		client.acme = m
+		if client.ACME.HTTPAddr != "" {
+			client.listening.Expect(client.ACME.HTTPAddr)
+		}
+	}
+	client.lock.Lock()
+	client.ctx = ctx
+	slots := make([]*tunnelSlot, len(client.Tunnels))
+	for i, tunnel := range client.Tunnels {
+		slots[i] = client.addSlot(ctx, tunnel)
+	}
+	client.lock.Unlock()
+
+	errc := make(chan error, len(client.Tunnels)+2)
+	if client.ACME != nil && client.ACME.HTTPAddr != "" {
+		go func() { errc <- client.serveACME(ctx) }()
+	}
+	switch {
+	case client.Relay:
+		client.lost = make(chan net.Conn, 1)
+		go func() { errc <- client.dialRelay(ctx) }()
+	case len(client.Exec) > 0:
+		go func() { errc <- client.runExec(ctx) }()
+	default:
+		log.Printf("Listen PROXY at %s with %s\n", client.Channel.Addr, client.Channel.Transport)
+		ln, err := client.Channel.Listen()
+		if err != nil {
+			return err
+		}
+		ln = protocol.LimitAccepts(ln, client.AcceptRate)
+		client.listening.Up(client.Channel.Addr)
+		defer client.listening.Done(client.Channel.Addr)
+		go func() { errc <- acceptLoop(ctx, ln, client.handleProxyConn) }()
+	}
+	for _, slot := range slots {
+		slot := slot
+		go func() {
+			ln, err := client.listenTunnel(slot.tunnel.Load())
+			if err == nil {
+				err = client.serveTunnel(slot.ctx, ctx, ln, slot)
+			}
+			// a tunnel a reload removed isn't a failure
+			if slot.ctx.Err() == nil || ctx.Err() != nil {
+				errc <- err
+			}
+		}()
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-errc:
+		return err
+	}
+}
+
+// ServeTunnel serves a tunnel added while Run runs, until ctx or the context
+// of Run is done
+func (client *Client) ServeTunnel(ctx context.Context, tunnel *Tunnel) error {
+	client.lock.Lock()
+	runCtx := client.ctx
+	client.lock.Unlock()
+	if runCtx == nil {
+		return errNotRunning
+	}
+	if err := client.validateTunnel(tunnel); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(runCtx, cancel)
+	defer stop()
+	ln, err := client.listenTunnel(tunnel)
+	if err != nil {
+		return err
+	}
+	slot := &tunnelSlot{ctx: ctx}
+	slot.tunnel.Store(tunnel)
+	return client.serveTunnel(ctx, ctx, ln, slot)
+}
+
+func (client *Client) validateTunnel(tunnel *Tunnel) error {
+	if tunnel.E2EKey != "" && client.E2E == nil {
+		return errNoE2EKey
+	}
+	if len(tunnel.ACME) > 0 && client.ACME == nil {
+		return errNoACME
+	}
+	return tunnel.validate(client.Relay)
+}
+
+// listenTunnel listens LAddr of tunnel, a TCP address or a unix socket, over
+// UDP as well for a dns tunnel
+func (client *Client) listenTunnel(tunnel *Tunnel) (net.Listener, error) {
+	log.Printf("Listen CLIENT at %s\n", tunnel.LAddr)
+	var lc net.ListenConfig
+	if tunnel.Mode == ModeTPROXY {
+		lc.Control = transparentControl
+	}
+	network, addr := protocol.SplitNetwork(tunnel.LAddr)
+	if network == "unix" {
+		if err := protocol.RemoveStaleSocket(addr); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := lc.Listen(context.Background(), network, addr)
+	if err != nil {
+		return nil, err
+	}
+	ln = protocol.LimitAccepts(ln, client.AcceptRate)
+	if tunnel.Mode == ModeDNS {
+		return listenDNS(ln)
+	}
+	return ln, nil
+}
+
+// serveTunnel accepts the connections of the tunnel of slot on ln until ctx
+// is done, they're handled with the tunnel as it is when accepted, the
+// requests of a reverse tunnel as it is when they're read, and their
+// streams are aborted once streams is done
+func (client *Client) serveTunnel(ctx, streams context.Context, ln net.Listener, slot *tunnelSlot) error {
+	addr := slot.tunnel.Load().LAddr
+	client.listening.Up(addr)
+	defer client.listening.Done(addr)
+	if slot.tunnel.Load().Mode == ModeReverse {
+		return client.serveReverse(ctx, streams, ln, slot)
+	}
+	if dl, ok := ln.(*dnsListener); ok {
+		go client.serveDNS(ctx, streams, dl.pc, slot)
+	}
+	return acceptLoop(ctx, ln, func(conn net.Conn) {
+		client.handleConn(streams, slot.tunnel.Load(), &slot.streams, conn)
+	})
+}
+
+// Dialer dials through the proxy without a name, it's usable once the proxy
+// connected
+func (client *Client) Dialer() *Dialer {
+	return client.dialer
+}
+
+// AgentDialer dials through the proxy called name, it's usable once the proxy
+// connected
+func (client *Client) AgentDialer(name string) *Dialer {
+	return client.dialerFor(name)
+}
+
+// Agents lists the names of the proxies connected
+func (client *Client) Agents() []string {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	var names []string
+	for name, dialer := range client.dialers {
+		if dialer.Connected() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// dialerFor is the dialer of the proxy called name, the unnamed one is the
+// default dialer
+func (client *Client) dialerFor(name string) *Dialer {
+	if name == "" {
+		return client.dialer
+	}
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	dialer := client.dialers[name]
+	if dialer == nil {
+		dialer = client.agentDialer(name)
+		if client.dialers == nil {
+			client.dialers = map[string]*Dialer{}
+		}
+		client.dialers[name] = dialer
+	}
+	return dialer
+}
+
+// agentDialer is the dialer of the proxy called name, the listeners it asks for
+// dial back through it
+func (client *Client) agentDialer(name string) *Dialer {
+	dialer := newDialer(client.Options)
+	dialer.requests = func(conn net.Conn, w *protocol.ControlWriter, head string, opts map[string]string) {
+		client.handleRequest(name, conn, w, head, opts)
+	}
+	return dialer
+}
+
+// Control describes the control connection of the proxy
+func (client *Client) Control() protocol.ControlInfo {
+	return client.control.Info()
+}
+
+// Healthy tells whether the listeners of the channel and the tunnels are up
+func (client *Client) Healthy() error {
+	client.lock.Lock()
+	ctx := client.ctx
+	client.lock.Unlock()
+	if ctx == nil || ctx.Err() != nil {
+		return errNotRunning
+	}
+	return client.listening.Err()
+}
+
+// Ready tells whether the client is healthy and a proxy, or the relay, is
+// connected to carry the streams
+func (client *Client) Ready() error {
+	if err := client.Healthy(); err != nil {
+		return err
+	}
+	if len(client.connectedAgents()) == 0 {
+		return errNotConnected
+	}
+	return nil
+}
+
+// LastErrors lists the last errors of the tunnels
+func (client *Client) LastErrors() []protocol.ErrorEntry {
+	return client.errors.List()
+}
+
+// acceptLoop serves the connections of ln until it's closed
+func acceptLoop(ctx context.Context, ln net.Listener, handler func(net.Conn)) error {
+	stop := context.AfterFunc(ctx, func() { ln.Close() })
+	defer stop()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			log.Printf("Accept: %s\n", err)
+			continue
+		}
+		go handler(conn)
+	}
+}
+
+// handleConn forwards a connection accepted by tunnel, slots counts the
+// streams of its listener, the stream is aborted once ctx is done
+func (client *Client) handleConn(ctx context.Context, tunnel *Tunnel, slots *protocol.Limiter, conn net.Conn) {
+	log.Printf("handle CLIENT conn %v\n", conn)
+	if len(tunnel.ACME) > 0 {
+		var err error
+		if conn, err = client.terminateTLS(tunnel, conn); err != nil {
+			if err != errACMEChallenge {
+				log.Printf("TLS %v: %s\n", conn, err)
+			}
+			protocol.CloseConn("CLIENT", conn)
+			return
+		}
+	}
+	raddr := tunnel.RAddr
+	if len(tunnel.Routes) > 0 {
+		var route Route
+		var err error
+		conn, route, err = tunnel.route(conn)
+		if err != nil {
+			log.Printf("Route %v: %s\n", conn, err)
+			client.errors.Add("route", err)
+			tunnel.failConn(conn, err)
+			protocol.CloseConn("CLIENT", conn)
+			return
+		}
+		raddr = route.RAddr
+		switch {
+		case route.Agent == "":
+		case client.Relay:
+			// the relay picks the agent of the raddr
+			raddr = route.Agent + "/" + raddr
+		default:
+			routed := *tunnel
+			routed.Agent = route.Agent
+			tunnel = &routed
+		}
+	}
+	if tunnel.Mode == ModeTransparent || tunnel.Mode == ModeTPROXY {
+		var err error
+		if tunnel.Mode == ModeTPROXY {
+			raddr, err = tproxyDst(conn, tunnel.LAddr)
+		} else {
+			raddr, err = originalDst(conn)
+		}
+		if err != nil {
+			log.Printf("Original destination of %v: %s\n", conn, err)
+			protocol.CloseConn("CLIENT", conn)
+			return
+		}
+	}
+	var req proxyRequest
+	if tunnel.Mode == ModeSOCKS5 || tunnel.Mode == ModeHTTP {
+		var err error
+		conn, raddr, req, err = tunnel.acceptRequest(conn, client.HandshakeTimeout)
+		if err != nil {
+			log.Printf("%s request from %v: %s\n", tunnel.Mode, conn, err)
+			protocol.CloseConn("CLIENT", conn)
+			return
+		}
+		if assoc, ok := req.(*socksUDPRequest); ok {
+			client.serveAssociate(ctx, tunnel, slots, conn, assoc)
+			return
+		}
+	}
+	info := protocol.StreamInfo{Tunnel: tunnel.Label, From: conn.RemoteAddr().String(), Addr: raddr}
+	// the dial is abandoned if the client goes away meanwhile
+	dialCtx, stop := watchClose(ctx, conn)
+	free, err := client.admitStream(dialCtx, tunnel, slots)
+	var rconn net.Conn
+	var release func()
+	if err == nil {
+		if client.direct(raddr) {
+			rconn, release, err = client.dialDirect(dialCtx, tunnel, info)
+		} else {
+			rconn, release, err = client.openStream(dialCtx, tunnel, info)
+		}
+		if err != nil {
+			free()
+		}
+	}
+	// the failures are told on conn itself, a reset needs the TCP conn
+	if piped := stop(); err == nil {
+		conn = piped
+	}
+	if err != nil {
+		if req != nil {
+			req.failed(conn, err)
+		} else {
+			tunnel.failConn(conn, err)
+		}
+		protocol.CloseConn("CLIENT", conn)
+		return
+	}
+	defer free()
+	defer release()
+	if tunnel.NoDelay != nil {
+		protocol.SetNoDelay(conn, *tunnel.NoDelay)
+		protocol.SetNoDelay(rconn, *tunnel.NoDelay)
+	}
+	if req != nil {
+		if err := req.established(conn, rconn); err != nil {
+			log.Printf("Write: %s\n", err)
+			protocol.CloseConn("PROXY", rconn)
+			protocol.CloseConn("CLIENT", conn)
+			return
+		}
+	}
+	stats := client.PipeStream(ctx, info, "CLIENT", conn, "PROXY", rconn)
+	client.Hooks.StreamClose(info, stats)
+}
+
+// admitStream takes a slot for a stream of tunnel among the streams of its
+// listener, slots, and those of the client, free gives them back
+func (client *Client) admitStream(ctx context.Context, tunnel *Tunnel, slots *protocol.Limiter) (func(), error) {
+	var err error
+	if !slots.Acquire(ctx, tunnel.MaxStreams, client.StreamsWait) {
+		err = protocol.LimitError("tunnel "+tunnel.LAddr, tunnel.MaxStreams)
+	} else if !client.streams.Acquire(ctx, client.MaxStreams, client.StreamsWait) {
+		slots.Release()
+		err = protocol.LimitError("the client", client.MaxStreams)
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		log.Printf("Refused CLIENT conn at %s: %s\n", tunnel.LAddr, err)
+		return nil, err
+	}
+	return func() {
+		client.streams.Release()
+		slots.Release()
+	}, nil
+}
+
+// openStream dials the stream of info unless the hooks refuse it, release
+// is called once the stream is closed
+func (client *Client) openStream(ctx context.Context, tunnel *Tunnel, info protocol.StreamInfo) (net.Conn, func(), error) {
+	if err := client.Hooks.StreamOpen(info); err != nil {
+		log.Printf("Refused %s: %s\n", info.Addr, err)
+		return nil, nil, protocol.PolicyError(err)
+	}
+	raddr := info.Addr
+	if tunnel.Resolve == ResolveClient {
+		var err error
+		if raddr, err = client.resolveAddr(ctx, raddr); err != nil {
+			log.Printf("Dial error, %s\n", err)
+			client.errors.Add("dial "+info.Addr, err)
+			client.Hooks.DialError(info.Addr, err)
+			return nil, nil, err
+		}
+	}
+	addr, chain, err := client.chainAddr(tunnel, raddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	opts := map[string]string{"codecs": strings.Join(tunnel.Compress, ","), "from": info.From, "chain": chain}
+	if info.Net != "" {
+		opts[protocol.NetOption] = info.Net
+	}
+	if tunnel.Flush != nil {
+		opts[protocol.FlushOption] = tunnel.Flush.String()
+	}
+	if tunnel.NoDelay != nil {
+		opts[protocol.NoDelayOption] = strconv.FormatBool(*tunnel.NoDelay)
+	}
+	if tunnel.E2EKey != "" {
+		opts["e2e"] = "noise"
+	}
+	if tunnel.TLS != "" && info.Net == "" {
+		opts[protocol.TLSOption], opts[protocol.SNIOption] = tunnel.TLS, tunnel.SNI
+	}
+	agent, rconn, release, err := client.dialAgent(ctx, tunnel.Agent, addr, opts)
+	if err == nil && tunnel.E2EKey != "" {
+		if rconn, err = client.sealStream(tunnel, agent, addr, rconn); err != nil {
+			release()
+		}
+	}
+	if err != nil && errors.Is(err, context.Canceled) {
+		log.Printf("Dial %s abandoned\n", info.Addr)
+		return nil, nil, err
+	}
+	if err != nil {
+		log.Printf("Dial error, %s\n", err)
+		client.errors.Add("dial "+info.Addr, err)
+		client.Hooks.DialError(info.Addr, err)
+		return nil, nil, err
+	}
+	return rconn, release, nil
+}
+
+// sealStream runs the e2e handshake with agent on the stream to raddr, the
+// path is agent/host:port, as the raddr of a relay client already is
+func (client *Client) sealStream(tunnel *Tunnel, agent, raddr string, conn net.Conn) (net.Conn, error) {
+	path := raddr
+	if !client.Relay {
+		path = agent + "/" + raddr
+	}
+	sealed, err := protocol.Handshake(conn, client.HandshakeTimeout, func() (net.Conn, error) {
+		return client.E2E.Client(conn, tunnel.E2EKey, path)
+	})
+	if err != nil {
+		protocol.CloseConn("PROXY", conn)
+		return nil, &protocol.DialError{Hop: protocol.HopRemote, Kind: protocol.KindFailed, Msg: "e2e handshake, " + err.Error()}
+	}
+	return sealed, nil
+}
+
+func (client *Client) handleProxyConn(conn net.Conn) {
+	if client.Bans.Banned(conn.RemoteAddr()) {
+		conn.Close()
+		return
+	}
+	log.Printf("handle CLIENT_PROXY conn %v\n", conn)
+	r := bufio.NewReader(conn)
+	// connections which don't say who they are in time are closed
+	conn.SetReadDeadline(time.Now().Add(client.HandshakeTimeout))
+	bytes, err := r.ReadSlice('\n')
+	if err != nil {
+		log.Printf("ReadSlice from %v: %s, got %s\n", conn.RemoteAddr(), err, protocol.HexPrefix(bytes))
+		badConnIDs.Add(1)
+		client.Bans.Fail(conn.RemoteAddr())
+		protocol.CloseConn("PROXY", conn)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	line := string(bytes)
+	head, opts := protocol.ParseLine(line)
+	if head == "ctrl" {
+		if err := client.challenge(conn, r, opts); err != nil {
+			protocol.CloseConn("PROXY", conn)
+			return
+		}
+		if err := client.validate(conn, head, opts); err != nil {
+			protocol.CloseConn("PROXY", conn)
+			return
+		}
+		client.Bans.Succeed(conn.RemoteAddr())
+		if !client.admit(conn) {
+			return
+		}
+		client.setControl(conn, r, opts)
+		return
+	}
+	connID, err := strconv.ParseInt(head, 10, 32)
+	if err != nil || connID <= 0 {
+		client.Bans.Fail(conn.RemoteAddr())
+		client.rejectProxyConn(conn, "invalid conn id", bytes)
+		return
+	}
+	// the challenge reads on past bytes, of the buffer of r
+	if err := client.challenge(conn, r, opts); err != nil {
+		protocol.CloseConn("PROXY", conn)
+		return
+	}
+	if err := client.validate(conn, head, opts); err != nil {
+		client.rejectProxyConn(conn, "auth failed", []byte(line))
+		return
+	}
+	if !client.dialerFor(opts["name"]).setProxyConn(int32(connID), conn) {
+		client.rejectProxyConn(conn, "duplicated conn id", []byte(line))
+		return
+	}
+	conn.Write([]byte("ok\n"))
+}
+
+// challenge challenges the connection whose first line asked it in opts, a
+// connection which fails to answer counts as a failed handshake
+func (client *Client) challenge(conn net.Conn, r *bufio.Reader, opts map[string]string) error {
+	err := protocol.Challenge(conn, r, opts, client.HandshakeTimeout)
+	if err != nil {
+		log.Printf("Challenge %v: %s\n", conn.RemoteAddr(), err)
+		badConnIDs.Add(1)
+		client.Bans.Fail(conn.RemoteAddr())
+	}
+	return err
+}
+
+// validate validates the connection whose first line is head and opts with
+// the authenticator
+func (client *Client) validate(conn net.Conn, head string, opts map[string]string) error {
+	auth := client.auth()
+	if auth == nil {
+		return nil
+	}
+	var err error
+	if head == "ctrl" {
+		err = auth.ValidateControl(conn, opts)
+	} else {
+		err = auth.ValidateStream(conn, opts)
+	}
+	if err != nil {
+		log.Printf("Auth %v: %s\n", conn.RemoteAddr(), err)
+		authFailures.Add(1)
+		client.Bans.Fail(conn.RemoteAddr())
+		client.errors.Add("auth "+conn.RemoteAddr().String(), err)
+	}
+	return err
+}
+
+// setControl makes conn the control connection of the dialer of the proxy
+// name told in opts, of its hello, and returns the connection the replies are
+// read on, the status tracks the proxy without a name
+func (client *Client) setControl(conn net.Conn, r *bufio.Reader, opts map[string]string) net.Conn {
+	var session *protocol.Session
+	if opts["mux"] != "" {
+		session = protocol.NewSession(conn, r)
+		conn = session.ControlConn()
+	} else if r.Buffered() > 0 {
+		// the requests the proxy sent right after its hello
+		conn = &peekConn{Conn: conn, r: r}
+	}
+	name := opts["name"]
+	if name != "" {
+		log.Printf("Agent %s at %v\n", name, conn.RemoteAddr())
+	}
+	peer := protocol.ParseCapabilities(opts)
+	protocol.CheckVersion("PROXY", peer)
+	if session != nil && peer.Has("reset") {
+		session.AllowReset()
+	}
+	if session != nil && peer.Has("halfclose") {
+		session.AllowHalfClose()
+	}
+	if session != nil && peer.Has("window") {
+		session.AllowWindow()
+	}
+	w := client.dialerFor(name).setConn(conn, session, peer)
+	if name == "" {
+		client.control.Set(conn, peer)
+	}
+	client.Hooks.ControlConnect(conn)
+	if err := w.WriteLine(protocol.FormatLine("caps", protocol.LocalCapabilities().Options())); err != nil {
+		log.Printf("Write: %s\n", err)
+	}
+	return conn
+}
+
+// admit admits the control connection conn, or replies it busy and closes it
+func (client *Client) admit(conn net.Conn) bool {
+	if client.Admission == nil {
+		return true
+	}
+	ok, retry := client.Admission.Admit()
+	if !ok {
+		log.Printf("Busy %v, retry in %s\n", conn.RemoteAddr(), retry)
+		conn.SetWriteDeadline(time.Now().Add(client.HandshakeTimeout))
+		conn.Write([]byte(protocol.BusyLine(retry)))
+		protocol.CloseConn("PROXY", conn)
+	}
+	return ok
+}
+
+// rejectProxyConn NACKs a data connection whose conn id line is bad
+func (client *Client) rejectProxyConn(conn net.Conn, reason string, line []byte) {
+	log.Printf("%s from %v, %s\n", reason, conn.RemoteAddr(), protocol.HexPrefix(line))
+	badConnIDs.Add(1)
+	conn.SetWriteDeadline(time.Now().Add(client.HandshakeTimeout))
+	conn.Write([]byte("nack\n"))
+	protocol.CloseConn("PROXY", conn)
+}
+
+var (
+	errNotConnected = &protocol.DialError{Hop: protocol.HopChannel, Kind: protocol.KindUnreachable, Msg: "proxy is not connected"}
+	errNoMux        = errors.New("custom frames need -mux")
+	errNotRunning   = errors.New("client is not running")
+	errNoE2EKey     = errors.New("e2e tunnels need the e2e key of the client")
+	errNoUDP        = &protocol.DialError{Hop: protocol.HopRemote, Kind: protocol.KindFailed, Msg: "the proxy doesn't dial udp streams"}
+	errNoTLS        = &protocol.DialError{Hop: protocol.HopRemote, Kind: protocol.KindFailed, Msg: "the proxy doesn't originate tls"}
+)
+
+// Dialer construct connection used by client request
+type Dialer struct {
+	sync.Mutex
+	conn    net.Conn
+	writer  *protocol.ControlWriter
+	reader  *bufio.Reader
+	mux     *protocol.Session
+	opts    protocol.Options
+	control *protocol.ControlState
+	// cancels tells whether the proxy of conn takes the cancels of the dials
+	cancels bool
+	// udp tells whether the proxy of conn dials the udp streams
+	udp bool
+	// tls tells whether the proxy of conn originates the TLS of the streams
+	tls bool
+	// requests serves the requests of the proxy on a control connection,
+	// head is empty once the connection failed
+	requests func(conn net.Conn, w *protocol.ControlWriter, head string, opts map[string]string)
+
+	nextID      uint32
+	pendingLock sync.Mutex
+	pending     map[string]*pendingDial
+
+	connsLock sync.Mutex
+	conns     map[int32]net.Conn
+}
+
+// pendingDial waits the reply of a dial request sent on conn
+type pendingDial struct {
+	conn  net.Conn
+	reply chan dialReply
+}
+
+type dialReply struct {
+	head string
+	opts map[string]string
+	err  error
+}
+
+// NewDialer create new dialer
+func NewDialer(conn net.Conn) *Dialer {
+	r := newDialer(protocol.Options{}.WithDefaults())
+	r.setConn(conn, nil, nil)
+	return r
+}
+
+// NewSessionDialer is a dialer whose streams are carried by session, the
+// control connection of a proxy with mux accepted by other means than Run
+func NewSessionDialer(session *protocol.Session, opts protocol.Options) *Dialer {
+	r := newDialer(opts.WithDefaults())
+	r.setConn(session.ControlConn(), session, nil)
+	return r
+}
+
+func newDialer(opts protocol.Options) *Dialer {
+	return &Dialer{
+		opts:    opts,
+		pending: map[string]*pendingDial{},
+		conns:   map[int32]net.Conn{},
+	}
+}
+
+// Dial construct connection used by client request, concurrent dials share
+// the control connection and are told apart by their request id
+func (dialer *Dialer) Dial(addr string) (net.Conn, error) {
+	return dialer.dial(context.Background(), addr, nil)
+}
+
+// DialContext is Dial with the signature of net.Dialer, for
+// http.Transport.DialContext and alike, ctx aborts the pending dial, its
+// deadline bounds the dial of the proxy too, and the errors are *net.OpError
+func (dialer *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	conn, err := dialer.dial(ctx, addr, nil)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	return conn, nil
+}
+
+// DialOptions dials addr with opts in the dial request, for the relays which
+// forward the options of the streams they broker
+func (dialer *Dialer) DialOptions(ctx context.Context, addr string, opts map[string]string) (net.Conn, error) {
+	return dialer.dial(ctx, addr, opts)
+}
+
+// dial sends opts in the dial request, the codecs offered for the stream of
+// which the proxy picks the first it accepts, the from address of the
+// connection the stream is for and alike
+func (dialer *Dialer) dial(ctx context.Context, addr string, opts map[string]string) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	log.Printf("dial to %s", addr)
+	id := strconv.FormatUint(uint64(atomic.AddUint32(&dialer.nextID, 1)), 10)
+	// the dial is pending before the connection can be cleared, so its
+	// failure fails the dial
+	dialer.Lock()
+	conn, w, mux, cancels := dialer.conn, dialer.writer, dialer.mux, dialer.cancels
+	if w == nil {
+		dialer.Unlock()
+		return nil, errNotConnected
+	}
+	if opts[protocol.NetOption] == protocol.NetUDP && !dialer.udp {
+		dialer.Unlock()
+		return nil, errNoUDP
+	}
+	if opts[protocol.TLSOption] != "" && !dialer.tls {
+		dialer.Unlock()
+		return nil, errNoTLS
+	}
+	pending := &pendingDial{conn: conn, reply: make(chan dialReply, 1)}
+	dialer.pendingLock.Lock()
+	dialer.pending[id] = pending
+	dialer.pendingLock.Unlock()
+	dialer.Unlock()
+	reqOpts := map[string]string{"id": id}
+	for k, v := range opts {
+		if k != "id" {
+			reqOpts[k] = v
+		}
+	}
+	if budget, ok := protocol.DialBudget(ctx); ok {
+		reqOpts[protocol.BudgetOption] = budget
+	}
+	req := protocol.FormatLine("dial:"+protocol.EscapeAddr(addr), reqOpts)
+	log.Printf("REQ: %s", req)
+	if err := w.WriteLine(req); err != nil {
+		dialer.pendingLock.Lock()
+		delete(dialer.pending, id)
+		dialer.pendingLock.Unlock()
+		return nil, err
+	}
+	// the stream is written as its tunnel asks, the options of the dialer
+	// when it doesn't or the policy is invalid
+	flush, _ := protocol.ParseFlushPolicy(opts[protocol.FlushOption])
+	select {
+	case reply := <-pending.reply:
+		return dialer.stream(reply, mux, flush)
+	case <-ctx.Done():
+		dialer.pendingLock.Lock()
+		_, waiting := dialer.pending[id]
+		delete(dialer.pending, id)
+		dialer.pendingLock.Unlock()
+		dialsAbandoned.Add(1)
+		if !waiting {
+			// the reply is on its way, the stream it brings is closed
+			go func() {
+				if conn, err := dialer.stream(<-pending.reply, mux, nil); err == nil {
+					conn.Close()
+				}
+			}()
+		} else if cancels {
+			// the proxy stops dialing rather than connect the remote
+			// for nobody
+			if err := w.WriteLine(protocol.FormatLine("cancel", map[string]string{"id": id})); err != nil {
+				log.Printf("Write: %s\n", err)
+			}
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// stream is the data connection of a dial reply, written with the flush
+// policy flush
+func (dialer *Dialer) stream(reply dialReply, mux *protocol.Session, flush *protocol.FlushPolicy) (net.Conn, error) {
+	if reply.err != nil {
+		return nil, protocol.NewDialError(protocol.HopChannel, reply.err)
+	}
+	if reply.head == "err" {
+		return nil, protocol.ParseDialError(reply.opts)
+	}
+	connID, err := strconv.Atoi(reply.head)
+	if err != nil {
+		return nil, err
+	}
+	var dataConn net.Conn
+	if mux != nil {
+		dataConn = mux.Stream(uint32(connID))
+	} else {
+		dialer.connsLock.Lock()
+		dataConn = dialer.conns[int32(connID)]
+		delete(dialer.conns, int32(connID))
+		dialer.connsLock.Unlock()
+	}
+	if dataConn == nil {
+		return nil, &protocol.DialError{Hop: protocol.HopChannel, Kind: protocol.KindFailed, Msg: "can't get conn"}
+	}
+	if name := reply.opts["codec"]; name != "" && protocol.GetCodec(name) == nil {
+		dataConn.Close()
+		return nil, fmt.Errorf("unknown codec, %s", name)
+	}
+	return dialer.opts.WithFlush(flush).WrapStream(dataConn, reply.opts["codec"]), nil
+}
+
+// SetPeer records the capabilities the proxy told in its hello, for the
+// dialers of NewSessionDialer
+func (dialer *Dialer) SetPeer(peer *protocol.Capabilities) {
+	dialer.Lock()
+	defer dialer.Unlock()
+	dialer.cancels = peer != nil && peer.Has("cancel")
+	dialer.udp = peer != nil && peer.Has("udp")
+	dialer.tls = peer != nil && peer.Has("tls")
+}
+
+// Connected tells if the control connection is up
+func (dialer *Dialer) Connected() bool {
+	dialer.Lock()
+	defer dialer.Unlock()
+	return dialer.writer != nil
+}
+
+// SendFrame sends a custom frame to the proxy on the mux session
+func (dialer *Dialer) SendFrame(typ byte, payload []byte) error {
+	dialer.Lock()
+	session := dialer.mux
+	dialer.Unlock()
+	if session == nil {
+		return errNoMux
+	}
+	return session.SendFrame(typ, payload)
+}
+
+// isRequest tells whether head is of a request of the proxy, not a reply
+func isRequest(head string) bool {
+	kind, _, _ := strings.Cut(head, ":")
+	switch kind {
+	case "listen", "unlisten", "expose", "unexpose":
+		return strings.Contains(head, ":")
+	}
+	return false
+}
+
+// readReplies dispatches the replies read from a control connection to the
+// pending dials, which all fail once the connection does
+func (dialer *Dialer) readReplies(conn net.Conn, w *protocol.ControlWriter, r *bufio.Reader) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			log.Printf("ReadString: %s\n", err)
+			dialer.clearConn(conn)
+			dialer.failPending(conn, err)
+			if dialer.control != nil {
+				dialer.control.Clear(conn)
+			}
+			if dialer.requests != nil {
+				dialer.requests(conn, w, "", nil)
+			}
+			return
+		}
+		log.Printf("RSP: %s", line)
+		head, opts := protocol.ParseLine(line)
+		if s, ok := strings.CutPrefix(head, "expire:"); ok {
+			if connID, err := strconv.ParseInt(s, 10, 32); err == nil {
+				dialer.expireProxyConn(int32(connID))
+			}
+			continue
+		}
+		if dialer.requests != nil && isRequest(head) {
+			dialer.requests(conn, w, head, opts)
+			continue
+		}
+		dialer.pendingLock.Lock()
+		pending := dialer.pending[opts["id"]]
+		delete(dialer.pending, opts["id"])
+		dialer.pendingLock.Unlock()
+		if pending == nil {
+			log.Printf("unexpected reply, %s", line)
+			continue
+		}
+		pending.reply <- dialReply{head: head, opts: opts}
+	}
+}
+
+func (dialer *Dialer) failPending(conn net.Conn, err error) {
+	dialer.pendingLock.Lock()
+	defer dialer.pendingLock.Unlock()
+	for id, pending := range dialer.pending {
+		if pending.conn == conn {
+			delete(dialer.pending, id)
+			pending.reply <- dialReply{err: err}
+		}
+	}
+}
+
+// setConn sets the control connection, the streams are carried by mux when
+// it's not nil, peer is what the proxy told it supports when known
+func (dialer *Dialer) setConn(conn net.Conn, mux *protocol.Session, peer *protocol.Capabilities) *protocol.ControlWriter {
+	dialer.Lock()
+	defer dialer.Unlock()
+	if dialer.conn != nil {
+		protocol.CloseConn("PROXY", dialer.conn)
+	}
+	dialer.conn = conn
+	dialer.mux = mux
+	dialer.cancels = peer != nil && peer.Has("cancel")
+	dialer.udp = peer != nil && peer.Has("udp")
+	dialer.tls = peer != nil && peer.Has("tls")
+	dialer.writer = dialer.opts.NewControlWriter(dialer.conn)
+	dialer.reader = bufio.NewReader(dialer.conn)
+	go dialer.readReplies(dialer.conn, dialer.writer, dialer.reader)
+	return dialer.writer
+}
+
+// clearConn forgets the control connection conn once it failed, the dials
+// fail at once until the proxy connects again
+func (dialer *Dialer) clearConn(conn net.Conn) {
+	dialer.Lock()
+	defer dialer.Unlock()
+	if dialer.conn == conn {
+		dialer.conn, dialer.writer, dialer.reader, dialer.mux = nil, nil, nil, nil
+	}
+}
+
+// setProxyConn registers a data connection, false if connID is taken
+func (dialer *Dialer) setProxyConn(connID int32, conn net.Conn) bool {
+	log.Printf("set proxy conn %d, %v\n", connID, conn)
+	dialer.connsLock.Lock()
+	defer dialer.connsLock.Unlock()
+	if dialer.conns[connID] != nil {
+		return false
+	}
+	dialer.conns[connID] = conn
+	return true
+}
+
+// expireProxyConn drops the data connection connID the proxy told expired
+// out of its pool
+func (dialer *Dialer) expireProxyConn(connID int32) {
+	dialer.connsLock.Lock()
+	conn := dialer.conns[connID]
+	delete(dialer.conns, connID)
+	dialer.connsLock.Unlock()
+	if conn != nil {
+		protocol.CloseConn("PROXY", conn)
+	}
+}
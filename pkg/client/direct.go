@@ -0,0 +1,170 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/dworld/channel/pkg/protocol"
+)
+
+// kinds of the direct rules
+const (
+	directDomain = "domain"
+	directCIDR   = "cidr"
+	directPort   = "port"
+)
+
+// directStreams counts the connections of the tunnels the client dialed
+// itself for the direct rules
+var directStreams = protocol.NewCounter("direct_streams")
+
+// DirectRule is destinations the client dials itself in place of the proxy,
+// a domain and its subdomains, the IPs of a CIDR, or ports and port ranges.
+// The names aren't resolved, a CIDR matches the IPs asked
+type DirectRule struct {
+	Kind  string
+	Match string
+
+	cidr  *net.IPNet
+	ports [][2]int
+}
+
+// ParseDirectRule parses domain:example.com, cidr:10.0.0.0/8 or
+// port:22,8000-8100
+func ParseDirectRule(s string) (DirectRule, error) {
+	kind, match, ok := strings.Cut(s, ":")
+	rule := DirectRule{Kind: kind, Match: strings.ToLower(match)}
+	if !ok || rule.Match == "" {
+		return DirectRule{}, fmt.Errorf("invalid direct rule %s, want kind:match", s)
+	}
+	switch rule.Kind {
+	case directDomain:
+		rule.Match = strings.Trim(rule.Match, ".")
+	case directCIDR:
+		_, cidr, err := net.ParseCIDR(rule.Match)
+		if err != nil {
+			return DirectRule{}, fmt.Errorf("invalid direct rule %s, %s", s, err)
+		}
+		rule.cidr = cidr
+	case directPort:
+		for _, r := range strings.Split(rule.Match, ",") {
+			lo, hi, isRange := strings.Cut(r, "-")
+			if !isRange {
+				hi = lo
+			}
+			from, err := strconv.ParseUint(lo, 10, 16)
+			to, herr := strconv.ParseUint(hi, 10, 16)
+			if err != nil || herr != nil || from > to {
+				return DirectRule{}, fmt.Errorf("invalid direct rule %s, bad port range %s", s, r)
+			}
+			rule.ports = append(rule.ports, [2]int{int(from), int(to)})
+		}
+	default:
+		return DirectRule{}, fmt.Errorf("invalid direct rule %s, kind %s", s, rule.Kind)
+	}
+	return rule, nil
+}
+
+func (rule DirectRule) String() string {
+	return rule.Kind + ":" + rule.Match
+}
+
+func (rule DirectRule) matches(host string, port int) bool {
+	switch rule.Kind {
+	case directDomain:
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		return host == rule.Match || strings.HasSuffix(host, "."+rule.Match)
+	case directCIDR:
+		ip := net.ParseIP(host)
+		return ip != nil && rule.cidr.Contains(ip)
+	case directPort:
+		for _, r := range rule.ports {
+			if port >= r[0] && port <= r[1] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// direct tells whether the client dials raddr itself, as a rule of Direct
+// matches it or it's private
+func (client *Client) direct(raddr string) bool {
+	client.lock.Lock()
+	rules := client.Direct
+	client.lock.Unlock()
+	if len(rules) == 0 {
+		return false
+	}
+	if _, addr, ok := strings.Cut(raddr, "/"); ok {
+		// of a relay client
+		raddr = addr
+	}
+	host, portStr, err := net.SplitHostPort(raddr)
+	if err != nil {
+		return false
+	}
+	if !client.TunnelPrivate && privateHost(host) {
+		return true
+	}
+	port, _ := strconv.Atoi(portStr)
+	for _, rule := range rules {
+		if rule.matches(host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// privateHost tells whether host is loopback, link local or of the private
+// ranges of RFC 1918 and RFC 4193, localhost among the names
+func privateHost(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		return host == "localhost" || strings.HasSuffix(host, ".localhost")
+	}
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()
+}
+
+// dialDirect dials the remote of info from the client, as openStream does
+// through the proxy
+func (client *Client) dialDirect(ctx context.Context, tunnel *Tunnel, info protocol.StreamInfo) (net.Conn, func(), error) {
+	if err := client.Hooks.StreamOpen(info); err != nil {
+		log.Printf("Refused %s: %s\n", info.Addr, err)
+		return nil, nil, protocol.PolicyError(err)
+	}
+	raddr := info.Addr
+	if _, addr, ok := strings.Cut(raddr, "/"); ok {
+		raddr = addr
+	}
+	network := "tcp"
+	if info.Net == protocol.NetUDP {
+		network = "udp"
+	}
+	log.Printf("dial to %s direct\n", raddr)
+	conn, err := client.Resolver.DialContext(ctx, network, raddr)
+	if err == nil && tunnel.TLS != "" && info.Net == "" {
+		conn, err = protocol.OriginateTLS(ctx, conn, raddr, map[string]string{protocol.TLSOption: tunnel.TLS, protocol.SNIOption: tunnel.SNI}, client.OriginCAs)
+	}
+	if err != nil && ctx.Err() != nil {
+		log.Printf("Dial %s abandoned\n", info.Addr)
+		return nil, nil, ctx.Err()
+	}
+	if err != nil {
+		err = protocol.NewDialError(protocol.HopRemote, err)
+		log.Printf("Dial error, %s\n", err)
+		client.errors.Add("dial "+info.Addr, err)
+		client.Hooks.DialError(info.Addr, err)
+		return nil, nil, err
+	}
+	directStreams.Add(1)
+	if info.Net == protocol.NetUDP {
+		conn = protocol.UDPStream(conn)
+	}
+	return conn, func() {}, nil
+}
@@ -0,0 +1,198 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/dworld/channel/pkg/protocol"
+)
+
+const (
+	// dnsTimeout is how long a query of a dns tunnel waits for its answer
+	dnsTimeout = 5 * time.Second
+	// dnsHeader is the size of the header of the DNS messages
+	dnsHeader = 12
+	// dnsUDPSize is the largest answer over UDP to the queries without an
+	// EDNS payload size
+	dnsUDPSize = 512
+	// dnsTypeOPT is the type of the EDNS pseudo record
+	dnsTypeOPT = 41
+)
+
+var errDNSMessage = errors.New("malformed DNS message")
+
+// dnsListener is the TCP listener of a dns tunnel with the UDP socket bound
+// at the same address, closed with it
+type dnsListener struct {
+	net.Listener
+	pc net.PacketConn
+}
+
+func (ln *dnsListener) Close() error {
+	ln.pc.Close()
+	return ln.Listener.Close()
+}
+
+// listenDNS binds the UDP socket of the dns tunnel listening ln
+func listenDNS(ln net.Listener) (net.Listener, error) {
+	pc, err := net.ListenPacket("udp", ln.Addr().String())
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &dnsListener{Listener: ln, pc: pc}, nil
+}
+
+// serveDNS answers the UDP queries of the dns tunnel of slot on pc until ctx
+// is done, each is asked over TCP through a stream to the RAddr of the
+// tunnel, the TCP connections of the tunnel are forwarded as they are
+func (client *Client) serveDNS(ctx, streams context.Context, pc net.PacketConn, slot *tunnelSlot) {
+	stop := context.AfterFunc(ctx, func() { pc.Close() })
+	defer stop()
+	buf := make([]byte, protocol.MaxDatagram)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+				log.Printf("DNS %s: %s\n", pc.LocalAddr(), err)
+			}
+			return
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go client.answerDNS(streams, slot.tunnel.Load(), &slot.streams, pc, from, query)
+	}
+}
+
+// answerDNS asks query of from and writes its answer back, truncated when
+// it's longer than the UDP of from takes so it asks again over TCP
+func (client *Client) answerDNS(ctx context.Context, tunnel *Tunnel, slots *protocol.Limiter, pc net.PacketConn, from net.Addr, query []byte) {
+	if len(query) < dnsHeader {
+		return
+	}
+	info := protocol.StreamInfo{Tunnel: tunnel.Label, From: from.String(), Addr: tunnel.RAddr}
+	start := time.Now()
+	answer, err := client.exchangeDNS(ctx, tunnel, slots, info, query)
+	if err != nil {
+		log.Printf("DNS query of %s: %s\n", from, err)
+		return
+	}
+	if limit := dnsUDPLimit(query); len(answer) > limit {
+		if answer, err = truncateDNS(answer); err != nil {
+			log.Printf("DNS answer to %s: %s\n", from, err)
+			return
+		}
+	}
+	if _, err := pc.WriteTo(answer, from); err != nil {
+		log.Printf("DNS answer to %s: %s\n", from, err)
+	}
+	client.Hooks.StreamClose(info, protocol.StreamStats{In: int64(len(query)), Out: int64(len(answer)), Duration: time.Since(start)})
+}
+
+// exchangeDNS sends query on a stream of tunnel as DNS over TCP does and
+// reads its answer
+func (client *Client) exchangeDNS(ctx context.Context, tunnel *Tunnel, slots *protocol.Limiter, info protocol.StreamInfo, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+	free, err := client.admitStream(ctx, tunnel, slots)
+	if err != nil {
+		return nil, err
+	}
+	defer free()
+	var rconn net.Conn
+	var release func()
+	if client.direct(info.Addr) {
+		rconn, release, err = client.dialDirect(ctx, tunnel, info)
+	} else {
+		rconn, release, err = client.openStream(ctx, tunnel, info)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	defer rconn.Close()
+	deadline, _ := ctx.Deadline()
+	rconn.SetDeadline(deadline)
+	msg := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	if _, err := rconn.Write(append(msg, query...)); err != nil {
+		return nil, err
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(rconn, size[:]); err != nil {
+		return nil, err
+	}
+	answer := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(rconn, answer); err != nil {
+		return nil, err
+	}
+	return answer, nil
+}
+
+// dnsUDPLimit is the largest answer the asker of query takes over UDP, the
+// payload size of its EDNS record when it has one
+func dnsUDPLimit(query []byte) int {
+	counts := func(i int) int { return int(binary.BigEndian.Uint16(query[4+2*i:])) }
+	off := dnsHeader
+	var err error
+	for i := 0; i < counts(0); i++ {
+		if off, err = skipDNSName(query, off); err != nil || off+4 > len(query) {
+			return dnsUDPSize
+		}
+		off += 4
+	}
+	for i := 0; i < counts(1)+counts(2)+counts(3); i++ {
+		if off, err = skipDNSName(query, off); err != nil || off+10 > len(query) {
+			return dnsUDPSize
+		}
+		typ := binary.BigEndian.Uint16(query[off:])
+		// the class of OPT is the payload size
+		if size := int(binary.BigEndian.Uint16(query[off+2:])); typ == dnsTypeOPT && size > dnsUDPSize {
+			return size
+		}
+		off += 10 + int(binary.BigEndian.Uint16(query[off+8:]))
+	}
+	return dnsUDPSize
+}
+
+// truncateDNS is answer with TC set and its question alone
+func truncateDNS(answer []byte) ([]byte, error) {
+	if len(answer) < dnsHeader {
+		return nil, errDNSMessage
+	}
+	off := dnsHeader
+	var err error
+	for i := 0; i < int(binary.BigEndian.Uint16(answer[4:])); i++ {
+		if off, err = skipDNSName(answer, off); err != nil || off+4 > len(answer) {
+			return nil, errDNSMessage
+		}
+		off += 4
+	}
+	truncated := append([]byte(nil), answer[:off]...)
+	truncated[2] |= 0x02
+	// no answer, authority nor additional records
+	clear(truncated[6:dnsHeader])
+	return truncated, nil
+}
+
+// skipDNSName is the offset past the name at off of msg
+func skipDNSName(msg []byte, off int) (int, error) {
+	for off < len(msg) {
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			return off + 1, nil
+		case n&0xc0 == 0xc0:
+			// a pointer ends the name
+			if off+2 > len(msg) {
+				return 0, errDNSMessage
+			}
+			return off + 2, nil
+		}
+		off += 1 + n
+	}
+	return 0, errDNSMessage
+}
@@ -0,0 +1,128 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// dnsName is name in labels
+func dnsName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(name, ".") {
+		b = append(append(b, byte(len(label))), label...)
+	}
+	return append(b, 0)
+}
+
+// dnsMessage is a message of id 0x1234 asking name of type A, with the
+// answers and additional records given
+func dnsMessage(name string, answers, additional [][]byte) []byte {
+	msg := []byte{0x12, 0x34, 0x81, 0x80, 0, 1}
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(answers)))
+	msg = binary.BigEndian.AppendUint16(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(additional)))
+	msg = append(msg, dnsName(name)...)
+	msg = append(msg, 0, 1, 0, 1)
+	for _, rr := range append(answers, additional...) {
+		msg = append(msg, rr...)
+	}
+	return msg
+}
+
+// dnsA is an A record of the name of the question
+func dnsA(ip [4]byte) []byte {
+	return append([]byte{0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4}, ip[:]...)
+}
+
+// dnsOPT is the EDNS record of payload size
+func dnsOPT(size uint16) []byte {
+	rr := []byte{0, 0, dnsTypeOPT}
+	rr = binary.BigEndian.AppendUint16(rr, size)
+	return append(rr, 0, 0, 0, 0, 0, 0)
+}
+
+func TestDNSUDPLimit(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		query []byte
+		want  int
+	}{
+		{"no edns", dnsMessage("example.com", nil, nil), dnsUDPSize},
+		{"edns", dnsMessage("example.com", nil, [][]byte{dnsOPT(1232)}), 1232},
+		{"edns below 512", dnsMessage("example.com", nil, [][]byte{dnsOPT(256)}), dnsUDPSize},
+		{"edns after a record", dnsMessage("example.com", nil, [][]byte{dnsA([4]byte{1, 2, 3, 4}), dnsOPT(4096)}), 4096},
+		{"truncated question", dnsMessage("example.com", nil, nil)[:dnsHeader+5], dnsUDPSize},
+		{"truncated edns", dnsMessage("example.com", nil, [][]byte{dnsOPT(1232)})[:dnsHeader+17+5], dnsUDPSize},
+		{"header only", dnsMessage("example.com", nil, nil)[:dnsHeader], dnsUDPSize},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := dnsUDPLimit(tc.query); got != tc.want {
+				t.Errorf("limit %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTruncateDNS(t *testing.T) {
+	var answers [][]byte
+	for i := 0; i < 40; i++ {
+		answers = append(answers, dnsA([4]byte{10, 0, 0, byte(i)}))
+	}
+	answer := dnsMessage("example.com", answers, [][]byte{dnsOPT(1232)})
+	question := dnsMessage("example.com", nil, nil)
+	want := append([]byte(nil), question...)
+	// TC set
+	want[2] |= 0x02
+	for _, tc := range []struct {
+		name   string
+		answer []byte
+		want   []byte
+		err    bool
+	}{
+		{"answers dropped", answer, want, false},
+		{"question only", question, want, false},
+		{"short header", answer[:dnsHeader-1], nil, true},
+		{"truncated question", answer[:dnsHeader+6], nil, true},
+		{"question past the end", answer[:dnsHeader+13+2], nil, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := truncateDNS(tc.answer)
+			if (err != nil) != tc.err {
+				t.Fatalf("truncate error %v", err)
+			}
+			if !bytes.Equal(got, tc.want) {
+				t.Errorf("truncated %x\nwant %x", got, tc.want)
+			}
+		})
+	}
+	if len(answer) <= dnsUDPSize {
+		t.Fatalf("answer of %d bytes fits UDP", len(answer))
+	}
+}
+
+func TestSkipDNSName(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		msg  []byte
+		off  int
+		want int
+		err  bool
+	}{
+		{"labels", dnsName("www.example.com"), 0, 17, false},
+		{"root", []byte{0}, 0, 1, false},
+		{"pointer", []byte{0xc0, 12}, 0, 2, false},
+		{"labels then pointer", []byte{3, 'w', 'w', 'w', 0xc0, 12}, 0, 6, false},
+		{"truncated pointer", []byte{0xc0}, 0, 0, true},
+		{"label past the end", []byte{5, 'a', 'b'}, 0, 0, true},
+		{"no end", []byte{1, 'a'}, 0, 0, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := skipDNSName(tc.msg, tc.off)
+			if (err != nil) != tc.err || got != tc.want {
+				t.Errorf("skip %d, %v, want %d, error %v", got, err, tc.want, tc.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package client
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"strings"
+)
+
+// dialErrorWriters write a protocol-correct error to the client when the
+// tunnel dial fails, keyed by backend protocol
+var dialErrorWriters = map[string]func(w io.Writer, msg string) error{
+	"mysql": writeMySQLError,
+	"redis": writeRedisError,
+}
+
+// writeDialError replies err to the client in its backend protocol, it writes
+// nothing for unknown protocols and the connection is just closed
+func writeDialError(w io.Writer, protocol string, err error) {
+	write := dialErrorWriters[protocol]
+	if write == nil {
+		return
+	}
+	msg := "channel: " + strings.NewReplacer("\r", " ", "\n", " ").Replace(err.Error())
+	if err := write(w, msg); err != nil {
+		log.Printf("write %s error: %s\n", protocol, err)
+	}
+}
+
+// mysqlUnknownError is ER_UNKNOWN_ERROR
+const mysqlUnknownError = 1105
+
+// writeMySQLError writes an ERR packet in place of the initial handshake, the
+// client reports it as "ERROR 1105 (HY000): channel: ..."
+func writeMySQLError(w io.Writer, msg string) error {
+	payload := make([]byte, 3, 3+len(msg))
+	payload[0] = 0xff
+	binary.LittleEndian.PutUint16(payload[1:], mysqlUnknownError)
+	payload = append(payload, msg...)
+	header := make([]byte, 4)
+	header[0] = byte(len(payload))
+	header[1] = byte(len(payload) >> 8)
+	header[2] = byte(len(payload) >> 16)
+	// header[3] is the sequence id, 0 for the first packet
+	_, err := w.Write(append(header, payload...))
+	return err
+}
+
+// writeRedisError writes an error reply, read by the client as the reply of
+// its first command
+func writeRedisError(w io.Writer, msg string) error {
+	_, err := io.WriteString(w, "-ERR "+msg+"\r\n")
+	return err
+}
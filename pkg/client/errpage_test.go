@@ -0,0 +1,39 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestWriteDialError(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	for _, tc := range []struct {
+		name     string
+		protocol string
+		err      error
+		want     []byte
+	}{
+		{"mysql", "mysql", errors.New("connection refused"),
+			append([]byte{0x1e, 0, 0, 0, 0xff, 0x51, 0x04}, "channel: connection refused"...)},
+		// the length takes the second byte of the header
+		{"mysql long", "mysql", errors.New(long),
+			append([]byte{0x38, 0x01, 0, 0, 0xff, 0x51, 0x04}, "channel: "+long...)},
+		{"redis", "redis", errors.New("connection refused"),
+			[]byte("-ERR channel: connection refused\r\n")},
+		// a reply is a line
+		{"redis lines", "redis", errors.New("dial\r\nfailed\n"),
+			[]byte("-ERR channel: dial  failed \r\n")},
+		{"unknown", "postgres", errors.New("connection refused"), nil},
+		{"none", "", errors.New("connection refused"), nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			writeDialError(&buf, tc.protocol, tc.err)
+			if !bytes.Equal(buf.Bytes(), tc.want) {
+				t.Errorf("wrote % x\nwant  % x", buf.Bytes(), tc.want)
+			}
+		})
+	}
+}
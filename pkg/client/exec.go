@@ -0,0 +1,62 @@
+package client
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/dworld/channel/pkg/transport"
+)
+
+// runExec runs the proxy of Exec as a child of the client, again whenever it
+// exits, until ctx is done
+func (client *Client) runExec(ctx context.Context) error {
+	for ctx.Err() == nil {
+		if err := client.execProxy(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Exec %s: %s\n", client.Exec[0], err)
+			client.errors.Add("exec "+client.Exec[0], err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+	return ctx.Err()
+}
+
+// execProxy starts the proxy of Exec with its stdin and stdout as the
+// control connection, served as one the proxy dialed, and waits for it to
+// exit. Its stderr is the client's so its logs are with the client's
+func (client *Client) execProxy(ctx context.Context) error {
+	// pipes of our own, exec closes those of StdoutPipe once the child
+	// exits, maybe before the session read all of it
+	childIn, stdin, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	stdout, childOut, err := os.Pipe()
+	if err != nil {
+		childIn.Close()
+		stdin.Close()
+		return err
+	}
+	cmd := exec.CommandContext(ctx, client.Exec[0], client.Exec[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = childIn, childOut, os.Stderr
+	err = cmd.Start()
+	childIn.Close()
+	childOut.Close()
+	conn := transport.NewPipeConn(stdout, stdin, "exec:"+client.Exec[0])
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	log.Printf("Exec PROXY %s, pid %d\n", strings.Join(client.Exec, " "), cmd.Process.Pid)
+	client.handleProxyConn(conn)
+	err = cmd.Wait()
+	conn.Close()
+	log.Printf("PROXY pid %d exited\n", cmd.Process.Pid)
+	return err
+}
@@ -0,0 +1,158 @@
+package client
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dworld/channel/pkg/protocol"
+)
+
+// Exposed is an HTTP server a proxy exposed at Host, the reverse tunnels
+// route the requests to it to RAddr through Agent
+type Exposed struct {
+	Name  string    `json:"name"`
+	Host  string    `json:"host"`
+	Agent string    `json:"agent"`
+	RAddr string    `json:"raddr"`
+	Since time.Time `json:"since"`
+}
+
+// exposed is an entry of the registry and the control connection it was
+// asked on, the entry goes once the connection fails
+type exposed struct {
+	Exposed
+	conn net.Conn
+}
+
+// validExposeName tells whether name is a DNS label
+func validExposeName(name string) bool {
+	if name == "" || len(name) > 63 || name[0] == '-' || name[len(name)-1] == '-' {
+		return false
+	}
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// handleExpose serves the expose and unexpose requests of the proxy agent
+func (client *Client) handleExpose(agent string, conn net.Conn, w *protocol.ControlWriter, kind, name string, opts map[string]string) {
+	if kind == "unexpose" {
+		client.listenersLock.Lock()
+		e := client.exposed[name]
+		if e != nil && e.conn == conn {
+			delete(client.exposed, name)
+		}
+		client.listenersLock.Unlock()
+		if e != nil && e.conn == conn {
+			log.Printf("Unexpose %s\n", e.Host)
+		}
+		return
+	}
+	host, err := client.expose(agent, conn, name, opts["raddr"])
+	if err != nil {
+		log.Printf("Expose %s: %s\n", name, err)
+		client.errors.Add("expose "+name, err)
+		err = w.WriteLine(protocol.FormatLine("exposeerr:"+name, map[string]string{"msg": err.Error()}))
+	} else {
+		err = w.WriteLine(protocol.FormatLine("exposed:"+name, map[string]string{"host": host}))
+	}
+	if err != nil {
+		log.Printf("Write: %s\n", err)
+	}
+}
+
+// expose registers name for the proxy agent on conn under ExposeDomain, a
+// name another connection holds is refused, but for the same agent
+// reconnecting whose former connection isn't noticed failed yet
+func (client *Client) expose(agent string, conn net.Conn, name, raddr string) (string, error) {
+	if client.ExposeDomain == "" {
+		return "", fmt.Errorf("expose not allowed, the client has no domain")
+	}
+	name = strings.ToLower(name)
+	if !validExposeName(name) {
+		return "", fmt.Errorf("invalid name, %s", name)
+	}
+	if _, _, err := net.SplitHostPort(raddr); err != nil {
+		return "", fmt.Errorf("invalid raddr, %s", raddr)
+	}
+	host := name + "." + client.ExposeDomain
+	if client.routedHost(host) {
+		return "", fmt.Errorf("%s is routed by the tunnels", host)
+	}
+	client.listenersLock.Lock()
+	defer client.listenersLock.Unlock()
+	if e := client.exposed[name]; e != nil && e.conn != conn && e.Agent != agent {
+		return "", fmt.Errorf("%s is exposed by agent %q already", host, e.Agent)
+	}
+	log.Printf("Expose %s to %s through %q\n", host, raddr, agent)
+	if client.exposed == nil {
+		client.exposed = map[string]*exposed{}
+	}
+	client.exposed[name] = &exposed{
+		Exposed: Exposed{Name: name, Host: host, Agent: agent, RAddr: raddr, Since: time.Now()},
+		conn:    conn,
+	}
+	return host, nil
+}
+
+// routedHost tells whether a host route of a reverse tunnel matches host
+func (client *Client) routedHost(host string) bool {
+	for _, tunnel := range client.ServedTunnels() {
+		if tunnel.Mode != ModeReverse {
+			continue
+		}
+		for _, route := range tunnel.Routes {
+			if route.Path == "" && route.matchRequest(host, "/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// exposedHost is the entry of the registry host is of
+func (client *Client) exposedHost(host string) (Exposed, bool) {
+	name, ok := strings.CutSuffix(host, "."+client.ExposeDomain)
+	if client.ExposeDomain == "" || !ok {
+		return Exposed{}, false
+	}
+	client.listenersLock.Lock()
+	defer client.listenersLock.Unlock()
+	e := client.exposed[name]
+	if e == nil {
+		return Exposed{}, false
+	}
+	return e.Exposed, true
+}
+
+// unexposeConn removes the entries asked on conn
+func (client *Client) unexposeConn(conn net.Conn) {
+	client.listenersLock.Lock()
+	defer client.listenersLock.Unlock()
+	for name, e := range client.exposed {
+		if e.conn == conn {
+			log.Printf("Unexpose %s\n", e.Host)
+			delete(client.exposed, name)
+		}
+	}
+}
+
+// ExposedHosts lists the registry of the HTTP servers the proxies exposed,
+// by name
+func (client *Client) ExposedHosts() []Exposed {
+	client.listenersLock.Lock()
+	defer client.listenersLock.Unlock()
+	list := make([]Exposed, 0, len(client.exposed))
+	for _, e := range client.exposed {
+		list = append(list, e.Exposed)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
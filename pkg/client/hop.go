@@ -0,0 +1,54 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/dworld/channel/pkg/transport"
+)
+
+// splitHop splits a hop, key@host:port, into the key and the address
+func splitHop(hop string) (string, string, error) {
+	i := strings.LastIndex(hop, "@")
+	if i <= 0 {
+		return "", "", fmt.Errorf("invalid hop, %s, not key@host:port", hop)
+	}
+	if _, _, err := net.SplitHostPort(hop[i+1:]); err != nil {
+		return "", "", fmt.Errorf("invalid hop, %s: %s", hop, err)
+	}
+	return hop[:i], hop[i+1:], nil
+}
+
+// sealChain seals the layers of the chain through hops to raddr, it returns
+// the address of the first hop, which the agent dials, and the chain it sends
+func sealChain(hops []string, raddr string) (string, string, error) {
+	next, chain := raddr, ""
+	for i := len(hops) - 1; i >= 0; i-- {
+		key, addr, err := splitHop(hops[i])
+		if err != nil {
+			return "", "", err
+		}
+		if chain, err = transport.SealHop(key, next, chain); err != nil {
+			return "", "", err
+		}
+		next = addr
+	}
+	return next, chain, nil
+}
+
+// chainAddr is the address the agent dials for the stream of tunnel to raddr
+// and the chain sent along, the agent of a relay client stays in front
+func (client *Client) chainAddr(tunnel *Tunnel, raddr string) (string, string, error) {
+	if len(tunnel.Hops) == 0 {
+		return raddr, "", nil
+	}
+	prefix := ""
+	if client.Relay {
+		if i := strings.Index(raddr, "/"); i >= 0 {
+			prefix, raddr = raddr[:i+1], raddr[i+1:]
+		}
+	}
+	first, chain, err := sealChain(tunnel.Hops, raddr)
+	return prefix + first, chain, err
+}
@@ -0,0 +1,46 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dworld/channel/pkg/protocol"
+)
+
+// Invariants are the checks of the accounting of the client, for
+// protocol.WatchInvariants
+func (client *Client) Invariants() []protocol.Invariant {
+	return []protocol.Invariant{{Name: "dials", Check: client.checkDials}}
+}
+
+// checkDials checks no dial waits the reply of a control connection which
+// failed or was replaced, failPending ends them
+func (client *Client) checkDials() error {
+	client.lock.Lock()
+	dialers := map[string]*Dialer{"": client.dialer}
+	for name, dialer := range client.dialers {
+		dialers[name] = dialer
+	}
+	client.lock.Unlock()
+	var issues []string
+	for name, dialer := range dialers {
+		dialer.Lock()
+		conn := dialer.conn
+		dialer.Unlock()
+		dialer.pendingLock.Lock()
+		stale := 0
+		for _, pending := range dialer.pending {
+			if pending.conn != conn {
+				stale++
+			}
+		}
+		dialer.pendingLock.Unlock()
+		if stale > 0 {
+			issues = append(issues, fmt.Sprintf("%d dials of proxy %q wait on a control connection gone", stale, name))
+		}
+	}
+	if len(issues) > 0 {
+		return fmt.Errorf("%s", strings.Join(issues, ", "))
+	}
+	return nil
+}
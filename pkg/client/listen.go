@@ -0,0 +1,128 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"path"
+	"strings"
+
+	"github.com/dworld/channel/pkg/protocol"
+)
+
+// remoteListener is a listener the proxy asked for on its control connection,
+// the connections accepted are dialed to the listener of the proxy
+type remoteListener struct {
+	conn   net.Conn
+	ln     net.Listener
+	cancel context.CancelFunc
+}
+
+// handleRequest serves the listen and unlisten requests of the proxy agent,
+// and the expose ones, the listeners and the names of conn are given up
+// once it failed
+func (client *Client) handleRequest(agent string, conn net.Conn, w *protocol.ControlWriter, head string, opts map[string]string) {
+	if head == "" {
+		client.closeListeners(conn)
+		client.unexposeConn(conn)
+		if client.lost != nil {
+			select {
+			case client.lost <- conn:
+			default:
+			}
+		}
+		return
+	}
+	kind, addr, _ := strings.Cut(head, ":")
+	if kind == "expose" || kind == "unexpose" {
+		client.handleExpose(agent, conn, w, kind, addr, opts)
+		return
+	}
+	if kind == "unlisten" {
+		client.listenersLock.Lock()
+		l := client.listeners[addr]
+		if l != nil && l.conn == conn {
+			delete(client.listeners, addr)
+		}
+		client.listenersLock.Unlock()
+		if l != nil && l.conn == conn {
+			log.Printf("Unlisten REMOTE at %s\n", addr)
+			l.cancel()
+		}
+		return
+	}
+	bound, err := client.listen(agent, conn, addr)
+	if err != nil {
+		log.Printf("Listen REMOTE at %s: %s\n", addr, err)
+		client.errors.Add("listen "+addr, err)
+		err = w.WriteLine(protocol.FormatLine("listenerr:"+addr, map[string]string{"msg": err.Error()}))
+	} else {
+		err = w.WriteLine(protocol.FormatLine("listening:"+addr, map[string]string{"addr": bound.String()}))
+	}
+	if err != nil {
+		log.Printf("Write: %s\n", err)
+	}
+}
+
+// listen listens addr for the proxy agent on conn, again for the same
+// connection keeps the listener
+func (client *Client) listen(agent string, conn net.Conn, addr string) (net.Addr, error) {
+	if !client.allowListen(addr) {
+		return nil, fmt.Errorf("listen not allowed, %s", addr)
+	}
+	client.listenersLock.Lock()
+	defer client.listenersLock.Unlock()
+	if l := client.listeners[addr]; l != nil {
+		if l.conn == conn {
+			return l.ln.Addr(), nil
+		}
+		// a listener of a former control connection not noticed failed yet
+		l.cancel()
+		delete(client.listeners, addr)
+	}
+	log.Printf("Listen REMOTE at %s\n", addr)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	ln = protocol.LimitAccepts(ln, client.AcceptRate)
+	tunnel := &Tunnel{LAddr: addr, RAddr: protocol.ListenerPrefix + addr, Agent: agent}
+	tunnel.validate(false)
+	ctx, cancel := context.WithCancel(client.ctx)
+	if client.listeners == nil {
+		client.listeners = map[string]*remoteListener{}
+	}
+	client.listeners[addr] = &remoteListener{conn: conn, ln: ln, cancel: cancel}
+	// the streams of the listeners of the proxy have the caps of the client
+	slots := new(protocol.Limiter)
+	go acceptLoop(ctx, ln, func(c net.Conn) {
+		client.handleConn(ctx, tunnel, slots, c)
+	})
+	return ln.Addr(), nil
+}
+
+func (client *Client) allowListen(addr string) bool {
+	client.lock.Lock()
+	patterns := client.AllowListen
+	client.lock.Unlock()
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, addr); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// closeListeners closes the listeners asked on conn
+func (client *Client) closeListeners(conn net.Conn) {
+	client.listenersLock.Lock()
+	defer client.listenersLock.Unlock()
+	for addr, l := range client.listeners {
+		if l.conn == conn {
+			log.Printf("Unlisten REMOTE at %s\n", addr)
+			l.cancel()
+			delete(client.listeners, addr)
+		}
+	}
+}
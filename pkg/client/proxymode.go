@@ -0,0 +1,275 @@
+package client
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dworld/channel/pkg/protocol"
+)
+
+// modes of a tunnel, what LAddr serves
+const (
+	ModeForward = ""
+	ModeSOCKS5  = "socks5"
+	ModeHTTP    = "http"
+	// ModeSNI routes the TLS connections by the server name of their
+	// ClientHello to the sni routes, TLS isn't terminated and the
+	// connections no route matches are refused
+	ModeSNI = "sni"
+	// ModeReverse serves HTTP, each request goes to the raddr of the first
+	// host route matching its host and path, RAddr when none does
+	ModeReverse = "reverse"
+	// ModeTransparent takes the connections an iptables REDIRECT turned to
+	// LAddr, each goes to the destination it had before, linux only
+	ModeTransparent = "transparent"
+	// ModeTPROXY takes the connections a TPROXY rule delivers to LAddr, each
+	// goes to the destination it's addressed to, from the hosts the traffic
+	// is routed through as well, linux only
+	ModeTPROXY = "tproxy"
+	// ModeDNS forwards the DNS queries to the resolver at RAddr, those of
+	// UDP at LAddr are asked over TCP and their answers truncated as the
+	// asker takes them, so it asks again over TCP which LAddr forwards too
+	ModeDNS = "dns"
+)
+
+// proxyRequest is the request of a connection to a socks5 or http tunnel, it
+// replies the outcome of the dial in the protocol
+type proxyRequest interface {
+	// established replies the success, rconn is the stream to the remote
+	established(conn, rconn net.Conn) error
+	// failed replies err, a DialError tells the failing hop
+	failed(conn net.Conn, err error)
+}
+
+// acceptRequest reads the request of a connection to a socks5 or http tunnel
+// and returns the address it asks for
+func (tunnel *Tunnel) acceptRequest(conn net.Conn, timeout time.Duration) (net.Conn, string, proxyRequest, error) {
+	r := bufio.NewReader(conn)
+	peeked := &peekConn{Conn: conn, r: r}
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+	if tunnel.Mode == ModeSOCKS5 {
+		raddr, cmd, err := socksAccept(conn, r)
+		if cmd == socksAssociate {
+			return peeked, raddr, &socksUDPRequest{}, err
+		}
+		return peeked, raddr, socksRequest{}, err
+	}
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return peeked, "", nil, err
+	}
+	raddr, err := httpTarget(req)
+	if err != nil {
+		writeHTTPError(conn, http.StatusBadRequest, httpError{Error: err.Error()})
+		return peeked, "", nil, err
+	}
+	return peeked, raddr, &httpRequest{req: req, raddr: raddr}, nil
+}
+
+const (
+	socksVersion     = 5
+	socksAuthNone    = 0
+	socksNoMethods   = 0xff
+	socksConnect     = 1
+	socksAssociate   = 3
+	socksIPv4        = 1
+	socksDomain      = 3
+	socksIPv6        = 4
+	socksSucceeded   = 0
+	socksFailure     = 1
+	socksNotAllowed  = 2
+	socksNetUnreach  = 3
+	socksHostUnreach = 4
+	socksRefused     = 5
+	socksTTLExpired  = 6
+	socksBadCommand  = 7
+	socksBadAddress  = 8
+)
+
+// socksAccept reads the greeting and the CONNECT or UDP ASSOCIATE request
+// of a socks5 client and returns its address and command, no auth is offered
+// as laddr is expected to be local
+func socksAccept(conn net.Conn, r *bufio.Reader) (string, byte, error) {
+	var greeting [2]byte
+	if _, err := io.ReadFull(r, greeting[:]); err != nil {
+		return "", 0, err
+	}
+	if greeting[0] != socksVersion {
+		return "", 0, fmt.Errorf("invalid socks version %d", greeting[0])
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return "", 0, err
+	}
+	if !strings.ContainsRune(string(methods), socksAuthNone) {
+		conn.Write([]byte{socksVersion, socksNoMethods})
+		return "", 0, errors.New("socks client wants auth")
+	}
+	if _, err := conn.Write([]byte{socksVersion, socksAuthNone}); err != nil {
+		return "", 0, err
+	}
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return "", 0, err
+	}
+	if header[1] != socksConnect && header[1] != socksAssociate {
+		writeSocksReply(conn, socksBadCommand)
+		return "", 0, fmt.Errorf("unsupported socks command %d", header[1])
+	}
+	addr, err := readSocksAddr(r, header[3])
+	if errors.Is(err, errSocksAddrType) {
+		writeSocksReply(conn, socksBadAddress)
+	}
+	return addr, header[1], err
+}
+
+var errSocksAddrType = errors.New("unsupported socks address type")
+
+// readSocksAddr reads the address of type atyp of a request or a datagram,
+// host:port
+func readSocksAddr(r io.Reader, atyp byte) (string, error) {
+	var host string
+	switch atyp {
+	case socksIPv4, socksIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp == socksIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("%w %d", errSocksAddrType, atyp)
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+func writeSocksReply(w io.Writer, rep byte) error {
+	// the bound address is left unspecified
+	_, err := w.Write([]byte{socksVersion, rep, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+type socksRequest struct{}
+
+func (socksRequest) established(conn, rconn net.Conn) error {
+	return writeSocksReply(conn, socksSucceeded)
+}
+
+// failed maps the kind of the dial error to the reply code, the failures of
+// the channel itself are general failures
+func (socksRequest) failed(conn net.Conn, err error) {
+	rep := byte(socksFailure)
+	de := protocol.NewDialError(protocol.HopRemote, err)
+	if de.Hop != protocol.HopChannel {
+		switch de.Kind {
+		case protocol.KindDenied:
+			rep = socksNotAllowed
+		case protocol.KindUnreachable:
+			rep = socksNetUnreach
+		case protocol.KindHost:
+			rep = socksHostUnreach
+		case protocol.KindRefused:
+			rep = socksRefused
+		case protocol.KindTimeout:
+			rep = socksTTLExpired
+		}
+	}
+	writeSocksReply(conn, rep)
+}
+
+// httpTarget is the address a proxy request asks for, the authority of a
+// CONNECT or the host of an absolute http url
+func httpTarget(req *http.Request) (string, error) {
+	if req.Method == http.MethodConnect {
+		if _, _, err := net.SplitHostPort(req.Host); err != nil {
+			return "", fmt.Errorf("invalid CONNECT authority, %s", req.Host)
+		}
+		return req.Host, nil
+	}
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		return "", fmt.Errorf("not a proxy request, %s", req.RequestURI)
+	}
+	if req.URL.Port() == "" {
+		return net.JoinHostPort(req.URL.Hostname(), "80"), nil
+	}
+	return req.URL.Host, nil
+}
+
+type httpRequest struct {
+	req   *http.Request
+	raddr string
+}
+
+// established answers a CONNECT, or forwards the request in origin form,
+// one request per connection
+func (r *httpRequest) established(conn, rconn net.Conn) error {
+	if r.req.Method == http.MethodConnect {
+		_, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		return err
+	}
+	r.req.Header.Del("Proxy-Connection")
+	r.req.Header.Del("Proxy-Authorization")
+	r.req.Close = true
+	return r.req.Write(rconn)
+}
+
+// failed answers 504 to the timeouts, 403 to the refused, 503 past the
+// limits and 502 to the other failures
+func (r *httpRequest) failed(conn net.Conn, err error) {
+	de := protocol.NewDialError(protocol.HopRemote, err)
+	writeHTTPError(conn, dialErrorStatus(de), httpError{Error: de.Msg, Hop: de.Hop, Kind: de.Kind, Addr: r.raddr})
+}
+
+// dialErrorStatus is the HTTP status replied for de
+func dialErrorStatus(de *protocol.DialError) int {
+	switch de.Kind {
+	case protocol.KindTimeout:
+		return http.StatusGatewayTimeout
+	case protocol.KindDenied:
+		return http.StatusForbidden
+	case protocol.KindLimit:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
+
+// httpError is the JSON body of the errors of the http tunnels
+type httpError struct {
+	Error string `json:"error"`
+	Hop   string `json:"hop,omitempty"`
+	Kind  string `json:"kind,omitempty"`
+	Addr  string `json:"addr,omitempty"`
+}
+
+func writeHTTPError(w io.Writer, code int, e httpError) {
+	body, _ := json.Marshal(e)
+	body = append(body, '\n')
+	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nContent-Type: application/json\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		code, http.StatusText(code), len(body), body)
+}
@@ -0,0 +1,147 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/dworld/channel/pkg/protocol"
+)
+
+// writtenConn keeps what's written to it
+type writtenConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *writtenConn) Write(b []byte) (int, error) {
+	return c.buf.Write(b)
+}
+
+func TestSocksFailed(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		rep  byte
+	}{
+		{"denied", &protocol.DialError{Hop: protocol.HopRemote, Kind: protocol.KindDenied}, socksNotAllowed},
+		{"unreachable", &protocol.DialError{Hop: protocol.HopRemote, Kind: protocol.KindUnreachable}, socksNetUnreach},
+		{"host", &protocol.DialError{Hop: protocol.HopRemote, Kind: protocol.KindHost}, socksHostUnreach},
+		{"refused", &protocol.DialError{Hop: protocol.HopRemote, Kind: protocol.KindRefused}, socksRefused},
+		{"timeout", &protocol.DialError{Hop: protocol.HopRemote, Kind: protocol.KindTimeout}, socksTTLExpired},
+		{"upstream refused", &protocol.DialError{Hop: protocol.HopUpstream, Kind: protocol.KindRefused}, socksRefused},
+		{"policy denied", &protocol.DialError{Hop: protocol.HopPolicy, Kind: protocol.KindDenied}, socksNotAllowed},
+		{"limit", &protocol.DialError{Hop: protocol.HopPolicy, Kind: protocol.KindLimit}, socksFailure},
+		{"channel refused", &protocol.DialError{Hop: protocol.HopChannel, Kind: protocol.KindRefused}, socksFailure},
+		{"channel timeout", &protocol.DialError{Hop: protocol.HopChannel, Kind: protocol.KindTimeout}, socksFailure},
+		{"other", errors.New("boom"), socksFailure},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conn := &writtenConn{}
+			socksRequest{}.failed(conn, tc.err)
+			want := []byte{socksVersion, tc.rep, 0, socksIPv4, 0, 0, 0, 0, 0, 0}
+			if !bytes.Equal(conn.buf.Bytes(), want) {
+				t.Errorf("reply % x, want % x", conn.buf.Bytes(), want)
+			}
+		})
+	}
+}
+
+func TestSocksAccept(t *testing.T) {
+	greeting := []byte{socksVersion, 1, socksAuthNone}
+	for _, tc := range []struct {
+		name    string
+		request []byte
+		addr    string
+		cmd     byte
+		// reply is written after the method chosen, none when the request
+		// is accepted
+		reply []byte
+	}{
+		{"connect ipv4", []byte{socksVersion, socksConnect, 0, socksIPv4, 10, 0, 0, 1, 0, 80}, "10.0.0.1:80", socksConnect, nil},
+		{"connect domain", append([]byte{socksVersion, socksConnect, 0, socksDomain, 11}, "example.com\x01\xbb"...), "example.com:443", socksConnect, nil},
+		{"associate", []byte{socksVersion, socksAssociate, 0, socksIPv4, 0, 0, 0, 0, 0, 0}, "0.0.0.0:0", socksAssociate, nil},
+		{"bind", []byte{socksVersion, 2, 0, socksIPv4, 10, 0, 0, 1, 0, 80}, "", 0, []byte{socksVersion, socksBadCommand, 0, socksIPv4, 0, 0, 0, 0, 0, 0}},
+		{"address type", []byte{socksVersion, socksConnect, 0, 9, 10, 0, 0, 1, 0, 80}, "", socksConnect, []byte{socksVersion, socksBadAddress, 0, socksIPv4, 0, 0, 0, 0, 0, 0}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conn := &writtenConn{}
+			r := bufio.NewReader(bytes.NewReader(append(append([]byte(nil), greeting...), tc.request...)))
+			addr, cmd, err := socksAccept(conn, r)
+			if (err == nil) != (tc.reply == nil) {
+				t.Fatalf("err %v", err)
+			}
+			if addr != tc.addr || cmd != tc.cmd {
+				t.Errorf("addr %q cmd %d, want %q %d", addr, cmd, tc.addr, tc.cmd)
+			}
+			want := append([]byte{socksVersion, socksAuthNone}, tc.reply...)
+			if !bytes.Equal(conn.buf.Bytes(), want) {
+				t.Errorf("replied % x, want % x", conn.buf.Bytes(), want)
+			}
+		})
+	}
+}
+
+func TestSocksAcceptAuth(t *testing.T) {
+	conn := &writtenConn{}
+	// username and password only
+	r := bufio.NewReader(bytes.NewReader([]byte{socksVersion, 1, 2}))
+	if _, _, err := socksAccept(conn, r); err == nil {
+		t.Fatal("accepted a client wanting auth")
+	}
+	if want := []byte{socksVersion, socksNoMethods}; !bytes.Equal(conn.buf.Bytes(), want) {
+		t.Errorf("replied % x, want % x", conn.buf.Bytes(), want)
+	}
+}
+
+func TestHTTPFailed(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		err    error
+		status int
+		body   string
+	}{
+		{"timeout", &protocol.DialError{Hop: protocol.HopRemote, Kind: protocol.KindTimeout, Msg: "i/o timeout"}, http.StatusGatewayTimeout,
+			`{"error":"i/o timeout","hop":"remote","kind":"timeout","addr":"example.com:80"}`},
+		{"refused", &protocol.DialError{Hop: protocol.HopRemote, Kind: protocol.KindRefused, Msg: "connection refused"}, http.StatusBadGateway,
+			`{"error":"connection refused","hop":"remote","kind":"refused","addr":"example.com:80"}`},
+		{"channel", &protocol.DialError{Hop: protocol.HopChannel, Kind: protocol.KindUnreachable, Msg: "not connected"}, http.StatusBadGateway,
+			`{"error":"not connected","hop":"channel","kind":"unreachable","addr":"example.com:80"}`},
+		{"denied", &protocol.DialError{Hop: protocol.HopPolicy, Kind: protocol.KindDenied, Msg: "not allowed"}, http.StatusForbidden,
+			`{"error":"not allowed","hop":"policy","kind":"denied","addr":"example.com:80"}`},
+		{"limit", &protocol.DialError{Hop: protocol.HopPolicy, Kind: protocol.KindLimit, Msg: "too many"}, http.StatusServiceUnavailable,
+			`{"error":"too many","hop":"policy","kind":"limit","addr":"example.com:80"}`},
+		{"other", errors.New("boom"), http.StatusBadGateway,
+			`{"error":"boom","hop":"remote","kind":"failed","addr":"example.com:80"}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conn := &writtenConn{}
+			(&httpRequest{raddr: "example.com:80"}).failed(conn, tc.err)
+			resp, err := http.ReadResponse(bufio.NewReader(&conn.buf), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tc.status {
+				t.Errorf("status %d, want %d", resp.StatusCode, tc.status)
+			}
+			if got := resp.Header.Get("Content-Type"); got != "application/json" {
+				t.Errorf("content type %q", got)
+			}
+			if !resp.Close {
+				t.Error("connection kept")
+			}
+			if string(body) != tc.body+"\n" {
+				t.Errorf("body %s, want %s", body, tc.body)
+			}
+		})
+	}
+}
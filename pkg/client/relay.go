@@ -0,0 +1,91 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/dworld/channel/pkg/protocol"
+)
+
+// dialRelay connects to the relay at Channel, again whenever the control
+// connection fails, until ctx is done. The relay serves the connection as a
+// proxy with mux would
+func (client *Client) dialRelay(ctx context.Context) error {
+	for ctx.Err() == nil {
+		retry := time.Second
+		if err := client.connectRelay(ctx); err != nil {
+			log.Printf("Relay %s: %s\n", client.Channel.Addr, err)
+			client.errors.Add("relay "+client.Channel.Addr, err)
+			client.Hooks.DialError(client.Channel.Addr, err)
+			var busy *protocol.BusyError
+			if errors.As(err, &busy) {
+				retry = busy.Retry
+			}
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(retry):
+		}
+	}
+	return ctx.Err()
+}
+
+// connectRelay introduces the client to the relay and waits for the control
+// connection to fail
+func (client *Client) connectRelay(ctx context.Context) error {
+	log.Printf("dial to %s\n", client.Channel.Addr)
+	conn, err := client.Channel.Dial()
+	if err != nil {
+		return err
+	}
+	defer protocol.CloseConn("RELAY", conn)
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	token := client.token()
+	hello := map[string]string{"name": client.Name}
+	if token != "" {
+		hello[protocol.ChallengeOption] = "1"
+	}
+	if _, err := io.WriteString(conn, protocol.FormatLine("relay", hello)); err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+	if token != "" {
+		if err := protocol.AnswerChallenge(conn, r, token, client.HandshakeTimeout); err != nil {
+			return err
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(client.HandshakeTimeout))
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
+	head, opts := protocol.ParseLine(line)
+	if head == "err" {
+		return fmt.Errorf("refused, %s", opts["msg"])
+	}
+	if head == "busy" {
+		return protocol.ParseBusyError(opts)
+	}
+	if head != "ctrl" || opts["mux"] == "" {
+		return fmt.Errorf("unexpected hello, %s", strings.TrimSpace(line))
+	}
+	ctrl := client.setControl(conn, r, opts)
+	for {
+		select {
+		case lost := <-client.lost:
+			if lost == ctrl {
+				return nil
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+
+	"github.com/dworld/channel/pkg/protocol"
+)
+
+// Update is what Reload changes of a running client
+type Update struct {
+	// Tunnels replace the tunnels, matched by LAddr
+	Tunnels []*Tunnel
+	// Auth replaces the authenticator of the proxies
+	Auth protocol.Authenticator
+	// Token replaces the token sent to the relay
+	Token string
+	// AllowListen replaces the address patterns the proxy may ask to listen
+	AllowListen []string
+	// Direct replaces the destinations the client dials itself
+	Direct []DirectRule
+}
+
+// tunnelSlot is a tunnel served at its LAddr, a reload swaps the tunnel the
+// next connections are accepted with or stops serving it
+type tunnelSlot struct {
+	tunnel atomic.Pointer[Tunnel]
+	ctx    context.Context
+	stop   context.CancelFunc
+	// streams counts the streams of the listener for the MaxStreams of the
+	// tunnel
+	streams protocol.Limiter
+}
+
+// addSlot serves tunnel at its LAddr from now on, until ctx is done or a
+// reload removes it
+func (client *Client) addSlot(ctx context.Context, tunnel *Tunnel) *tunnelSlot {
+	slot := &tunnelSlot{}
+	slot.tunnel.Store(tunnel)
+	slot.ctx, slot.stop = context.WithCancel(ctx)
+	if client.slots == nil {
+		client.slots = map[string]*tunnelSlot{}
+	}
+	client.slots[tunnel.LAddr] = slot
+	return slot
+}
+
+// Reload applies update to the running client. The tunnels gone stop
+// listening, the new ones listen and the connections accepted by those
+// changed take the new settings, the streams open go on as they are. The
+// tunnels are all checked and listened before any change, so a failed
+// reload leaves the client as it was
+func (client *Client) Reload(update Update) error {
+	for _, tunnel := range update.Tunnels {
+		if err := client.validateTunnel(tunnel); err != nil {
+			return err
+		}
+	}
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	if client.ctx == nil {
+		return errNotRunning
+	}
+	lns := map[string]net.Listener{}
+	for _, tunnel := range update.Tunnels {
+		slot := client.slots[tunnel.LAddr]
+		if slot == nil {
+			continue
+		}
+		// the listener is kept, it's served as HTTP, bound transparent or
+		// with UDP or not from the start
+		for _, mode := range []string{ModeReverse, ModeTPROXY, ModeDNS} {
+			if (slot.tunnel.Load().Mode == mode) != (tunnel.Mode == mode) {
+				return fmt.Errorf("tunnel %s can't turn %s or back, remove it first", tunnel.LAddr, mode)
+			}
+		}
+	}
+	for _, tunnel := range update.Tunnels {
+		if client.slots[tunnel.LAddr] != nil || lns[tunnel.LAddr] != nil {
+			continue
+		}
+		ln, err := client.listenTunnel(tunnel)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return err
+		}
+		lns[tunnel.LAddr] = ln
+	}
+	kept := map[string]bool{}
+	for _, tunnel := range update.Tunnels {
+		kept[tunnel.LAddr] = true
+		if ln := lns[tunnel.LAddr]; ln != nil {
+			tunnel := tunnel
+			slot := client.addSlot(client.ctx, tunnel)
+			go func() {
+				if err := client.serveTunnel(slot.ctx, client.ctx, ln, slot); err != nil && slot.ctx.Err() == nil {
+					log.Printf("Tunnel %s: %s\n", tunnel.LAddr, err)
+					client.errors.Add("listen "+tunnel.LAddr, err)
+				}
+			}()
+			continue
+		}
+		client.slots[tunnel.LAddr].tunnel.Store(tunnel)
+	}
+	for addr, slot := range client.slots {
+		if !kept[addr] {
+			log.Printf("Stop CLIENT at %s\n", addr)
+			slot.stop()
+			delete(client.slots, addr)
+		}
+	}
+	client.Tunnels = update.Tunnels
+	client.Auth = update.Auth
+	client.Token = update.Token
+	client.AllowListen = update.AllowListen
+	client.Direct = update.Direct
+	return nil
+}
+
+// ServedTunnels are the tunnels the client serves, as reloaded
+func (client *Client) ServedTunnels() []*Tunnel {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return client.Tunnels
+}
+
+// auth is the authenticator of the proxies, as reloaded
+func (client *Client) auth() protocol.Authenticator {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return client.Auth
+}
+
+// token is the token sent to the relay, as reloaded
+func (client *Client) token() string {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return client.Token
+}
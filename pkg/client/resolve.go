@@ -0,0 +1,48 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/dworld/channel/pkg/protocol"
+)
+
+// where the host names of the remotes of a tunnel are resolved
+const (
+	// ResolveProxy sends the names in the dial requests, the proxy resolves
+	// them in its network as socks5h does
+	ResolveProxy = "proxy"
+	// ResolveClient resolves the names with the Resolver of the client, the
+	// dial requests carry the IP
+	ResolveClient = "client"
+)
+
+// resolveAddr is raddr with the IP of its host as the client resolves it,
+// the agent of a relay raddr kept, a unix socket or an exec target as it is
+func (client *Client) resolveAddr(ctx context.Context, raddr string) (string, error) {
+	if network, _ := protocol.SplitNetwork(raddr); network == "unix" || strings.HasPrefix(raddr, protocol.ExecScheme) {
+		return raddr, nil
+	}
+	agent, addr, relayed := strings.Cut(raddr, "/")
+	if !relayed {
+		agent, addr = "", raddr
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	ips, err := client.Resolver.LookupHost(ctx, host)
+	if err != nil {
+		return "", protocol.NewDialError(protocol.HopRemote, err)
+	}
+	if len(ips) == 0 {
+		return "", &protocol.DialError{Hop: protocol.HopRemote, Kind: protocol.KindHost, Msg: fmt.Sprintf("no address of %s", host)}
+	}
+	addr = net.JoinHostPort(ips[0], port)
+	if relayed {
+		return agent + "/" + addr, nil
+	}
+	return addr, nil
+}
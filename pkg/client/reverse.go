@@ -0,0 +1,221 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dworld/channel/pkg/protocol"
+)
+
+// reverseIdleTimeout is how long the streams a reverse tunnel keeps for the
+// next requests stay idle
+const reverseIdleTimeout = 90 * time.Second
+
+// reverseTunnel serves the HTTP requests of a reverse tunnel, each goes to
+// the raddr of the route of its host and path on a stream kept open for the
+// next requests to it, a transport per agent
+type reverseTunnel struct {
+	client  *Client
+	slot    *tunnelSlot
+	streams context.Context
+
+	lock       sync.Mutex
+	transports map[string]*http.Transport
+}
+
+// reverseKey is the context key of the reverseTarget of a request
+type reverseKey struct{}
+
+// reverseTarget is where the streams of a request are dialed, addr is the
+// raddr of the route, with the agent for a relay client
+type reverseTarget struct {
+	tunnel *Tunnel
+	addr   string
+	from   string
+}
+
+// serveReverse serves the requests of the reverse tunnel of slot on ln until
+// ctx is done, their streams are aborted once streams is done
+func (client *Client) serveReverse(ctx, streams context.Context, ln net.Listener, slot *tunnelSlot) error {
+	rt := &reverseTunnel{client: client, slot: slot, streams: streams}
+	server := &http.Server{
+		Handler:           rt,
+		ReadHeaderTimeout: client.HandshakeTimeout,
+	}
+	stop := context.AfterFunc(ctx, func() { server.Close() })
+	defer stop()
+	defer rt.closeIdle()
+	err := server.Serve(&reverseListener{Listener: ln, client: client, slot: slot})
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func (rt *reverseTunnel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tunnel := rt.slot.tunnel.Load()
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	route, ok := tunnel.routeRequest(host, r.URL.Path)
+	e, isExposed := rt.client.exposedHost(host)
+	if isExposed && (!ok || route.Kind == "") {
+		// the routes of the tunnel first, its raddr after the registry
+		route, ok = Route{RAddr: e.RAddr, Agent: e.Agent}, true
+	}
+	if !ok {
+		err := fmt.Errorf("%w, host %s path %s", errNoRoute, host, r.URL.Path)
+		log.Printf("Route %s: %s\n", r.RemoteAddr, err)
+		rt.client.errors.Add("route", err)
+		writeReverseError(w, http.StatusBadGateway, httpError{Error: err.Error()})
+		return
+	}
+	target := reverseTarget{tunnel: tunnel, addr: route.RAddr, from: r.RemoteAddr}
+	switch {
+	case isExposed && route.Kind == "":
+		// of an unnamed proxy too
+		routed := *tunnel
+		routed.Agent = e.Agent
+		target.tunnel = &routed
+	case route.Agent == "":
+	case rt.client.Relay:
+		target.addr = route.Agent + "/" + route.RAddr
+	default:
+		routed := *tunnel
+		routed.Agent = route.Agent
+		target.tunnel = &routed
+	}
+	// the streams kept are of the agent they go through
+	agent := target.tunnel.Agent
+	if rt.client.Relay {
+		agent = route.Agent
+	}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Scheme = "http"
+			pr.Out.URL.Host = route.RAddr
+			pr.Out.Host = pr.In.Host
+			pr.SetXForwarded()
+		},
+		Transport: rt.transport(agent),
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			rt.fail(w, target.addr, err)
+		},
+	}
+	proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), reverseKey{}, target)))
+}
+
+// fail replies the error of a request to addr, a DialError tells its hop
+func (rt *reverseTunnel) fail(w http.ResponseWriter, addr string, err error) {
+	var de *protocol.DialError
+	if !errors.As(err, &de) {
+		// the dial went well, the request failed on the stream
+		log.Printf("Request to %s: %s\n", addr, err)
+		writeReverseError(w, http.StatusBadGateway, httpError{Error: err.Error(), Addr: addr})
+		return
+	}
+	writeReverseError(w, dialErrorStatus(de), httpError{Error: de.Msg, Hop: de.Hop, Kind: de.Kind, Addr: addr})
+}
+
+func writeReverseError(w http.ResponseWriter, code int, e httpError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(e)
+}
+
+// transport is the transport of the streams through agent
+func (rt *reverseTunnel) transport(agent string) *http.Transport {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	t := rt.transports[agent]
+	if t == nil {
+		t = &http.Transport{
+			DialContext:     rt.dial,
+			IdleConnTimeout: reverseIdleTimeout,
+		}
+		if rt.transports == nil {
+			rt.transports = map[string]*http.Transport{}
+		}
+		rt.transports[agent] = t
+	}
+	return t
+}
+
+func (rt *reverseTunnel) closeIdle() {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	for _, t := range rt.transports {
+		t.CloseIdleConnections()
+	}
+}
+
+// dial opens the stream of the request of ctx, the transport gets one end of
+// a pipe the other end of which is piped with the stream as the connections
+// of the other tunnels are, so it's capped, counted and hooked as them
+func (rt *reverseTunnel) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	target := ctx.Value(reverseKey{}).(reverseTarget)
+	tunnel := target.tunnel
+	free, err := rt.client.admitStream(ctx, tunnel, &rt.slot.streams)
+	if err != nil {
+		return nil, err
+	}
+	info := protocol.StreamInfo{Tunnel: tunnel.Label, From: target.from, Addr: target.addr}
+	rconn, release, err := rt.client.openStream(ctx, tunnel, info)
+	if err != nil {
+		free()
+		return nil, err
+	}
+	if tunnel.NoDelay != nil {
+		protocol.SetNoDelay(rconn, *tunnel.NoDelay)
+	}
+	conn, peer := net.Pipe()
+	go func() {
+		defer free()
+		defer release()
+		stats := rt.client.PipeStream(rt.streams, info, "CLIENT", peer, "PROXY", rconn)
+		rt.client.Hooks.StreamClose(info, stats)
+	}()
+	return conn, nil
+}
+
+// reverseListener terminates the TLS of the connections of a reverse tunnel
+// with ACME hosts, as the tunnel is when they're accepted
+type reverseListener struct {
+	net.Listener
+	client *Client
+	slot   *tunnelSlot
+}
+
+func (ln *reverseListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil || len(ln.slot.tunnel.Load().ACME) == 0 {
+		return conn, err
+	}
+	// the handshake is run by the server, off the accept loop
+	return tls.Server(conn, ln.client.acmeConfig(func() *Tunnel { return ln.slot.tunnel.Load() })), nil
+}
+
+// routeRequest picks the first host route matching host and path, RAddr of
+// the tunnel when none does
+func (tunnel *Tunnel) routeRequest(host, urlPath string) (Route, bool) {
+	for _, route := range tunnel.Routes {
+		if route.matchRequest(host, urlPath) {
+			return route, true
+		}
+	}
+	if tunnel.RAddr == "" {
+		return Route{}, false
+	}
+	return Route{RAddr: tunnel.RAddr}, true
+}
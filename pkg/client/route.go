@@ -0,0 +1,266 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"time"
+)
+
+// kinds of the first-byte routes
+const (
+	routeSNI  = "sni"
+	routeHost = "host"
+	routeSSH  = "ssh"
+)
+
+const (
+	tlsRecordHeader = 5
+	tlsMaxRecord    = 16384
+	maxPeekHTTP     = 8192
+)
+
+var errNoRoute = errors.New("no route matches the connection")
+
+// Route sends the connections whose first bytes match to RAddr, Match is a
+// server name or host pattern like *.example.com, ssh routes match any
+// ssh client. Path is the path prefix of the host routes of the reverse
+// tunnels. Agent names the proxy the streams go through in place of the one
+// of the tunnel
+type Route struct {
+	Kind  string
+	Match string
+	Path  string
+	RAddr string
+	Agent string
+}
+
+// ParseRoute parses kind:match=raddr, or ssh=raddr, the match of a host
+// route may end with a path prefix, host:name/path=raddr, and raddr is
+// host:port or agent/host:port
+func ParseRoute(s string) (Route, error) {
+	i := strings.LastIndex(s, "=")
+	if i < 0 {
+		return Route{}, fmt.Errorf("invalid route %s, want kind:match=raddr", s)
+	}
+	route := Route{Kind: s[:i], RAddr: s[i+1:]}
+	if j := strings.Index(route.Kind, ":"); j >= 0 {
+		route.Kind, route.Match = route.Kind[:j], strings.ToLower(route.Kind[j+1:])
+	}
+	if i := strings.Index(route.Match, "/"); i >= 0 && route.Kind == routeHost {
+		route.Match, route.Path = route.Match[:i], route.Match[i:]
+	}
+	switch route.Kind {
+	case routeSNI, routeHost:
+		if route.Match == "" {
+			return Route{}, fmt.Errorf("invalid route %s, %s needs a match", s, route.Kind)
+		}
+		if _, err := path.Match(route.Match, ""); err != nil {
+			return Route{}, fmt.Errorf("invalid route %s, %s", s, err)
+		}
+	case routeSSH:
+	default:
+		return Route{}, fmt.Errorf("invalid route %s, kind is sni, host or ssh", s)
+	}
+	if agent, raddr, ok := strings.Cut(route.RAddr, "/"); ok {
+		route.Agent, route.RAddr = agent, raddr
+	}
+	if _, _, err := net.SplitHostPort(route.RAddr); err != nil {
+		return Route{}, fmt.Errorf("invalid route %s, %s", s, err)
+	}
+	return route, nil
+}
+
+// peekConn replays the bytes peeked by the router before the rest of conn
+type peekConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekConn) String() string {
+	return fmt.Sprint(c.Conn)
+}
+
+// NetConn is the wrapped connection
+func (c *peekConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *peekConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// route picks the first route matching the first bytes of conn, connections
+// which send nothing in SniffTimeout, like server-first protocols, go to
+// RAddr of the tunnel but with ModeSNI
+func (tunnel *Tunnel) route(conn net.Conn) (net.Conn, Route, error) {
+	r := bufio.NewReaderSize(conn, tlsRecordHeader+tlsMaxRecord)
+	peeked := &peekConn{Conn: conn, r: r}
+	conn.SetReadDeadline(time.Now().Add(tunnel.SniffTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	kind, name := sniff(r)
+	for _, route := range tunnel.Routes {
+		if route.Kind != kind {
+			continue
+		}
+		if route.Kind == routeSSH {
+			return peeked, route, nil
+		}
+		if ok, _ := path.Match(route.Match, name); ok {
+			return peeked, route, nil
+		}
+	}
+	if tunnel.RAddr == "" || tunnel.Mode == ModeSNI {
+		return peeked, Route{}, fmt.Errorf("%w, %s %s", errNoRoute, kind, name)
+	}
+	return peeked, Route{RAddr: tunnel.RAddr}, nil
+}
+
+// String is the route as ParseRoute parses it
+func (route Route) String() string {
+	s := route.Kind
+	if route.Match != "" {
+		s += ":" + route.Match + route.Path
+	}
+	if route.Agent != "" {
+		return s + "=" + route.Agent + "/" + route.RAddr
+	}
+	return s + "=" + route.RAddr
+}
+
+// matchRequest tells whether the host route matches an HTTP request to host
+// and path, the path prefix matches whole segments
+func (route Route) matchRequest(host, urlPath string) bool {
+	if ok, _ := path.Match(route.Match, host); route.Kind != routeHost || !ok {
+		return false
+	}
+	prefix := strings.TrimSuffix(route.Path, "/")
+	return prefix == "" || urlPath == prefix || strings.HasPrefix(urlPath, prefix+"/")
+}
+
+// sniff tells the kind of connection and the name it asks for from its
+// first bytes
+func sniff(r *bufio.Reader) (string, string) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return "", ""
+	}
+	switch {
+	case first[0] == 0x16:
+		return routeSNI, sniffSNI(r)
+	case first[0] == 'S':
+		if banner, err := r.Peek(4); err == nil && string(banner) == "SSH-" {
+			return routeSSH, ""
+		}
+	case first[0] >= 'A' && first[0] <= 'Z':
+		return routeHost, sniffHost(r)
+	}
+	return "", ""
+}
+
+// sniffSNI reads the server name of a TLS ClientHello
+func sniffSNI(r *bufio.Reader) string {
+	header, err := r.Peek(tlsRecordHeader)
+	if err != nil {
+		return ""
+	}
+	size := int(binary.BigEndian.Uint16(header[3:]))
+	if size > tlsMaxRecord {
+		return ""
+	}
+	record, err := r.Peek(tlsRecordHeader + size)
+	if err != nil {
+		return ""
+	}
+	return parseSNI(record[tlsRecordHeader:])
+}
+
+// parseSNI parses the server_name extension of a ClientHello handshake
+// message
+func parseSNI(msg []byte) string {
+	// type, length, version, random
+	if len(msg) < 38 || msg[0] != 1 {
+		return ""
+	}
+	msg = msg[38:]
+	// session id, cipher suites and compression methods
+	for _, lenSize := range []int{1, 2, 1} {
+		if len(msg) < lenSize {
+			return ""
+		}
+		n := int(msg[0])
+		if lenSize == 2 {
+			n = int(binary.BigEndian.Uint16(msg))
+		}
+		if len(msg) < lenSize+n {
+			return ""
+		}
+		msg = msg[lenSize+n:]
+	}
+	if len(msg) < 2 {
+		return ""
+	}
+	exts := msg[2:]
+	if n := int(binary.BigEndian.Uint16(msg)); n < len(exts) {
+		exts = exts[:n]
+	}
+	for len(exts) >= 4 {
+		typ := binary.BigEndian.Uint16(exts)
+		n := int(binary.BigEndian.Uint16(exts[2:]))
+		if len(exts) < 4+n {
+			return ""
+		}
+		data := exts[4 : 4+n]
+		exts = exts[4+n:]
+		if typ != 0 {
+			continue
+		}
+		// server name list, of type, length and name
+		if len(data) < 5 || data[2] != 0 {
+			return ""
+		}
+		n = int(binary.BigEndian.Uint16(data[3:]))
+		if len(data) < 5+n {
+			return ""
+		}
+		return strings.ToLower(string(data[5 : 5+n]))
+	}
+	return ""
+}
+
+// sniffHost reads the Host header of an HTTP request
+func sniffHost(r *bufio.Reader) string {
+	for {
+		buf, _ := r.Peek(r.Buffered())
+		if i := bytes.Index(buf, []byte("\r\n\r\n")); i >= 0 {
+			return parseHost(buf[:i])
+		}
+		if len(buf) >= maxPeekHTTP {
+			return parseHost(buf)
+		}
+		if _, err := r.Peek(len(buf) + 1); err != nil {
+			return parseHost(buf)
+		}
+	}
+}
+
+func parseHost(head []byte) string {
+	lines := strings.Split(string(head), "\r\n")
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || !strings.EqualFold(strings.TrimSpace(name), "host") {
+			continue
+		}
+		host := strings.ToLower(strings.TrimSpace(value))
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return host
+	}
+	return ""
+}
@@ -0,0 +1,197 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRoute(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want Route
+		ok   bool
+	}{
+		{"sni:*.example.com=10.0.0.1:443", Route{Kind: routeSNI, Match: "*.example.com", RAddr: "10.0.0.1:443"}, true},
+		{"sni:Example.COM=a1/10.0.0.1:443", Route{Kind: routeSNI, Match: "example.com", RAddr: "10.0.0.1:443", Agent: "a1"}, true},
+		{"host:example.com=10.0.0.1:80", Route{Kind: routeHost, Match: "example.com", RAddr: "10.0.0.1:80"}, true},
+		{"host:example.com/api/v1=10.0.0.1:80", Route{Kind: routeHost, Match: "example.com", Path: "/api/v1", RAddr: "10.0.0.1:80"}, true},
+		{"ssh=10.0.0.1:22", Route{Kind: routeSSH, RAddr: "10.0.0.1:22"}, true},
+		// a path is of the host routes only
+		{"sni:example.com/api=10.0.0.1:443", Route{Kind: routeSNI, Match: "example.com/api", RAddr: "10.0.0.1:443"}, true},
+		{"sni=10.0.0.1:443", Route{}, false},
+		{"host:/api=10.0.0.1:80", Route{}, false},
+		{"ftp:example.com=10.0.0.1:21", Route{}, false},
+		{"sni:[a=10.0.0.1:443", Route{}, false},
+		{"sni:example.com=10.0.0.1", Route{}, false},
+		{"sni:example.com", Route{}, false},
+	} {
+		t.Run(tc.s, func(t *testing.T) {
+			got, err := ParseRoute(tc.s)
+			if (err == nil) != tc.ok {
+				t.Fatalf("err %v, want ok %v", err, tc.ok)
+			}
+			if got != tc.want {
+				t.Fatalf("route %+v, want %+v", got, tc.want)
+			}
+			if !tc.ok {
+				return
+			}
+			if again, err := ParseRoute(got.String()); err != nil || again != got {
+				t.Errorf("%s parsed again as %+v, %v", got, again, err)
+			}
+		})
+	}
+}
+
+// clientHello is the first record of a TLS client asking serverName, none
+// when empty
+func clientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	go func() {
+		tls.Client(conn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+		conn.Close()
+	}()
+	r := bufio.NewReader(peer)
+	header := make([]byte, tlsRecordHeader)
+	if _, err := io.ReadFull(r, header); err != nil {
+		t.Fatal(err)
+	}
+	record := make([]byte, int(header[3])<<8|int(header[4]))
+	if _, err := io.ReadFull(r, record); err != nil {
+		t.Fatal(err)
+	}
+	return append(header, record...)
+}
+
+func TestSniff(t *testing.T) {
+	hello := clientHello(t, "Www.Example.com")
+	for _, tc := range []struct {
+		name  string
+		first []byte
+		kind  string
+		match string
+	}{
+		{"tls", hello, routeSNI, "www.example.com"},
+		{"tls without sni", clientHello(t, ""), routeSNI, ""},
+		{"tls truncated", hello[:len(hello)-10], routeSNI, ""},
+		{"http", []byte("GET / HTTP/1.1\r\nHost: Example.com:8080\r\nAccept: */*\r\n\r\n"), routeHost, "example.com"},
+		{"http host later", []byte("POST /x HTTP/1.1\r\nContent-Length: 0\r\nhost:example.com\r\n\r\n"), routeHost, "example.com"},
+		{"http without host", []byte("GET / HTTP/1.0\r\n\r\n"), routeHost, ""},
+		{"http ipv6", []byte("GET / HTTP/1.1\r\nHost: [::1]:8080\r\n\r\n"), routeHost, "::1"},
+		{"ssh", []byte("SSH-2.0-OpenSSH_9.6\r\n"), routeSSH, ""},
+		{"not ssh", []byte("STARTTLS\r\n"), "", ""},
+		{"binary", []byte{0, 1, 2, 3}, "", ""},
+		{"nothing", nil, "", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := bufio.NewReaderSize(bytes.NewReader(tc.first), tlsRecordHeader+tlsMaxRecord)
+			kind, match := sniff(r)
+			if kind != tc.kind || match != tc.match {
+				t.Errorf("sniffed %q %q, want %q %q", kind, match, tc.kind, tc.match)
+			}
+			// nothing is consumed
+			if rest, _ := io.ReadAll(r); !bytes.Equal(rest, tc.first) {
+				t.Errorf("consumed the first bytes")
+			}
+		})
+	}
+}
+
+func TestMatchRequest(t *testing.T) {
+	for _, tc := range []struct {
+		route string
+		host  string
+		path  string
+		want  bool
+	}{
+		{"host:example.com=10.0.0.1:80", "example.com", "/", true},
+		{"host:example.com=10.0.0.1:80", "other.com", "/", false},
+		{"host:*.example.com=10.0.0.1:80", "www.example.com", "/x", true},
+		{"host:*.example.com=10.0.0.1:80", "example.com", "/x", false},
+		{"host:example.com/api=10.0.0.1:80", "example.com", "/api", true},
+		{"host:example.com/api=10.0.0.1:80", "example.com", "/api/v1", true},
+		{"host:example.com/api/=10.0.0.1:80", "example.com", "/api/v1", true},
+		// the prefix matches whole segments
+		{"host:example.com/api=10.0.0.1:80", "example.com", "/apis", false},
+		{"host:example.com/api=10.0.0.1:80", "example.com", "/", false},
+		{"sni:example.com=10.0.0.1:443", "example.com", "/", false},
+	} {
+		t.Run(tc.route+" "+tc.host+tc.path, func(t *testing.T) {
+			route, err := ParseRoute(tc.route)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := route.matchRequest(tc.host, tc.path); got != tc.want {
+				t.Errorf("match %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTunnelRoute(t *testing.T) {
+	var routes []Route
+	for _, s := range []string{"sni:*.example.com=10.0.0.1:443", "host:example.com=a1/10.0.0.2:80", "ssh=10.0.0.3:22"} {
+		route, err := ParseRoute(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		routes = append(routes, route)
+	}
+	for _, tc := range []struct {
+		name  string
+		mode  string
+		raddr string
+		// first is sent by the client, nothing when nil
+		first []byte
+		want  string
+	}{
+		{"sni", ModeForward, "10.0.0.9:1", clientHello(t, "www.example.com"), "10.0.0.1:443"},
+		{"host", ModeForward, "10.0.0.9:1", []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), "10.0.0.2:80"},
+		{"ssh", ModeForward, "10.0.0.9:1", []byte("SSH-2.0-OpenSSH_9.6\r\n"), "10.0.0.3:22"},
+		{"fallback", ModeForward, "10.0.0.9:1", []byte("GET / HTTP/1.1\r\nHost: other.com\r\n\r\n"), "10.0.0.9:1"},
+		// the server-first protocols send nothing
+		{"silent", ModeForward, "10.0.0.9:1", nil, "10.0.0.9:1"},
+		{"sni without a match", ModeSNI, "10.0.0.9:1", clientHello(t, "other.com"), ""},
+		{"no raddr", ModeForward, "", []byte("SELECT 1\r\n"), ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, peer := net.Pipe()
+			defer conn.Close()
+			defer peer.Close()
+			if tc.first != nil {
+				go peer.Write(tc.first)
+			}
+			tunnel := &Tunnel{Mode: tc.mode, RAddr: tc.raddr, Routes: routes, SniffTimeout: 50 * time.Millisecond}
+			peeked, route, err := tunnel.route(conn)
+			if tc.want == "" {
+				if !errors.Is(err, errNoRoute) {
+					t.Fatalf("err %v, want %v", err, errNoRoute)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if route.RAddr != tc.want {
+				t.Fatalf("routed to %s, want %s", route.RAddr, tc.want)
+			}
+			if tc.first == nil {
+				return
+			}
+			// the bytes sniffed are read again
+			got := make([]byte, len(tc.first))
+			if _, err := io.ReadFull(peeked, got); err != nil || !bytes.Equal(got, tc.first) {
+				t.Errorf("replayed %q, %v", strings.TrimSpace(string(got)), err)
+			}
+		})
+	}
+}
@@ -0,0 +1,313 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dworld/channel/pkg/protocol"
+)
+
+// associateQueue is how many datagrams of a destination wait for its stream,
+// those past it are dropped as a congested network would
+const associateQueue = 64
+
+var errUDPHops = &protocol.DialError{Hop: protocol.HopRemote, Kind: protocol.KindFailed, Msg: "udp streams don't go through hops"}
+
+// socksUDPRequest is a UDP ASSOCIATE request of a socks5 client, its failures
+// are replied as those of CONNECT
+type socksUDPRequest struct {
+	socksRequest
+}
+
+// socksAssociation relays the datagrams of a UDP ASSOCIATE, each destination
+// the client sends to gets a udp stream
+type socksAssociation struct {
+	client *Client
+	tunnel *Tunnel
+	slots  *protocol.Limiter
+	ctx    context.Context
+	pc     *net.UDPConn
+	// ip is of the TCP connection of the request, the datagrams of the other
+	// hosts are dropped
+	ip net.IP
+
+	lock sync.Mutex
+	// peer is where the client sends the datagrams from, set by the first
+	peer  *net.UDPAddr
+	conns map[string]*associateConn
+}
+
+// serveAssociate serves the UDP ASSOCIATE of conn at a UDP port of the
+// address conn came to, until conn closes
+func (client *Client) serveAssociate(ctx context.Context, tunnel *Tunnel, slots *protocol.Limiter, conn net.Conn, req *socksUDPRequest) {
+	defer protocol.CloseConn("CLIENT", conn)
+	if len(tunnel.Hops) > 0 {
+		req.failed(conn, errUDPHops)
+		return
+	}
+	laddr, _ := conn.LocalAddr().(*net.TCPAddr)
+	raddr, _ := conn.RemoteAddr().(*net.TCPAddr)
+	if laddr == nil || raddr == nil {
+		req.failed(conn, errors.New("udp associate needs a TCP connection"))
+		return
+	}
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: laddr.IP})
+	if err != nil {
+		log.Printf("Associate %v: %s\n", conn, err)
+		req.failed(conn, err)
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	assoc := &socksAssociation{client: client, tunnel: tunnel, slots: slots, ctx: ctx, pc: pc, ip: raddr.IP,
+		conns: map[string]*associateConn{}}
+	defer assoc.close()
+	bound := pc.LocalAddr().(*net.UDPAddr)
+	if err := writeSocksBound(conn, socksSucceeded, bound.IP, bound.Port); err != nil {
+		cancel()
+		return
+	}
+	log.Printf("Associate %v at %s\n", conn, bound)
+	go func() {
+		// the association lasts as long as its TCP connection
+		io.Copy(io.Discard, conn)
+		cancel()
+		pc.Close()
+	}()
+	assoc.serve()
+	cancel()
+}
+
+// writeSocksBound replies rep with the bound address ip:port
+func writeSocksBound(w io.Writer, rep byte, ip net.IP, port int) error {
+	b := []byte{socksVersion, rep, 0, socksIPv4}
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, ip4...)
+	} else {
+		b[3] = socksIPv6
+		b = append(b, ip.To16()...)
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(port))
+	_, err := w.Write(b)
+	return err
+}
+
+// serve reads the datagrams of the client until the association closes
+func (assoc *socksAssociation) serve() {
+	buf := make([]byte, protocol.MaxDatagram)
+	for {
+		n, from, err := assoc.pc.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !from.IP.Equal(assoc.ip) {
+			continue
+		}
+		assoc.lock.Lock()
+		if assoc.peer == nil {
+			assoc.peer = from
+		}
+		known := assoc.peer.Port == from.Port
+		assoc.lock.Unlock()
+		if !known {
+			continue
+		}
+		header, dst, err := parseSocksDatagram(buf[:n])
+		if err != nil {
+			log.Printf("Associate datagram from %s: %s\n", from, err)
+			continue
+		}
+		payload := append([]byte(nil), buf[len(header):n]...)
+		assoc.conn(dst, header).queue(payload)
+	}
+}
+
+// parseSocksDatagram is the header and the destination of a datagram of the
+// client, fragments aren't taken
+func parseSocksDatagram(p []byte) ([]byte, string, error) {
+	if len(p) < 4 {
+		return nil, "", errors.New("short datagram")
+	}
+	if p[2] != 0 {
+		return nil, "", errors.New("fragmented datagram")
+	}
+	r := bytes.NewReader(p[4:])
+	dst, err := readSocksAddr(r, p[3])
+	if err != nil {
+		return nil, "", err
+	}
+	return append([]byte(nil), p[:len(p)-r.Len()]...), dst, nil
+}
+
+// conn is the connection of the datagrams to dst, its stream is opened
+// when it's new
+func (assoc *socksAssociation) conn(dst string, header []byte) *associateConn {
+	assoc.lock.Lock()
+	defer assoc.lock.Unlock()
+	if c := assoc.conns[dst]; c != nil {
+		return c
+	}
+	c := &associateConn{assoc: assoc, dst: dst, header: header, datagrams: make(chan []byte, associateQueue),
+		closed: make(chan struct{})}
+	assoc.conns[dst] = c
+	go assoc.openStream(c)
+	return c
+}
+
+// openStream pipes c with a udp stream to its destination, through the
+// proxy or direct
+func (assoc *socksAssociation) openStream(c *associateConn) {
+	defer c.Close()
+	client := assoc.client
+	assoc.lock.Lock()
+	from := assoc.peer.String()
+	assoc.lock.Unlock()
+	info := protocol.StreamInfo{Tunnel: assoc.tunnel.Label, From: from, Addr: c.dst, Net: protocol.NetUDP}
+	free, err := client.admitStream(assoc.ctx, assoc.tunnel, assoc.slots)
+	if err != nil {
+		log.Printf("Associate %s: %s\n", c.dst, err)
+		return
+	}
+	defer free()
+	var rconn net.Conn
+	var release func()
+	if client.direct(c.dst) {
+		rconn, release, err = client.dialDirect(assoc.ctx, assoc.tunnel, info)
+	} else {
+		rconn, release, err = client.openStream(assoc.ctx, assoc.tunnel, info)
+	}
+	if err != nil {
+		return
+	}
+	defer release()
+	stats := client.PipeStream(assoc.ctx, info, "CLIENT", c, "PROXY", rconn)
+	client.Hooks.StreamClose(info, stats)
+}
+
+// reply sends p, a datagram with its header, to the client
+func (assoc *socksAssociation) reply(p []byte) error {
+	assoc.lock.Lock()
+	peer := assoc.peer
+	assoc.lock.Unlock()
+	_, err := assoc.pc.WriteToUDP(p, peer)
+	return err
+}
+
+func (assoc *socksAssociation) remove(c *associateConn) {
+	assoc.lock.Lock()
+	defer assoc.lock.Unlock()
+	if assoc.conns[c.dst] == c {
+		delete(assoc.conns, c.dst)
+	}
+}
+
+func (assoc *socksAssociation) close() {
+	assoc.pc.Close()
+	assoc.lock.Lock()
+	conns := assoc.conns
+	assoc.conns = map[string]*associateConn{}
+	assoc.lock.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// associateConn is the datagrams of an association to a destination as the
+// udp streams frame them, its reads are those of the client and its writes
+// are sent back to it with the header of the destination
+type associateConn struct {
+	assoc     *socksAssociation
+	dst       string
+	header    []byte
+	datagrams chan []byte
+	closed    chan struct{}
+	once      sync.Once
+
+	read    []byte
+	written []byte
+}
+
+// queue hands p to the stream, it's dropped when the stream lags
+func (c *associateConn) queue(p []byte) {
+	select {
+	case c.datagrams <- p:
+	default:
+	}
+}
+
+func (c *associateConn) Read(p []byte) (int, error) {
+	if len(c.read) == 0 {
+		timer := time.NewTimer(protocol.UDPIdleTimeout)
+		defer timer.Stop()
+		select {
+		case d := <-c.datagrams:
+			c.read = binary.BigEndian.AppendUint16(nil, uint16(len(d)))
+			c.read = append(c.read, d...)
+		case <-c.closed:
+			return 0, io.EOF
+		case <-timer.C:
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, c.read)
+	c.read = c.read[n:]
+	return n, nil
+}
+
+func (c *associateConn) Write(p []byte) (int, error) {
+	c.written = append(c.written, p...)
+	for len(c.written) >= 2 {
+		size := 2 + int(binary.BigEndian.Uint16(c.written))
+		if len(c.written) < size {
+			break
+		}
+		if err := c.assoc.reply(append(append([]byte(nil), c.header...), c.written[2:size]...)); err != nil {
+			return 0, err
+		}
+		c.written = c.written[size:]
+	}
+	if len(c.written) == 0 {
+		c.written = nil
+	}
+	return len(p), nil
+}
+
+func (c *associateConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.assoc.remove(c)
+	})
+	return nil
+}
+
+func (c *associateConn) LocalAddr() net.Addr {
+	return c.assoc.pc.LocalAddr()
+}
+
+func (c *associateConn) RemoteAddr() net.Addr {
+	c.assoc.lock.Lock()
+	defer c.assoc.lock.Unlock()
+	return c.assoc.peer
+}
+
+func (c *associateConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *associateConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *associateConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *associateConn) String() string {
+	return "udp associate " + c.dst
+}
@@ -0,0 +1,61 @@
+package client
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/dworld/channel/pkg/protocol"
+)
+
+// stdioWait is how long RunStdio waits for a proxy to connect
+const stdioWait = 30 * time.Second
+
+// RunStdio runs the client for the one stream of conn, the stdin and stdout
+// of the process, to the RAddr of tunnel, as the ProxyCommand of ssh wants.
+// The stream is dialed once a proxy is connected and the client stops once
+// it's closed
+func (client *Client) RunStdio(ctx context.Context, tunnel *Tunnel, conn net.Conn) error {
+	if err := client.validateTunnel(tunnel); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() { errc <- client.Run(ctx) }()
+	wait := time.NewTimer(stdioWait)
+	defer wait.Stop()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for client.Ready() != nil {
+		select {
+		case err := <-errc:
+			return err
+		case <-wait.C:
+			return errNotConnected
+		case <-ticker.C:
+		}
+	}
+	info := protocol.StreamInfo{Tunnel: tunnel.Label, From: conn.RemoteAddr().String(), Addr: tunnel.RAddr}
+	free, err := client.admitStream(ctx, tunnel, new(protocol.Limiter))
+	if err != nil {
+		return err
+	}
+	defer free()
+	var rconn net.Conn
+	var release func()
+	if client.direct(info.Addr) {
+		rconn, release, err = client.dialDirect(ctx, tunnel, info)
+	} else {
+		rconn, release, err = client.openStream(ctx, tunnel, info)
+	}
+	if err != nil {
+		return err
+	}
+	defer release()
+	stats := client.PipeStream(ctx, info, "CLIENT", conn, "PROXY", rconn)
+	client.Hooks.StreamClose(info, stats)
+	cancel()
+	<-errc
+	return nil
+}
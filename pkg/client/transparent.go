@@ -0,0 +1,66 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+var errNotRedirected = errors.New("not redirected to the tunnel")
+
+// originalDst is the address conn was sent to before a REDIRECT of the
+// firewall turned it to the transparent tunnel, through the wrappers which
+// tell their NetConn
+func originalDst(conn net.Conn) (string, error) {
+	c := conn
+	for {
+		switch tc := c.(type) {
+		case *net.TCPConn:
+			raddr, err := tcpOriginalDst(tc)
+			if err != nil {
+				return "", err
+			}
+			// a connection made to laddr itself would dial it again
+			if laddr, ok := tc.LocalAddr().(*net.TCPAddr); ok && laddr.String() == raddr.String() {
+				return "", errNotRedirected
+			}
+			return raddr.String(), nil
+		case interface{ NetConn() net.Conn }:
+			c = tc.NetConn()
+		default:
+			return "", fmt.Errorf("%s tunnel needs TCP connections, not %T", ModeTransparent, conn)
+		}
+	}
+}
+
+// tproxyDst is the address conn is addressed to, a TPROXY rule delivers it
+// to the tproxy tunnel at laddr untouched
+func tproxyDst(conn net.Conn, laddr string) (string, error) {
+	addr, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return "", fmt.Errorf("%s tunnel needs TCP connections, not %T", ModeTPROXY, conn)
+	}
+	// a connection made to laddr itself would dial it again
+	if _, port, _ := net.SplitHostPort(laddr); port == strconv.Itoa(addr.Port) && isLocalIP(addr.IP) {
+		return "", errNotRedirected
+	}
+	return addr.String(), nil
+}
+
+// isLocalIP tells whether ip is of the host
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+const (
+	// soOriginalDst is SO_ORIGINAL_DST of netfilter, IP6T_SO_ORIGINAL_DST
+	// has the same number
+	soOriginalDst = 80
+	// ipv6Transparent is IPV6_TRANSPARENT, syscall lacks it
+	ipv6Transparent = 75
+)
+
+// transparentControl sets IP_TRANSPARENT on the listener of a tproxy tunnel
+// before it's bound, so it takes the connections to the addresses of other
+// hosts, it needs CAP_NET_ADMIN
+func transparentControl(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		if network == "tcp6" {
+			if serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6Transparent, 1); serr != nil {
+				return
+			}
+			// the IPv4 traffic of a dual stack listener
+		}
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TRANSPARENT, 1)
+	})
+	if err == nil {
+		err = serr
+	}
+	if err != nil {
+		return fmt.Errorf("set the transparent option of %s: %w", address, err)
+	}
+	return nil
+}
+
+// tcpOriginalDst reads the destination conntrack recorded for conn before
+// the NAT of the REDIRECT
+func tcpOriginalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	laddr, _ := conn.LocalAddr().(*net.TCPAddr)
+	var addr *net.TCPAddr
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if laddr != nil && laddr.IP.To4() != nil {
+			// a sockaddr_in fits the 16 bytes of the mreq
+			mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+			if err != nil {
+				serr = err
+				return
+			}
+			sa := mreq.Multiaddr
+			addr = &net.TCPAddr{IP: net.IPv4(sa[4], sa[5], sa[6], sa[7]), Port: int(binary.BigEndian.Uint16(sa[2:4]))}
+			return
+		}
+		// the sockaddr_in6 is where the mtu info starts
+		info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+		if err != nil {
+			serr = err
+			return
+		}
+		var port [2]byte
+		binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, info.Addr.Addr[:])
+		addr = &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(port[:]))}
+	})
+	if err == nil {
+		err = serr
+	}
+	if err == syscall.ENOENT {
+		// conntrack has no NAT of it
+		return nil, errNotRedirected
+	}
+	return addr, err
+}
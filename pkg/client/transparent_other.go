@@ -0,0 +1,18 @@
+//go:build !linux
+
+package client
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"syscall"
+)
+
+func transparentControl(network, address string, c syscall.RawConn) error {
+	return fmt.Errorf("%s tunnel needs linux, not %s", ModeTPROXY, runtime.GOOS)
+}
+
+func tcpOriginalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, fmt.Errorf("%s tunnel needs linux, not %s", ModeTransparent, runtime.GOOS)
+}
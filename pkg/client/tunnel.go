@@ -0,0 +1,203 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/dworld/channel/pkg/protocol"
+)
+
+// reset behaviors of a failed tunnel connection
+const (
+	ResetRST     = "rst"
+	ResetFIN     = "fin"
+	ResetDelayed = "delay"
+)
+
+// Tunnel forwards the connections accepted at LAddr to RAddr through the proxy
+type Tunnel struct {
+	// Label names the tunnel in the status
+	Label string
+	// LAddr is the local address, or the path of a unix socket after
+	// protocol.UnixScheme
+	LAddr string
+	// Mode is what LAddr serves, forward to RAddr, or socks5 and http
+	// proxying to the address asked
+	Mode string
+	// RAddr is the real address, or the comma separated backends the proxy
+	// dials in turn, a backend per stream, each with its weight after =, or
+	// a unix socket of the proxy as LAddr, or protocol.ExecScheme and the
+	// command the proxy runs for each stream
+	RAddr string
+	// Agent names the proxy the streams go through, the proxy connected
+	// without a name when empty
+	Agent string
+	// E2EKey is the noise public key of the agent, the streams are sealed
+	// end to end with it so a relay brokering them can't read them
+	E2EKey string
+	// Hops chain the streams through further proxies after the agent, each
+	// is the e2e public key of a proxy and the address of its hop listener,
+	// key@host:port, a hop only learns the address after it
+	Hops []string
+	// Protocol is the backend protocol of RAddr, used to reply protocol errors
+	Protocol string
+	// Reset is how a failed connection ends, rst, fin or delay
+	Reset string
+	// ResetDelay is the wait before FIN when Reset is delay
+	ResetDelay time.Duration
+	// Compress is the codecs offered for the streams, none compresses nothing
+	// which suits traffic encrypted already
+	Compress []string
+	// Routes pick the real address by the first bytes of the connections,
+	// RAddr takes the connections no route matches
+	Routes []Route
+	// SniffTimeout is how long the routes wait for the first bytes
+	SniffTimeout time.Duration
+	// Flush is when the writes of the streams to the channel are sent, on
+	// the client and on the proxy, the options of each when nil
+	Flush *protocol.FlushPolicy
+	// NoDelay turns Nagle's algorithm off on the connections of the tunnel
+	// and the data connections of their streams, on the client and on the
+	// proxy, Go leaves it off when nil
+	NoDelay *bool
+	// MaxStreams caps the streams of the tunnel open at once, none when 0
+	MaxStreams int
+	// Preset is latency or throughput, it sets NoDelay and Flush unless
+	// they're set
+	Preset string
+	// ACME is the host names whose TLS is terminated at LAddr, with the
+	// certificates the ACME of the client fetches, the streams carry the
+	// plain connections
+	ACME []string
+	// Resolve is where the host names of the remotes are resolved,
+	// ResolveProxy or ResolveClient, the proxy when empty
+	Resolve string
+	// TLS wraps the connections to the remotes in TLS, the connections at
+	// LAddr being plain, protocol.TLSVerify verifies the certificates and
+	// protocol.TLSInsecure doesn't, none when empty
+	TLS string
+	// SNI is the server name of the TLS, the host of the remote when empty
+	SNI string
+}
+
+// validate checks the fields of tunnel and fills the defaults, the RAddr of a
+// relay client names its agent, agent/host:port
+func (tunnel *Tunnel) validate(relay bool) error {
+	switch tunnel.Reset {
+	case "":
+		tunnel.Reset = ResetFIN
+	case ResetRST, ResetFIN, ResetDelayed:
+	default:
+		return fmt.Errorf("invalid reset, %s", tunnel.Reset)
+	}
+	if _, ok := dialErrorWriters[tunnel.Protocol]; tunnel.Protocol != "" && !ok {
+		return fmt.Errorf("invalid protocol, %s", tunnel.Protocol)
+	}
+	switch tunnel.Resolve {
+	case "", ResolveProxy, ResolveClient:
+	default:
+		return fmt.Errorf("invalid resolve, %s", tunnel.Resolve)
+	}
+	if network, _ := protocol.SplitNetwork(tunnel.LAddr); network == "unix" {
+		switch tunnel.Mode {
+		case ModeTransparent, ModeTPROXY, ModeDNS:
+			return fmt.Errorf("%s tunnel listens TCP, not %s", tunnel.Mode, tunnel.LAddr)
+		}
+	}
+	if err := protocol.ValidateTLS(tunnel.TLS); err != nil {
+		return err
+	}
+	if tunnel.TLS != "" && len(tunnel.Hops) > 0 {
+		return fmt.Errorf("tls isn't originated through hops")
+	}
+	switch tunnel.Mode {
+	case ModeForward:
+	case ModeSOCKS5, ModeHTTP, ModeTransparent, ModeTPROXY, ModeDNS:
+		if len(tunnel.Routes) > 0 {
+			return fmt.Errorf("routes need a forward tunnel, not %s", tunnel.Mode)
+		}
+	case ModeReverse:
+		for _, route := range tunnel.Routes {
+			if route.Kind != routeHost {
+				return fmt.Errorf("%s tunnel routes by host only, not %s", tunnel.Mode, route)
+			}
+		}
+	case ModeSNI:
+		if len(tunnel.Routes) == 0 {
+			return fmt.Errorf("%s tunnel needs sni routes", tunnel.Mode)
+		}
+		for _, route := range tunnel.Routes {
+			if route.Kind != routeSNI {
+				return fmt.Errorf("%s tunnel routes by sni only, not %s", tunnel.Mode, route)
+			}
+		}
+	default:
+		return fmt.Errorf("invalid tunnel mode, %s", tunnel.Mode)
+	}
+	if tunnel.SniffTimeout <= 0 {
+		tunnel.SniffTimeout = time.Second
+	}
+	if tunnel.Preset != "" {
+		noDelay, flush, err := protocol.ParsePreset(tunnel.Preset)
+		if err != nil {
+			return err
+		}
+		if tunnel.NoDelay == nil {
+			tunnel.NoDelay = &noDelay
+		}
+		if tunnel.Flush == nil {
+			tunnel.Flush = flush
+		}
+	}
+	for _, route := range tunnel.Routes {
+		if route.Path != "" && tunnel.Mode != ModeReverse {
+			return fmt.Errorf("route %s has a path, it needs a %s tunnel", route, ModeReverse)
+		}
+	}
+	agent, raddr := tunnel.Agent, tunnel.RAddr
+	if a, addr, ok := splitRelayAddr(tunnel.RAddr); ok && relay {
+		agent, raddr = a, addr
+	}
+	if protocol.IsBackends(raddr) {
+		if tunnel.Resolve == ResolveClient {
+			return fmt.Errorf("the backends of %s are resolved by the proxy", tunnel.RAddr)
+		}
+		if _, err := protocol.ParseBackends(raddr); err != nil {
+			return err
+		}
+	}
+	for _, route := range tunnel.Routes {
+		if route.Agent != "" && route.Agent != agent && tunnel.E2EKey != "" {
+			return fmt.Errorf("route %s goes through another agent than the e2e key of the tunnel", route)
+		}
+	}
+	for _, hop := range tunnel.Hops {
+		if _, _, err := splitHop(hop); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitRelayAddr splits the agent off the raddr of a relay client, the unix
+// sockets and the exec targets name no agent
+func splitRelayAddr(raddr string) (string, string, bool) {
+	if strings.HasPrefix(raddr, protocol.UnixScheme) || strings.HasPrefix(raddr, protocol.ExecScheme) {
+		return "", raddr, false
+	}
+	return strings.Cut(raddr, "/")
+}
+
+// failConn replies err to a connection whose dial failed and prepares it to be
+// closed the configured way
+func (tunnel *Tunnel) failConn(conn net.Conn, err error) {
+	writeDialError(conn, tunnel.Protocol, err)
+	switch tunnel.Reset {
+	case ResetRST:
+		protocol.ResetConn(conn)
+	case ResetDelayed:
+		time.Sleep(tunnel.ResetDelay)
+	}
+}
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/dworld/channel/pkg/protocol"
+)
+
+// VerifyReport is the result of Verify, Upstream is what the proxy received
+// of the client and Downstream what the client received of the proxy
+type VerifyReport struct {
+	Agent      string                `json:"agent,omitempty"`
+	Size       int                   `json:"size"`
+	Upstream   protocol.VerifyResult `json:"upstream"`
+	Downstream protocol.VerifyResult `json:"downstream"`
+}
+
+// verifyTimeout bounds a Verify without a deadline in its ctx
+const verifyTimeout = time.Minute
+
+// Verify exchanges size bytes of the verify pattern with the proxy called
+// agent over a stream without codec, for telling whether the network
+// between them passes the bytes untouched and what rewrote them otherwise
+func (client *Client) Verify(ctx context.Context, agent string, size int) (VerifyReport, error) {
+	report := VerifyReport{Agent: agent, Size: size}
+	if size <= 0 || size > protocol.MaxVerifySize {
+		return report, fmt.Errorf("invalid verify size, %d", size)
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, verifyTimeout)
+		defer cancel()
+	}
+	conn, err := client.dialerFor(agent).DialOptions(ctx, protocol.VerifyPrefix+strconv.Itoa(size), nil)
+	if err != nil {
+		return report, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	pattern := protocol.VerifyPattern(size)
+	if _, err := conn.Write(pattern); err != nil {
+		return report, err
+	}
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return report, fmt.Errorf("no verify reply, %w", err)
+	}
+	head, opts := protocol.ParseLine(line)
+	if head != "verify" {
+		return report, fmt.Errorf("verify reply rewritten, %q", line)
+	}
+	if report.Upstream, err = protocol.ParseVerifyResult(opts); err != nil {
+		return report, err
+	}
+	// reading a byte past the pattern tells the bytes added, a read error
+	// leaves a truncated pattern to compare
+	got, _ := io.ReadAll(io.LimitReader(r, int64(size)+1))
+	report.Downstream = protocol.CompareVerify(pattern, got)
+	return report, nil
+}
@@ -0,0 +1,109 @@
+package protocol
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// acceptPrune is how often the buckets of the IPs gone quiet are forgotten
+const acceptPrune = 10 * time.Second
+
+var acceptsLimited = NewCounter("accepts_rate_limited")
+
+// AcceptRate caps the connections accepted from each source IP at Rate a
+// second, with bursts of Burst
+type AcceptRate struct {
+	Rate  float64
+	Burst int
+
+	lock    sync.Mutex
+	buckets map[string]*acceptBucket
+	pruned  time.Time
+}
+
+type acceptBucket struct {
+	tokens  float64
+	last    time.Time
+	limited bool
+}
+
+// Allow takes a token for a connection from addr
+func (a *AcceptRate) Allow(addr net.Addr) bool {
+	ip := banIP(addr)
+	burst := float64(a.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	now := time.Now()
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.pruneLocked(now, burst)
+	if a.buckets == nil {
+		a.buckets = map[string]*acceptBucket{}
+	}
+	b := a.buckets[ip]
+	if b == nil {
+		b = &acceptBucket{tokens: burst}
+		a.buckets[ip] = b
+	} else if b.tokens += now.Sub(b.last).Seconds() * a.Rate; b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		b.limited = false
+		return true
+	}
+	acceptsLimited.Add(1)
+	if !b.limited {
+		// once until it's allowed again, a flood would flood the log
+		log.Printf("Rate limited the connections of %s\n", ip)
+		b.limited = true
+	}
+	return false
+}
+
+// pruneLocked forgets the buckets refilled already, every acceptPrune
+func (a *AcceptRate) pruneLocked(now time.Time, burst float64) {
+	if now.Sub(a.pruned) < acceptPrune {
+		return
+	}
+	a.pruned = now
+	for ip, b := range a.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*a.Rate >= burst {
+			delete(a.buckets, ip)
+		}
+	}
+}
+
+// LimitAccepts wraps ln so the connections past rate are closed as they're
+// accepted, ln as it is when rate is nil. Each listener has buckets of its
+// own, the connections to a tunnel don't take those of the channel
+func LimitAccepts(ln net.Listener, rate *AcceptRate) net.Listener {
+	if rate == nil || rate.Rate <= 0 {
+		return ln
+	}
+	return &rateListener{Listener: ln, rate: &AcceptRate{Rate: rate.Rate, Burst: rate.Burst}}
+}
+
+type rateListener struct {
+	net.Listener
+	rate *AcceptRate
+}
+
+func (ln *rateListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := ln.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if ln.rate.Allow(conn.RemoteAddr()) {
+			return conn, nil
+		}
+		// RST, so the connections refused hold nothing in TIME_WAIT
+		ResetConn(conn)
+		conn.Close()
+	}
+}
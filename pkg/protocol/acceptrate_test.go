@@ -0,0 +1,140 @@
+package protocol
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// rewindBucket moves the last accept of ip back by d, as if d passed
+func rewindBucket(a *AcceptRate, ip string, d time.Duration) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.buckets[ip].last = a.buckets[ip].last.Add(-d)
+}
+
+// allowN counts the connections of addr allowed out of n
+func allowN(a *AcceptRate, addr net.Addr, n int) int {
+	allowed := 0
+	for i := 0; i < n; i++ {
+		if a.Allow(addr) {
+			allowed++
+		}
+	}
+	return allowed
+}
+
+func TestAcceptRateBuckets(t *testing.T) {
+	a := &AcceptRate{Rate: 1, Burst: 3}
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}
+	if got := allowN(a, addr, 5); got != 3 {
+		t.Fatalf("allowed %d, want the burst of 3", got)
+	}
+	// the ports of an IP take the same bucket
+	if a.Allow(&net.TCPAddr{IP: addr.IP, Port: 2000}) {
+		t.Fatal("another port of the IP allowed")
+	}
+	if got := allowN(a, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1000}, 5); got != 3 {
+		t.Fatalf("allowed %d of another IP, want its own burst of 3", got)
+	}
+}
+
+func TestAcceptRateRefill(t *testing.T) {
+	a := &AcceptRate{Rate: 2, Burst: 3}
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}
+	allowN(a, addr, 3)
+	// half a second earns a token at 2 a second
+	rewindBucket(a, "192.0.2.1", 500*time.Millisecond)
+	if got := allowN(a, addr, 3); got != 1 {
+		t.Fatalf("allowed %d after half a second, want 1", got)
+	}
+	// the bucket holds the burst at most
+	rewindBucket(a, "192.0.2.1", time.Hour)
+	if got := allowN(a, addr, 5); got != 3 {
+		t.Fatalf("allowed %d after an hour, want the burst of 3", got)
+	}
+}
+
+func TestAcceptRateBurst(t *testing.T) {
+	// no burst is a burst of 1
+	a := &AcceptRate{Rate: 1}
+	if got := allowN(a, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}, 3); got != 1 {
+		t.Fatalf("allowed %d, want 1", got)
+	}
+}
+
+func TestAcceptRatePrune(t *testing.T) {
+	a := &AcceptRate{Rate: 1, Burst: 2}
+	full := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}
+	empty := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1000}
+	allowN(a, full, 2)
+	rewindBucket(a, "192.0.2.1", time.Minute)
+	allowN(a, empty, 2)
+	a.lock.Lock()
+	a.pruned = a.pruned.Add(-acceptPrune)
+	a.lock.Unlock()
+	// the next accept forgets the buckets refilled, not those refilling
+	allowN(a, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 3), Port: 1000}, 1)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, ok := a.buckets["192.0.2.1"]; ok {
+		t.Error("bucket refilled kept")
+	}
+	if _, ok := a.buckets["192.0.2.2"]; !ok {
+		t.Error("bucket refilling forgotten")
+	}
+}
+
+func TestLimitAccepts(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if LimitAccepts(ln, nil) != ln || LimitAccepts(ln, &AcceptRate{}) != ln {
+		t.Fatal("listener wrapped without a rate")
+	}
+	rate := &AcceptRate{Rate: 0.001, Burst: 1}
+	limited := LimitAccepts(ln, rate)
+	// the buckets are of the listener, not of rate
+	rate.Allow(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := limited.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	select {
+	case conn := <-accepted:
+		defer conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("first connection not accepted")
+	}
+	// the second is reset as it's accepted
+	conns[1].SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conns[1].Read(make([]byte, 1)); err == nil {
+		t.Fatal("second connection not closed")
+	}
+	select {
+	case conn := <-accepted:
+		if conn != nil {
+			conn.Close()
+			t.Fatal("second connection accepted")
+		}
+	default:
+	}
+}
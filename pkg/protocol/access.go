@@ -0,0 +1,65 @@
+package protocol
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// AccessLog writes a JSON line for each closed stream, apart from the debug
+// log, as log pipelines ingest them. Set StreamClose as the OnStreamClose
+// hook, the bytes up are those sent toward the remote
+type AccessLog struct {
+	// Proxy tells the stats are of a proxy or relay, whose edge is the
+	// remote, rather than of a client
+	Proxy bool
+
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// NewAccessLog writes the access log to w
+func NewAccessLog(w io.Writer, proxy bool) *AccessLog {
+	return &AccessLog{Proxy: proxy, w: w}
+}
+
+// accessEntry is a line of the access log
+type accessEntry struct {
+	Time      string  `json:"time"`
+	Tunnel    string  `json:"tunnel,omitempty"`
+	From      string  `json:"from"`
+	To        string  `json:"to"`
+	BytesUp   int64   `json:"bytes_up"`
+	BytesDown int64   `json:"bytes_down"`
+	Duration  float64 `json:"duration"`
+	Reason    string  `json:"reason"`
+}
+
+// StreamClose logs the stream of info
+func (l *AccessLog) StreamClose(info StreamInfo, stats StreamStats) {
+	up, down := stats.In, stats.Out
+	if l.Proxy {
+		up, down = down, up
+	}
+	b, err := json.Marshal(accessEntry{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		Tunnel:    info.Tunnel,
+		From:      info.From,
+		To:        info.Addr,
+		BytesUp:   up,
+		BytesDown: down,
+		Duration:  stats.Duration.Seconds(),
+		Reason:    stats.Reason,
+	})
+	if err != nil {
+		log.Printf("access log: %s\n", err)
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if _, err := l.w.Write(append(b, '\n')); err != nil {
+		log.Printf("access log: %s\n", err)
+	}
+}
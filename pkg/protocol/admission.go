@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// admission metrics
+var (
+	admissionAdmitted = NewCounter("admission_admitted")
+	admissionRefused  = NewCounter("admission_refused")
+)
+
+// Admission admits the control connections of the agents at Rate a second
+// with bursts of Burst, so a gateway restart reconnecting them all at once
+// doesn't thrash on the session, pool and listener setup. The refused are
+// replied a busy line with a retry hint jittered over the time the backlog
+// of refused agents takes to be admitted, which spreads their retries
+type Admission struct {
+	// Rate is the control connections admitted a second
+	Rate float64
+	// Burst is how many are admitted at once, 1 when 0
+	Burst int
+
+	lock    sync.Mutex
+	tokens  float64
+	last    time.Time
+	backlog int
+}
+
+// Admit takes a token for a control connection, or tells how long its agent
+// should wait before connecting again
+func (a *Admission) Admit() (bool, time.Duration) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	burst := float64(a.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	now := time.Now()
+	if a.last.IsZero() {
+		a.tokens = burst
+	} else if a.tokens += now.Sub(a.last).Seconds() * a.Rate; a.tokens > burst {
+		a.tokens = burst
+	}
+	a.last = now
+	if a.tokens >= 1 {
+		a.tokens--
+		if a.backlog > 0 {
+			a.backlog--
+		}
+		admissionAdmitted.Add(1)
+		return true, 0
+	}
+	a.backlog++
+	admissionRefused.Add(1)
+	wait := (1 - a.tokens) / a.Rate
+	spread := float64(a.backlog) / a.Rate
+	return false, time.Duration((wait + rand.Float64()*spread) * float64(time.Second))
+}
+
+// BusyError is the busy reply of a gateway refusing a control connection,
+// Retry is how long to wait before connecting again
+type BusyError struct {
+	Retry time.Duration
+}
+
+func (e *BusyError) Error() string {
+	return fmt.Sprintf("busy, retry in %s", e.Retry)
+}
+
+// BusyLine is the busy reply with the retry hint retry
+func BusyLine(retry time.Duration) string {
+	return FormatLine("busy", map[string]string{"retry": retry.Round(time.Millisecond).String()})
+}
+
+// ParseBusyError is the error of a busy reply, a hint missing or invalid is
+// a second
+func ParseBusyError(opts map[string]string) *BusyError {
+	retry, err := time.ParseDuration(opts["retry"])
+	if err != nil || retry <= 0 {
+		retry = time.Second
+	}
+	return &BusyError{Retry: retry}
+}
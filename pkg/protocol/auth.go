@@ -0,0 +1,98 @@
+package protocol
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"net"
+	"path"
+	"time"
+)
+
+// Authenticator validates the proxies connecting to the channel, an error
+// closes the connection
+type Authenticator interface {
+	// ValidateControl validates a control connection, opts are of its hello
+	ValidateControl(conn net.Conn, opts map[string]string) error
+	// ValidateStream validates a data connection, opts are of its conn id
+	// line
+	ValidateStream(conn net.Conn, opts map[string]string) error
+}
+
+var (
+	errBadToken  = errors.New("invalid token")
+	errNotTLS    = errors.New("not a tls connection, mtls needs the tls or quic transport without obfs nor encryption")
+	errNoCert    = errors.New("no verified client certificate")
+	errCertNames = errors.New("client certificate name not allowed")
+)
+
+// TokenAuth accepts the connections which answer the challenge of the
+// channel with Token, or which send it in the token option when Plain
+type TokenAuth struct {
+	Token string
+	// Skew is how far the timestamps of the answers may be off the clock,
+	// DefaultSkew when 0
+	Skew time.Duration
+	// Plain accepts the token sent as it is, by the proxies before the
+	// challenges, a handshake captured can be replayed then
+	Plain bool
+}
+
+func (a TokenAuth) ValidateControl(conn net.Conn, opts map[string]string) error {
+	return a.validate(opts)
+}
+
+func (a TokenAuth) ValidateStream(conn net.Conn, opts map[string]string) error {
+	return a.validate(opts)
+}
+
+func (a TokenAuth) validate(opts map[string]string) error {
+	if _, ok := opts[macOption]; ok {
+		return a.validateAnswer(opts)
+	}
+	if !a.Plain {
+		return errNoChallenge
+	}
+	if subtle.ConstantTimeCompare([]byte(opts["token"]), []byte(a.Token)) != 1 {
+		return errBadToken
+	}
+	return nil
+}
+
+// MTLSAuth accepts the connections of the tls or quic transport with a client
+// certificate verified by the CA of the channel, whose common name or a DNS
+// name matches one of the Names patterns, any when empty
+type MTLSAuth struct {
+	Names []string
+}
+
+func (a MTLSAuth) ValidateControl(conn net.Conn, opts map[string]string) error {
+	return a.validate(conn)
+}
+
+func (a MTLSAuth) ValidateStream(conn net.Conn, opts map[string]string) error {
+	return a.validate(conn)
+}
+
+func (a MTLSAuth) validate(conn net.Conn) error {
+	tc, ok := conn.(interface{ ConnectionState() tls.ConnectionState })
+	if !ok {
+		return errNotTLS
+	}
+	state := tc.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return errNoCert
+	}
+	if len(a.Names) == 0 {
+		return nil
+	}
+	cert := state.VerifiedChains[0][0]
+	for _, name := range append([]string{cert.Subject.CommonName}, cert.DNSNames...) {
+		for _, pattern := range a.Names {
+			if ok, _ := path.Match(pattern, name); ok {
+				return nil
+			}
+		}
+	}
+	return errCertNames
+}
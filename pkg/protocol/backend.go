@@ -0,0 +1,45 @@
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Backend is a backend of a raddr list, host:port with its weight after =,
+// e.g. "10.0.0.1:80=95,10.0.0.2:80=5" sends 5% of the streams to the second
+type Backend struct {
+	Addr   string
+	Weight int
+}
+
+// IsBackends tells whether raddr is a list of backends or a backend with its
+// weight, the unix sockets and the exec targets aren't
+func IsBackends(raddr string) bool {
+	if strings.HasPrefix(raddr, ExecScheme) || strings.HasPrefix(raddr, UnixScheme) {
+		return false
+	}
+	return strings.ContainsAny(raddr, ",=")
+}
+
+// ParseBackends splits the comma separated backends of raddr, those without
+// a weight weigh 1
+func ParseBackends(raddr string) ([]Backend, error) {
+	var backends []Backend
+	for _, s := range strings.Split(raddr, ",") {
+		backend := Backend{Addr: s, Weight: 1}
+		if addr, weight, ok := strings.Cut(s, "="); ok {
+			w, err := strconv.Atoi(weight)
+			if err != nil || w <= 0 {
+				return nil, fmt.Errorf("invalid weight of backend %s", s)
+			}
+			backend = Backend{Addr: addr, Weight: w}
+		}
+		if _, _, err := net.SplitHostPort(backend.Addr); err != nil {
+			return nil, fmt.Errorf("invalid backend, %s", err)
+		}
+		backends = append(backends, backend)
+	}
+	return backends, nil
+}
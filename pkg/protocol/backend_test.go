@@ -0,0 +1,43 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseBackends(t *testing.T) {
+	for _, tc := range []struct {
+		raddr    string
+		backends bool
+		want     []Backend
+		err      bool
+	}{
+		{raddr: "db:5432", want: []Backend{{"db:5432", 1}}},
+		{raddr: "a:80,b:80", backends: true, want: []Backend{{"a:80", 1}, {"b:80", 1}}},
+		{raddr: "a:80=95,b:80=5", backends: true, want: []Backend{{"a:80", 95}, {"b:80", 5}}},
+		{raddr: "a:80=3", backends: true, want: []Backend{{"a:80", 3}}},
+		{raddr: "[::1]:80=2,b:80", backends: true, want: []Backend{{"[::1]:80", 2}, {"b:80", 1}}},
+		{raddr: "a:80=0", backends: true, err: true},
+		{raddr: "a:80=-1", backends: true, err: true},
+		{raddr: "a:80=x", backends: true, err: true},
+		{raddr: "a:80,b", backends: true, err: true},
+		{raddr: "a:80,", backends: true, err: true},
+		{raddr: "unix:///run/db.sock", want: nil},
+		{raddr: "exec:cat a,b=c", want: nil},
+	} {
+		if got := IsBackends(tc.raddr); got != tc.backends {
+			t.Errorf("IsBackends(%q) = %v, want %v", tc.raddr, got, tc.backends)
+		}
+		if !tc.backends && tc.want == nil {
+			continue
+		}
+		got, err := ParseBackends(tc.raddr)
+		if (err != nil) != tc.err {
+			t.Errorf("ParseBackends(%q) error %v", tc.raddr, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ParseBackends(%q) = %v, want %v", tc.raddr, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package protocol
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// ban metrics
+var (
+	bansTotal   = NewCounter("bans_total")
+	bansActive  = NewGauge("bans_active")
+	bansRefused = NewCounter("bans_refused")
+)
+
+// Bans bans for Duration the source IPs whose connections to the channel
+// failed the handshake or the auth Threshold times within Window, a nil Bans
+// bans none
+type Bans struct {
+	Threshold int
+	Window    time.Duration
+	Duration  time.Duration
+
+	lock sync.Mutex
+	// failures are counted since the first of the window
+	failures map[string]*banFailures
+	// banned is until when the IPs are banned
+	banned map[string]time.Time
+	pruned time.Time
+}
+
+type banFailures struct {
+	n     int
+	first time.Time
+}
+
+func banIP(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// Banned tells whether the IP of addr is banned, its connections are to be
+// closed at once
+func (b *Bans) Banned(addr net.Addr) bool {
+	if b == nil || b.Threshold <= 0 {
+		return false
+	}
+	ip := banIP(addr)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	until, ok := b.banned[ip]
+	if !ok {
+		return false
+	}
+	if !time.Now().Before(until) {
+		b.unbanLocked(ip)
+		return false
+	}
+	bansRefused.Add(1)
+	return true
+}
+
+// Fail records a failed handshake or auth from addr and bans its IP once it
+// failed Threshold times within Window
+func (b *Bans) Fail(addr net.Addr) {
+	if b == nil || b.Threshold <= 0 {
+		return
+	}
+	ip := banIP(addr)
+	now := time.Now()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.pruneLocked(now)
+	if until, ok := b.banned[ip]; ok && now.Before(until) {
+		return
+	}
+	if b.failures == nil {
+		b.failures = map[string]*banFailures{}
+		b.banned = map[string]time.Time{}
+	}
+	f := b.failures[ip]
+	if f == nil || now.Sub(f.first) > b.Window {
+		f = &banFailures{first: now}
+		b.failures[ip] = f
+	}
+	if f.n++; f.n < b.Threshold {
+		return
+	}
+	delete(b.failures, ip)
+	if _, ok := b.banned[ip]; !ok {
+		bansActive.Add(1)
+	}
+	b.banned[ip] = now.Add(b.Duration)
+	bansTotal.Add(1)
+	log.Printf("Ban %s for %s after %d failures\n", ip, b.Duration, b.Threshold)
+}
+
+// Succeed forgets the failures of the IP of addr once it passed the auth
+func (b *Bans) Succeed(addr net.Addr) {
+	if b == nil || b.Threshold <= 0 {
+		return
+	}
+	ip := banIP(addr)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.failures, ip)
+}
+
+func (b *Bans) unbanLocked(ip string) {
+	delete(b.banned, ip)
+	bansActive.Add(-1)
+	log.Printf("Unban %s\n", ip)
+}
+
+// pruneLocked forgets the failures past the window and the bans over, once
+// a window
+func (b *Bans) pruneLocked(now time.Time) {
+	if now.Sub(b.pruned) < b.Window {
+		return
+	}
+	b.pruned = now
+	for ip, f := range b.failures {
+		if now.Sub(f.first) > b.Window {
+			delete(b.failures, ip)
+		}
+	}
+	for ip, until := range b.banned {
+		if !now.Before(until) {
+			b.unbanLocked(ip)
+		}
+	}
+}
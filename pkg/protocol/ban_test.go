@@ -0,0 +1,108 @@
+package protocol
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// ageBans moves the failures and the ban of ip back by d, as if d passed
+func ageBans(b *Bans, ip string, d time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if f := b.failures[ip]; f != nil {
+		f.first = f.first.Add(-d)
+	}
+	if until, ok := b.banned[ip]; ok {
+		b.banned[ip] = until.Add(-d)
+	}
+	b.pruned = b.pruned.Add(-d)
+}
+
+func TestBansThreshold(t *testing.T) {
+	b := &Bans{Threshold: 3, Window: time.Minute, Duration: time.Hour}
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}
+	other := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1000}
+	b.Fail(addr)
+	b.Fail(addr)
+	if b.Banned(addr) {
+		t.Fatal("banned below the threshold")
+	}
+	// the ports of an IP count together
+	b.Fail(&net.TCPAddr{IP: addr.IP, Port: 2000})
+	if !b.Banned(addr) {
+		t.Fatal("not banned at the threshold")
+	}
+	if b.Banned(other) {
+		t.Fatal("another IP banned")
+	}
+}
+
+func TestBansWindow(t *testing.T) {
+	b := &Bans{Threshold: 3, Window: time.Minute, Duration: time.Hour}
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}
+	b.Fail(addr)
+	b.Fail(addr)
+	// the failures past the window start another
+	ageBans(b, "192.0.2.1", 2*time.Minute)
+	b.Fail(addr)
+	b.Fail(addr)
+	if b.Banned(addr) {
+		t.Fatal("banned for failures over two windows")
+	}
+	b.Fail(addr)
+	if !b.Banned(addr) {
+		t.Fatal("not banned at the threshold within the window")
+	}
+}
+
+func TestBansExpire(t *testing.T) {
+	b := &Bans{Threshold: 1, Window: time.Minute, Duration: time.Hour}
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}
+	b.Fail(addr)
+	ageBans(b, "192.0.2.1", 59*time.Minute)
+	if !b.Banned(addr) {
+		t.Fatal("ban over before its duration")
+	}
+	ageBans(b, "192.0.2.1", time.Minute)
+	if b.Banned(addr) {
+		t.Fatal("ban not over after its duration")
+	}
+	// banned again from scratch
+	b.Fail(addr)
+	if !b.Banned(addr) {
+		t.Fatal("not banned again")
+	}
+}
+
+func TestBansSucceed(t *testing.T) {
+	b := &Bans{Threshold: 3, Window: time.Minute, Duration: time.Hour}
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}
+	b.Fail(addr)
+	b.Fail(addr)
+	b.Succeed(addr)
+	b.Fail(addr)
+	b.Fail(addr)
+	if b.Banned(addr) {
+		t.Fatal("failures before a success counted")
+	}
+	b.Fail(addr)
+	if !b.Banned(addr) {
+		t.Fatal("not banned at the threshold after a success")
+	}
+}
+
+func TestBansNil(t *testing.T) {
+	var b *Bans
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}
+	b.Fail(addr)
+	b.Succeed(addr)
+	if b.Banned(addr) {
+		t.Fatal("a nil Bans banned")
+	}
+	off := &Bans{Window: time.Minute, Duration: time.Hour}
+	off.Fail(addr)
+	if off.Banned(addr) {
+		t.Fatal("banned without a threshold")
+	}
+}
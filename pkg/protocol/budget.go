@@ -0,0 +1,36 @@
+package protocol
+
+import (
+	"context"
+	"time"
+)
+
+// BudgetOption is the option of the dial requests telling the time the
+// caller has left for the dial, the proxy gives up its dial of the remote
+// once it passed rather than connecting a backend nobody waits for. It is a
+// duration rather than a deadline so the clocks of both ends need not agree
+const BudgetOption = "budget"
+
+// DialBudget is the budget option of the deadline of ctx, ok is false
+// without a deadline
+func DialBudget(ctx context.Context) (string, bool) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return "", false
+	}
+	left := time.Until(deadline).Round(time.Millisecond)
+	if left < time.Millisecond {
+		left = time.Millisecond
+	}
+	return left.String(), true
+}
+
+// BudgetContext is ctx bounded by the budget option of a dial request, ctx
+// itself when the request has none or an invalid one
+func BudgetContext(ctx context.Context, opts map[string]string) (context.Context, context.CancelFunc) {
+	budget, err := time.ParseDuration(opts[BudgetOption])
+	if err != nil || budget <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, budget)
+}
@@ -0,0 +1,168 @@
+package protocol
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dworld/channel/pkg/transport"
+)
+
+// Capabilities is what a binary is built with, exchanged on the control
+// connection so mismatches can be told from the status, with the public
+// address STUN found for it
+type Capabilities struct {
+	Transports []string `json:"transports"`
+	Codecs     []string `json:"codecs"`
+	Obfs       []string `json:"obfs"`
+	Features   []string `json:"features"`
+	Frames     []string `json:"frames"`
+	Version    string   `json:"version,omitempty"`
+	Public     string   `json:"public,omitempty"`
+	NAT        string   `json:"nat,omitempty"`
+}
+
+var (
+	natLock sync.Mutex
+	nat     transport.NATInfo
+)
+
+// SetNAT records the public address of the node told in the capabilities
+func SetNAT(info transport.NATInfo) {
+	natLock.Lock()
+	defer natLock.Unlock()
+	nat = info
+}
+
+// LocalCapabilities is what this binary is built with
+func LocalCapabilities() Capabilities {
+	caps := Capabilities{
+		Transports: transport.Names(),
+		Codecs:     CodecNames(),
+		Obfs:       transport.ObfuscatorNames(),
+		Features:   []string{"mux", "noise", "psk", "pool", "frames", "listen", "cancel", "reset", "halfclose", "window", "udp", "tls"},
+		Version:    BuildInfo().Version,
+	}
+	for _, typ := range FrameTypes() {
+		caps.Frames = append(caps.Frames, fmt.Sprintf("%#x", typ))
+	}
+	natLock.Lock()
+	caps.Public, caps.NAT = nat.Public, nat.NAT
+	natLock.Unlock()
+	return caps
+}
+
+// Has tells whether feature is among the features
+func (caps *Capabilities) Has(feature string) bool {
+	for _, f := range caps.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckVersion logs the version of peer when it's of another release than
+// this binary, the first thing to look at when the two disagree
+func CheckVersion(name string, peer *Capabilities) {
+	local := BuildInfo().Version
+	if peer == nil || peer.Version == local {
+		return
+	}
+	peerVersion := peer.Version
+	if peerVersion == "" {
+		peerVersion = "unknown, older than the versions told"
+	}
+	log.Printf("%s version %s, this is %s\n", name, peerVersion, local)
+}
+
+// Options encodes the capabilities as protocol line options
+func (caps Capabilities) Options() map[string]string {
+	return map[string]string{
+		"transports": strings.Join(caps.Transports, ","),
+		"codecs":     strings.Join(caps.Codecs, ","),
+		"obfs":       strings.Join(caps.Obfs, ","),
+		"features":   strings.Join(caps.Features, ","),
+		"frames":     strings.Join(caps.Frames, ","),
+		"version":    caps.Version,
+		"public":     caps.Public,
+		"nat":        caps.NAT,
+	}
+}
+
+// ParseCapabilities decodes the capabilities from protocol line options
+func ParseCapabilities(opts map[string]string) *Capabilities {
+	split := func(s string) []string {
+		if s == "" {
+			return nil
+		}
+		return strings.Split(s, ",")
+	}
+	return &Capabilities{
+		Transports: split(opts["transports"]),
+		Codecs:     split(opts["codecs"]),
+		Obfs:       split(opts["obfs"]),
+		Features:   split(opts["features"]),
+		Frames:     split(opts["frames"]),
+		Version:    opts["version"],
+		Public:     opts["public"],
+		NAT:        opts["nat"],
+	}
+}
+
+// ControlInfo describes the control connection, Addr is empty when there's
+// none
+type ControlInfo struct {
+	Addr  string
+	Since time.Time
+	Peer  *Capabilities
+}
+
+// ControlState tracks the control connection for the status
+type ControlState struct {
+	lock  sync.Mutex
+	conn  net.Conn
+	since time.Time
+	peer  *Capabilities
+}
+
+// Set records conn as the control connection
+func (state *ControlState) Set(conn net.Conn, peer *Capabilities) {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	state.conn = conn
+	state.since = time.Now()
+	state.peer = peer
+}
+
+// SetPeer records the capabilities the peer of conn told
+func (state *ControlState) SetPeer(conn net.Conn, peer *Capabilities) {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if state.conn == conn {
+		state.peer = peer
+	}
+}
+
+// Clear forgets conn unless another control connection replaced it
+func (state *ControlState) Clear(conn net.Conn) {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if state.conn == conn {
+		state.conn = nil
+		state.peer = nil
+	}
+}
+
+// Info describes the current control connection
+func (state *ControlState) Info() ControlInfo {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if state.conn == nil {
+		return ControlInfo{}
+	}
+	return ControlInfo{Addr: state.conn.RemoteAddr().String(), Since: state.since, Peer: state.peer}
+}
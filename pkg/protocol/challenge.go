@@ -0,0 +1,116 @@
+package protocol
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ChallengeOption of a hello or a conn id line asks the channel for a nonce,
+// the token isn't sent but the HMAC of the nonce and a timestamp keyed with
+// it, so a handshake captured can't be replayed
+const ChallengeOption = "challenge"
+
+// DefaultSkew is how far the timestamps of the answers may be off the clock
+// of the channel when the TokenAuth sets none
+const DefaultSkew = 30 * time.Second
+
+// the options of the answer Challenge sets for the TokenAuth
+const (
+	nonceOption = "nonce"
+	tsOption    = "ts"
+	macOption   = "mac"
+)
+
+var (
+	errNoChallenge = errors.New("no answer to a challenge")
+	errBadAnswer   = errors.New("invalid answer to the challenge")
+)
+
+// Challenge challenges the connection whose first line asked it in opts, it
+// writes a nonce, reads the answer with r and sets the nonce, the timestamp
+// and the mac in opts for the TokenAuth. They're removed off the opts of a
+// line which didn't ask, the opts must go through it before they're
+// validated
+func Challenge(conn net.Conn, r *bufio.Reader, opts map[string]string, timeout time.Duration) error {
+	delete(opts, nonceOption)
+	delete(opts, tsOption)
+	delete(opts, macOption)
+	if _, ok := opts[ChallengeOption]; !ok {
+		return nil
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	nonce := hex.EncodeToString(b)
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := io.WriteString(conn, FormatLine("nonce", map[string]string{"n": nonce})); err != nil {
+		return err
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	head, answer := ParseLine(line)
+	if head != "auth" {
+		return errBadAnswer
+	}
+	opts[nonceOption], opts[tsOption], opts[macOption] = nonce, answer[tsOption], answer[macOption]
+	return nil
+}
+
+// AnswerChallenge reads the nonce the channel replies to a line which asked
+// a challenge with r and answers it with the HMAC keyed with token
+func AnswerChallenge(conn net.Conn, r *bufio.Reader, token string, timeout time.Duration) error {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	line, err := r.ReadString('\n')
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return fmt.Errorf("read nonce: %w", err)
+	}
+	head, opts := ParseLine(line)
+	if head != "nonce" || opts["n"] == "" {
+		return fmt.Errorf("no challenge, %s", strings.TrimSpace(line))
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	_, err = io.WriteString(conn, FormatLine("auth", map[string]string{tsOption: ts, macOption: challengeMAC(token, opts["n"], ts)}))
+	return err
+}
+
+func challengeMAC(token, nonce, ts string) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	io.WriteString(mac, nonce+" "+ts)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validateAnswer checks the answer Challenge set in opts
+func (a TokenAuth) validateAnswer(opts map[string]string) error {
+	sec, err := strconv.ParseInt(opts[tsOption], 10, 64)
+	if err != nil {
+		return errBadAnswer
+	}
+	skew := a.Skew
+	if skew <= 0 {
+		skew = DefaultSkew
+	}
+	if d := time.Since(time.Unix(sec, 0)); d > skew || d < -skew {
+		return fmt.Errorf("answer %s off the clock, past the skew of %s", d.Round(time.Second), skew)
+	}
+	want := challengeMAC(a.Token, opts[nonceOption], opts[tsOption])
+	if subtle.ConstantTimeCompare([]byte(opts[macOption]), []byte(want)) != 1 {
+		return errBadToken
+	}
+	return nil
+}
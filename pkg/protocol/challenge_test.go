@@ -0,0 +1,110 @@
+package protocol
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// challenged runs a challenge of the channel answered with answer, and
+// returns the opts the channel would validate
+func challenged(t *testing.T, answer func(conn net.Conn, r *bufio.Reader) error) map[string]string {
+	t.Helper()
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	errs := make(chan error, 1)
+	go func() { errs <- answer(peer, bufio.NewReader(peer)) }()
+	opts := map[string]string{ChallengeOption: "1"}
+	if err := Challenge(conn, bufio.NewReader(conn), opts, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	return opts
+}
+
+func TestChallenge(t *testing.T) {
+	opts := challenged(t, func(conn net.Conn, r *bufio.Reader) error {
+		return AnswerChallenge(conn, r, "secret", time.Second)
+	})
+	if opts[nonceOption] == "" || opts[tsOption] == "" {
+		t.Fatalf("opts %v, want the nonce and the timestamp", opts)
+	}
+	if want := challengeMAC("secret", opts[nonceOption], opts[tsOption]); opts[macOption] != want {
+		t.Fatalf("mac %s, want the HMAC of the nonce and the timestamp %s", opts[macOption], want)
+	}
+	if err := (TokenAuth{Token: "secret"}).ValidateControl(nil, opts); err != nil {
+		t.Fatalf("answer refused: %s", err)
+	}
+	if err := (TokenAuth{Token: "other"}).ValidateControl(nil, opts); !errors.Is(err, errBadToken) {
+		t.Fatalf("answer of another token accepted, err %v", err)
+	}
+}
+
+func TestChallengeNotAsked(t *testing.T) {
+	// a line which didn't ask can't bring its own answer
+	opts := map[string]string{nonceOption: "n", tsOption: "1", macOption: "m"}
+	if err := Challenge(nil, nil, opts, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if len(opts) != 0 {
+		t.Fatalf("opts %v, want the answer removed", opts)
+	}
+	if err := (TokenAuth{Token: "secret"}).ValidateControl(nil, opts); !errors.Is(err, errNoChallenge) {
+		t.Fatalf("err %v, want %v", err, errNoChallenge)
+	}
+}
+
+func TestChallengeReplay(t *testing.T) {
+	captured := challenged(t, func(conn net.Conn, r *bufio.Reader) error {
+		return AnswerChallenge(conn, r, "secret", time.Second)
+	})
+	// the answer captured sent again to the next challenge, of another nonce
+	opts := challenged(t, func(conn net.Conn, r *bufio.Reader) error {
+		if _, err := r.ReadString('\n'); err != nil {
+			return err
+		}
+		_, err := io.WriteString(conn, FormatLine("auth", map[string]string{tsOption: captured[tsOption], macOption: captured[macOption]}))
+		return err
+	})
+	if opts[nonceOption] == captured[nonceOption] {
+		t.Fatal("nonce reused")
+	}
+	if err := (TokenAuth{Token: "secret"}).ValidateControl(nil, opts); !errors.Is(err, errBadToken) {
+		t.Fatalf("replayed answer accepted, err %v", err)
+	}
+}
+
+func TestChallengeSkew(t *testing.T) {
+	auth := TokenAuth{Token: "secret", Skew: 30 * time.Second}
+	for _, tc := range []struct {
+		name string
+		// off is the seconds the timestamp is ahead of the clock
+		off int64
+		ok  bool
+	}{
+		{"on time", 0, true},
+		{"inside behind", -29, true},
+		{"inside ahead", 29, true},
+		{"outside behind", -31, false},
+		{"outside ahead", 31, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := strconv.FormatInt(time.Now().Unix()+tc.off, 10)
+			opts := map[string]string{nonceOption: "n", tsOption: ts, macOption: challengeMAC("secret", "n", ts)}
+			if err := auth.ValidateControl(nil, opts); (err == nil) != tc.ok {
+				t.Errorf("err %v, want ok %v", err, tc.ok)
+			}
+		})
+	}
+	opts := map[string]string{nonceOption: "n", tsOption: "now", macOption: challengeMAC("secret", "n", "now")}
+	if err := auth.ValidateControl(nil, opts); !errors.Is(err, errBadAnswer) {
+		t.Fatalf("err %v, want %v", err, errBadAnswer)
+	}
+}
@@ -0,0 +1,98 @@
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// coalesceConn buffers small writes and sends them together once the delay
+// elapses or the buffer is full, so chatty protocols cost one frame per batch
+// rather than per message
+type coalesceConn struct {
+	net.Conn
+	delay time.Duration
+
+	lock  sync.Mutex
+	buf   []byte
+	timer *time.Timer
+	armed bool
+	err   error
+}
+
+func newCoalesceConn(conn net.Conn, delay time.Duration, size int) *coalesceConn {
+	return &coalesceConn{Conn: conn, delay: delay, buf: make([]byte, 0, size)}
+}
+
+// String keeps logs showing the underlying connection
+func (c *coalesceConn) String() string {
+	return fmt.Sprint(c.Conn)
+}
+
+// NetConn is the wrapped connection
+func (c *coalesceConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *coalesceConn) Write(p []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+	if len(c.buf)+len(p) > cap(c.buf) {
+		if err := c.flushLocked(); err != nil {
+			return 0, err
+		}
+		if len(p) >= cap(c.buf) {
+			return c.Conn.Write(p)
+		}
+	}
+	c.buf = append(c.buf, p...)
+	if !c.armed {
+		c.armed = true
+		if c.timer == nil {
+			c.timer = time.AfterFunc(c.delay, c.flush)
+		} else {
+			c.timer.Reset(c.delay)
+		}
+	}
+	return len(p), nil
+}
+
+// CloseWrite sends the writes buffered before the connection is half closed
+func (c *coalesceConn) CloseWrite() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.flushLocked(); err != nil {
+		return err
+	}
+	return CloseWrite(c.Conn)
+}
+
+func (c *coalesceConn) flush() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.flushLocked()
+}
+
+func (c *coalesceConn) flushLocked() error {
+	c.armed = false
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	if len(c.buf) == 0 || c.err != nil {
+		return c.err
+	}
+	_, c.err = c.Conn.Write(c.buf)
+	c.buf = c.buf[:0]
+	return c.err
+}
+
+func (c *coalesceConn) Close() error {
+	c.lock.Lock()
+	c.flushLocked()
+	c.lock.Unlock()
+	return c.Conn.Close()
+}
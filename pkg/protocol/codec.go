@@ -0,0 +1,336 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Codec compresses stream payloads block by block, each block is coded alone
+type Codec interface {
+	// Name identifies the codec in the negotiation
+	Name() string
+	// Encode appends the encoded src to dst
+	Encode(dst, src []byte) ([]byte, error)
+	// Decode appends the decoded src to dst, at most limit bytes are decoded
+	Decode(dst, src []byte, limit int) ([]byte, error)
+}
+
+var (
+	codecsLock sync.RWMutex
+	codecs     = map[string]Codec{}
+)
+
+func init() {
+	RegisterCodec(flateCodec{})
+}
+
+// RegisterCodec makes a codec selectable by its name, it replaces any codec
+// registered with the same name
+func RegisterCodec(codec Codec) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+	codecs[codec.Name()] = codec
+}
+
+// GetCodec returns the codec registered with name, nil if none
+func GetCodec(name string) Codec {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	return codecs[name]
+}
+
+// CodecNames lists the registered codecs
+func CodecNames() []string {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	var names []string
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseCodecs checks a comma separated codec list
+func ParseCodecs(list string) ([]string, error) {
+	if list == "" {
+		return nil, nil
+	}
+	names := strings.Split(list, ",")
+	for _, name := range names {
+		if GetCodec(name) == nil {
+			return nil, fmt.Errorf("unknown codec, %s", name)
+		}
+	}
+	return names, nil
+}
+
+// SelectCodec returns the first offered codec we also accept
+func SelectCodec(offered string, accepted []string) string {
+	if offered == "" {
+		return ""
+	}
+	for _, name := range strings.Split(offered, ",") {
+		for _, accept := range accepted {
+			if name == accept {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// incompressible sniffs payloads which are encrypted or compressed already
+func incompressible(b []byte) bool {
+	signatures := [][]byte{
+		{0x16, 0x03},             // TLS handshake
+		{0x17, 0x03},             // TLS application data
+		{0x1f, 0x8b},             // gzip
+		{'P', 'K', 0x03, 0x04},   // zip
+		{0x28, 0xb5, 0x2f, 0xfd}, // zstd
+		{0xfd, '7', 'z', 'X', 'Z', 0x00},
+		{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c},
+		{'B', 'Z', 'h'},
+		{0x89, 'P', 'N', 'G'},
+		{0xff, 0xd8, 0xff}, // jpeg
+		[]byte("SSH-"),
+	}
+	for _, sig := range signatures {
+		if bytes.HasPrefix(b, sig) {
+			return true
+		}
+	}
+	return false
+}
+
+// frame flags of the compressed stream
+const (
+	frameRaw     = 0
+	frameEncoded = 1
+)
+
+const (
+	frameHeaderSize = 5
+	// maxFrameSize bounds a frame before and after decoding
+	maxFrameSize = 1 << 20
+)
+
+// the writer judges the ratio every adaptiveWindow bytes, when encoding saves
+// less than 1-adaptiveRatio it sends adaptiveBypass bytes raw before probing
+// again
+const (
+	adaptiveWindow = 256 << 10
+	adaptiveRatio  = 0.9
+	adaptiveBypass = 4 << 20
+)
+
+var errFrameTooLarge = errors.New("frame too large")
+
+// codecConn frames the stream of a data connection, each frame being raw or
+// encoded by the codec. The writer bypasses the codec when its first payload
+// looks incompressible or when encoding doesn't pay off.
+type codecConn struct {
+	net.Conn
+	codec Codec
+
+	reader  *bufio.Reader
+	payload []byte
+	decoded []byte
+	pending []byte
+
+	writeLock  sync.Mutex
+	sniffed    bool
+	bypassLeft int
+	sampleIn   int
+	sampleOut  int
+	frame      []byte
+}
+
+func newCodecConn(conn net.Conn, codec Codec) *codecConn {
+	return &codecConn{Conn: conn, codec: codec, reader: bufio.NewReader(conn)}
+}
+
+// String keeps logs showing the underlying connection
+func (c *codecConn) String() string {
+	return fmt.Sprint(c.Conn)
+}
+
+// NetConn is the wrapped connection
+func (c *codecConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *codecConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if err := c.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *codecConn) readFrame() error {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxFrameSize {
+		return errFrameTooLarge
+	}
+	if cap(c.payload) < int(size) {
+		c.payload = make([]byte, size)
+	}
+	c.payload = c.payload[:size]
+	if _, err := io.ReadFull(c.reader, c.payload); err != nil {
+		return err
+	}
+	switch header[0] {
+	case frameRaw:
+		c.pending = c.payload
+	case frameEncoded:
+		decoded, err := c.codec.Decode(c.decoded[:0], c.payload, maxFrameSize)
+		if err != nil {
+			return err
+		}
+		c.decoded = decoded
+		c.pending = decoded
+	default:
+		return fmt.Errorf("invalid frame flag, %d", header[0])
+	}
+	return nil
+}
+
+func (c *codecConn) Write(p []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if !c.sniffed {
+		c.sniffed = true
+		if incompressible(p) {
+			c.bypassLeft = adaptiveBypass
+		}
+	}
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxFrameSize {
+			chunk = chunk[:maxFrameSize]
+		}
+		if err := c.writeFrame(chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+func (c *codecConn) writeFrame(chunk []byte) error {
+	frame := append(c.frame[:0], make([]byte, frameHeaderSize)...)
+	flag := byte(frameRaw)
+	if c.bypassLeft > 0 {
+		c.bypassLeft -= len(chunk)
+	} else {
+		encoded, err := c.codec.Encode(frame, chunk)
+		if err != nil {
+			return err
+		}
+		if len(encoded)-frameHeaderSize < len(chunk) {
+			frame = encoded
+			flag = frameEncoded
+		}
+		c.sample(len(chunk), len(encoded)-frameHeaderSize)
+	}
+	if flag == frameRaw {
+		frame = append(frame[:frameHeaderSize], chunk...)
+	}
+	frame[0] = flag
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(frame)-frameHeaderSize))
+	c.frame = frame
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// sample accounts a chunk sent through the codec, out is what went on the
+// wire, and starts bypassing the codec when the ratio is poor
+func (c *codecConn) sample(in, out int) {
+	if out > in {
+		out = in
+	}
+	c.sampleIn += in
+	c.sampleOut += out
+	if c.sampleIn < adaptiveWindow {
+		return
+	}
+	if float64(c.sampleOut) >= adaptiveRatio*float64(c.sampleIn) {
+		log.Printf("bypass %s, ratio %.2f\n", c.codec.Name(), float64(c.sampleOut)/float64(c.sampleIn))
+		c.bypassLeft = adaptiveBypass
+	}
+	c.sampleIn = 0
+	c.sampleOut = 0
+}
+
+// flateCodec is DEFLATE, writers and readers are pooled as they are costly
+type flateCodec struct{}
+
+var (
+	flateWriters sync.Pool
+	flateReaders sync.Pool
+)
+
+func (flateCodec) Name() string {
+	return "flate"
+}
+
+func (flateCodec) Encode(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	w, _ := flateWriters.Get().(*flate.Writer)
+	if w == nil {
+		var err error
+		w, err = flate.NewWriter(buf, flate.BestSpeed)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		w.Reset(buf)
+	}
+	defer flateWriters.Put(w)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateCodec) Decode(dst, src []byte, limit int) ([]byte, error) {
+	r, _ := flateReaders.Get().(io.ReadCloser)
+	if r == nil {
+		r = flate.NewReader(bytes.NewReader(src))
+	} else if err := r.(flate.Resetter).Reset(bytes.NewReader(src), nil); err != nil {
+		return nil, err
+	}
+	defer flateReaders.Put(r)
+	buf := bytes.NewBuffer(dst)
+	n, err := buf.ReadFrom(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > int64(limit) {
+		return nil, errFrameTooLarge
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,37 @@
+//go:build snappy
+// +build snappy
+
+package protocol
+
+import "github.com/golang/snappy"
+
+func init() {
+	RegisterCodec(snappyCodec{})
+}
+
+// snappyCodec is the snappy block format, fast with a modest ratio
+type snappyCodec struct{}
+
+func (snappyCodec) Name() string {
+	return "snappy"
+}
+
+func (snappyCodec) Encode(dst, src []byte) ([]byte, error) {
+	encoded := snappy.Encode(nil, src)
+	return append(dst, encoded...), nil
+}
+
+func (snappyCodec) Decode(dst, src []byte, limit int) ([]byte, error) {
+	n, err := snappy.DecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	if n > limit {
+		return nil, errFrameTooLarge
+	}
+	decoded, err := snappy.Decode(nil, src)
+	if err != nil {
+		return nil, err
+	}
+	return append(dst, decoded...), nil
+}
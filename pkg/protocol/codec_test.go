@@ -0,0 +1,131 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"testing"
+)
+
+// frameConn records each frame written and reads what it's given
+type frameConn struct {
+	net.Conn
+	in     io.Reader
+	frames [][]byte
+}
+
+func (c *frameConn) Read(p []byte) (int, error) { return c.in.Read(p) }
+
+func (c *frameConn) Write(p []byte) (int, error) {
+	c.frames = append(c.frames, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func compressible(n int) []byte {
+	return bytes.Repeat([]byte("channel "), n/8)
+}
+
+func random(n int) []byte {
+	b := make([]byte, n)
+	rand.NewChaCha8([32]byte{}).Read(b)
+	return b
+}
+
+func tlsRecord(n int) []byte {
+	return append([]byte{0x16, 0x03, 0x01}, make([]byte, n-3)...)
+}
+
+func TestCodecBypass(t *testing.T) {
+	const (
+		raw     = frameRaw
+		encoded = frameEncoded
+	)
+	for _, tc := range []struct {
+		name   string
+		writes [][]byte
+		flags  []byte
+	}{
+		{"compressible", [][]byte{compressible(4096), compressible(4096)}, []byte{encoded, encoded}},
+		{"random", [][]byte{random(4096)}, []byte{raw}},
+		{"sniffed", [][]byte{tlsRecord(4096), compressible(4096)}, []byte{raw, raw}},
+		{"sniffed first write only", [][]byte{compressible(4096), tlsRecord(4096)}, []byte{encoded, encoded}},
+		{
+			"bypass ends",
+			[][]byte{tlsRecord(adaptiveBypass), compressible(4096)},
+			[]byte{raw, raw, raw, raw, encoded},
+		},
+		{
+			"poor ratio",
+			[][]byte{random(adaptiveWindow), compressible(4096)},
+			[]byte{raw, raw},
+		},
+		{
+			"good ratio",
+			[][]byte{compressible(adaptiveWindow), compressible(4096)},
+			[]byte{encoded, encoded},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conn := &frameConn{}
+			c := newCodecConn(conn, flateCodec{})
+			for _, b := range tc.writes {
+				if _, err := c.Write(b); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var flags []byte
+			for _, frame := range conn.frames {
+				flags = append(flags, frame[0])
+			}
+			if !bytes.Equal(flags, tc.flags) {
+				t.Errorf("frame flags %v, want %v", flags, tc.flags)
+			}
+			r := newCodecConn(&frameConn{in: bytes.NewReader(bytes.Join(conn.frames, nil))}, flateCodec{})
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := bytes.Join(tc.writes, nil); !bytes.Equal(got, want) {
+				t.Errorf("read %d bytes, want %d", len(got), len(want))
+			}
+		})
+	}
+}
+
+func TestCodecRejects(t *testing.T) {
+	frame := func(flag byte, size uint32, payload []byte) []byte {
+		header := make([]byte, frameHeaderSize)
+		header[0] = flag
+		binary.BigEndian.PutUint32(header[1:], size)
+		return append(header, payload...)
+	}
+	encoded, err := flateCodec{}.Encode(nil, make([]byte, maxFrameSize+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name  string
+		input []byte
+		err   error
+	}{
+		{"truncated header", []byte{frameRaw, 0, 0}, io.ErrUnexpectedEOF},
+		{"truncated payload", frame(frameRaw, 8, []byte("abc")), io.ErrUnexpectedEOF},
+		{"frame too large", frame(frameRaw, maxFrameSize+1, nil), errFrameTooLarge},
+		{"decoded too large", frame(frameEncoded, uint32(len(encoded)), encoded), errFrameTooLarge},
+		{"invalid flag", frame(7, 3, []byte("abc")), nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newCodecConn(&frameConn{in: bytes.NewReader(tc.input)}, flateCodec{})
+			_, err := c.Read(make([]byte, 64))
+			if err == nil {
+				t.Fatal("read passed")
+			}
+			if tc.err != nil && !errors.Is(err, tc.err) {
+				t.Errorf("read error %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+//go:build zstd
+// +build zstd
+
+package protocol
+
+import "github.com/klauspost/compress/zstd"
+
+// the encoder and decoder are safe for concurrent EncodeAll and DecodeAll
+var (
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+func init() {
+	var err error
+	zstdEncoder, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	if err != nil {
+		panic(err)
+	}
+	zstdDecoder, err = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxFrameSize))
+	if err != nil {
+		panic(err)
+	}
+	RegisterCodec(zstdCodec{})
+}
+
+// zstdCodec is zstandard at its fastest level
+type zstdCodec struct{}
+
+func (zstdCodec) Name() string {
+	return "zstd"
+}
+
+func (zstdCodec) Encode(dst, src []byte) ([]byte, error) {
+	return zstdEncoder.EncodeAll(src, dst), nil
+}
+
+func (zstdCodec) Decode(dst, src []byte, limit int) ([]byte, error) {
+	start := len(dst)
+	decoded, err := zstdDecoder.DecodeAll(src, dst)
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded)-start > limit {
+		return nil, errFrameTooLarge
+	}
+	return decoded, nil
+}
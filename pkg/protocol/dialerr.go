@@ -0,0 +1,83 @@
+package protocol
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// hops of a stream, from the client to the remote, a dial error tells which
+// one failed
+const (
+	HopChannel  = "channel"
+	HopUpstream = "upstream"
+	HopRemote   = "remote"
+	// HopPolicy is the hooks of the client or proxy refusing the stream
+	HopPolicy = "policy"
+)
+
+// kinds of the dial errors
+const (
+	KindFailed      = "failed"
+	KindRefused     = "refused"
+	KindTimeout     = "timeout"
+	KindUnreachable = "unreachable"
+	KindHost        = "host"
+	KindDenied      = "denied"
+)
+
+// DialError is a failed dial of a stream, the proxy tells the hop and kind
+// in its err replies so they can be mapped to the errors of SOCKS and HTTP
+type DialError struct {
+	Hop  string
+	Kind string
+	Msg  string
+}
+
+func (e *DialError) Error() string {
+	return e.Msg
+}
+
+// NewDialError classifies err of hop, the hop and kind of a DialError in err
+// are kept
+func NewDialError(hop string, err error) *DialError {
+	var de *DialError
+	if errors.As(err, &de) {
+		return &DialError{Hop: de.Hop, Kind: de.Kind, Msg: err.Error()}
+	}
+	return &DialError{Hop: hop, Kind: errorKind(err), Msg: err.Error()}
+}
+
+func errorKind(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr):
+		return KindHost
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return KindRefused
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return KindUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return KindTimeout
+	}
+	return KindFailed
+}
+
+// Options are the options of the err reply
+func (e *DialError) Options() map[string]string {
+	return map[string]string{"hop": e.Hop, "kind": e.Kind, "msg": e.Msg}
+}
+
+// ParseDialError is the error of an err reply, the replies of older proxies
+// have no hop nor kind
+func ParseDialError(opts map[string]string) *DialError {
+	e := &DialError{Hop: opts["hop"], Kind: opts["kind"], Msg: opts["msg"]}
+	if e.Hop == "" {
+		e.Hop = HopRemote
+	}
+	if e.Kind == "" {
+		e.Kind = KindFailed
+	}
+	return e
+}
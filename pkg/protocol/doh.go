@@ -0,0 +1,139 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// dohMessage is the media type of the DNS messages of RFC 8484
+const dohMessage = "application/dns-message"
+
+// maxDNSMessage caps the answers of a DNS over HTTPS server
+const maxDNSMessage = 65535
+
+// dohConn carries the DNS messages the go DNS client frames as on TCP, each
+// query written is POSTed to url and its answer read back
+type dohConn struct {
+	ctx    context.Context
+	client *http.Client
+	url    string
+
+	lock     sync.Mutex
+	deadline time.Time
+	w        bytes.Buffer
+	r        bytes.Buffer
+}
+
+func newDoHConn(ctx context.Context, client *http.Client, url string) *dohConn {
+	return &dohConn{ctx: ctx, client: client, url: url}
+}
+
+func (c *dohConn) Write(p []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.w.Write(p)
+}
+
+func (c *dohConn) Read(p []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.r.Len() == 0 {
+		if err := c.exchange(); err != nil {
+			return 0, err
+		}
+	}
+	return c.r.Read(p)
+}
+
+// exchange POSTs the query written, its length first, and puts its answer
+// to be read the same way
+func (c *dohConn) exchange() error {
+	b := c.w.Bytes()
+	if len(b) < 2 || len(b) < 2+int(binary.BigEndian.Uint16(b)) {
+		return io.ErrUnexpectedEOF
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	query := append([]byte(nil), b[2:2+n]...)
+	c.w.Next(2 + n)
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(query))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", dohMessage)
+	req.Header.Set("Accept", dohMessage)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", c.url, resp.Status)
+	}
+	answer, err := io.ReadAll(io.LimitReader(resp.Body, maxDNSMessage+1))
+	if err != nil {
+		return err
+	}
+	if len(answer) > maxDNSMessage {
+		return fmt.Errorf("%s: answer too long", c.url)
+	}
+	var size [2]byte
+	binary.BigEndian.PutUint16(size[:], uint16(len(answer)))
+	c.r.Write(size[:])
+	c.r.Write(answer)
+	return nil
+}
+
+func (c *dohConn) Close() error {
+	return nil
+}
+
+func (c *dohConn) LocalAddr() net.Addr {
+	return dohAddr(c.url)
+}
+
+func (c *dohConn) RemoteAddr() net.Addr {
+	return dohAddr(c.url)
+}
+
+func (c *dohConn) SetDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *dohConn) SetReadDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+
+func (c *dohConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *dohConn) String() string {
+	return "doh " + c.url
+}
+
+// dohAddr is the URL of a DNS over HTTPS server as a net.Addr
+type dohAddr string
+
+func (a dohAddr) Network() string {
+	return "https"
+}
+
+func (a dohAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,40 @@
+package protocol
+
+import (
+	"sync"
+	"time"
+)
+
+// maxErrors is how many errors an ErrorLog keeps
+const maxErrors = 16
+
+// ErrorEntry is an error of an ErrorLog
+type ErrorEntry struct {
+	Time  time.Time `json:"time"`
+	Op    string    `json:"op"`
+	Error string    `json:"error"`
+}
+
+// ErrorLog keeps the last errors of the client or proxy, for the status
+type ErrorLog struct {
+	lock    sync.Mutex
+	entries []ErrorEntry
+}
+
+// Add records err of op, the oldest error is dropped once full
+func (l *ErrorLog) Add(op string, err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.entries) == maxErrors {
+		copy(l.entries, l.entries[1:])
+		l.entries = l.entries[:maxErrors-1]
+	}
+	l.entries = append(l.entries, ErrorEntry{Time: time.Now(), Op: op, Error: err.Error()})
+}
+
+// List returns the errors from the oldest
+func (l *ErrorLog) List() []ErrorEntry {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]ErrorEntry(nil), l.entries...)
+}
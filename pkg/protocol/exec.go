@@ -0,0 +1,41 @@
+package protocol
+
+import (
+	"net/url"
+	"strings"
+)
+
+// ExecScheme prefixes the targets the proxy runs a process of for each
+// stream, the stream is its stdin and stdout, e.g.
+// exec:rsync --server -logDtpre.iLsfxC . /backup
+const ExecScheme = "exec:"
+
+// ExecCommand is the command line of an ExecScheme addr split at the spaces
+func ExecCommand(addr string) ([]string, bool) {
+	line, ok := strings.CutPrefix(addr, ExecScheme)
+	if !ok {
+		return nil, false
+	}
+	return strings.Fields(line), true
+}
+
+// EscapeAddr is addr as the head of a dial request takes it, the spaces of
+// the exec targets escaped as in the option values, those of a relay raddr
+// too
+func EscapeAddr(addr string) string {
+	if !strings.Contains(addr, ExecScheme) {
+		return addr
+	}
+	return valueEscaper.Replace(addr)
+}
+
+// UnescapeAddr is the addr of the head of a dial request, EscapeAddr undone
+func UnescapeAddr(addr string) string {
+	if !strings.Contains(addr, ExecScheme) {
+		return addr
+	}
+	if s, err := url.PathUnescape(addr); err == nil {
+		return s
+	}
+	return addr
+}
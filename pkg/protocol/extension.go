@@ -0,0 +1,80 @@
+package protocol
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+)
+
+// MuxExtension is the first frame type of the extension range, the frame
+// types from it up are left to embedders
+const MuxExtension = 0x80
+
+// FrameSender sends custom frames to the peer of a mux session
+type FrameSender interface {
+	SendFrame(typ byte, payload []byte) error
+}
+
+// FrameHandler handles a custom frame, it runs on the read loop of the session
+// and must not block
+type FrameHandler func(sender FrameSender, payload []byte)
+
+var (
+	frameHandlersLock sync.RWMutex
+	frameHandlers     = map[byte]FrameHandler{}
+)
+
+// RegisterFrameType registers the handler of a custom frame type in the
+// extension range, frames of types without a handler are dropped
+func RegisterFrameType(typ byte, handler FrameHandler) error {
+	if typ < MuxExtension {
+		return fmt.Errorf("frame type %#x is reserved, extensions start at %#x", typ, MuxExtension)
+	}
+	frameHandlersLock.Lock()
+	defer frameHandlersLock.Unlock()
+	if _, ok := frameHandlers[typ]; ok {
+		return fmt.Errorf("frame type %#x is registered", typ)
+	}
+	frameHandlers[typ] = handler
+	return nil
+}
+
+// FrameTypes lists the registered custom frame types
+func FrameTypes() []byte {
+	frameHandlersLock.RLock()
+	defer frameHandlersLock.RUnlock()
+	var types []byte
+	for typ := range frameHandlers {
+		types = append(types, typ)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
+func getFrameHandler(typ byte) FrameHandler {
+	frameHandlersLock.RLock()
+	defer frameHandlersLock.RUnlock()
+	return frameHandlers[typ]
+}
+
+// SendFrame sends a custom frame on the control lane of the session
+func (session *Session) SendFrame(typ byte, payload []byte) error {
+	if typ < MuxExtension {
+		return fmt.Errorf("frame type %#x is reserved, extensions start at %#x", typ, MuxExtension)
+	}
+	if len(payload) > MuxMaxPayload {
+		return fmt.Errorf("frame payload of %d bytes is over %d", len(payload), MuxMaxPayload)
+	}
+	return session.send(&muxFrame{typ: typ, payload: payload})
+}
+
+// handleExtension dispatches a frame of the extension range
+func (session *Session) handleExtension(typ byte, payload []byte) {
+	handler := getFrameHandler(typ)
+	if handler == nil {
+		log.Printf("mux session %v: dropped frame type %#x without handler\n", session.conn, typ)
+		return
+	}
+	handler(session, payload)
+}
@@ -0,0 +1,99 @@
+package protocol
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FlushOption is the option of the dial requests telling the flush policy of
+// the stream, so the proxy writes its side of the stream the same way
+const FlushOption = "flush"
+
+// the flush policies
+const (
+	// FlushImmediate writes each write to the channel at once, as the
+	// interactive protocols need
+	FlushImmediate = "immediate"
+	// FlushCoalesce coalesces the small writes for a delay, 1ms by default,
+	// coalesce:5ms
+	FlushCoalesce = "coalesce"
+	// FlushSize buffers the writes until a size, sent after a delay at the
+	// latest, 10ms by default, size:16384 or size:16384:50ms
+	FlushSize = "size"
+)
+
+// default delays of the flush policies
+const (
+	coalesceDelay = time.Millisecond
+	sizeDelay     = 10 * time.Millisecond
+)
+
+// FlushPolicy is when the writes of a stream to the channel are sent
+type FlushPolicy struct {
+	// Delay is how long the writes are buffered at most, none when 0
+	Delay time.Duration
+	// Size is how many bytes are buffered before they're sent, BufSize
+	// when 0
+	Size int
+}
+
+// ParseFlushPolicy parses immediate, coalesce[:delay] or size:bytes[:delay],
+// nil when s is empty
+func ParseFlushPolicy(s string) (*FlushPolicy, error) {
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.Split(s, ":")
+	policy := &FlushPolicy{}
+	var delay string
+	switch {
+	case parts[0] == FlushImmediate && len(parts) == 1:
+		return policy, nil
+	case parts[0] == FlushCoalesce && len(parts) <= 2:
+		policy.Delay = coalesceDelay
+		if len(parts) == 2 {
+			delay = parts[1]
+		}
+	case parts[0] == FlushSize && (len(parts) == 2 || len(parts) == 3):
+		size, err := strconv.Atoi(parts[1])
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid flush size, %s", s)
+		}
+		policy.Delay, policy.Size = sizeDelay, size
+		if len(parts) == 3 {
+			delay = parts[2]
+		}
+	default:
+		return nil, fmt.Errorf("invalid flush policy, %s", s)
+	}
+	if delay != "" {
+		d, err := time.ParseDuration(delay)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid flush delay, %s", s)
+		}
+		policy.Delay = d
+	}
+	return policy, nil
+}
+
+// String is the policy as ParseFlushPolicy parses it
+func (policy *FlushPolicy) String() string {
+	switch {
+	case policy.Delay <= 0:
+		return FlushImmediate
+	case policy.Size > 0:
+		return fmt.Sprintf("%s:%d:%s", FlushSize, policy.Size, policy.Delay)
+	}
+	return FlushCoalesce + ":" + policy.Delay.String()
+}
+
+// WithFlush is opts with the flush of policy in place of FlushDelay and
+// FlushSize, opts as they are when policy is nil
+func (opts Options) WithFlush(policy *FlushPolicy) Options {
+	if policy != nil {
+		opts.FlushDelay, opts.FlushSize = policy.Delay, policy.Size
+	}
+	return opts
+}
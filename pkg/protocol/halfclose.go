@@ -0,0 +1,25 @@
+package protocol
+
+import (
+	"errors"
+	"net"
+)
+
+// errNoHalfClose is of the connections which can only be closed both ways
+var errNoHalfClose = errors.New("half close not supported")
+
+// CloseWrite half closes conn, FIN on TCP and a half close frame on the mux,
+// through the wrappers which tell their NetConn, the reads go on until the
+// peer closes. It fails for the connections which can't be half closed
+func CloseWrite(conn net.Conn) error {
+	for {
+		switch c := conn.(type) {
+		case interface{ CloseWrite() error }:
+			return c.CloseWrite()
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return errNoHalfClose
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package protocol
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// ErrHandshakeTimeout is the error of a handshake which ran past its timeout
+var ErrHandshakeTimeout = errors.New("handshake timed out")
+
+// Handshake runs handshake on conn, closing conn once timeout runs out, as
+// not every conn takes deadlines, the mux streams don't
+func Handshake(conn net.Conn, timeout time.Duration, handshake func() (net.Conn, error)) (net.Conn, error) {
+	timer := time.AfterFunc(timeout, func() { conn.Close() })
+	sealed, err := handshake()
+	if !timer.Stop() {
+		return nil, ErrHandshakeTimeout
+	}
+	return sealed, err
+}
@@ -0,0 +1,77 @@
+package protocol
+
+import (
+	"net"
+	"time"
+)
+
+// StreamInfo describes a stream to the hooks
+type StreamInfo struct {
+	// Tunnel is the label of the tunnel on the client
+	Tunnel string
+	// From is the address of the connection the stream is for
+	From string
+	// Addr is the remote the stream is dialed to
+	Addr string
+	// Net is the network of the remote, NetUDP of the udp streams, TCP
+	// when empty
+	Net string
+}
+
+// StreamStats counts a closed stream, In is read from the connection at the
+// edge, the tunnel's on the client and the remote's on the proxy, and Out is
+// written to it. Reason is why it closed, the connection which closed first
+// as "client closed", the error of a copy, ReasonAborted or ReasonIdle
+type StreamStats struct {
+	In       int64
+	Out      int64
+	Duration time.Duration
+	Reason   string
+}
+
+// PolicyError is the dial error of a stream refused by OnStreamOpen
+func PolicyError(err error) *DialError {
+	return &DialError{Hop: HopPolicy, Kind: KindDenied, Msg: err.Error()}
+}
+
+// Hooks are called on the events of the client or proxy, the nil ones are
+// skipped and they're called inline so they must not block
+type Hooks struct {
+	// OnStreamOpen is called before a stream is dialed, an error refuses it
+	OnStreamOpen func(info StreamInfo) error
+	// OnStreamClose is called once the stream is closed
+	OnStreamClose func(info StreamInfo, stats StreamStats)
+	// OnControlConnect is called once a control connection is up
+	OnControlConnect func(conn net.Conn)
+	// OnDialError is called for the failed dials of addr
+	OnDialError func(addr string, err error)
+}
+
+// StreamOpen calls OnStreamOpen
+func (h *Hooks) StreamOpen(info StreamInfo) error {
+	if h.OnStreamOpen == nil {
+		return nil
+	}
+	return h.OnStreamOpen(info)
+}
+
+// StreamClose calls OnStreamClose
+func (h *Hooks) StreamClose(info StreamInfo, stats StreamStats) {
+	if h.OnStreamClose != nil {
+		h.OnStreamClose(info, stats)
+	}
+}
+
+// ControlConnect calls OnControlConnect
+func (h *Hooks) ControlConnect(conn net.Conn) {
+	if h.OnControlConnect != nil {
+		h.OnControlConnect(conn)
+	}
+}
+
+// DialError calls OnDialError
+func (h *Hooks) DialError(addr string, err error) {
+	if h.OnDialError != nil {
+		h.OnDialError(addr, err)
+	}
+}
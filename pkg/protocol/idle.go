@@ -0,0 +1,43 @@
+package protocol
+
+import (
+	"log"
+	"time"
+)
+
+// ReasonIdle is the close reason of the streams closed by the idle timeout
+const ReasonIdle = "idle"
+
+// minIdleTick is the least interval the idle timeout is checked at
+const minIdleTick = 10 * time.Millisecond
+
+// idleTick is how often an idle timeout is checked, a quarter of it but no
+// less than minIdleTick
+func idleTick(timeout time.Duration) time.Duration {
+	return max(timeout/4, minIdleTick)
+}
+
+// watchIdle calls idle once no byte moved either way on the stream of ls for
+// timeout, checking every idleTick of it, until done is closed
+func watchIdle(ls *liveStream, timeout time.Duration, done <-chan struct{}, idle func()) {
+	ticker := time.NewTicker(idleTick(timeout))
+	defer ticker.Stop()
+	last, since := ls.in.Load()+ls.out.Load(), time.Now()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			if n := ls.in.Load() + ls.out.Load(); n != last {
+				last, since = n, now
+				continue
+			}
+			if now.Sub(since) < timeout {
+				continue
+			}
+			log.Printf("Stream %s -> %s idle for %s, closing\n", ls.info.From, ls.info.Addr, now.Sub(since).Round(time.Second))
+			idle()
+			return
+		}
+	}
+}
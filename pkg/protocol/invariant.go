@@ -0,0 +1,206 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// idleGoroutineSlack is how many goroutines past the fewest seen with no
+// stream open are taken for the timers and reconnects of an idle process
+const idleGoroutineSlack = 16
+
+// Invariant is a cross-check of the internal accounting, Check tells what is
+// off, nil when it holds
+type Invariant struct {
+	Name  string
+	Check func() error
+}
+
+// sessions are the mux sessions not failed yet, for the invariants
+var sessions struct {
+	sync.Mutex
+	m map[*Session]struct{}
+}
+
+func addSession(session *Session) {
+	sessions.Lock()
+	defer sessions.Unlock()
+	if sessions.m == nil {
+		sessions.m = map[*Session]struct{}{}
+	}
+	sessions.m[session] = struct{}{}
+}
+
+func removeSession(session *Session) {
+	sessions.Lock()
+	defer sessions.Unlock()
+	delete(sessions.m, session)
+}
+
+func liveSessions() []*Session {
+	sessions.Lock()
+	defer sessions.Unlock()
+	list := make([]*Session, 0, len(sessions.m))
+	for session := range sessions.m {
+		list = append(list, session)
+	}
+	return list
+}
+
+// Invariants are the checks of the streams, the mux sessions and the
+// goroutines of the process
+func Invariants() []Invariant {
+	return []Invariant{
+		{Name: "streams", Check: checkStreams},
+		{Name: "mux", Check: checkSessions},
+		{Name: "goroutines", Check: goroutineCheck()},
+	}
+}
+
+// checkStreams checks the streams_open gauge counts the streams LiveStreams
+// lists
+func checkStreams() error {
+	live.Lock()
+	n := len(live.streams)
+	live.Unlock()
+	if open := streamsOpen.Value(); open != int64(n) {
+		return fmt.Errorf("streams_open is %d, %d streams live", open, n)
+	}
+	return nil
+}
+
+// checkSessions checks the mux sessions hold no stream closed by both sides,
+// or by the peer with nobody to read it
+func checkSessions() error {
+	var issues []string
+	for _, session := range liveSessions() {
+		var closed, remote []uint32
+		session.lock.Lock()
+		for id, stream := range session.streams {
+			if id == 0 {
+				continue
+			}
+			select {
+			case <-stream.closed:
+				closed = append(closed, id)
+				continue
+			default:
+			}
+			select {
+			case <-stream.remoteClosed:
+				remote = append(remote, id)
+			default:
+			}
+		}
+		session.lock.Unlock()
+		if len(closed) > 0 {
+			issues = append(issues, fmt.Sprintf("%v holds closed streams %v", session.conn, sortedIDs(closed)))
+		}
+		if len(remote) > 0 {
+			issues = append(issues, fmt.Sprintf("%v holds streams closed by the peer %v", session.conn, sortedIDs(remote)))
+		}
+	}
+	if len(issues) > 0 {
+		return fmt.Errorf("%s", strings.Join(issues, ", "))
+	}
+	return nil
+}
+
+func sortedIDs(ids []uint32) []uint32 {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// goroutineCheck checks that with no stream open the goroutines come back to
+// about the fewest seen so far with none, the goroutines of closed streams
+// stay above it
+func goroutineCheck() func() error {
+	idle := -1
+	return func() error {
+		if streamsOpen.Value() != 0 {
+			return nil
+		}
+		n := runtime.NumGoroutine()
+		if idle < 0 || n < idle {
+			idle = n
+		}
+		if n > idle+idleGoroutineSlack {
+			return fmt.Errorf("%d goroutines with no stream open, %d before", n, idle)
+		}
+		return nil
+	}
+}
+
+// WatchInvariants runs the checks every interval until ctx is done. A check
+// failing twice in a row is logged, again whenever what it tells changes,
+// with a dump of the streams, the mux sessions and the goroutines the first
+// time, the accounting moves while the streams are dialed and closed so a
+// single failure tells nothing
+func WatchInvariants(ctx context.Context, interval time.Duration, invariants []Invariant) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	failing := map[string]int{}
+	logged := map[string]string{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		dump := false
+		for _, invariant := range invariants {
+			err := invariant.Check()
+			if err == nil {
+				if _, ok := logged[invariant.Name]; ok {
+					log.Printf("Invariant %s holds again\n", invariant.Name)
+				}
+				delete(failing, invariant.Name)
+				delete(logged, invariant.Name)
+				continue
+			}
+			failing[invariant.Name]++
+			if failing[invariant.Name] < 2 || logged[invariant.Name] == err.Error() {
+				continue
+			}
+			log.Printf("Invariant %s: %s\n", invariant.Name, err)
+			if _, ok := logged[invariant.Name]; !ok {
+				dump = true
+			}
+			logged[invariant.Name] = err.Error()
+		}
+		if dump {
+			log.Printf("Invariants dump:\n%s", dumpState())
+		}
+	}
+}
+
+// dumpState describes the streams, the mux sessions and the goroutines
+func dumpState() string {
+	var b bytes.Buffer
+	streams := LiveStreams()
+	fmt.Fprintf(&b, "%d streams live, streams_open %d\n", len(streams), streamsOpen.Value())
+	for _, s := range streams {
+		fmt.Fprintf(&b, "  stream %d %s %s -> %s since %s, in %d out %d\n", s.ID, s.Tunnel, s.From, s.Addr,
+			s.Since.Format(time.RFC3339), s.In, s.Out)
+	}
+	for _, session := range liveSessions() {
+		session.lock.Lock()
+		ids := make([]uint32, 0, len(session.streams))
+		for id := range session.streams {
+			ids = append(ids, id)
+		}
+		session.lock.Unlock()
+		fmt.Fprintf(&b, "mux session %v streams %v\n", session.conn, sortedIDs(ids))
+	}
+	fmt.Fprintf(&b, "%d goroutines\n", runtime.NumGoroutine())
+	pprof.Lookup("goroutine").WriteTo(&b, 1)
+	return b.String()
+}
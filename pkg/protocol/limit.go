@@ -0,0 +1,77 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// KindLimit is the kind of the dial errors of the streams refused past a
+// limit of the streams open at once
+const KindLimit = "limit"
+
+var streamsRefused = NewCounter("streams_refused")
+
+// Limiter counts the streams open at once to cap them, the zero Limiter is
+// ready to use
+type Limiter struct {
+	lock sync.Mutex
+	open int
+	// freed is closed once a stream is released, for those waiting
+	freed chan struct{}
+}
+
+// Acquire takes a slot for a stream unless max are open, waiting up to wait
+// for one to be released, or until ctx is done. It caps nothing when max is
+// 0
+func (l *Limiter) Acquire(ctx context.Context, max int, wait time.Duration) bool {
+	var timeout <-chan time.Time
+	for {
+		l.lock.Lock()
+		if max <= 0 || l.open < max {
+			l.open++
+			l.lock.Unlock()
+			return true
+		}
+		if l.freed == nil {
+			l.freed = make(chan struct{})
+		}
+		freed := l.freed
+		l.lock.Unlock()
+		if wait <= 0 {
+			streamsRefused.Add(1)
+			return false
+		}
+		if timeout == nil {
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case <-freed:
+		case <-timeout:
+			streamsRefused.Add(1)
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// Release frees the slot of a stream closed
+func (l *Limiter) Release() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.open--
+	if l.freed != nil {
+		close(l.freed)
+		l.freed = nil
+	}
+}
+
+// LimitError is the dial error of a stream refused as max streams of what
+// are open
+func LimitError(what string, max int) *DialError {
+	return &DialError{Hop: HopPolicy, Kind: KindLimit, Msg: fmt.Sprintf("too many streams, %s has %d open", what, max)}
+}
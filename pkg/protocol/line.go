@@ -0,0 +1,103 @@
+// Package protocol is the wire protocol of the channel, the control lines,
+// the mux frames and the stream codecs
+package protocol
+
+import (
+	"bufio"
+	"encoding/hex"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ListenerPrefix is the raddr prefix of the dials to the listeners of the
+// proxy, e.g. "listener::8080" for a listener at :8080 of the client
+const ListenerPrefix = "listener:"
+
+// valueEscaper escapes what would break an option value apart
+var valueEscaper = strings.NewReplacer("%", "%25", " ", "%20", "\t", "%09", "\r", "%0D", "\n", "%0A")
+
+// ParseLine splits a protocol line into its head and the key=value options
+// following it, e.g. "dial:www.qq.com:80 codecs=flate"
+func ParseLine(line string) (string, map[string]string) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	opts := map[string]string{}
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) == 2 {
+			v, err := url.PathUnescape(kv[1])
+			if err != nil {
+				v = kv[1]
+			}
+			opts[kv[0]] = v
+		} else {
+			opts[kv[0]] = ""
+		}
+	}
+	return fields[0], opts
+}
+
+// FormatLine is the reverse of ParseLine, options are sorted by key and the
+// empty ones omitted
+func FormatLine(head string, opts map[string]string) string {
+	keys := make([]string, 0, len(opts))
+	for k, v := range opts {
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	line := head
+	for _, k := range keys {
+		line += " " + k + "=" + valueEscaper.Replace(opts[k])
+	}
+	return line + "\n"
+}
+
+// ControlWriter serializes the messages written on a control connection, they
+// are batched for AckDelay to save writes when many dials are in flight
+type ControlWriter struct {
+	sync.Mutex
+	conn net.Conn
+	w    *bufio.Writer
+}
+
+// NewControlWriter makes the writer of the control connection conn
+func (opts Options) NewControlWriter(conn net.Conn) *ControlWriter {
+	var w net.Conn = conn
+	if opts.AckDelay > 0 {
+		w = newCoalesceConn(conn, opts.AckDelay, opts.BufSize)
+	}
+	return &ControlWriter{conn: conn, w: bufio.NewWriter(w)}
+}
+
+// Conn is the control connection written
+func (cw *ControlWriter) Conn() net.Conn {
+	return cw.conn
+}
+
+// WriteLine writes a line and flushes it, or leaves it to the ack delay
+func (cw *ControlWriter) WriteLine(line string) error {
+	cw.Lock()
+	defer cw.Unlock()
+	if _, err := cw.w.WriteString(line); err != nil {
+		return err
+	}
+	return cw.w.Flush()
+}
+
+// maxLogBytes bounds the bytes of bad input in logs
+const maxLogBytes = 32
+
+// HexPrefix formats the first bytes of b for logs
+func HexPrefix(b []byte) string {
+	if len(b) > maxLogBytes {
+		return hex.EncodeToString(b[:maxLogBytes]) + "..."
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,90 @@
+package protocol
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LiveStream is a stream being piped, In and Out count its bytes so far as
+// StreamStats counts them once it's closed
+type LiveStream struct {
+	ID     uint64    `json:"id"`
+	Tunnel string    `json:"tunnel,omitempty"`
+	From   string    `json:"from,omitempty"`
+	Addr   string    `json:"addr,omitempty"`
+	Since  time.Time `json:"since"`
+	In     int64     `json:"in"`
+	Out    int64     `json:"out"`
+}
+
+type liveStream struct {
+	id    uint64
+	info  StreamInfo
+	since time.Time
+	in    atomic.Int64
+	out   atomic.Int64
+}
+
+// live are the streams being piped, the bytes of the closed ones are summed
+// in closedIn and closedOut
+var live struct {
+	sync.Mutex
+	next      uint64
+	streams   map[uint64]*liveStream
+	closedIn  int64
+	closedOut int64
+}
+
+func addLive(info StreamInfo) *liveStream {
+	live.Lock()
+	defer live.Unlock()
+	if live.streams == nil {
+		live.streams = map[uint64]*liveStream{}
+	}
+	live.next++
+	s := &liveStream{id: live.next, info: info, since: time.Now()}
+	live.streams[s.id] = s
+	return s
+}
+
+func removeLive(s *liveStream) {
+	live.Lock()
+	defer live.Unlock()
+	delete(live.streams, s.id)
+	live.closedIn += s.in.Load()
+	live.closedOut += s.out.Load()
+}
+
+// LiveStreams lists the streams being piped, the oldest first
+func LiveStreams() []LiveStream {
+	live.Lock()
+	defer live.Unlock()
+	streams := make([]LiveStream, 0, len(live.streams))
+	for _, s := range live.streams {
+		streams = append(streams, LiveStream{
+			ID:     s.id,
+			Tunnel: s.info.Tunnel,
+			From:   s.info.From,
+			Addr:   s.info.Addr,
+			Since:  s.since,
+			In:     s.in.Load(),
+			Out:    s.out.Load(),
+		})
+	}
+	sort.Slice(streams, func(i, j int) bool { return streams[i].ID < streams[j].ID })
+	return streams
+}
+
+// liveBytes is the bytes of all the streams so far, the closed and the live
+func liveBytes() (in, out int64) {
+	live.Lock()
+	defer live.Unlock()
+	in, out = live.closedIn, live.closedOut
+	for _, s := range live.streams {
+		in += s.in.Load()
+		out += s.out.Load()
+	}
+	return in, out
+}
@@ -0,0 +1,175 @@
+package protocol
+
+import (
+	"expvar"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics receives the metrics of the channel as they change, for the
+// embedders routing them to their own registry, the names are those of the
+// expvars at /debug/vars which are kept whatever the Metrics
+type Metrics interface {
+	// Count adds delta to the counter name
+	Count(name string, delta int64)
+	// Gauge sets the gauge name to value
+	Gauge(name string, value float64)
+	// Observe adds value to the histogram name, the durations are in seconds
+	Observe(name string, value float64)
+}
+
+// NopMetrics drops the metrics
+type NopMetrics struct{}
+
+func (NopMetrics) Count(name string, delta int64)     {}
+func (NopMetrics) Gauge(name string, value float64)   {}
+func (NopMetrics) Observe(name string, value float64) {}
+
+// metricsHolder holds the Metrics of any type in an atomic.Pointer
+type metricsHolder struct {
+	Metrics
+}
+
+var currentMetrics atomic.Pointer[metricsHolder]
+
+// SetMetrics routes the metrics of the process to m, NopMetrics when nil
+func SetMetrics(m Metrics) {
+	if m == nil {
+		m = NopMetrics{}
+	}
+	currentMetrics.Store(&metricsHolder{m})
+}
+
+func metrics() Metrics {
+	if h := currentMetrics.Load(); h != nil {
+		return h.Metrics
+	}
+	return NopMetrics{}
+}
+
+// Counter is an expvar counter reported to the Metrics too
+type Counter struct {
+	name string
+	v    *expvar.Int
+}
+
+// NewCounter publishes the counter name
+func NewCounter(name string) *Counter {
+	return &Counter{name: name, v: expvar.NewInt(name)}
+}
+
+func (c *Counter) Add(delta int64) {
+	c.v.Add(delta)
+	metrics().Count(c.name, delta)
+}
+
+func (c *Counter) Value() int64 {
+	return c.v.Value()
+}
+
+// Gauge is an expvar gauge reported to the Metrics too
+type Gauge struct {
+	name string
+	v    *expvar.Int
+}
+
+// NewGauge publishes the gauge name
+func NewGauge(name string) *Gauge {
+	return &Gauge{name: name, v: expvar.NewInt(name)}
+}
+
+func (g *Gauge) Add(delta int64) {
+	g.v.Add(delta)
+	metrics().Gauge(g.name, float64(g.v.Value()))
+}
+
+func (g *Gauge) Set(value int64) {
+	g.v.Set(value)
+	metrics().Gauge(g.name, float64(value))
+}
+
+func (g *Gauge) Value() int64 {
+	return g.v.Value()
+}
+
+// observe adds d to the histogram name of the Metrics, the histograms have no
+// expvar, their sums are the _ns counters
+func observe(name string, d time.Duration) {
+	metrics().Observe(name, d.Seconds())
+}
+
+// mux metrics, the durations are in nanoseconds, the stalls of each stream
+// are only in the expvars
+var (
+	muxControlQueue    = NewGauge("mux_control_queue")
+	muxDataQueue       = NewGauge("mux_data_queue")
+	muxControlFrames   = NewCounter("mux_control_frames")
+	muxControlWait     = NewCounter("mux_control_wait_ns")
+	muxControlWaitMax  = NewGauge("mux_control_wait_max_ns")
+	muxDataFrames      = NewCounter("mux_data_frames")
+	muxDataWait        = NewCounter("mux_data_wait_ns")
+	muxStalls          = NewCounter("mux_stalls")
+	muxStallTime       = NewCounter("mux_stall_ns")
+	muxStallMax        = NewGauge("mux_stall_max_ns")
+	muxStreamStallTime = expvar.NewMap("mux_stream_stall_ns")
+	muxSlowResets      = NewCounter("mux_slow_resets")
+)
+
+// stream metrics, counting the streams piped through the channel
+var (
+	streamsOpen  = NewGauge("streams_open")
+	streamsTotal = NewCounter("streams_total")
+)
+
+// StreamCounts counts the streams piped through the channel, In and Out are
+// the bytes of all of them so far
+type StreamCounts struct {
+	Open  int64 `json:"open"`
+	Total int64 `json:"total"`
+	In    int64 `json:"in"`
+	Out   int64 `json:"out"`
+}
+
+// Streams returns the stream counts
+func Streams() StreamCounts {
+	in, out := liveBytes()
+	return StreamCounts{Open: streamsOpen.Value(), Total: streamsTotal.Value(), In: in, Out: out}
+}
+
+// setMax raises v to d
+func setMax(v *Gauge, d time.Duration) {
+	if int64(d) > v.Value() {
+		v.Set(int64(d))
+	}
+}
+
+// observeQueued accounts the time a frame waited in its send queue
+func observeQueued(control bool, d time.Duration) {
+	if control {
+		muxControlQueue.Add(-1)
+		muxControlFrames.Add(1)
+		muxControlWait.Add(int64(d))
+		setMax(muxControlWaitMax, d)
+		observe("mux_control_wait_seconds", d)
+		return
+	}
+	muxDataQueue.Add(-1)
+	muxDataFrames.Add(1)
+	muxDataWait.Add(int64(d))
+	observe("mux_data_wait_seconds", d)
+}
+
+// observeStall accounts the time the writes of a stream waited for the
+// window of the peer, which holds up that stream alone
+func observeStall(id uint32, d time.Duration) {
+	muxStalls.Add(1)
+	muxStallTime.Add(int64(d))
+	setMax(muxStallMax, d)
+	observe("mux_stall_seconds", d)
+	muxStreamStallTime.Add(strconv.FormatUint(uint64(id), 10), int64(d))
+}
+
+func forgetStream(id uint32) {
+	muxStreamStallTime.Delete(strconv.FormatUint(uint64(id), 10))
+}
@@ -0,0 +1,86 @@
+//go:build otel
+// +build otel
+
+package protocol
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/metric"
+)
+
+// OTelMetrics records the metrics of the channel with the instruments of an
+// OpenTelemetry meter, created as they first change
+type OTelMetrics struct {
+	meter      metric.Meter
+	lock       sync.Mutex
+	counters   map[string]metric.Int64Counter
+	gauges     map[string]metric.Float64Gauge
+	histograms map[string]metric.Float64Histogram
+}
+
+// NewOTelMetrics is the Metrics of meter, e.g.
+// SetMetrics(NewOTelMetrics(otel.Meter("channel")))
+func NewOTelMetrics(meter metric.Meter) *OTelMetrics {
+	return &OTelMetrics{
+		meter:      meter,
+		counters:   map[string]metric.Int64Counter{},
+		gauges:     map[string]metric.Float64Gauge{},
+		histograms: map[string]metric.Float64Histogram{},
+	}
+}
+
+func (m *OTelMetrics) Count(name string, delta int64) {
+	m.lock.Lock()
+	c, ok := m.counters[name]
+	if !ok {
+		var err error
+		if c, err = m.meter.Int64Counter(name); err != nil {
+			log.Printf("create metric %s: %s\n", name, err)
+		}
+		m.counters[name] = c
+	}
+	m.lock.Unlock()
+	if c != nil && delta > 0 {
+		c.Add(context.Background(), delta)
+	}
+}
+
+func (m *OTelMetrics) Gauge(name string, value float64) {
+	m.lock.Lock()
+	g, ok := m.gauges[name]
+	if !ok {
+		var err error
+		if g, err = m.meter.Float64Gauge(name); err != nil {
+			log.Printf("create metric %s: %s\n", name, err)
+		}
+		m.gauges[name] = g
+	}
+	m.lock.Unlock()
+	if g != nil {
+		g.Record(context.Background(), value)
+	}
+}
+
+func (m *OTelMetrics) Observe(name string, value float64) {
+	m.lock.Lock()
+	h, ok := m.histograms[name]
+	if !ok {
+		unit := "By"
+		if strings.HasSuffix(name, "_seconds") {
+			unit = "s"
+		}
+		var err error
+		if h, err = m.meter.Float64Histogram(name, metric.WithUnit(unit)); err != nil {
+			log.Printf("create metric %s: %s\n", name, err)
+		}
+		m.histograms[name] = h
+	}
+	m.lock.Unlock()
+	if h != nil {
+		h.Record(context.Background(), value)
+	}
+}
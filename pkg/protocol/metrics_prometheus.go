@@ -0,0 +1,98 @@
+//go:build prometheus
+// +build prometheus
+
+package protocol
+
+import (
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PrometheusMetrics registers the metrics of the channel to a registry as
+// they first change, under its namespace
+type PrometheusMetrics struct {
+	reg        prometheus.Registerer
+	namespace  string
+	lock       sync.Mutex
+	counters   map[string]prometheus.Counter
+	gauges     map[string]prometheus.Gauge
+	histograms map[string]prometheus.Histogram
+}
+
+// NewPrometheusMetrics is the Metrics of reg, prometheus.DefaultRegisterer
+// when nil, e.g. SetMetrics(NewPrometheusMetrics(nil, "channel"))
+func NewPrometheusMetrics(reg prometheus.Registerer, namespace string) *PrometheusMetrics {
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+	return &PrometheusMetrics{
+		reg:        reg,
+		namespace:  namespace,
+		counters:   map[string]prometheus.Counter{},
+		gauges:     map[string]prometheus.Gauge{},
+		histograms: map[string]prometheus.Histogram{},
+	}
+}
+
+func (m *PrometheusMetrics) Count(name string, delta int64) {
+	m.lock.Lock()
+	c, ok := m.counters[name]
+	if !ok {
+		c = prometheus.NewCounter(prometheus.CounterOpts{Namespace: m.namespace, Name: name, Help: "channel counter " + name})
+		m.register(name, c)
+		m.counters[name] = c
+	}
+	m.lock.Unlock()
+	if delta > 0 {
+		c.Add(float64(delta))
+	}
+}
+
+func (m *PrometheusMetrics) Gauge(name string, value float64) {
+	m.lock.Lock()
+	g, ok := m.gauges[name]
+	if !ok {
+		g = prometheus.NewGauge(prometheus.GaugeOpts{Namespace: m.namespace, Name: name, Help: "channel gauge " + name})
+		m.register(name, g)
+		m.gauges[name] = g
+	}
+	m.lock.Unlock()
+	g.Set(value)
+}
+
+func (m *PrometheusMetrics) Observe(name string, value float64) {
+	m.lock.Lock()
+	h, ok := m.histograms[name]
+	if !ok {
+		h = prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: m.namespace,
+			Name:      name,
+			Help:      "channel histogram " + name,
+			Buckets:   histogramBuckets(name),
+		})
+		m.register(name, h)
+		m.histograms[name] = h
+	}
+	m.lock.Unlock()
+	h.Observe(value)
+}
+
+// register logs a collector the registry refused, it is still updated so
+// the callers don't check
+func (m *PrometheusMetrics) register(name string, c prometheus.Collector) {
+	if err := m.reg.Register(c); err != nil {
+		log.Printf("register metric %s: %s\n", name, err)
+	}
+}
+
+// histogramBuckets are the default buckets for the durations in seconds and
+// powers of 4 from 512 for the sizes in bytes
+func histogramBuckets(name string) []float64 {
+	if strings.HasSuffix(name, "_seconds") {
+		return prometheus.DefBuckets
+	}
+	return prometheus.ExponentialBuckets(512, 4, 10)
+}
@@ -0,0 +1,603 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// frame types of the mux, stream 0 is the control connection, the types from
+// MuxExtension up are custom frames
+const (
+	MuxData  = 0
+	MuxOpen  = 1
+	MuxClose = 2
+	// MuxReset closes a stream abortively, its reads fail with ErrReset,
+	// sent only to the peers which told the reset feature
+	MuxReset = 3
+	// MuxCloseWrite half closes a stream, its reads end with EOF while it can
+	// still be written, sent only to the peers which told the halfclose
+	// feature
+	MuxCloseWrite = 4
+	// MuxWindow grows the window of a stream by the 4 byte count of its
+	// payload, once the peer read as much, sent only to the peers which told
+	// the window feature
+	MuxWindow = 5
+)
+
+const (
+	MuxHeaderSize = 7
+	MuxMaxPayload = 0xffff
+	// muxWindow is the bytes of a stream sent ahead of the reads of the
+	// peer, the most a stream buffers. A stream of a peer without windows
+	// which buffers more is reset, the control stream is never
+	muxWindow = 64 * MuxMaxPayload
+)
+
+var (
+	errStreamClosed         = errors.New("stream closed")
+	errSessionClosed        = errors.New("mux session closed")
+	errDeadlineNotSupported = errors.New("deadline not supported")
+)
+
+type muxFrame struct {
+	typ     byte
+	stream  uint32
+	payload []byte
+	queued  time.Time
+	done    chan error
+}
+
+func (frame *muxFrame) isControl() bool {
+	return frame.typ != MuxData || frame.stream == 0
+}
+
+// Session carries the control connection and the streams on one connection.
+// Control frames are queued apart and always written before data frames, so
+// dials and closes aren't stuck behind bulk transfers.
+type Session struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	control chan *muxFrame
+	data    chan *muxFrame
+
+	lock    sync.Mutex
+	streams map[uint32]*muxStream
+
+	once sync.Once
+	done chan struct{}
+	err  error
+
+	// resets tells whether the peer knows the reset frames
+	resets atomic.Bool
+	// halfCloses tells whether the peer knows the half close frames
+	halfCloses atomic.Bool
+	// windows tells whether the peer knows the window frames
+	windows atomic.Bool
+}
+
+// NewSession starts a session on conn, r reads conn and may hold bytes read
+// past the hello
+func NewSession(conn net.Conn, r *bufio.Reader) *Session {
+	session := &Session{
+		conn:    conn,
+		reader:  r,
+		control: make(chan *muxFrame, 64),
+		data:    make(chan *muxFrame, 64),
+		streams: map[uint32]*muxStream{},
+		done:    make(chan struct{}),
+	}
+	session.streams[0] = newMuxStream(session, 0)
+	addSession(session)
+	go session.writeLoop()
+	go session.readLoop()
+	return session
+}
+
+// ControlConn is the control connection carried as stream 0
+func (session *Session) ControlConn() net.Conn {
+	return session.streams[0]
+}
+
+// AllowReset lets the streams be reset, once the peer told it knows the
+// reset frames, they're closed only before
+func (session *Session) AllowReset() {
+	session.resets.Store(true)
+}
+
+// AllowHalfClose lets the streams be half closed, once the peer told it knows
+// the half close frames, CloseWrite fails before
+func (session *Session) AllowHalfClose() {
+	session.halfCloses.Store(true)
+}
+
+// AllowWindow bounds the writes of the streams by the windows the peer grants
+// and grants them as they're read, once the peer told it knows the window
+// frames. The streams opened before aren't bounded
+func (session *Session) AllowWindow() {
+	session.windows.Store(true)
+}
+
+// Open creates a stream and tells the peer about it before anything is sent
+// on it
+func (session *Session) Open(id uint32) (net.Conn, error) {
+	stream := newMuxStream(session, id)
+	session.lock.Lock()
+	session.streams[id] = stream
+	session.lock.Unlock()
+	if err := session.send(&muxFrame{typ: MuxOpen, stream: id}); err != nil {
+		session.remove(stream)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Stream returns the stream opened by the peer
+func (session *Session) Stream(id uint32) net.Conn {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	stream := session.streams[id]
+	if stream == nil {
+		return nil
+	}
+	return stream
+}
+
+// remove forgets stream, unless its id is of another stream already
+func (session *Session) remove(stream *muxStream) {
+	session.lock.Lock()
+	if session.streams[stream.id] == stream {
+		delete(session.streams, stream.id)
+	}
+	session.lock.Unlock()
+	forgetStream(stream.id)
+}
+
+// resetStream resets stream for why, it's forgotten at once so its next
+// frames are dropped, and the frame is sent aside so the read loop doesn't
+// wait for it
+func (session *Session) resetStream(stream *muxStream, why string) {
+	log.Printf("Reset mux stream %d of %v: %s\n", stream.id, session.conn, why)
+	stream.reset.Store(true)
+	session.remove(stream)
+	go stream.Close()
+}
+
+// send queues a frame and waits until it's written, control frames and data
+// of the control stream go to the priority queue
+func (session *Session) send(frame *muxFrame) error {
+	frame.done = make(chan error, 1)
+	frame.queued = time.Now()
+	queue, depth := session.data, muxDataQueue
+	if frame.isControl() {
+		queue, depth = session.control, muxControlQueue
+	}
+	depth.Add(1)
+	select {
+	case queue <- frame:
+	case <-session.done:
+		depth.Add(-1)
+		return session.err
+	}
+	select {
+	case err := <-frame.done:
+		return err
+	case <-session.done:
+		return session.err
+	}
+}
+
+func (session *Session) writeLoop() {
+	w := bufio.NewWriterSize(session.conn, MuxMaxPayload+MuxHeaderSize)
+	header := make([]byte, MuxHeaderSize)
+	for {
+		var frame *muxFrame
+		select {
+		case frame = <-session.control:
+		default:
+			select {
+			case frame = <-session.control:
+			case frame = <-session.data:
+			default:
+				// flush once both queues run dry
+				if err := w.Flush(); err != nil {
+					session.fail(err)
+					return
+				}
+				select {
+				case frame = <-session.control:
+				case frame = <-session.data:
+				case <-session.done:
+					return
+				}
+			}
+		}
+		observeQueued(frame.isControl(), time.Since(frame.queued))
+		header[0] = frame.typ
+		binary.BigEndian.PutUint32(header[1:], frame.stream)
+		binary.BigEndian.PutUint16(header[5:], uint16(len(frame.payload)))
+		w.Write(header)
+		_, err := w.Write(frame.payload)
+		frame.done <- err
+		if err != nil {
+			session.fail(err)
+			return
+		}
+	}
+}
+
+func (session *Session) readLoop() {
+	header := make([]byte, MuxHeaderSize)
+	for {
+		if _, err := io.ReadFull(session.reader, header); err != nil {
+			session.fail(err)
+			return
+		}
+		typ := header[0]
+		id := binary.BigEndian.Uint32(header[1:])
+		payload := make([]byte, binary.BigEndian.Uint16(header[5:]))
+		if _, err := io.ReadFull(session.reader, payload); err != nil {
+			session.fail(err)
+			return
+		}
+		switch typ {
+		case MuxOpen:
+			session.lock.Lock()
+			stream := session.streams[id]
+			if stream == nil {
+				session.streams[id] = newMuxStream(session, id)
+			}
+			session.lock.Unlock()
+			if stream == nil {
+				continue
+			}
+			if id == 0 {
+				session.fail(errors.New("mux open of the control stream"))
+				return
+			}
+			session.resetStream(stream, "opened again")
+			continue
+		case MuxWindow:
+			if len(payload) != 4 {
+				session.fail(fmt.Errorf("invalid mux window of %d bytes", len(payload)))
+				return
+			}
+		case MuxData, MuxClose, MuxReset, MuxCloseWrite:
+		default:
+			if typ >= MuxExtension {
+				session.handleExtension(typ, payload)
+				continue
+			}
+			session.fail(fmt.Errorf("invalid mux frame type, %d", typ))
+			return
+		}
+		session.lock.Lock()
+		stream := session.streams[id]
+		session.lock.Unlock()
+		if stream == nil {
+			// closed here already
+			continue
+		}
+		if typ == MuxReset {
+			stream.reset.Store(true)
+		}
+		if typ == MuxClose || typ == MuxReset {
+			stream.remoteClose()
+			continue
+		}
+		if typ == MuxCloseWrite {
+			stream.remoteCloseWrite()
+			continue
+		}
+		if typ == MuxWindow {
+			stream.grant(int(binary.BigEndian.Uint32(payload)))
+			continue
+		}
+		// never waits on a stream, one slow to read is reset once past its
+		// window
+		if !stream.push(payload) {
+			muxSlowResets.Add(1)
+			session.resetStream(stream, "past its window")
+		}
+	}
+}
+
+func (session *Session) fail(err error) {
+	session.once.Do(func() {
+		log.Printf("mux session %v: %s\n", session.conn, err)
+		session.err = errSessionClosed
+		close(session.done)
+		session.conn.Close()
+		removeSession(session)
+	})
+}
+
+// muxStream is a connection carried by the session
+type muxStream struct {
+	session *Session
+	id      uint32
+
+	// lock guards the frames read ahead and the windows
+	lock sync.Mutex
+	// frames are the payloads not read yet, ready tells Read of a new one
+	frames  [][]byte
+	ready   chan struct{}
+	pending []byte
+	// unread is the bytes received not read yet, read those read since the
+	// last window granted to the peer
+	unread int
+	read   int
+	// window is the bytes the stream may send before the peer grants more,
+	// granted tells Write it did, the writes are bounded by it when windowed
+	window   int
+	granted  chan struct{}
+	windowed bool
+
+	closeOnce    sync.Once
+	closed       chan struct{}
+	remoteOnce   sync.Once
+	remoteClosed chan struct{}
+	// remoteEOFOnce closes remoteEOF once the peer half closed the stream
+	remoteEOFOnce sync.Once
+	remoteEOF     chan struct{}
+	// writeClosed is set by CloseWrite
+	writeClosed atomic.Bool
+	// reset is set by the peer resetting the stream, or by ResetConn before
+	// the stream is closed
+	reset atomic.Bool
+}
+
+func newMuxStream(session *Session, id uint32) *muxStream {
+	return &muxStream{
+		session:      session,
+		id:           id,
+		ready:        make(chan struct{}, 1),
+		window:       muxWindow,
+		granted:      make(chan struct{}, 1),
+		windowed:     id != 0 && session.windows.Load(),
+		closed:       make(chan struct{}),
+		remoteClosed: make(chan struct{}),
+		remoteEOF:    make(chan struct{}),
+	}
+}
+
+func (stream *muxStream) String() string {
+	return fmt.Sprintf("mux stream %d of %v", stream.id, stream.session.conn)
+}
+
+// push queues payload for Read, false when it's past the window of the
+// stream
+func (stream *muxStream) push(payload []byte) bool {
+	stream.lock.Lock()
+	if stream.id != 0 && stream.unread+len(payload) > muxWindow {
+		stream.lock.Unlock()
+		return false
+	}
+	stream.unread += len(payload)
+	stream.frames = append(stream.frames, payload)
+	stream.lock.Unlock()
+	select {
+	case stream.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// pop takes the next frame to pending, false when none was received
+func (stream *muxStream) pop() bool {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	if len(stream.frames) == 0 {
+		return false
+	}
+	stream.pending = stream.frames[0]
+	stream.frames[0] = nil
+	stream.frames = stream.frames[1:]
+	return true
+}
+
+// consume accounts n bytes read, the peer is granted them once they're a
+// quarter of the window
+func (stream *muxStream) consume(n int) {
+	stream.lock.Lock()
+	stream.unread -= n
+	stream.read += n
+	grant := 0
+	if stream.id != 0 && stream.read >= muxWindow/4 && stream.session.windows.Load() {
+		grant, stream.read = stream.read, 0
+	}
+	stream.lock.Unlock()
+	if grant > 0 {
+		payload := binary.BigEndian.AppendUint32(nil, uint32(grant))
+		stream.session.send(&muxFrame{typ: MuxWindow, stream: stream.id, payload: payload})
+	}
+}
+
+// grant grows the window by n bytes the peer read
+func (stream *muxStream) grant(n int) {
+	stream.lock.Lock()
+	stream.window += n
+	stream.lock.Unlock()
+	select {
+	case stream.granted <- struct{}{}:
+	default:
+	}
+}
+
+// reserve takes up to n bytes of the window, waiting for the peer to grant
+// some when it's empty
+func (stream *muxStream) reserve(n int) (int, error) {
+	var stalled time.Time
+	for {
+		stream.lock.Lock()
+		if stream.window > 0 {
+			n = min(n, stream.window)
+			stream.window -= n
+			stream.lock.Unlock()
+			if !stalled.IsZero() {
+				observeStall(stream.id, time.Since(stalled))
+			}
+			return n, nil
+		}
+		stream.lock.Unlock()
+		if stalled.IsZero() {
+			stalled = time.Now()
+		}
+		select {
+		case <-stream.granted:
+		case <-stream.closed:
+			return 0, errStreamClosed
+		case <-stream.remoteClosed:
+			if stream.reset.Load() {
+				return 0, ErrReset
+			}
+			return 0, io.ErrClosedPipe
+		case <-stream.session.done:
+			return 0, stream.session.err
+		}
+	}
+}
+
+func (stream *muxStream) Read(p []byte) (int, error) {
+	for len(stream.pending) == 0 {
+		if stream.pop() {
+			continue
+		}
+		select {
+		case <-stream.ready:
+		case <-stream.remoteClosed:
+			// the frames before the close are buffered already
+			if stream.pop() {
+				continue
+			}
+			if stream.reset.Load() {
+				return 0, ErrReset
+			}
+			return 0, io.EOF
+		case <-stream.remoteEOF:
+			if stream.pop() {
+				continue
+			}
+			return 0, io.EOF
+		case <-stream.closed:
+			return 0, errStreamClosed
+		case <-stream.session.done:
+			return 0, stream.session.err
+		}
+	}
+	n := copy(p, stream.pending)
+	stream.pending = stream.pending[n:]
+	stream.consume(n)
+	return n, nil
+}
+
+func (stream *muxStream) Write(p []byte) (int, error) {
+	if stream.writeClosed.Load() {
+		return 0, io.ErrClosedPipe
+	}
+	written := 0
+	for len(p) > 0 {
+		select {
+		case <-stream.closed:
+			return written, errStreamClosed
+		case <-stream.remoteClosed:
+			if stream.reset.Load() {
+				return written, ErrReset
+			}
+			return written, io.ErrClosedPipe
+		default:
+		}
+		chunk := p
+		if len(chunk) > MuxMaxPayload {
+			chunk = chunk[:MuxMaxPayload]
+		}
+		if stream.windowed {
+			n, err := stream.reserve(len(chunk))
+			if err != nil {
+				return written, err
+			}
+			chunk = chunk[:n]
+		}
+		// the frame is written before send returns, so chunk can be reused
+		if err := stream.session.send(&muxFrame{typ: MuxData, stream: stream.id, payload: chunk}); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+func (stream *muxStream) remoteClose() {
+	stream.remoteOnce.Do(func() { close(stream.remoteClosed) })
+	if stream.id == 0 {
+		stream.session.fail(io.EOF)
+	}
+}
+
+func (stream *muxStream) remoteCloseWrite() {
+	stream.remoteEOFOnce.Do(func() { close(stream.remoteEOF) })
+}
+
+// CloseWrite half closes the stream, the peer reads EOF once it read what was
+// written before and may go on writing. It fails when the peer doesn't know
+// the half close frames, the stream is to be closed then
+func (stream *muxStream) CloseWrite() error {
+	if stream.id == 0 || !stream.session.halfCloses.Load() {
+		return errNoHalfClose
+	}
+	if stream.writeClosed.Swap(true) {
+		return nil
+	}
+	select {
+	case <-stream.closed:
+		return errStreamClosed
+	default:
+	}
+	return stream.session.send(&muxFrame{typ: MuxCloseWrite, stream: stream.id})
+}
+
+// Close closes the stream both ways, the control stream closes the session
+func (stream *muxStream) Close() error {
+	stream.closeOnce.Do(func() {
+		close(stream.closed)
+		stream.session.remove(stream)
+		typ := byte(MuxClose)
+		if stream.reset.Load() && stream.session.resets.Load() {
+			typ = MuxReset
+		}
+		stream.session.send(&muxFrame{typ: typ, stream: stream.id})
+		if stream.id == 0 {
+			stream.session.fail(errSessionClosed)
+		}
+	})
+	return nil
+}
+
+func (stream *muxStream) LocalAddr() net.Addr {
+	return stream.session.conn.LocalAddr()
+}
+
+func (stream *muxStream) RemoteAddr() net.Addr {
+	return stream.session.conn.RemoteAddr()
+}
+
+func (stream *muxStream) SetDeadline(t time.Time) error {
+	return errDeadlineNotSupported
+}
+
+func (stream *muxStream) SetReadDeadline(t time.Time) error {
+	return errDeadlineNotSupported
+}
+
+func (stream *muxStream) SetWriteDeadline(t time.Time) error {
+	return errDeadlineNotSupported
+}
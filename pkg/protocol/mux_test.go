@@ -0,0 +1,193 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipeConn names a pipe in the logs, which would print its fields otherwise
+type pipeConn struct {
+	net.Conn
+}
+
+func (pipeConn) String() string {
+	return "pipe"
+}
+
+// muxPipe is a session and the raw conn of its peer
+func muxPipe(t *testing.T) (*Session, net.Conn) {
+	t.Helper()
+	conn, peer := net.Pipe()
+	session := NewSession(pipeConn{conn}, bufio.NewReader(conn))
+	t.Cleanup(func() { peer.Close() })
+	return session, peer
+}
+
+func muxBytes(typ byte, id uint32, payload []byte) []byte {
+	frame := make([]byte, MuxHeaderSize, MuxHeaderSize+len(payload))
+	frame[0] = typ
+	binary.BigEndian.PutUint32(frame[1:], id)
+	binary.BigEndian.PutUint16(frame[5:], uint16(len(payload)))
+	return append(frame, payload...)
+}
+
+func readMux(t *testing.T, r io.Reader) (byte, uint32, []byte) {
+	t.Helper()
+	header := make([]byte, MuxHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		t.Fatalf("read frame header: %s", err)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[5:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatalf("read frame payload: %s", err)
+	}
+	return header[0], binary.BigEndian.Uint32(header[1:]), payload
+}
+
+var muxRoundTrips = []struct {
+	name  string
+	id    uint32
+	size  int
+	sizes []int
+}{
+	{"control", 0, 5, []int{5}},
+	{"one byte", 3, 1, []int{1}},
+	{"max payload", 3, MuxMaxPayload, []int{MuxMaxPayload}},
+	{"split", 7, 2*MuxMaxPayload + 1, []int{MuxMaxPayload, MuxMaxPayload, 1}},
+}
+
+func TestMuxEncode(t *testing.T) {
+	for _, tc := range muxRoundTrips {
+		t.Run(tc.name, func(t *testing.T) {
+			session, peer := muxPipe(t)
+			stream := session.ControlConn()
+			r := bufio.NewReader(peer)
+			if tc.id != 0 {
+				go session.Open(tc.id)
+				if typ, id, payload := readMux(t, r); typ != MuxOpen || id != tc.id || len(payload) != 0 {
+					t.Fatalf("frame %d of stream %d with %d bytes, want an open of %d", typ, id, len(payload), tc.id)
+				}
+				stream = session.Stream(tc.id)
+			}
+			data := compressible(tc.size + 8)[:tc.size]
+			go stream.Write(data)
+			var got []byte
+			for _, size := range tc.sizes {
+				typ, id, payload := readMux(t, r)
+				if typ != MuxData || id != tc.id || len(payload) != size {
+					t.Fatalf("frame %d of stream %d with %d bytes, want data of %d with %d", typ, id, len(payload), tc.id, size)
+				}
+				got = append(got, payload...)
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("payloads differ from the write")
+			}
+		})
+	}
+}
+
+func TestMuxDecode(t *testing.T) {
+	for _, tc := range muxRoundTrips {
+		t.Run(tc.name, func(t *testing.T) {
+			session, peer := muxPipe(t)
+			data := compressible(tc.size + 8)[:tc.size]
+			// the open is handled before the read loop reads on
+			if tc.id != 0 {
+				if _, err := peer.Write(muxBytes(MuxOpen, tc.id, nil)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var wire []byte
+			rest := data
+			for _, size := range tc.sizes {
+				wire = append(wire, muxBytes(MuxData, tc.id, rest[:size])...)
+				rest = rest[size:]
+			}
+			if _, err := peer.Write(wire); err != nil {
+				t.Fatal(err)
+			}
+			stream := session.Stream(tc.id)
+			if stream == nil {
+				t.Fatalf("stream %d not opened", tc.id)
+			}
+			got := make([]byte, len(data))
+			if _, err := io.ReadFull(stream, got); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("read differs from the payloads")
+			}
+		})
+	}
+}
+
+func TestMuxRejects(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		input []byte
+		// eof closes the peer after the input, the frame is cut short
+		eof bool
+	}{
+		{"truncated header", []byte{MuxData, 0, 0}, true},
+		{"truncated payload", muxBytes(MuxData, 0, []byte("abcdef"))[:MuxHeaderSize+3], true},
+		{"invalid type", muxBytes(MuxExtension-1, 0, nil), false},
+		{"short window", muxBytes(MuxWindow, 0, []byte{0, 1, 0}), false},
+		{"control opened", muxBytes(MuxOpen, 0, nil), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			session, peer := muxPipe(t)
+			go func() {
+				peer.Write(tc.input)
+				if tc.eof {
+					peer.Close()
+				}
+			}()
+			select {
+			case <-session.done:
+			case <-time.After(time.Second):
+				t.Fatal("session still open")
+			}
+			if n, err := session.ControlConn().Read(make([]byte, 64)); err == nil || n != 0 {
+				t.Errorf("read %d bytes, error %v", n, err)
+			}
+		})
+	}
+}
+
+func TestMuxStreamResets(t *testing.T) {
+	var pastWindow []byte
+	for range muxWindow / MuxMaxPayload {
+		pastWindow = append(pastWindow, muxBytes(MuxData, 3, make([]byte, MuxMaxPayload))...)
+	}
+	pastWindow = append(pastWindow, muxBytes(MuxData, 3, []byte{0})...)
+	for _, tc := range []struct {
+		name   string
+		resets bool
+		input  []byte
+		want   byte
+	}{
+		{"opened twice", true, muxBytes(MuxOpen, 3, nil), MuxReset},
+		{"opened twice without resets", false, muxBytes(MuxOpen, 3, nil), MuxClose},
+		{"past its window", true, pastWindow, MuxReset},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			session, peer := muxPipe(t)
+			if tc.resets {
+				session.AllowReset()
+			}
+			go peer.Write(append(muxBytes(MuxOpen, 3, nil), tc.input...))
+			typ, id, _ := readMux(t, peer)
+			if typ != tc.want || id != 3 {
+				t.Fatalf("frame %d of stream %d, want %d of 3", typ, id, tc.want)
+			}
+			if session.Stream(3) != nil {
+				t.Error("stream kept after its reset")
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package protocol
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+)
+
+// NoDelayOption is the option of the dial requests telling whether the
+// stream goes without Nagle's algorithm, so the proxy sets its side the same
+const NoDelayOption = "nodelay"
+
+// the tuning presets of the tunnels
+const (
+	// PresetLatency sends each write at once, as the interactive protocols
+	// need
+	PresetLatency = "latency"
+	// PresetThroughput gathers the small writes into full segments and
+	// frames
+	PresetThroughput = "throughput"
+)
+
+// ParseNoDelay parses a no delay of the flags or the dial requests, true or
+// false, nil when s is empty
+func ParseNoDelay(s string) (*bool, error) {
+	if s == "" {
+		return nil, nil
+	}
+	noDelay, err := strconv.ParseBool(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid nodelay, %s", s)
+	}
+	return &noDelay, nil
+}
+
+// ParsePreset is the no delay and the flush policy of the preset name
+func ParsePreset(name string) (bool, *FlushPolicy, error) {
+	switch name {
+	case PresetLatency:
+		return true, &FlushPolicy{}, nil
+	case PresetThroughput:
+		return false, &FlushPolicy{Delay: sizeDelay, Size: DefaultBufSize}, nil
+	}
+	return false, nil, fmt.Errorf("invalid preset, %s", name)
+}
+
+// SetNoDelay sets TCP_NODELAY on conn through the wrappers which tell their
+// NetConn, the connections shared by streams as the mux are left as they are
+func SetNoDelay(conn net.Conn, noDelay bool) {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			if err := c.SetNoDelay(noDelay); err != nil {
+				log.Printf("SetNoDelay: %s\n", err)
+			}
+			return
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return
+		}
+	}
+}
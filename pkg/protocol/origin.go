@@ -0,0 +1,67 @@
+package protocol
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+)
+
+// the options of the dial requests asking the dialer of a stream to wrap its
+// connection to the remote in TLS, for the clients which speak plain to a
+// remote taking TLS only
+const (
+	// TLSOption is how the certificate of the remote is verified,
+	// TLSVerify or TLSInsecure
+	TLSOption = "tls"
+	// SNIOption is the server name of the TLS, the host of the remote when
+	// missing
+	SNIOption = "sni"
+)
+
+// the values of TLSOption
+const (
+	TLSVerify   = "verify"
+	TLSInsecure = "insecure"
+)
+
+// ValidateTLS checks the value of TLSOption, empty originates no TLS
+func ValidateTLS(s string) error {
+	switch s {
+	case "", TLSVerify, TLSInsecure:
+		return nil
+	}
+	return fmt.Errorf("invalid tls, %s", s)
+}
+
+// OriginateTLS is the TLS client on conn to addr the options of a dial
+// request ask for, conn itself when they ask none. roots verify the remote,
+// the system roots when nil
+func OriginateTLS(ctx context.Context, conn net.Conn, addr string, opts map[string]string, roots *x509.CertPool) (net.Conn, error) {
+	mode := opts[TLSOption]
+	if mode == "" {
+		return conn, nil
+	}
+	if err := ValidateTLS(mode); err != nil {
+		return nil, err
+	}
+	name := opts[SNIOption]
+	if name == "" {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			name = host
+		}
+	}
+	config := &tls.Config{
+		ServerName:         name,
+		RootCAs:            roots,
+		InsecureSkipVerify: mode == TLSInsecure,
+		MinVersion:         tls.VersionTLS12,
+	}
+	tconn := tls.Client(conn, config)
+	if err := tconn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, &DialError{Hop: HopRemote, Kind: KindFailed, Msg: fmt.Sprintf("tls to %s: %s", addr, err)}
+	}
+	return tconn, nil
+}
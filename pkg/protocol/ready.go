@@ -0,0 +1,58 @@
+package protocol
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Listeners tracks the listeners of a client, proxy or relay for their
+// health checks, a listener is expected until it's up and forgotten once
+// done
+type Listeners struct {
+	lock sync.Mutex
+	up   map[string]bool
+}
+
+// Expect records the listener name as not up yet
+func (l *Listeners) Expect(name string) {
+	l.set(name, false)
+}
+
+// Up records the listener name as listening
+func (l *Listeners) Up(name string) {
+	l.set(name, true)
+}
+
+// Done forgets the listener name
+func (l *Listeners) Done(name string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.up, name)
+}
+
+func (l *Listeners) set(name string, up bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.up == nil {
+		l.up = map[string]bool{}
+	}
+	l.up[name] = up
+}
+
+// Err tells the listeners expected but not up, nil when all are
+func (l *Listeners) Err() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var down []string
+	for name, up := range l.up {
+		if !up {
+			down = append(down, name)
+		}
+	}
+	if len(down) == 0 {
+		return nil
+	}
+	sort.Strings(down)
+	return fmt.Errorf("not listening at %v", down)
+}
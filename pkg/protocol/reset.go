@@ -0,0 +1,40 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"syscall"
+)
+
+// ErrReset is the error of the reads of a stream the peer reset
+var ErrReset = fmt.Errorf("stream reset, %w", syscall.ECONNRESET)
+
+// IsReset tells whether err is of a connection reset, not closed
+func IsReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET)
+}
+
+// ResetConn makes the close of conn a reset, RST on TCP and a reset frame on
+// the mux, through the wrappers which tell their NetConn. The other
+// connections are closed as they are
+func ResetConn(conn net.Conn) {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			// close sends RST instead of FIN with no linger
+			if err := c.SetLinger(0); err != nil {
+				log.Printf("SetLinger: %s\n", err)
+			}
+			return
+		case *muxStream:
+			c.reset.Store(true)
+			return
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return
+		}
+	}
+}
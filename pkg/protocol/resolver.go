@@ -0,0 +1,239 @@
+package protocol
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dworld/channel/pkg/transport"
+)
+
+// DefaultResolveTimeout is how long a DNS server of a Resolver has to answer
+// when its Timeout is 0
+const DefaultResolveTimeout = 5 * time.Second
+
+// ResolverSystem is the server of the Resolver asking the system resolver,
+// as a fallback of the others
+const ResolverSystem = "system"
+
+// resolver metrics
+var (
+	resolveCacheHits = NewCounter("resolve_cache_hits")
+	resolveFailures  = NewCounter("resolve_failures")
+)
+
+// Resolver resolves the host names of the remotes through Servers in place of
+// the system resolver, a nil Resolver leaves them to the system
+type Resolver struct {
+	// Servers are the DNS servers, host:port or host of port 53,
+	// tls://host:port of DNS over TLS, port 853 by default, an https:// URL
+	// of DNS over HTTPS, or ResolverSystem, each is asked in turn once those
+	// before failed
+	Servers []string
+	// Timeout is how long a server has to answer
+	Timeout time.Duration
+	// CacheTTL is how long the addresses of a name are reused, they're
+	// asked each time when 0
+	CacheTTL time.Duration
+	// Bind is where the queries to the servers originate from, those of the
+	// routes when nil
+	Bind *transport.Bind
+
+	resolvers []dnsServer
+
+	lock  sync.Mutex
+	cache map[string]resolved
+}
+
+// dnsServer is the go DNS client asking addr alone
+type dnsServer struct {
+	addr     string
+	resolver *net.Resolver
+}
+
+type resolved struct {
+	ips     []string
+	expires time.Time
+}
+
+// Init checks the servers, before the first lookup
+func (r *Resolver) Init() error {
+	if len(r.Servers) == 0 {
+		return errors.New("resolver needs servers")
+	}
+	if r.Timeout <= 0 {
+		r.Timeout = DefaultResolveTimeout
+	}
+	r.resolvers = nil
+	for _, server := range r.Servers {
+		resolver, err := newResolver(server, r.Bind)
+		if err != nil {
+			return err
+		}
+		r.resolvers = append(r.resolvers, dnsServer{addr: server, resolver: resolver})
+	}
+	return nil
+}
+
+// newResolver is the resolver asking server alone from bind, the system
+// resolver for ResolverSystem
+func newResolver(server string, bind *transport.Bind) (*net.Resolver, error) {
+	var dial func(ctx context.Context, network string) (net.Conn, error)
+	switch {
+	case server == ResolverSystem:
+		return net.DefaultResolver, nil
+	case strings.HasPrefix(server, "https://"):
+		u, err := url.Parse(server)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid resolver %s", server)
+		}
+		client := &http.Client{Transport: &http.Transport{ForceAttemptHTTP2: true, DialContext: bind.Dialer("tcp").DialContext}}
+		dial = func(ctx context.Context, _ string) (net.Conn, error) {
+			return newDoHConn(ctx, client, server), nil
+		}
+	case strings.HasPrefix(server, "tls://"):
+		addr, err := resolverAddr(strings.TrimPrefix(server, "tls://"), "853")
+		if err != nil {
+			return nil, err
+		}
+		host, _, _ := net.SplitHostPort(addr)
+		dialer := &tls.Dialer{NetDialer: bind.Dialer("tcp"), Config: &tls.Config{ServerName: host}}
+		dial = func(ctx context.Context, _ string) (net.Conn, error) {
+			// not a PacketConn, the go DNS client frames the messages as
+			// on TCP
+			return dialer.DialContext(ctx, "tcp", addr)
+		}
+	default:
+		addr, err := resolverAddr(server, "53")
+		if err != nil {
+			return nil, err
+		}
+		dial = func(ctx context.Context, network string) (net.Conn, error) {
+			return bind.Dialer(network).DialContext(ctx, network, addr)
+		}
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dial(ctx, network)
+		},
+	}, nil
+}
+
+// resolverAddr is host:port of server, with port when server is a host
+func resolverAddr(server, port string) (string, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, port)
+	}
+	if host, _, err := net.SplitHostPort(server); err != nil || host == "" {
+		return "", fmt.Errorf("invalid resolver %s", server)
+	}
+	return server, nil
+}
+
+// LookupHost is the IPs of host, host itself when it's an IP
+func (r *Resolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{host}, nil
+	}
+	if r == nil {
+		return net.DefaultResolver.LookupHost(ctx, host)
+	}
+	if ips := r.cached(host); ips != nil {
+		resolveCacheHits.Add(1)
+		return ips, nil
+	}
+	var err error
+	for _, server := range r.resolvers {
+		var ips []string
+		lookupCtx, cancel := context.WithTimeout(ctx, r.Timeout)
+		ips, err = server.resolver.LookupHost(lookupCtx, host)
+		cancel()
+		if err == nil {
+			r.store(host, ips)
+			return ips, nil
+		}
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) {
+			// it tells the server of resolv.conf
+			dnsErr.Server = server.addr
+		}
+		if ctx.Err() != nil || dnsErr != nil && dnsErr.IsNotFound {
+			// the other servers would tell the same
+			break
+		}
+	}
+	resolveFailures.Add(1)
+	return nil, err
+}
+
+func (r *Resolver) cached(host string) []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	entry, ok := r.cache[host]
+	if !ok {
+		return nil
+	}
+	if !time.Now().Before(entry.expires) {
+		delete(r.cache, host)
+		return nil
+	}
+	return entry.ips
+}
+
+func (r *Resolver) store(host string, ips []string) {
+	if r.CacheTTL <= 0 {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.cache == nil {
+		r.cache = map[string]resolved{}
+	}
+	now := time.Now()
+	for name, entry := range r.cache {
+		if !now.Before(entry.expires) {
+			delete(r.cache, name)
+		}
+	}
+	r.cache[host] = resolved{ips: ips, expires: now.Add(r.CacheTTL)}
+}
+
+// DialContext dials addr, host:port, at the addresses of its host in turn
+// until one connects
+func (r *Resolver) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return r.DialFrom(ctx, &net.Dialer{}, network, addr)
+}
+
+// DialFrom is DialContext with dialer, which sets where the connections
+// originate from
+func (r *Resolver) DialFrom(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	if r == nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := r.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip, port)); err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,90 @@
+package protocol
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// spliceChunk is how many bytes a splice copies before counting them, so the
+// live counts of the spliced streams move along
+const spliceChunk = 64 * 1024
+
+// CopyConn copies src to dst and returns the bytes copied, when both are
+// plain TCP connections it uses TCPConn.ReadFrom which splices the bytes in
+// the kernel on Linux, otherwise it falls back to the pooled buffer copy
+func (opts Options) CopyConn(dst, src net.Conn) int64 {
+	n, _ := opts.copyConn(dst, src, nil)
+	return n
+}
+
+// copyConn is CopyConn adding the bytes to count as they are copied when
+// it's not nil, the error is nil once src is done
+func (opts Options) copyConn(dst, src net.Conn, count *atomic.Int64) (int64, error) {
+	dstTCP, ok := dst.(*net.TCPConn)
+	if !ok {
+		return opts.copyWithError(dst, src, count)
+	}
+	srcTCP, ok := src.(*net.TCPConn)
+	if !ok {
+		return opts.copyWithError(dst, src, count)
+	}
+	if count == nil {
+		n, err := dstTCP.ReadFrom(srcTCP)
+		if err != nil {
+			log.Printf("Splice: %s\n", err)
+		}
+		return n, err
+	}
+	// ReadFrom still splices a TCP connection behind a LimitedReader
+	var total int64
+	for {
+		if opts.IdleTimeout > 0 {
+			// a trickle is counted before the idle timeout runs out, not
+			// once the chunk is full
+			srcTCP.SetReadDeadline(time.Now().Add(idleTick(opts.IdleTimeout)))
+		}
+		n, err := dstTCP.ReadFrom(&io.LimitedReader{R: srcTCP, N: spliceChunk})
+		total += n
+		count.Add(n)
+		if opts.IdleTimeout > 0 && errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Splice: %s\n", err)
+			return total, err
+		}
+		if n < spliceChunk {
+			return total, nil
+		}
+	}
+}
+
+func (opts Options) copyWithError(dst io.Writer, src io.Reader, count *atomic.Int64) (int64, error) {
+	buf := getBuffer(opts.BufSize)
+	defer putBuffer(buf)
+	if count != nil {
+		dst = &countWriter{w: dst, n: count}
+	}
+	n, err := io.CopyBuffer(dst, src, *buf)
+	if err != nil {
+		log.Printf("Copy: %s\n", err)
+	}
+	return n, err
+}
+
+// countWriter adds the bytes written to n
+type countWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n.Add(int64(n))
+	return n, err
+}
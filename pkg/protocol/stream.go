@@ -0,0 +1,158 @@
+package protocol
+
+import (
+	"context"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBufSize is the default size of the buffers used to copy streams
+const DefaultBufSize = 32 * 1024
+
+// Options tunes how the control and data connections are written
+type Options struct {
+	// BufSize is the size of the buffers used to copy streams
+	BufSize int
+	// AckDelay is how long control messages are batched
+	AckDelay time.Duration
+	// FlushDelay is how long small writes to the channel are coalesced
+	FlushDelay time.Duration
+	// FlushSize is how many bytes are coalesced before they're written,
+	// BufSize when 0
+	FlushSize int
+	// IdleTimeout closes the streams no byte moved on either way for so
+	// long, never when 0
+	IdleTimeout time.Duration
+}
+
+// WithDefaults fills the zero options with their defaults
+func (opts Options) WithDefaults() Options {
+	if opts.BufSize <= 0 {
+		opts.BufSize = DefaultBufSize
+	}
+	return opts
+}
+
+// WrapStream applies the negotiated codec and write coalescing to a data
+// connection
+func (opts Options) WrapStream(conn net.Conn, codec string) net.Conn {
+	if codec != "" {
+		conn = newCodecConn(conn, GetCodec(codec))
+	}
+	if opts.FlushDelay > 0 {
+		size := opts.FlushSize
+		if size <= 0 {
+			size = opts.BufSize
+		}
+		conn = newCoalesceConn(conn, opts.FlushDelay, size)
+	}
+	return conn
+}
+
+// Pipe copies the connections both ways, a side done half closes the other
+// so the copy back goes on, and closes them once both are done, at once when
+// either can't be half closed, reset when it was reset, or once ctx is done
+// which aborts the copies, conn is the edge of the stream the stats count
+func (opts Options) Pipe(ctx context.Context, name string, conn net.Conn, peerName string, peer net.Conn) StreamStats {
+	var info StreamInfo
+	if addr := conn.RemoteAddr(); addr != nil {
+		info.From = addr.String()
+	}
+	return opts.PipeStream(ctx, info, name, conn, peerName, peer)
+}
+
+// PipeStream is Pipe of the stream of info, which LiveStreams lists while
+// it's piped
+func (opts Options) PipeStream(ctx context.Context, info StreamInfo, name string, conn net.Conn, peerName string, peer net.Conn) StreamStats {
+	streamsOpen.Add(1)
+	streamsTotal.Add(1)
+	defer streamsOpen.Add(-1)
+	ls := addLive(info)
+	defer removeLive(ls)
+	start := time.Now()
+	// the reason is of the first copy done, or of ctx
+	var once sync.Once
+	var reason string
+	end := func(r string) { once.Do(func() { reason = r }) }
+	stop := context.AfterFunc(ctx, func() {
+		end(ReasonAborted)
+		conn.Close()
+		peer.Close()
+	})
+	defer stop()
+	if opts.IdleTimeout > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go watchIdle(ls, opts.IdleTimeout, done, func() {
+			end(ReasonIdle)
+			conn.Close()
+			peer.Close()
+		})
+	}
+	// a reset of either side resets the other, at once
+	reset := func() {
+		ResetConn(conn)
+		ResetConn(peer)
+	}
+	// done ends a copy to dst, a clean end is passed on as a half close,
+	// otherwise both are closed which ends the other copy
+	done := func(dst net.Conn, err error) bool {
+		if IsReset(err) {
+			reset()
+		} else if err == nil && CloseWrite(dst) == nil {
+			return true
+		}
+		conn.Close()
+		peer.Close()
+		return false
+	}
+	out := make(chan int64, 1)
+	go func() {
+		n, err := opts.copyConn(conn, peer, &ls.out)
+		end(closeReason(peerName, err))
+		done(conn, err)
+		out <- n
+	}()
+	in, err := opts.copyConn(peer, conn, &ls.in)
+	end(closeReason(name, err))
+	halfClosed := done(peer, err)
+	var outN int64
+	if halfClosed {
+		// the copy back goes on until peer is done too
+		outN = <-out
+	}
+	CloseConn(peerName, peer)
+	CloseConn(name, conn)
+	if !halfClosed {
+		outN = <-out
+	}
+	stats := StreamStats{In: in, Out: outN, Duration: time.Since(start), Reason: reason}
+	observe("stream_duration_seconds", stats.Duration)
+	metrics().Observe("stream_bytes", float64(stats.In+stats.Out))
+	return stats
+}
+
+// ReasonAborted is the close reason of the streams aborted by their
+// context, as on shutdown
+const ReasonAborted = "aborted"
+
+// closeReason is the close reason of the copy from the connection name
+// ending with err
+func closeReason(name string, err error) string {
+	if IsReset(err) {
+		return strings.ToLower(name) + " reset"
+	}
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	return strings.ToLower(name) + " closed"
+}
+
+// CloseConn closes conn and logs it
+func CloseConn(name string, conn net.Conn) {
+	log.Printf("close %s conn %v\n", name, conn)
+	conn.Close()
+}
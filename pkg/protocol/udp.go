@@ -0,0 +1,132 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// NetOption is the option of the dial requests naming the network of the
+// remote, tcp when missing
+const NetOption = "net"
+
+// NetUDP is the network of the udp streams, they carry the datagrams each
+// after its length in 2 bytes
+const NetUDP = "udp"
+
+const (
+	// MaxDatagram is the largest datagram of a udp stream
+	MaxDatagram = 65535
+	// UDPIdleTimeout ends a udp stream once no datagram came from its
+	// remote for so long, UDP tells no close
+	UDPIdleTimeout = 2 * time.Minute
+)
+
+var errDatagramSize = errors.New("datagram too large")
+
+// DatagramConn reads and writes the datagrams of a udp stream
+type DatagramConn struct {
+	net.Conn
+	r    *bufio.Reader
+	lock sync.Mutex
+}
+
+// NewDatagramConn is the datagrams of the udp stream conn
+func NewDatagramConn(conn net.Conn) *DatagramConn {
+	return &DatagramConn{Conn: conn, r: bufio.NewReader(conn)}
+}
+
+// ReadDatagram reads the next datagram
+func (c *DatagramConn) ReadDatagram() ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(c.r, size[:]); err != nil {
+		return nil, err
+	}
+	p := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(c.r, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// WriteDatagram writes p as a datagram, whole
+func (c *DatagramConn) WriteDatagram(p []byte) error {
+	if len(p) > MaxDatagram {
+		return errDatagramSize
+	}
+	b := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(b, uint16(len(p)))
+	copy(b[2:], p)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_, err := c.Conn.Write(b)
+	return err
+}
+
+func (c *DatagramConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// udpStream is the connected UDP socket of the remote of a udp stream, its
+// reads are the datagrams framed as on the stream and its writes are the
+// framed datagrams sent each on its own, so the streams pipe it as they do
+// a TCP connection
+type udpStream struct {
+	net.Conn
+	buf []byte
+	// read is what remains to be read of the datagram framed in buf
+	read []byte
+	// written is the frames written not whole yet
+	written []byte
+}
+
+// UDPStream frames the datagrams of conn, a connected UDP socket, for a udp
+// stream. The reads end once no datagram came for UDPIdleTimeout
+func UDPStream(conn net.Conn) net.Conn {
+	return &udpStream{Conn: conn, buf: make([]byte, 2+MaxDatagram)}
+}
+
+func (c *udpStream) Read(p []byte) (int, error) {
+	if len(c.read) == 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(UDPIdleTimeout))
+		n, err := c.Conn.Read(c.buf[2:])
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		binary.BigEndian.PutUint16(c.buf, uint16(n))
+		c.read = c.buf[:2+n]
+	}
+	n := copy(p, c.read)
+	c.read = c.read[n:]
+	return n, nil
+}
+
+func (c *udpStream) Write(p []byte) (int, error) {
+	c.written = append(c.written, p...)
+	for len(c.written) >= 2 {
+		size := 2 + int(binary.BigEndian.Uint16(c.written))
+		if len(c.written) < size {
+			break
+		}
+		if _, err := c.Conn.Write(c.written[2:size]); err != nil {
+			return 0, err
+		}
+		c.written = c.written[size:]
+	}
+	if len(c.written) == 0 {
+		c.written = nil
+	}
+	return len(p), nil
+}
+
+func (c *udpStream) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,37 @@
+package protocol
+
+import (
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// UnixScheme prefixes the addresses of unix sockets, e.g.
+// unix:///var/run/docker.sock
+const UnixScheme = "unix://"
+
+// SplitNetwork is the network of addr and its address in it, unix and the
+// path of a UnixScheme address, tcp and addr itself otherwise
+func SplitNetwork(addr string) (string, string) {
+	if path, ok := strings.CutPrefix(addr, UnixScheme); ok {
+		return "unix", path
+	}
+	return "tcp", addr
+}
+
+// RemoveStaleSocket removes the unix socket at path which no process listens
+// at anymore, as a process killed leaves, so it can be listened again
+func RemoveStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		// the process still listens, the listen fails on it
+		conn.Close()
+		return nil
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,234 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// VerifyPrefix is the raddr prefix of the verify streams, e.g. "verify:65536",
+// the proxy reads that much of VerifyPattern, replies a verify line of what
+// it read and sends the pattern back, so both directions of the channel are
+// checked to pass the bytes untouched
+const VerifyPrefix = "verify:"
+
+// MaxVerifySize bounds the pattern of a verify stream
+const MaxVerifySize = 16 << 20
+
+// verifySection is a part of the pattern looking like what the middleboxes
+// rewrite
+type verifySection struct {
+	name string
+	data []byte
+}
+
+var verifySections = []verifySection{
+	{"http", []byte("GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\nUser-Agent: channel-verify\r\nAccept-Encoding: gzip\r\nConnection: keep-alive\r\n\r\n")},
+	{"tls", fakeClientHello("example.com")},
+	{"text", []byte("line one\nline two\r\nline three\r\n\tcafé ü €\x00\n")},
+	{"bytes", allBytes()},
+	{"zeros", make([]byte, 256)},
+	{"random", pseudoRandom(1024)},
+}
+
+// verifyCycle is the sections back to back, the pattern repeats it
+var verifyCycle []byte
+
+func init() {
+	for _, s := range verifySections {
+		verifyCycle = append(verifyCycle, s.data...)
+	}
+}
+
+// VerifyPattern is the size bytes sent on a verify stream, the same in both
+// directions
+func VerifyPattern(size int) []byte {
+	b := make([]byte, size)
+	for i := 0; i < size; i += len(verifyCycle) {
+		copy(b[i:], verifyCycle)
+	}
+	return b
+}
+
+// ParseVerifyAddr is the size of a verify raddr, ok is false for another raddr
+func ParseVerifyAddr(raddr string) (int, bool) {
+	if !strings.HasPrefix(raddr, VerifyPrefix) {
+		return 0, false
+	}
+	size, err := strconv.Atoi(raddr[len(VerifyPrefix):])
+	if err != nil || size <= 0 || size > MaxVerifySize {
+		return 0, false
+	}
+	return size, true
+}
+
+// VerifyResult is what a side of a verify stream received, Offset is the
+// first byte differing from the pattern, -1 when all of it came untouched
+type VerifyResult struct {
+	Offset   int    `json:"offset"`
+	Received int    `json:"received"`
+	Section  string `json:"section,omitempty"`
+	Want     string `json:"want,omitempty"`
+	Got      string `json:"got,omitempty"`
+	Suspect  string `json:"suspect,omitempty"`
+}
+
+// verifyContext is how many bytes from the offset are kept in Want and Got
+const verifyContext = 16
+
+// CompareVerify compares got with the pattern want and guesses what
+// transformed it
+func CompareVerify(want, got []byte) VerifyResult {
+	r := VerifyResult{Offset: -1, Received: len(got)}
+	n := len(want)
+	if len(got) < n {
+		n = len(got)
+	}
+	i := 0
+	for i < n && want[i] == got[i] {
+		i++
+	}
+	if i == len(want) && len(got) == len(want) {
+		return r
+	}
+	r.Offset = i
+	r.Section = sectionAt(i)
+	r.Want = hexAt(want, i)
+	r.Got = hexAt(got, i)
+	r.Suspect = suspect(want[i:], got[i:], r.Section)
+	return r
+}
+
+// hexAt is the hex of the verifyContext bytes of b from i
+func hexAt(b []byte, i int) string {
+	end := i + verifyContext
+	if end > len(b) {
+		end = len(b)
+	}
+	return hex.EncodeToString(b[i:end])
+}
+
+// suspect guesses the transformation of the bytes from the first differing
+// one, want and got start there
+func suspect(want, got []byte, section string) string {
+	switch {
+	case len(got) == 0:
+		return "truncated, a middlebox or the remote end closed the stream early"
+	case len(want) == 0:
+		return "bytes added past the end"
+	case bytes.HasPrefix(got, []byte("HTTP/")):
+		return "an HTTP proxy answering in place of the peer"
+	case len(got) >= 3 && got[0] == 0x16 && got[1] == 0x03 && section != "tls":
+		return "TLS interception, a TLS handshake appeared in the stream"
+	case want[0] == '\r' && got[0] == '\n':
+		return "line endings rewritten, CRLF to LF"
+	case want[0] == '\n' && got[0] == '\r':
+		return "line endings rewritten, LF to CRLF"
+	case want[0]&0x80 != 0 && got[0] == want[0]&0x7f:
+		return "8-bit stripping, the high bit of the bytes cleared"
+	case section == "http":
+		return "HTTP proxy rewriting the requests"
+	case section == "tls":
+		return "TLS interception (MITM), the ClientHello rewritten"
+	case section == "zeros" || section == "random":
+		return "payload rewritten, likely compression or a content filter"
+	}
+	return "bytes corrupted in transit"
+}
+
+// sectionAt names the section of the pattern at offset
+func sectionAt(offset int) string {
+	offset %= len(verifyCycle)
+	for _, s := range verifySections {
+		if offset < len(s.data) {
+			return s.name
+		}
+		offset -= len(s.data)
+	}
+	return ""
+}
+
+// Options are the options of the verify line of r
+func (r VerifyResult) Options() map[string]string {
+	opts := map[string]string{
+		"offset":   strconv.Itoa(r.Offset),
+		"received": strconv.Itoa(r.Received),
+	}
+	if r.Offset >= 0 {
+		opts["section"] = r.Section
+		opts["want"] = r.Want
+		opts["got"] = r.Got
+		opts["suspect"] = r.Suspect
+	}
+	return opts
+}
+
+// ParseVerifyResult is the VerifyResult of the options of a verify line
+func ParseVerifyResult(opts map[string]string) (VerifyResult, error) {
+	offset, err := strconv.Atoi(opts["offset"])
+	if err != nil {
+		return VerifyResult{}, fmt.Errorf("invalid verify offset, %s", opts["offset"])
+	}
+	received, _ := strconv.Atoi(opts["received"])
+	return VerifyResult{
+		Offset:   offset,
+		Received: received,
+		Section:  opts["section"],
+		Want:     opts["want"],
+		Got:      opts["got"],
+		Suspect:  opts["suspect"],
+	}, nil
+}
+
+// fakeClientHello is a TLS 1.2 ClientHello record for host, as the TLS
+// interceptors expect it
+func fakeClientHello(host string) []byte {
+	sni := []byte{0, 0}
+	sni = appendUint16(sni, len(host)+5)
+	sni = appendUint16(sni, len(host)+3)
+	sni = append(sni, 0)
+	sni = appendUint16(sni, len(host))
+	sni = append(sni, host...)
+
+	hello := []byte{0x03, 0x03}
+	hello = append(hello, pseudoRandom(32)...)
+	hello = append(hello, 0)                            // session id
+	hello = append(hello, 0, 4, 0x13, 0x01, 0xc0, 0x2f) // cipher suites
+	hello = append(hello, 1, 0)                         // compression
+	hello = appendUint16(hello, len(sni))
+	hello = append(hello, sni...)
+
+	handshake := []byte{0x01, 0, byte(len(hello) >> 8), byte(len(hello))}
+	handshake = append(handshake, hello...)
+	record := []byte{0x16, 0x03, 0x01}
+	record = appendUint16(record, len(handshake))
+	return append(record, handshake...)
+}
+
+func appendUint16(b []byte, v int) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func allBytes() []byte {
+	b := make([]byte, 256)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return b
+}
+
+// pseudoRandom is n bytes of a fixed xorshift sequence, incompressible but
+// the same on both sides
+func pseudoRandom(n int) []byte {
+	b := make([]byte, n)
+	x := uint32(2463534242)
+	for i := range b {
+		x ^= x << 13
+		x ^= x >> 17
+		x ^= x << 5
+		b[i] = byte(x)
+	}
+	return b
+}
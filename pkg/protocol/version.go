@@ -0,0 +1,75 @@
+package protocol
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+// the build of the binary, set with -ldflags, as
+// -X github.com/dworld/channel/pkg/protocol.Version=1.2.0, the build info of
+// the module and of the vcs fills those left empty
+var (
+	// Version is the semantic version of the release
+	Version string
+	// Commit is the git commit built
+	Commit string
+	// BuildDate is when the binary was built
+	BuildDate string
+)
+
+// Build describes the build of the binary
+type Build struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit,omitempty"`
+	Date    string `json:"date,omitempty"`
+	Go      string `json:"go"`
+}
+
+var (
+	buildOnce sync.Once
+	build     Build
+)
+
+// BuildInfo is the build of the binary, of the ldflags or else of the build
+// info, the version is dev when neither tells it
+func BuildInfo() Build {
+	buildOnce.Do(func() {
+		build = Build{Version: Version, Commit: Commit, Date: BuildDate, Go: runtime.Version()}
+		info, ok := debug.ReadBuildInfo()
+		if ok {
+			if v := info.Main.Version; build.Version == "" && v != "" && v != "(devel)" {
+				build.Version = v
+			}
+			settings := map[string]string{}
+			for _, s := range info.Settings {
+				settings[s.Key] = s.Value
+			}
+			if build.Commit == "" && settings["vcs.revision"] != "" {
+				build.Commit = settings["vcs.revision"]
+				if settings["vcs.modified"] == "true" {
+					build.Commit += "-dirty"
+				}
+			}
+			if build.Date == "" {
+				build.Date = settings["vcs.time"]
+			}
+		}
+		if build.Version == "" {
+			build.Version = "dev"
+		}
+	})
+	return build
+}
+
+func (b Build) String() string {
+	s := "channel " + b.Version
+	if b.Commit != "" {
+		s += " commit " + b.Commit
+	}
+	if b.Date != "" {
+		s += " built " + b.Date
+	}
+	return fmt.Sprintf("%s %s %s/%s", s, b.Go, runtime.GOOS, runtime.GOARCH)
+}
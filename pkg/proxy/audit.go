@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// errAuditKey is a signed audit log verified without its key
+var errAuditKey = errors.New("signed audit line, the key is needed")
+
+// AuditLog appends a line for each destination the proxy dials to a file
+// apart from the logs, before it's dialed. The lines are synced to disk one
+// by one and a dial whose line can't be written is refused, so no remote is
+// dialed unrecorded. Hashed, the lines are chained, each holds the hash of
+// the line before and its own, so a line removed or edited breaks the chain,
+// with a key the hashes are signed with HMAC-SHA256 as well
+type AuditLog struct {
+	lock sync.Mutex
+	f    *os.File
+	hash bool
+	key  []byte
+	seq  uint64
+	prev string
+}
+
+// AuditEntry is a line of the audit log. Gateway is the channel of the
+// client the dial request came from, or the hop listener for the chained
+// streams, and From the connection it's for, the one the client accepted or
+// the hop before
+type AuditEntry struct {
+	Seq     uint64 `json:"seq"`
+	Time    string `json:"time"`
+	Gateway string `json:"gateway,omitempty"`
+	From    string `json:"from,omitempty"`
+	To      string `json:"to"`
+	Prev    string `json:"prev,omitempty"`
+	Hash    string `json:"hash,omitempty"`
+	Sig     string `json:"sig,omitempty"`
+}
+
+// OpenAuditLog opens the audit log at path to append to it, the sequence and
+// the chain go on from its last line. A key signs the lines and implies hash
+func OpenAuditLog(path string, hash bool, key []byte) (*AuditLog, error) {
+	audit := &AuditLog{hash: hash || key != nil, key: key}
+	if f, err := os.Open(path); err == nil {
+		last, err := lastAuditEntry(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("audit log %s: %s", path, err)
+		}
+		audit.seq, audit.prev = last.Seq, last.Hash
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	audit.f = f
+	return audit, nil
+}
+
+// lastAuditEntry is the last line of the audit log r, zero when it's empty
+func lastAuditEntry(r io.Reader) (AuditEntry, error) {
+	var last AuditEntry
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		last = AuditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &last); err != nil {
+			return last, err
+		}
+	}
+	return last, scanner.Err()
+}
+
+// Dial records the dial to raddr of the request of from on gateway, an error
+// refuses the dial
+func (audit *AuditLog) Dial(gateway, from, raddr string) error {
+	audit.lock.Lock()
+	defer audit.lock.Unlock()
+	entry := AuditEntry{
+		Seq:     audit.seq + 1,
+		Time:    time.Now().UTC().Format(time.RFC3339Nano),
+		Gateway: gateway,
+		From:    from,
+		To:      raddr,
+	}
+	if audit.hash {
+		entry.Prev = audit.prev
+		entry.Hash, entry.Sig = audit.sign(entry)
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := audit.f.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("audit log: %s", err)
+	}
+	if err := audit.f.Sync(); err != nil {
+		return fmt.Errorf("audit log: %s", err)
+	}
+	audit.seq, audit.prev = entry.Seq, entry.Hash
+	return nil
+}
+
+// sign is the hash of entry without its hash and signature, and its
+// signature when there's a key
+func (audit *AuditLog) sign(entry AuditEntry) (string, string) {
+	entry.Hash, entry.Sig = "", ""
+	b, _ := json.Marshal(entry)
+	sum := sha256.Sum256(b)
+	hash := hex.EncodeToString(sum[:])
+	if audit.key == nil {
+		return hash, ""
+	}
+	mac := hmac.New(sha256.New, audit.key)
+	mac.Write([]byte(hash))
+	return hash, hex.EncodeToString(mac.Sum(nil))
+}
+
+// Close closes the file of the audit log
+func (audit *AuditLog) Close() error {
+	return audit.f.Close()
+}
+
+// VerifyAudit checks the chain of the audit log r from its first line, of seq
+// 1, and the signatures of its lines with key, it returns how many lines are
+// fine before the first which isn't and what's wrong with it
+func VerifyAudit(r io.Reader, key []byte) (int, error) {
+	check := &AuditLog{key: key}
+	var seq uint64
+	prev := ""
+	n := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return n, fmt.Errorf("line %d: %s", n+1, err)
+		}
+		// the lines cut off the head would leave a chain fine from the new
+		// first one
+		if n == 0 && entry.Seq != 1 {
+			return n, fmt.Errorf("line 1: seq %d, the lines before are missing", entry.Seq)
+		}
+		if n == 0 && entry.Prev != "" {
+			return n, fmt.Errorf("line 1: prev set, the lines before are missing")
+		}
+		if n > 0 && entry.Seq != seq+1 {
+			return n, fmt.Errorf("line %d: seq %d after %d, lines missing", n+1, entry.Seq, seq)
+		}
+		if entry.Hash == "" {
+			return n, fmt.Errorf("line %d: not hashed", n+1)
+		}
+		if n > 0 && entry.Prev != prev {
+			return n, fmt.Errorf("line %d: chain broken, prev isn't the hash of the line before", n+1)
+		}
+		if entry.Sig != "" && key == nil {
+			return n, fmt.Errorf("line %d: %s", n+1, errAuditKey)
+		}
+		hash, sig := check.sign(entry)
+		if hash != entry.Hash {
+			return n, fmt.Errorf("line %d: hash mismatch, the line was edited", n+1)
+		}
+		if key != nil && !hmac.Equal([]byte(sig), []byte(entry.Sig)) {
+			return n, fmt.Errorf("line %d: invalid signature", n+1)
+		}
+		seq, prev = entry.Seq, entry.Hash
+		n++
+	}
+	return n, scanner.Err()
+}
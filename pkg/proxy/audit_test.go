@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// auditLines writes n dials to a new audit log signed with key and returns
+// its lines
+func auditLines(t *testing.T, key []byte, n int) []string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	for _, dials := range []int{n / 2, n - n/2} {
+		// opened again, the chain goes on
+		audit, err := OpenAuditLog(path, true, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < dials; i++ {
+			if err := audit.Dial("127.0.0.1:7000", "10.0.0.1:5000", "example.com:443"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		audit.Close()
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.SplitAfter(strings.TrimSuffix(string(b), "\n"), "\n")
+}
+
+func TestVerifyAudit(t *testing.T) {
+	key := []byte("secret")
+	lines := auditLines(t, key, 5)
+	if len(lines) != 5 {
+		t.Fatalf("%d lines, want 5", len(lines))
+	}
+	edited := append([]string(nil), lines...)
+	edited[2] = strings.Replace(edited[2], "example.com", "example.org", 1)
+	for _, tc := range []struct {
+		name  string
+		lines []string
+		key   []byte
+		n     int
+		err   string
+	}{
+		{"intact", lines, key, 5, ""},
+		{"head cut", lines[2:], key, 0, "line 1: seq 3"},
+		{"line removed", append(append([]string(nil), lines[:2]...), lines[3:]...), key, 2, "line 3: seq 4 after 2"},
+		{"line edited", edited, key, 2, "line 3: hash mismatch"},
+		{"no key", lines, nil, 0, "the key is needed"},
+		{"other key", lines, []byte("other"), 0, "invalid signature"},
+		{"empty", nil, key, 0, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			n, err := VerifyAudit(strings.NewReader(strings.Join(tc.lines, "")), tc.key)
+			if n != tc.n {
+				t.Errorf("%d lines fine, want %d", n, tc.n)
+			}
+			if tc.err == "" && err != nil || tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+				t.Errorf("err %v, want %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestVerifyAuditGenesis(t *testing.T) {
+	// the first line of a log its head was cut off of and whose seq was set
+	// back to 1 still has the hash of the line before
+	lines := auditLines(t, nil, 2)
+	forged := bytes.Replace([]byte(lines[1]), []byte(`"seq":2`), []byte(`"seq":1`), 1)
+	n, err := VerifyAudit(bytes.NewReader(forged), nil)
+	if n != 0 || err == nil || !strings.Contains(err.Error(), "prev set") {
+		t.Fatalf("%d lines fine, err %v, want the prev of line 1 refused", n, err)
+	}
+}
@@ -0,0 +1,275 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dworld/channel/pkg/protocol"
+)
+
+// backendSetLimit is the number of backend lists whose turn is kept, past it
+// they start over
+const backendSetLimit = 4096
+
+// HealthTCP is the health check connecting to the backends, the others are
+// the path of an HTTP GET
+const HealthTCP = "tcp"
+
+// backend is a backend of a raddr list, down once it failed HealthFall
+// checks in a row until it passes HealthRise
+type backend struct {
+	addr   string
+	weight int
+	down   atomic.Bool
+	// current is the smooth weighted round-robin of the set, under its lock
+	current int
+	// streak counts the checks in a row whose result differs from down, of
+	// the checking goroutine only
+	streak int
+}
+
+// backendSet is the backends of a raddr list, their turns weighted
+type backendSet struct {
+	lock     sync.Mutex
+	backends []*backend
+}
+
+// pick is the backend of the next stream but those tried, among those up
+// unless all are down, the backends are picked as often as they weigh and
+// spread out. It's nil once all were tried
+func (set *backendSet) pick(tried map[string]bool) *backend {
+	set.lock.Lock()
+	defer set.lock.Unlock()
+	for _, all := range []bool{false, true} {
+		var best *backend
+		total := 0
+		for _, b := range set.backends {
+			if tried[b.addr] || !all && b.down.Load() {
+				continue
+			}
+			b.current += b.weight
+			total += b.weight
+			if best == nil || b.current > best.current {
+				best = b
+			}
+		}
+		if best != nil {
+			best.current -= total
+			return best
+		}
+	}
+	return nil
+}
+
+// backendSets holds the backend sets by raddr list
+type backendSets struct {
+	sync.Mutex
+	m map[string]*backendSet
+}
+
+// set is the backend set of raddr, a comma separated list of backends
+func (sets *backendSets) set(raddr string) (*backendSet, error) {
+	sets.Lock()
+	defer sets.Unlock()
+	if set, ok := sets.m[raddr]; ok {
+		return set, nil
+	}
+	if sets.m == nil || len(sets.m) >= backendSetLimit {
+		sets.m = map[string]*backendSet{}
+	}
+	backends, err := protocol.ParseBackends(raddr)
+	if err != nil {
+		return nil, err
+	}
+	set := &backendSet{}
+	for _, b := range backends {
+		set.backends = append(set.backends, &backend{addr: b.Addr, weight: b.Weight})
+	}
+	sets.m[raddr] = set
+	return set, nil
+}
+
+// all is the backends of all the sets
+func (sets *backendSets) all() []*backend {
+	sets.Lock()
+	defer sets.Unlock()
+	var backends []*backend
+	for _, set := range sets.m {
+		backends = append(backends, set.backends...)
+	}
+	return backends
+}
+
+// pickBackend is the backend of raddr the stream dials, in turn among those
+// of a comma separated list which are up as often as they weigh, raddr itself
+// when it's a single address. The turn goes on when all are down
+func (proxy *Proxy) pickBackend(raddr string) string {
+	if !protocol.IsBackends(raddr) {
+		return raddr
+	}
+	set, err := proxy.backends.set(raddr)
+	if err != nil {
+		// the dial fails on it
+		return raddr
+	}
+	return set.pick(nil).addr
+}
+
+// backendRetries counts the dials retried on another backend
+var backendRetries = protocol.NewCounter("backend_retries")
+
+// dialBackends dials info.Addr, a backend of raddr, and once a dial failed
+// the next backends of raddr in turn, up to BackendAttempts within
+// BackendTimeout. info is set to the backend dialed, the backends the hooks
+// or the audit refuse are passed over
+func (proxy *Proxy) dialBackends(ctx context.Context, raddr string, info *protocol.StreamInfo, opts map[string]string) (net.Conn, error) {
+	if info.Addr == raddr || proxy.BackendAttempts <= 1 {
+		return proxy.dialBreaker(ctx, info.Addr, opts)
+	}
+	ctx, cancel := context.WithTimeout(ctx, proxy.BackendTimeout)
+	defer cancel()
+	conn, err := proxy.dialBreaker(ctx, info.Addr, opts)
+	if err == nil {
+		return conn, nil
+	}
+	set, serr := proxy.backends.set(raddr)
+	if serr != nil {
+		return nil, err
+	}
+	tried := map[string]bool{info.Addr: true}
+	for attempt := 1; attempt < proxy.BackendAttempts && ctx.Err() == nil; attempt++ {
+		b := set.pick(tried)
+		if b == nil {
+			break
+		}
+		tried[b.addr] = true
+		next := *info
+		next.Addr = b.addr
+		if proxy.Hooks.StreamOpen(next) != nil || proxy.audit(proxy.channelAddr(), next) != nil {
+			continue
+		}
+		log.Printf("Retry %s on %s: %s\n", info.Addr, b.addr, err)
+		backendRetries.Add(1)
+		if conn, err = proxy.dialBreaker(ctx, b.addr, opts); err == nil {
+			*info = next
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+func (proxy *Proxy) validateBackends() error {
+	if proxy.BackendAttempts <= 0 {
+		proxy.BackendAttempts = 3
+	}
+	if proxy.BackendTimeout <= 0 {
+		proxy.BackendTimeout = 10 * time.Second
+	}
+	if proxy.HealthCheck != "" && proxy.HealthCheck != HealthTCP && !strings.HasPrefix(proxy.HealthCheck, "/") {
+		return fmt.Errorf("invalid health check, %s", proxy.HealthCheck)
+	}
+	if proxy.HealthInterval <= 0 {
+		proxy.HealthInterval = 10 * time.Second
+	}
+	if proxy.HealthFall <= 0 {
+		proxy.HealthFall = 3
+	}
+	if proxy.HealthRise <= 0 {
+		proxy.HealthRise = 2
+	}
+	return nil
+}
+
+// checkBackends checks the backends of the raddr lists dialed each
+// HealthInterval until ctx is done
+func (proxy *Proxy) checkBackends(ctx context.Context) {
+	ticker := time.NewTicker(proxy.HealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var wg sync.WaitGroup
+		for _, b := range proxy.backends.all() {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				proxy.checkBackend(ctx, b)
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+// checkBackend checks b once and takes it out of the turn or back in when
+// the thresholds are reached
+func (proxy *Proxy) checkBackend(ctx context.Context, b *backend) {
+	ctx, cancel := context.WithTimeout(ctx, proxy.HealthInterval)
+	defer cancel()
+	err := proxy.probe(ctx, b.addr)
+	if errors.Is(ctx.Err(), context.Canceled) {
+		// the proxy stops
+		return
+	}
+	down := b.down.Load()
+	if down == (err != nil) {
+		b.streak = 0
+		return
+	}
+	b.streak++
+	switch {
+	case !down && b.streak >= proxy.HealthFall:
+		log.Printf("Backend %s down: %s\n", b.addr, err)
+		b.down.Store(true)
+		b.streak = 0
+	case down && b.streak >= proxy.HealthRise:
+		log.Printf("Backend %s up\n", b.addr)
+		b.down.Store(false)
+		b.streak = 0
+	}
+}
+
+// probe connects to addr, and GETs the HealthCheck path on it unless it's
+// HealthTCP, an HTTP status of 400 or more fails it
+func (proxy *Proxy) probe(ctx context.Context, addr string) error {
+	if proxy.HealthCheck == HealthTCP {
+		conn, err := proxy.dialOutbound(ctx, addr, nil)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+proxy.HealthCheck, nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return proxy.dialOutbound(ctx, addr, nil)
+			},
+			DisableKeepAlives: true,
+		},
+		// a redirect answers the check
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode >= 400 {
+		return fmt.Errorf("status %s", rsp.Status)
+	}
+	return nil
+}
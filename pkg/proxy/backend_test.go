@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+// testSet is the backend set of raddr with the backends of down down
+func testSet(t *testing.T, raddr string, down ...string) *backendSet {
+	t.Helper()
+	set, err := (&backendSets{}).set(raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range set.backends {
+		for _, addr := range down {
+			if b.addr == addr {
+				b.down.Store(true)
+			}
+		}
+	}
+	return set
+}
+
+func TestBackendPick(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		raddr string
+		down  []string
+		want  string
+	}{
+		{"round robin", "a:1,b:1,c:1", nil, "a b c a b c"},
+		{"smooth weights", "a:1=5,b:1,c:1", nil, "a a b a c a a a a b a c a a"},
+		{"weights", "a:1=2,b:1=1", nil, "a b a a b a"},
+		{"down skipped", "a:1,b:1,c:1", []string{"b:1"}, "a c a c"},
+		{"all down", "a:1,b:1", []string{"a:1", "b:1"}, "a b a b"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			set := testSet(t, tc.raddr, tc.down...)
+			var got []string
+			for range strings.Fields(tc.want) {
+				addr := set.pick(nil).addr
+				got = append(got, strings.TrimSuffix(addr, ":1"))
+			}
+			if s := strings.Join(got, " "); s != tc.want {
+				t.Errorf("picked %s, want %s", s, tc.want)
+			}
+		})
+	}
+}
+
+func TestBackendPickTried(t *testing.T) {
+	set := testSet(t, "a:1,b:1,c:1", "c:1")
+	tried := map[string]bool{}
+	var got []string
+	for b := set.pick(tried); b != nil; b = set.pick(tried) {
+		tried[b.addr] = true
+		got = append(got, b.addr)
+	}
+	// the backends down are tried last
+	if s := strings.Join(got, " "); s != "a:1 b:1 c:1" {
+		t.Errorf("tried %s, want a:1 b:1 c:1", s)
+	}
+}
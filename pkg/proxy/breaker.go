@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dworld/channel/pkg/protocol"
+)
+
+// circuit is the dial failures in a row of a remote, it's open until
+// openUntil once they reached BreakerFailures, then a probe dial is let
+// through, half open, which closes it or opens it again
+type circuit struct {
+	failures  int
+	err       error
+	openUntil time.Time
+	probing   bool
+}
+
+// circuitOpenError fails fast a dial of a remote whose circuit is open, with
+// the failure which opened it
+type circuitOpenError struct {
+	addr  string
+	err   error
+	retry time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("circuit of %s open, retried in %s: %s", e.addr, e.retry.Round(time.Second), e.err)
+}
+
+func (e *circuitOpenError) Unwrap() error {
+	return e.err
+}
+
+// breaker holds the circuits by remote
+type breaker struct {
+	sync.Mutex
+	m map[string]*circuit
+}
+
+// circuitOpenDials counts the dials failed fast by an open circuit
+var circuitOpenDials = protocol.NewCounter("circuit_open_dials")
+
+// dialBreaker dials raddr unless its circuit is open, the failures of the
+// dials which weren't cancelled nor replayed by the failure cache count
+func (proxy *Proxy) dialBreaker(ctx context.Context, raddr string, opts map[string]string) (net.Conn, error) {
+	if proxy.BreakerFailures <= 0 {
+		return proxy.dialCached(ctx, raddr, opts)
+	}
+	if err := proxy.breaker.allow(raddr); err != nil {
+		circuitOpenDials.Add(1)
+		return nil, err
+	}
+	conn, err := proxy.dialCached(ctx, raddr, opts)
+	var cached *cachedDialError
+	proxy.breaker.done(raddr, err, err != nil && (ctx.Err() != nil || errors.As(err, &cached)), proxy.BreakerFailures, proxy.BreakerCooldown)
+	return conn, err
+}
+
+// allow tells whether a dial of addr goes, it's the probe of a circuit half
+// open, the dials meanwhile fail fast
+func (b *breaker) allow(addr string) error {
+	b.Lock()
+	defer b.Unlock()
+	c, ok := b.m[addr]
+	if !ok || c.openUntil.IsZero() {
+		return nil
+	}
+	if wait := time.Until(c.openUntil); wait > 0 || c.probing {
+		return &circuitOpenError{addr: addr, err: c.err, retry: max(wait, 0)}
+	}
+	c.probing = true
+	return nil
+}
+
+// done records the dial of addr which failed with err, ignored when it
+// neither succeeded nor failed on its own
+func (b *breaker) done(addr string, err error, ignored bool, failures int, cooldown time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+	c, ok := b.m[addr]
+	if ok {
+		c.probing = false
+	}
+	if err == nil {
+		delete(b.m, addr)
+		return
+	}
+	if ignored {
+		return
+	}
+	if !ok {
+		if b.m == nil {
+			b.m = map[string]*circuit{}
+		}
+		if len(b.m) >= dialFailureLimit {
+			// those closed are forgotten first
+			for addr, c := range b.m {
+				if c.openUntil.IsZero() {
+					delete(b.m, addr)
+				}
+			}
+		}
+		c = &circuit{}
+		b.m[addr] = c
+	}
+	c.failures++
+	c.err = err
+	if c.failures >= failures {
+		if c.openUntil.IsZero() {
+			log.Printf("Circuit of %s open after %d failures: %s\n", addr, c.failures, err)
+		}
+		c.openUntil = time.Now().Add(cooldown)
+	}
+}
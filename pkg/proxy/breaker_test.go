@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	errDial := errors.New("connection refused")
+	const addr = "db:5432"
+	// each step is a dial, allowed or failed fast, and its result
+	type step struct {
+		allowed bool
+		err     error
+		ignored bool
+		wait    time.Duration
+	}
+	for _, tc := range []struct {
+		name  string
+		steps []step
+	}{
+		{"opens after the failures", []step{
+			{allowed: true, err: errDial},
+			{allowed: true, err: errDial},
+			{allowed: true, err: errDial},
+			{allowed: false},
+		}},
+		{"a success resets the count", []step{
+			{allowed: true, err: errDial},
+			{allowed: true, err: errDial},
+			{allowed: true},
+			{allowed: true, err: errDial},
+			{allowed: true, err: errDial},
+			{allowed: true},
+		}},
+		{"ignored failures don't count", []step{
+			{allowed: true, err: errDial},
+			{allowed: true, err: errDial, ignored: true},
+			{allowed: true, err: errDial, ignored: true},
+			{allowed: true, err: errDial},
+			{allowed: true, err: errDial},
+			{allowed: false},
+		}},
+		{"probe closes it", []step{
+			{allowed: true, err: errDial},
+			{allowed: true, err: errDial},
+			{allowed: true, err: errDial, wait: 30 * time.Millisecond},
+			{allowed: true},
+			{allowed: true},
+		}},
+		{"failed probe opens it again", []step{
+			{allowed: true, err: errDial},
+			{allowed: true, err: errDial},
+			{allowed: true, err: errDial, wait: 30 * time.Millisecond},
+			{allowed: true, err: errDial},
+			{allowed: false},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &breaker{}
+			for i, s := range tc.steps {
+				err := b.allow(addr)
+				if (err == nil) != s.allowed {
+					t.Fatalf("dial %d allowed %v, want %v", i, err == nil, s.allowed)
+				}
+				if err != nil {
+					var open *circuitOpenError
+					if !errors.As(err, &open) || !errors.Is(err, errDial) {
+						t.Fatalf("dial %d failed with %v, want the circuit open on %v", i, err, errDial)
+					}
+					continue
+				}
+				b.done(addr, s.err, s.ignored, 3, 20*time.Millisecond)
+				time.Sleep(s.wait)
+			}
+		})
+	}
+}
+
+func TestBreakerOneProbe(t *testing.T) {
+	errDial := errors.New("connection refused")
+	b := &breaker{}
+	b.done("db:5432", errDial, false, 1, 0)
+	if err := b.allow("db:5432"); err != nil {
+		t.Fatalf("probe refused, %s", err)
+	}
+	// the dials meanwhile fail fast
+	if err := b.allow("db:5432"); err == nil {
+		t.Fatal("second probe allowed")
+	}
+	if err := b.allow("other:5432"); err != nil {
+		t.Fatalf("dial of another remote refused, %s", err)
+	}
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+
+	"github.com/dworld/channel/pkg/protocol"
+)
+
+// dialsCancelled counts the dials of remotes stopped by the cancel of the
+// client
+var dialsCancelled = protocol.NewCounter("dials_cancelled")
+
+// inflightDials are the dials of a control connection not replied yet, by
+// request id, so the client giving up on one cancels it
+type inflightDials struct {
+	sync.Mutex
+	m map[string]*inflightDial
+}
+
+type inflightDial struct {
+	cancel    context.CancelFunc
+	cancelled bool
+}
+
+// start registers the dial of request id, cancel stops it
+func (dials *inflightDials) start(id string, cancel context.CancelFunc) {
+	dials.Lock()
+	defer dials.Unlock()
+	if dials.m == nil {
+		dials.m = map[string]*inflightDial{}
+	}
+	dials.m[id] = &inflightDial{cancel: cancel}
+}
+
+// done forgets the dial of request id, it tells whether the client cancelled
+// it
+func (dials *inflightDials) done(id string) bool {
+	dials.Lock()
+	defer dials.Unlock()
+	dial := dials.m[id]
+	delete(dials.m, id)
+	return dial != nil && dial.cancelled
+}
+
+// cancel stops the dial of request id, the dials already replied are left
+// to the client to close
+func (dials *inflightDials) cancel(id string) {
+	dials.Lock()
+	defer dials.Unlock()
+	if dial := dials.m[id]; dial != nil && !dial.cancelled {
+		dial.cancelled = true
+		dial.cancel()
+	}
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dworld/channel/pkg/protocol"
+)
+
+// dialFailureLimit is the number of failures kept before the expired ones
+// are pruned
+const dialFailureLimit = 4096
+
+type dialFailure struct {
+	err error
+	at  time.Time
+}
+
+// cachedDialError is a recent failure replayed to a dial of the same target
+type cachedDialError struct {
+	err error
+	age time.Duration
+}
+
+func (e *cachedDialError) Error() string {
+	return fmt.Sprintf("%s (cached %s ago)", e.err, e.age.Round(time.Millisecond))
+}
+
+func (e *cachedDialError) Unwrap() error {
+	return e.err
+}
+
+// failureCache holds the recent dial failures by remote
+type failureCache struct {
+	sync.Mutex
+	m map[string]dialFailure
+}
+
+// cachedDialFailures counts the dials answered by a cached failure
+var cachedDialFailures = protocol.NewCounter("cached_dial_failures")
+
+// dialCached dials raddr unless it failed in the last DialFailTTL, then the
+// failure is returned at once, the dials cancelled by ctx aren't failures
+func (proxy *Proxy) dialCached(ctx context.Context, raddr string, opts map[string]string) (net.Conn, error) {
+	if proxy.DialFailTTL <= 0 {
+		return proxy.dialOutbound(ctx, raddr, opts)
+	}
+	cache := &proxy.failures
+	now := time.Now()
+	cache.Lock()
+	failure, ok := cache.m[raddr]
+	cache.Unlock()
+	if ok && now.Sub(failure.at) < proxy.DialFailTTL {
+		cachedDialFailures.Add(1)
+		return nil, &cachedDialError{err: failure.err, age: now.Sub(failure.at)}
+	}
+	conn, err := proxy.dialOutbound(ctx, raddr, opts)
+	cache.Lock()
+	defer cache.Unlock()
+	if err == nil {
+		delete(cache.m, raddr)
+		return conn, nil
+	}
+	if ctx.Err() != nil {
+		return nil, err
+	}
+	if cache.m == nil {
+		cache.m = map[string]dialFailure{}
+	}
+	if len(cache.m) >= dialFailureLimit {
+		for addr, failure := range cache.m {
+			if now.Sub(failure.at) >= proxy.DialFailTTL {
+				delete(cache.m, addr)
+			}
+		}
+	}
+	cache.m[raddr] = dialFailure{err: err, at: time.Now()}
+	return nil, err
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dworld/channel/pkg/protocol"
+	"github.com/dworld/channel/pkg/transport"
+)
+
+// execKillDelay is how long the process of a closed exec stream has to exit
+// on the EOF of its stdin before it's killed
+const execKillDelay = 5 * time.Second
+
+var errNoCommand = protocol.PolicyError(fmt.Errorf("no command of the exec target"))
+
+// execConn is the stdin and stdout of the process of an exec target, closed
+// the process is waited for, and killed if it doesn't exit
+type execConn struct {
+	net.Conn
+	cmd  *exec.Cmd
+	done chan struct{}
+	once sync.Once
+}
+
+// dialExec starts the process of command for a stream, its stderr is the
+// proxy's so its logs are with the proxy's
+func (proxy *Proxy) dialExec(command []string) (net.Conn, error) {
+	if len(command) == 0 {
+		return nil, errNoCommand
+	}
+	if !proxy.execAllowed(command) {
+		return nil, protocol.PolicyError(fmt.Errorf("exec of %s not allowed", command[0]))
+	}
+	// pipes of our own as the exec of the client, the process may exit
+	// before the stream read all it wrote
+	childIn, stdin, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, childOut, err := os.Pipe()
+	if err != nil {
+		childIn.Close()
+		stdin.Close()
+		return nil, err
+	}
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = childIn, childOut, os.Stderr
+	err = cmd.Start()
+	childIn.Close()
+	childOut.Close()
+	conn := transport.NewPipeConn(stdout, stdin, "exec:"+command[0])
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	log.Printf("Exec REMOTE %s, pid %d\n", strings.Join(command, " "), cmd.Process.Pid)
+	c := &execConn{Conn: conn, cmd: cmd, done: make(chan struct{})}
+	go func() {
+		err := cmd.Wait()
+		log.Printf("REMOTE pid %d exited: %v\n", cmd.Process.Pid, err)
+		close(c.done)
+	}()
+	return c, nil
+}
+
+// execAllowed tells whether command is a command line of AllowExec, with
+// the same arguments, the arguments come from the client
+func (proxy *Proxy) execAllowed(command []string) bool {
+	for _, line := range proxy.AllowExec {
+		if line == "*" || slices.Equal(strings.Fields(line), command) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *execConn) String() string {
+	return fmt.Sprintf("exec %s pid %d", c.cmd.Path, c.cmd.Process.Pid)
+}
+
+func (c *execConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *execConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		go func() {
+			select {
+			case <-c.done:
+			case <-time.After(execKillDelay):
+				c.cmd.Process.Kill()
+			}
+		}()
+	})
+	return err
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/dworld/channel/pkg/protocol"
+)
+
+// ParseExpose parses name=host:port of an HTTP server the proxy exposes
+func ParseExpose(s string) (string, string, error) {
+	name, raddr, ok := strings.Cut(s, "=")
+	if !ok || name == "" {
+		return "", "", fmt.Errorf("invalid expose %s, want name=host:port", s)
+	}
+	if _, _, err := net.SplitHostPort(raddr); err != nil {
+		return "", "", fmt.Errorf("invalid expose %s, %s", s, err)
+	}
+	return name, raddr, nil
+}
+
+// requestExpose asks the client on w to expose the servers of Expose, on
+// each control connection
+func (proxy *Proxy) requestExpose(w *protocol.ControlWriter) {
+	for _, s := range proxy.Expose {
+		// checked by init
+		name, raddr, _ := ParseExpose(s)
+		if err := w.WriteLine(protocol.FormatLine("expose:"+name, map[string]string{"raddr": raddr})); err != nil {
+			log.Printf("Write: %s\n", err)
+			return
+		}
+	}
+}
+
+// handleExposeReply logs a reply of the client to an expose request
+func (proxy *Proxy) handleExposeReply(head string, opts map[string]string) {
+	kind, name, _ := strings.Cut(head, ":")
+	if kind == "exposeerr" {
+		err := fmt.Errorf("%s", opts["msg"])
+		log.Printf("Expose %s: %s\n", name, err)
+		proxy.errors.Add("expose "+name, err)
+		return
+	}
+	log.Printf("Exposed %s at %s\n", name, opts["host"])
+}
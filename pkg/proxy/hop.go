@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/dworld/channel/pkg/protocol"
+)
+
+// errNoHopKey is a hop layer the proxy can't open without E2E
+var errNoHopKey = errors.New("hops need the e2e key of the proxy")
+
+// serveHops serves the chained streams the hops before the proxy dial to ln,
+// until ctx is done
+func (proxy *Proxy) serveHops(ctx context.Context, ln net.Listener) error {
+	stop := context.AfterFunc(ctx, func() { ln.Close() })
+	defer stop()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		go proxy.handleHop(ctx, conn)
+	}
+}
+
+// handleHop opens the layer of the chain sent on conn, dials the address it
+// holds with the rest of the chain, replies the dial and pipes the stream
+func (proxy *Proxy) handleHop(ctx context.Context, conn net.Conn) {
+	log.Printf("handle HOP conn %v\n", conn)
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(proxy.HandshakeTimeout))
+	line, err := r.ReadString('\n')
+	if err != nil {
+		log.Printf("ReadString from %v: %s\n", conn.RemoteAddr(), err)
+		protocol.CloseConn("HOP", conn)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	head, opts := protocol.ParseLine(line)
+	if head != "hop" {
+		replyHop(conn, fmt.Errorf("not a hop request, %s", strings.TrimSpace(line)))
+		protocol.CloseConn("HOP", conn)
+		return
+	}
+	if proxy.E2E == nil {
+		replyHop(conn, errNoHopKey)
+		protocol.CloseConn("HOP", conn)
+		return
+	}
+	next, rest, err := proxy.E2E.OpenHop(opts["chain"])
+	if err != nil {
+		log.Printf("Hop from %v: %s\n", conn.RemoteAddr(), err)
+		proxy.errors.Add("hop "+conn.RemoteAddr().String(), err)
+		replyHop(conn, err)
+		protocol.CloseConn("HOP", conn)
+		return
+	}
+	info := protocol.StreamInfo{From: conn.RemoteAddr().String(), Addr: next}
+	var rconn net.Conn
+	if rest == "" {
+		err = proxy.Hooks.StreamOpen(info)
+	}
+	if err == nil {
+		err = proxy.audit(proxy.HopListen, info)
+	}
+	if err != nil {
+		err = protocol.PolicyError(err)
+	} else if rest != "" {
+		rconn, err = proxy.dialHop(ctx, next, rest)
+	} else {
+		log.Printf("dial to %s\n", next)
+		rconn, err = proxy.dialCached(ctx, next, nil)
+	}
+	if err != nil {
+		log.Printf("Dial: %s\n", err)
+		proxy.errors.Add("dial "+next, err)
+		proxy.Hooks.DialError(next, err)
+		replyHop(conn, err)
+		protocol.CloseConn("HOP", conn)
+		return
+	}
+	if _, err := io.WriteString(conn, "ok\n"); err != nil {
+		log.Printf("Write: %s\n", err)
+		protocol.CloseConn("REMOTE", rconn)
+		protocol.CloseConn("HOP", conn)
+		return
+	}
+	stats := proxy.PipeStream(ctx, info, "REMOTE", rconn, "HOP", &bufferedConn{Conn: conn, r: r})
+	proxy.Hooks.StreamClose(info, stats)
+}
+
+// replyHop replies the failure of a hop, the hop of a DialError in it is kept
+func replyHop(conn net.Conn, err error) {
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	io.WriteString(conn, protocol.FormatLine("err", protocol.NewDialError(protocol.HopRemote, err).Options()))
+}
+
+// dialHop dials the hop at raddr and sends it chain, the layers sealed for it
+// and the hops after, the failures of the hops are remote
+func (proxy *Proxy) dialHop(ctx context.Context, raddr, chain string) (net.Conn, error) {
+	log.Printf("dial to hop %s\n", raddr)
+	conn, err := proxy.dialOutbound(ctx, raddr, nil)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(proxy.HandshakeTimeout))
+	// cancelling ctx aborts the handshake
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	r := bufio.NewReader(conn)
+	line := ""
+	_, err = io.WriteString(conn, protocol.FormatLine("hop", map[string]string{"chain": chain}))
+	if err == nil {
+		line, err = r.ReadString('\n')
+	}
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, protocol.NewDialError(protocol.HopRemote, fmt.Errorf("hop %s: %w", raddr, err))
+	}
+	conn.SetDeadline(time.Time{})
+	head, opts := protocol.ParseLine(line)
+	switch head {
+	case "ok":
+		return &bufferedConn{Conn: conn, r: r}, nil
+	case "err":
+		conn.Close()
+		return nil, protocol.ParseDialError(opts)
+	}
+	conn.Close()
+	return nil, protocol.NewDialError(protocol.HopRemote, fmt.Errorf("hop %s: unexpected reply, %s", raddr, strings.TrimSpace(line)))
+}
+
+// bufferedConn reads what was buffered of the connection before the rest
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) String() string {
+	return fmt.Sprint(c.Conn)
+}
+
+// NetConn is the wrapped connection
+func (c *bufferedConn) NetConn() net.Conn {
+	return c.Conn
+}
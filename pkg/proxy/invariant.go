@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"fmt"
+
+	"github.com/dworld/channel/pkg/protocol"
+)
+
+// Invariants are the checks of the accounting of the proxy, for
+// protocol.WatchInvariants
+func (proxy *Proxy) Invariants() []protocol.Invariant {
+	return []protocol.Invariant{{Name: "pool", Check: proxy.checkPool}}
+}
+
+// checkPool checks each idle connection of the pool holds a slot, so the pool
+// dials no more than its size
+func (proxy *Proxy) checkPool() error {
+	pool := proxy.pool.Load()
+	if pool == nil {
+		return nil
+	}
+	idle, slots := len(pool.idle), len(pool.slots)
+	if idle > slots {
+		return fmt.Errorf("%d idle data connections hold %d slots of %d", idle, slots, cap(pool.slots))
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/dworld/channel/pkg/protocol"
+)
+
+var errListenerClosed = errors.New("listener closed")
+
+// Listener is a listener at an address of the client, the connections the
+// client accepts there are dialed to it and accepted by the proxy program
+type Listener struct {
+	proxy *Proxy
+	addr  string
+	conns chan net.Conn
+
+	lock    sync.Mutex
+	bound   net.Addr
+	ready   chan error
+	settled bool
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// Listen asks the client to listen addr, the proxy must be running or about
+// to, Listen waits the client to reply or ctx to be done
+func (proxy *Proxy) Listen(ctx context.Context, addr string) (*Listener, error) {
+	ln := &Listener{
+		proxy: proxy,
+		addr:  addr,
+		conns: make(chan net.Conn),
+		ready: make(chan error, 1),
+		done:  make(chan struct{}),
+	}
+	proxy.listenersLock.Lock()
+	if proxy.listeners == nil {
+		proxy.listeners = map[string]*Listener{}
+	}
+	if proxy.listeners[addr] != nil {
+		proxy.listenersLock.Unlock()
+		return nil, errors.New("already listening " + addr)
+	}
+	proxy.listeners[addr] = ln
+	w := proxy.writer
+	proxy.listenersLock.Unlock()
+	if w != nil {
+		ln.request(w)
+	}
+	select {
+	case err := <-ln.ready:
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		return ln, nil
+	case <-ctx.Done():
+		ln.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// request asks the client on w to listen
+func (ln *Listener) request(w *protocol.ControlWriter) {
+	if err := w.WriteLine(protocol.FormatLine("listen:"+ln.addr, nil)); err != nil {
+		log.Printf("Write: %s\n", err)
+	}
+}
+
+// listened settles the reply of the client, only the first one is waited by
+// Listen, the later ones follow the reconnections
+func (ln *Listener) listened(bound string, err error) {
+	ln.lock.Lock()
+	defer ln.lock.Unlock()
+	if err == nil {
+		if addr, rerr := net.ResolveTCPAddr("tcp", bound); rerr == nil {
+			ln.bound = addr
+		}
+	} else {
+		log.Printf("Listen %s: %s\n", ln.addr, err)
+		ln.proxy.errors.Add("listen "+ln.addr, err)
+	}
+	if !ln.settled {
+		ln.settled = true
+		ln.ready <- err
+	}
+}
+
+// Accept waits the next connection accepted by the client
+func (ln *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.conns:
+		return conn, nil
+	case <-ln.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops the listener of the client
+func (ln *Listener) Close() error {
+	ln.closeOnce.Do(func() {
+		close(ln.done)
+		proxy := ln.proxy
+		proxy.listenersLock.Lock()
+		if proxy.listeners[ln.addr] == ln {
+			delete(proxy.listeners, ln.addr)
+		}
+		w := proxy.writer
+		proxy.listenersLock.Unlock()
+		if w != nil {
+			if err := w.WriteLine(protocol.FormatLine("unlisten:"+ln.addr, nil)); err != nil {
+				log.Printf("Write: %s\n", err)
+			}
+		}
+	})
+	return nil
+}
+
+// Addr is the address the client listens, addr as asked until it replied
+func (ln *Listener) Addr() net.Addr {
+	ln.lock.Lock()
+	defer ln.lock.Unlock()
+	if ln.bound != nil {
+		return ln.bound
+	}
+	return listenerAddr(ln.addr)
+}
+
+// deliver hands conn to Accept, false if the listener is closed
+func (ln *Listener) deliver(conn net.Conn) bool {
+	select {
+	case ln.conns <- conn:
+		return true
+	case <-ln.done:
+		return false
+	}
+}
+
+// listenerAddr is an address as asked to the client
+type listenerAddr string
+
+func (addr listenerAddr) Network() string {
+	return "tcp"
+}
+
+func (addr listenerAddr) String() string {
+	return string(addr)
+}
+
+// listener returns the listener a raddr of a dial request is for
+func (proxy *Proxy) listener(raddr string) (*Listener, bool) {
+	if !strings.HasPrefix(raddr, protocol.ListenerPrefix) {
+		return nil, false
+	}
+	proxy.listenersLock.Lock()
+	defer proxy.listenersLock.Unlock()
+	return proxy.listeners[raddr[len(protocol.ListenerPrefix):]], true
+}
+
+// setWriter sets the writer of the control connection and asks the client
+// for the listeners and the exposed servers again, w is nil once the
+// connection failed
+func (proxy *Proxy) setWriter(w *protocol.ControlWriter) {
+	proxy.listenersLock.Lock()
+	proxy.writer = w
+	var lns []*Listener
+	for _, ln := range proxy.listeners {
+		lns = append(lns, ln)
+	}
+	proxy.listenersLock.Unlock()
+	if w == nil {
+		return
+	}
+	for _, ln := range lns {
+		ln.request(w)
+	}
+	proxy.requestExpose(w)
+}
+
+// handleListenReply settles a reply of the client to a listen request
+func (proxy *Proxy) handleListenReply(head string, opts map[string]string) {
+	kind, addr, _ := strings.Cut(head, ":")
+	proxy.listenersLock.Lock()
+	ln := proxy.listeners[addr]
+	proxy.listenersLock.Unlock()
+	if ln == nil {
+		return
+	}
+	if kind == "listenerr" {
+		ln.listened("", errors.New(opts["msg"]))
+		return
+	}
+	ln.listened(opts["addr"], nil)
+}
+
+// acceptedConn is a connection accepted by the client for a listener
+type acceptedConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c acceptedConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c acceptedConn) String() string {
+	return fmt.Sprint(c.Conn)
+}
+
+// NetConn is the wrapped connection
+func (c acceptedConn) NetConn() net.Conn {
+	return c.Conn
+}
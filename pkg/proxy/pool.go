@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/dworld/channel/pkg/protocol"
+)
+
+// poolExpiryTick is how often the pool looks for expired connections
+const poolExpiryTick = time.Second
+
+// dataConn is a data connection registered to the client by its connID, the
+// pool replaces it once idle past expires unless that's zero
+type dataConn struct {
+	connID  int32
+	conn    net.Conn
+	expires time.Time
+}
+
+func (data *dataConn) expired(now time.Time) bool {
+	return !data.expires.IsZero() && now.After(data.expires)
+}
+
+// dataPool keeps idle data connections so dial requests don't wait for a new
+// connection to be dialed and registered, with mux it opens streams instead.
+// A connection holds a slot from its dial until it's taken or expired, so
+// those expire puts back always fit in idle
+type dataPool struct {
+	proxy *Proxy
+	// ctx is of the control connection, the dials stop with it
+	ctx   context.Context
+	idle  chan *dataConn
+	slots chan struct{}
+	done  chan struct{}
+	mux   *protocol.Session
+	// w is the control connection the client is told the connections
+	// expired on, so it drops them
+	w atomic.Pointer[protocol.ControlWriter]
+}
+
+func (proxy *Proxy) newDataPool(ctx context.Context, size int) *dataPool {
+	pool := &dataPool{
+		proxy: proxy,
+		ctx:   ctx,
+		idle:  make(chan *dataConn, size),
+		slots: make(chan struct{}, size),
+		done:  make(chan struct{}),
+	}
+	go pool.fill()
+	if proxy.PoolLifetime > 0 {
+		go pool.expire()
+	}
+	return pool
+}
+
+// expires is when a data connection dialed now expires, PoolLifetime cut by
+// up to PoolJitter of it
+func (pool *dataPool) expires() time.Time {
+	lifetime := pool.proxy.PoolLifetime
+	if lifetime <= 0 {
+		return time.Time{}
+	}
+	if jitter := pool.proxy.PoolJitter; jitter > 0 {
+		lifetime -= time.Duration(rand.Float64() * jitter * float64(lifetime))
+	}
+	return time.Now().Add(lifetime)
+}
+
+// expire closes the idle connections past their lifetime, fill replaces
+// them
+func (pool *dataPool) expire() {
+	ticker := time.NewTicker(poolExpiryTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pool.done:
+			return
+		case now := <-ticker.C:
+			pool.expireIdle(now)
+		}
+	}
+}
+
+// expireIdle goes once through the idle connections, those still fresh are
+// put back
+func (pool *dataPool) expireIdle(now time.Time) {
+	for n := len(pool.idle); n > 0; n-- {
+		var data *dataConn
+		select {
+		case data = <-pool.idle:
+		default:
+			return
+		}
+		if data.expired(now) {
+			pool.drop(data)
+			<-pool.slots
+			continue
+		}
+		pool.idle <- data
+	}
+}
+
+// drop closes the expired connection data and tells the client, which
+// forgets it
+func (pool *dataPool) drop(data *dataConn) {
+	log.Printf("pooled conn %d expired\n", data.connID)
+	protocol.CloseConn("PROXY", data.conn)
+	w := pool.w.Load()
+	if w == nil {
+		return
+	}
+	if err := w.WriteLine(protocol.FormatLine("expire:"+strconv.Itoa(int(data.connID)), nil)); err != nil {
+		log.Printf("Write: %s\n", err)
+	}
+}
+
+// fill dials a new data connection whenever a slot is free
+func (pool *dataPool) fill() {
+	for {
+		select {
+		case pool.slots <- struct{}{}:
+		case <-pool.done:
+			return
+		}
+		connID, conn, err := pool.proxy.dialData(pool.ctx)
+		if err != nil {
+			log.Printf("Dial: %s\n", err)
+			<-pool.slots
+			select {
+			case <-pool.done:
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		select {
+		case <-pool.done:
+			protocol.CloseConn("PROXY", conn)
+			return
+		default:
+		}
+		pool.idle <- &dataConn{connID: connID, conn: conn, expires: pool.expires()}
+	}
+}
+
+// get returns an idle data connection, or dials one when the pool is empty
+func (pool *dataPool) get() (int32, net.Conn, error) {
+	if pool.mux != nil {
+		connID := atomic.AddInt32(&pool.proxy.connID, 1)
+		conn, err := pool.mux.Open(uint32(connID))
+		return connID, conn, err
+	}
+	for {
+		select {
+		case data := <-pool.idle:
+			<-pool.slots
+			if data.expired(time.Now()) {
+				pool.drop(data)
+				continue
+			}
+			return data.connID, data.conn, nil
+		default:
+		}
+		return pool.proxy.dialData(pool.ctx)
+	}
+}
+
+func (pool *dataPool) close() {
+	close(pool.done)
+	for {
+		select {
+		case data := <-pool.idle:
+			protocol.CloseConn("PROXY", data.conn)
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,707 @@
+// Package proxy is the side of the channel which connects to the client and
+// dials the remotes it asks for
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dworld/channel/pkg/protocol"
+	"github.com/dworld/channel/pkg/transport"
+)
+
+// Proxy connects to the client at Channel and serves its dial requests
+type Proxy struct {
+	// Channel is where the client listens
+	Channel *transport.Channel
+	// Backups are the channels of standby clients, once the control
+	// connection to a channel failed and can't be made again for
+	// FailoverTimeout the proxy fails over to the next, in turn
+	Backups []*transport.Channel
+	// FailoverTimeout is how long a channel is dialed again before failing
+	// over, 30s when 0
+	FailoverTimeout time.Duration
+	// Name names the proxy to a relay, which dials through it the streams
+	// the clients ask for Name
+	Name string
+	// Token answers the challenges of the connections to the channel for
+	// the TokenAuth of the client, it's never sent
+	Token string
+	// Mux carries the streams on the control connection
+	Mux bool
+	// PoolSize is the number of idle data connections kept
+	PoolSize int
+	// PoolLifetime is how long an idle data connection of the pool is kept
+	// before it's replaced, 0 keeps them until used
+	PoolLifetime time.Duration
+	// PoolJitter is the fraction of PoolLifetime the lifetimes are cut by at
+	// random, so the connections of a pool filled at once don't expire and
+	// redial together, 0.2 when 0 and none when negative
+	PoolJitter float64
+	// Compress is the codecs accepted for the streams
+	Compress []string
+	// Upstream is the socks5 server the remotes are dialed through
+	Upstream string
+	// Resolver resolves the remotes dialed without Upstream, the system
+	// resolver when nil
+	Resolver *protocol.Resolver
+	// Bind is where the connections to the remotes and to Upstream
+	// originate from, those of the routes when nil
+	Bind *transport.Bind
+	// DialFailTTL is how long a failed dial to a remote is replayed to the
+	// next dials of it
+	DialFailTTL time.Duration
+	// BreakerFailures is the dial failures in a row of a remote which open
+	// its circuit, its dials fail fast then for BreakerCooldown until a
+	// probe dial succeeds, none when 0
+	BreakerFailures int
+	// BreakerCooldown is how long a circuit is open before a probe dial,
+	// 30s when 0
+	BreakerCooldown time.Duration
+	// BackendAttempts is the backends of a raddr list a stream dials in turn
+	// before it fails, 3 when 0
+	BackendAttempts int
+	// BackendTimeout bounds the dials of the backends of a stream, 10s when
+	// 0
+	BackendTimeout time.Duration
+	// HealthCheck checks the backends of the raddr lists dialed, HealthTCP
+	// connects to them and a path GETs it, none when empty. A backend down
+	// is out of the turn
+	HealthCheck string
+	// HealthInterval is how often the backends are checked, 10s when 0
+	HealthInterval time.Duration
+	// HealthFall is the failed checks in a row a backend is down after, 3
+	// when 0
+	HealthFall int
+	// HealthRise is the passed checks in a row a backend down is up after, 2
+	// when 0
+	HealthRise int
+	// AllowExec is the command lines the exec targets may run, arguments
+	// included as the client sends them, * any command with any arguments,
+	// none when empty
+	AllowExec []string
+	// OriginCAs verify the remotes the clients ask TLS to, the system roots
+	// when nil
+	OriginCAs *x509.CertPool
+	// HandshakeTimeout bounds the handshakes with the upstream
+	HandshakeTimeout time.Duration
+	// Dial dials the remotes in place of net.Dialer and Upstream, opts are
+	// of the dial request, the e2e sealing of the streams is left to what it
+	// dials
+	Dial func(ctx context.Context, addr string, opts map[string]string) (net.Conn, error)
+	// E2E is the static key of the proxy sealing the streams the clients
+	// ask to seal end to end, and opening the layers of the chains sealed
+	// for it
+	E2E *transport.E2EKeys
+	// HopListen is where the proxy serves as a hop the chained streams of
+	// the hops before it, none when empty
+	HopListen string
+	// Expose is the name=host:port of the HTTP servers the proxy asks the
+	// reverse tunnels of the client to route name.domain to
+	Expose []string
+	// Hooks are called on the streams, the control connections and the
+	// failed dials
+	Hooks protocol.Hooks
+	// Audit records the destinations dialed, none when nil
+	Audit *AuditLog
+	// MaxStreams caps the streams dialed open at once, none when 0
+	MaxStreams int
+	// StreamsWait is how long a dial past MaxStreams waits for a stream to
+	// close before it's refused, it's refused at once when 0
+	StreamsWait time.Duration
+	protocol.Options
+
+	// streams counts the streams dialed for MaxStreams
+	streams protocol.Limiter
+
+	upstream *url.URL
+	active   atomic.Pointer[transport.Channel]
+	connID   int32
+	failures failureCache
+	breaker  breaker
+	backends backendSets
+	control  protocol.ControlState
+	errors   protocol.ErrorLog
+	// listening tracks the listener of the hops
+	listening protocol.Listeners
+
+	listenersLock sync.Mutex
+	listeners     map[string]*Listener
+	writer        *protocol.ControlWriter
+	// pool is the data pool of the control connection, for the invariants
+	pool atomic.Pointer[dataPool]
+}
+
+// Run connects to the client, again whenever the control connection fails,
+// until ctx is done, or serves the stdio channel until the client closes it
+func (proxy *Proxy) Run(ctx context.Context) error {
+	if err := proxy.init(); err != nil {
+		return err
+	}
+	channels := append([]*transport.Channel{proxy.Channel}, proxy.Backups...)
+	for _, ch := range channels {
+		if err := ch.Init(false); err != nil {
+			return err
+		}
+	}
+	stdio := proxy.Channel.Transport == transport.Stdio
+	if stdio && (!proxy.Mux || len(proxy.Backups) > 0) {
+		return errStdio
+	}
+	if proxy.HealthCheck != "" {
+		go proxy.checkBackends(ctx)
+	}
+	if proxy.HopListen != "" {
+		if proxy.E2E == nil {
+			return errNoHopKey
+		}
+		ln, err := net.Listen("tcp", proxy.HopListen)
+		if err != nil {
+			return err
+		}
+		log.Printf("Listen HOP at %s\n", proxy.HopListen)
+		proxy.listening.Up(proxy.HopListen)
+		go func() {
+			defer proxy.listening.Expect(proxy.HopListen)
+			if err := proxy.serveHops(ctx, ln); err != nil && ctx.Err() == nil {
+				log.Printf("Hops: %s\n", err)
+			}
+		}()
+	}
+	i, down := 0, time.Now()
+	for ctx.Err() == nil {
+		ch := channels[i]
+		proxy.active.Store(ch)
+		log.Printf("dial to %s\n", ch.Addr)
+		conn, err := ch.DialContext(ctx)
+		if err != nil {
+			log.Printf("Dial: %s\n", err)
+			proxy.errors.Add("dial "+ch.Addr, err)
+			proxy.Hooks.DialError(ch.Addr, err)
+			if len(channels) > 1 && time.Since(down) >= proxy.FailoverTimeout {
+				i, down = (i+1)%len(channels), time.Now()
+				log.Printf("fail over from %s to %s\n", ch.Addr, channels[i].Addr)
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		stop := context.AfterFunc(ctx, func() { conn.Close() })
+		err = proxy.handle(ctx, conn)
+		stop()
+		if stdio {
+			// the client closed the pipes, it runs another proxy
+			return nil
+		}
+		var busy *protocol.BusyError
+		if errors.As(err, &busy) {
+			select {
+			case <-ctx.Done():
+			case <-time.After(busy.Retry):
+			}
+			continue
+		}
+		down = time.Now()
+	}
+	return ctx.Err()
+}
+
+// Serve serves the control connection conn of a client which dialed in, as
+// the clients of a relay do, until ctx is done or conn fails, the streams are
+// carried on conn so Mux is needed
+func (proxy *Proxy) Serve(ctx context.Context, conn net.Conn) error {
+	if !proxy.Mux {
+		return errServeNoMux
+	}
+	if err := proxy.init(); err != nil {
+		return err
+	}
+	if proxy.HealthCheck != "" {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go proxy.checkBackends(ctx)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	proxy.handle(ctx, conn)
+	return ctx.Err()
+}
+
+var (
+	errServeNoMux = errors.New("Serve needs Mux")
+	errStdio      = errors.New("the stdio transport needs mux and no backup paddr")
+	errNoE2E      = errors.New("e2e not configured on the proxy")
+	errNoControl  = errors.New("no control connection to the client")
+)
+
+func (proxy *Proxy) init() error {
+	proxy.Options = proxy.Options.WithDefaults()
+	if proxy.HandshakeTimeout <= 0 {
+		proxy.HandshakeTimeout = 10 * time.Second
+	}
+	if proxy.FailoverTimeout <= 0 {
+		proxy.FailoverTimeout = 30 * time.Second
+	}
+	if proxy.PoolSize < 0 {
+		return fmt.Errorf("invalid pool, %d", proxy.PoolSize)
+	}
+	if proxy.PoolJitter == 0 {
+		proxy.PoolJitter = 0.2
+	}
+	if proxy.PoolJitter > 1 {
+		return fmt.Errorf("invalid pool jitter, %g", proxy.PoolJitter)
+	}
+	for _, s := range proxy.Expose {
+		if _, _, err := ParseExpose(s); err != nil {
+			return err
+		}
+	}
+	if proxy.BreakerCooldown <= 0 {
+		proxy.BreakerCooldown = 30 * time.Second
+	}
+	if err := proxy.validateBackends(); err != nil {
+		return err
+	}
+	return proxy.validateUpstream()
+}
+
+// channel is the channel dialed, of Channel and Backups
+func (proxy *Proxy) channel() *transport.Channel {
+	if ch := proxy.active.Load(); ch != nil {
+		return ch
+	}
+	return proxy.Channel
+}
+
+// channelAddr names the channel in the errors, the connections given to
+// Serve have none
+func (proxy *Proxy) channelAddr() string {
+	ch := proxy.channel()
+	if ch == nil {
+		return "channel"
+	}
+	return ch.Addr
+}
+
+// Control describes the control connection to the client
+func (proxy *Proxy) Control() protocol.ControlInfo {
+	return proxy.control.Info()
+}
+
+// Healthy tells whether the listener of the hops is up
+func (proxy *Proxy) Healthy() error {
+	return proxy.listening.Err()
+}
+
+// Ready tells whether the proxy is healthy and its control connection to
+// the client is established
+func (proxy *Proxy) Ready() error {
+	if err := proxy.Healthy(); err != nil {
+		return err
+	}
+	if proxy.control.Info().Addr == "" {
+		return errNoControl
+	}
+	return nil
+}
+
+// LastErrors lists the last errors of the channel and the remotes
+func (proxy *Proxy) LastErrors() []protocol.ErrorEntry {
+	return proxy.errors.List()
+}
+
+// handle serves the control connection conn, the streams it dialed are
+// aborted once ctx is done, it returns the error which ended conn
+func (proxy *Proxy) handle(ctx context.Context, conn net.Conn) error {
+	log.Printf("handle PROXY conn %v\n", conn)
+	defer protocol.CloseConn("PROXY", conn)
+	r := bufio.NewReader(conn)
+	// tell the client this is the control connection
+	hello := protocol.LocalCapabilities().Options()
+	if proxy.Mux {
+		hello["mux"] = "1"
+	}
+	if proxy.Name != "" {
+		hello["name"] = proxy.Name
+	}
+	if proxy.Token != "" {
+		hello[protocol.ChallengeOption] = "1"
+	}
+	if _, err := io.WriteString(conn, protocol.FormatLine("ctrl", hello)); err != nil {
+		log.Printf("Write: %s\n", err)
+		return err
+	}
+	if proxy.Token != "" {
+		if err := protocol.AnswerChallenge(conn, r, proxy.Token, proxy.HandshakeTimeout); err != nil {
+			log.Printf("Challenge: %s\n", err)
+			return err
+		}
+	}
+	pool := &dataPool{proxy: proxy, ctx: ctx}
+	switch {
+	case proxy.Mux:
+		if err := readBusy(conn, r, proxy.HandshakeTimeout); err != nil {
+			log.Printf("ReadLine: %s\n", err)
+			return err
+		}
+		session := protocol.NewSession(conn, r)
+		pool.mux = session
+		conn = session.ControlConn()
+		r = bufio.NewReader(conn)
+	case proxy.PoolSize > 0:
+		pool = proxy.newDataPool(ctx, proxy.PoolSize)
+		defer pool.close()
+		proxy.pool.Store(pool)
+		defer proxy.pool.CompareAndSwap(pool, nil)
+	}
+	w := proxy.NewControlWriter(conn)
+	pool.w.Store(w)
+	proxy.control.Set(conn, nil)
+	defer proxy.control.Clear(conn)
+	proxy.setWriter(w)
+	defer proxy.setWriter(nil)
+	proxy.Hooks.ControlConnect(conn)
+	dials := &inflightDials{}
+	for {
+		if err := proxy.handleOne(ctx, r, w, pool, dials); err != nil {
+			log.Printf("ReadLine: %s\n", err)
+			return err
+		}
+	}
+}
+
+// readBusy reads the busy reply of a client refusing the control connection,
+// with mux it comes in place of the first frame
+func readBusy(conn net.Conn, r *bufio.Reader, timeout time.Duration) error {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	b, _ := r.Peek(5)
+	conn.SetReadDeadline(time.Time{})
+	if string(b) != "busy " {
+		return nil
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	_, opts := protocol.ParseLine(line)
+	return protocol.ParseBusyError(opts)
+}
+
+// handleOne reads a dial request and serves it in background, only errors
+// of the control connection are returned
+func (proxy *Proxy) handleOne(ctx context.Context, r *bufio.Reader, w *protocol.ControlWriter, pool *dataPool, dials *inflightDials) error {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	log.Printf("REQ: %s", line)
+	head, opts := protocol.ParseLine(line)
+	if head == "busy" {
+		// the client admits no more control connections for now
+		return protocol.ParseBusyError(opts)
+	}
+	if head == "caps" {
+		peer := protocol.ParseCapabilities(opts)
+		protocol.CheckVersion("CLIENT", peer)
+		if pool.mux != nil && peer.Has("reset") {
+			pool.mux.AllowReset()
+		}
+		if pool.mux != nil && peer.Has("halfclose") {
+			pool.mux.AllowHalfClose()
+		}
+		if pool.mux != nil && peer.Has("window") {
+			pool.mux.AllowWindow()
+		}
+		proxy.control.SetPeer(w.Conn(), peer)
+		return nil
+	}
+	if head == "cancel" {
+		dials.cancel(opts["id"])
+		return nil
+	}
+	if strings.HasPrefix(head, "listening:") || strings.HasPrefix(head, "listenerr:") {
+		proxy.handleListenReply(head, opts)
+		return nil
+	}
+	if strings.HasPrefix(head, "exposed:") || strings.HasPrefix(head, "exposeerr:") {
+		proxy.handleExposeReply(head, opts)
+		return nil
+	}
+	if len(head) <= 5 || !strings.HasPrefix(head, "dial:") {
+		log.Printf("invalid request, %s\n", line)
+		return nil
+	}
+	go proxy.dialRemote(ctx, w, protocol.UnescapeAddr(head[5:]), opts, pool, dials)
+	return nil
+}
+
+// dialRemote dials raddr for a dial request, or a backend of it, and pairs
+// it with a data connection, the client cancels the dial through dials
+func (proxy *Proxy) dialRemote(ctx context.Context, w *protocol.ControlWriter, raddr string, opts map[string]string, pool *dataPool, dials *inflightDials) {
+	id := opts["id"]
+	if ln, ok := proxy.listener(raddr); ok {
+		proxy.acceptRemote(w, ln, opts, pool)
+		return
+	}
+	if size, ok := protocol.ParseVerifyAddr(raddr); ok {
+		proxy.verifyRemote(w, size, opts, pool)
+		return
+	}
+	chain := opts["chain"]
+	addr := raddr
+	if chain == "" {
+		addr = proxy.pickBackend(raddr)
+	}
+	info := protocol.StreamInfo{From: opts["from"], Addr: addr, Net: opts[protocol.NetOption]}
+	if err := proxy.Hooks.StreamOpen(info); err != nil {
+		log.Printf("Refused %s: %s\n", addr, err)
+		replyError(w, id, protocol.HopPolicy, protocol.PolicyError(err))
+		return
+	}
+	if proxy.sealsE2E(opts) && (opts["e2e"] != "noise" || proxy.E2E == nil) {
+		replyError(w, id, protocol.HopRemote, errNoE2E)
+		return
+	}
+	if err := proxy.audit(proxy.channelAddr(), info); err != nil {
+		replyError(w, id, protocol.HopPolicy, protocol.PolicyError(err))
+		return
+	}
+	if !proxy.streams.Acquire(ctx, proxy.MaxStreams, proxy.StreamsWait) {
+		err := protocol.LimitError("the proxy", proxy.MaxStreams)
+		log.Printf("Refused %s: %s\n", addr, err)
+		replyError(w, id, protocol.HopPolicy, err)
+		return
+	}
+	defer proxy.streams.Release()
+	var rconn net.Conn
+	var err error
+	// the dial is abandoned once the client gave up waiting, the stream
+	// lives on ctx
+	dialCtx, cancel := protocol.BudgetContext(ctx, opts)
+	dials.start(id, cancel)
+	if chain != "" && proxy.Dial == nil {
+		// raddr is the first hop of a chain
+		rconn, err = proxy.dialHop(dialCtx, raddr, chain)
+	} else {
+		log.Printf("dial to %s\n", addr)
+		rconn, err = proxy.dialBackends(dialCtx, raddr, &info, opts)
+		addr = info.Addr
+		if err == nil && info.Net == "" {
+			rconn, err = protocol.OriginateTLS(dialCtx, rconn, addr, opts, proxy.OriginCAs)
+		}
+	}
+	cancel()
+	if dials.done(id) {
+		log.Printf("Dial %s cancelled by the client\n", addr)
+		dialsCancelled.Add(1)
+		if rconn != nil {
+			protocol.CloseConn("REMOTE", rconn)
+		}
+		return
+	}
+	if err != nil {
+		log.Printf("Dial: %s\n", err)
+		proxy.errors.Add("dial "+addr, err)
+		proxy.Hooks.DialError(addr, err)
+		replyError(w, id, protocol.HopRemote, err)
+		return
+	}
+	connID, proxyConn, err := pool.get()
+	if err != nil {
+		log.Printf("Dial: %s\n", err)
+		proxy.errors.Add("dial "+proxy.channelAddr(), err)
+		proxy.Hooks.DialError(proxy.channelAddr(), err)
+		protocol.CloseConn("REMOTE", rconn)
+		replyError(w, id, protocol.HopChannel, err)
+		return
+	}
+
+	codec := protocol.SelectCodec(opts["codecs"], proxy.Compress)
+	rsp := protocol.FormatLine(strconv.Itoa(int(connID)), map[string]string{"id": id, "codec": codec})
+	log.Printf("RSP: %s", rsp)
+	if err := w.WriteLine(rsp); err != nil {
+		log.Printf("Write: %s\n", err)
+		protocol.CloseConn("REMOTE", rconn)
+		protocol.CloseConn("PROXY", proxyConn)
+		return
+	}
+	log.Printf("construct connection %d\n", connID)
+
+	stream := proxy.WithFlush(flushPolicy(opts)).WrapStream(proxyConn, codec)
+	if proxy.sealsE2E(opts) {
+		// the path the client sealed the stream for, as a relay names it
+		sealed, err := protocol.Handshake(stream, proxy.HandshakeTimeout, func() (net.Conn, error) {
+			return proxy.E2E.Server(stream, proxy.Name+"/"+raddr)
+		})
+		if err != nil {
+			log.Printf("e2e handshake for %s: %s\n", addr, err)
+			proxy.errors.Add("e2e "+addr, err)
+			protocol.CloseConn("REMOTE", rconn)
+			protocol.CloseConn("PROXY", stream)
+			return
+		}
+		stream = sealed
+	}
+	if noDelay := noDelay(opts); noDelay != nil {
+		protocol.SetNoDelay(rconn, *noDelay)
+		protocol.SetNoDelay(stream, *noDelay)
+	}
+	stats := proxy.PipeStream(ctx, info, "REMOTE", rconn, "PROXY", stream)
+	proxy.Hooks.StreamClose(info, stats)
+}
+
+// audit records the dial of info requested on gateway in the audit log
+func (proxy *Proxy) audit(gateway string, info protocol.StreamInfo) error {
+	if proxy.Audit == nil {
+		return nil
+	}
+	if err := proxy.Audit.Dial(gateway, info.From, info.Addr); err != nil {
+		log.Printf("Refused %s: %s\n", info.Addr, err)
+		proxy.errors.Add("audit "+info.Addr, err)
+		return err
+	}
+	return nil
+}
+
+// sealsE2E tells whether the proxy ends the e2e sealing of the stream of
+// opts, a proxy with Dial hands it on
+func (proxy *Proxy) sealsE2E(opts map[string]string) bool {
+	return opts["e2e"] != "" && proxy.Dial == nil
+}
+
+// acceptRemote pairs a dial request for a listener with a data connection
+// and hands it to the listener
+func (proxy *Proxy) acceptRemote(w *protocol.ControlWriter, ln *Listener, opts map[string]string, pool *dataPool) {
+	id := opts["id"]
+	if ln == nil {
+		replyError(w, id, protocol.HopRemote, errListenerClosed)
+		return
+	}
+	stream := proxy.replyStream(w, opts, pool)
+	if stream == nil {
+		return
+	}
+	conn := acceptedConn{Conn: stream}
+	if from, err := net.ResolveTCPAddr("tcp", opts["from"]); err == nil {
+		conn.remote = from
+	}
+	if !ln.deliver(conn) {
+		protocol.CloseConn("PROXY", conn)
+	}
+}
+
+// replyStream pairs a dial request answered by the proxy itself with a data
+// connection, it's nil once the failure is replied
+func (proxy *Proxy) replyStream(w *protocol.ControlWriter, opts map[string]string, pool *dataPool) net.Conn {
+	id := opts["id"]
+	connID, proxyConn, err := pool.get()
+	if err != nil {
+		log.Printf("Dial: %s\n", err)
+		proxy.errors.Add("dial "+proxy.channelAddr(), err)
+		replyError(w, id, protocol.HopChannel, err)
+		return nil
+	}
+	codec := protocol.SelectCodec(opts["codecs"], proxy.Compress)
+	rsp := protocol.FormatLine(strconv.Itoa(int(connID)), map[string]string{"id": id, "codec": codec})
+	log.Printf("RSP: %s", rsp)
+	if err := w.WriteLine(rsp); err != nil {
+		log.Printf("Write: %s\n", err)
+		protocol.CloseConn("PROXY", proxyConn)
+		return nil
+	}
+	return proxy.WithFlush(flushPolicy(opts)).WrapStream(proxyConn, codec)
+}
+
+// flushPolicy is the flush policy the client asked for the stream of opts,
+// nil when it didn't or it's invalid
+func flushPolicy(opts map[string]string) *protocol.FlushPolicy {
+	policy, err := protocol.ParseFlushPolicy(opts[protocol.FlushOption])
+	if err != nil {
+		log.Printf("%s\n", err)
+	}
+	return policy
+}
+
+// noDelay is the no delay the client asked for the stream of opts, nil when
+// it didn't or it's invalid
+func noDelay(opts map[string]string) *bool {
+	noDelay, err := protocol.ParseNoDelay(opts[protocol.NoDelayOption])
+	if err != nil {
+		log.Printf("%s\n", err)
+	}
+	return noDelay
+}
+
+// dialData dials a data connection to the channel and registers it to the
+// client, closing it once ctx is done or the registration runs past
+// HandshakeTimeout
+func (proxy *Proxy) dialData(ctx context.Context) (int32, net.Conn, error) {
+	ch := proxy.channel()
+	log.Printf("dial to %s\n", ch.Addr)
+	conn, err := ch.DialContext(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	connID := atomic.AddInt32(&proxy.connID, 1)
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	_, err = protocol.Handshake(conn, proxy.HandshakeTimeout, func() (net.Conn, error) {
+		return conn, proxy.register(conn, connID)
+	})
+	if !stop() && err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return 0, nil, err
+	}
+	return connID, conn, nil
+}
+
+// register registers the data connection conn to the client as connID
+func (proxy *Proxy) register(conn net.Conn, connID int32) error {
+	opts := map[string]string{"name": proxy.Name}
+	if proxy.Token != "" {
+		opts[protocol.ChallengeOption] = "1"
+	}
+	if _, err := io.WriteString(conn, protocol.FormatLine(strconv.Itoa(int(connID)), opts)); err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+	if proxy.Token != "" {
+		if err := protocol.AnswerChallenge(conn, r, proxy.Token, proxy.HandshakeTimeout); err != nil {
+			return err
+		}
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if line != "ok\n" {
+		return fmt.Errorf("conn %d rejected, %s", connID, strings.TrimSpace(line))
+	}
+	return nil
+}
+
+// replyError replies the dial error err of hop, the hop of a DialError in
+// err is kept
+func replyError(w *protocol.ControlWriter, id, hop string, err error) {
+	opts := protocol.NewDialError(hop, err).Options()
+	opts["id"] = id
+	if err := w.WriteLine(protocol.FormatLine("err", opts)); err != nil {
+		log.Printf("Write: %s\n", err)
+	}
+}
@@ -0,0 +1,239 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/dworld/channel/pkg/protocol"
+)
+
+const (
+	socksVersion      = 5
+	socksAuthNone     = 0
+	socksAuthPassword = 2
+	socksAuthRefused  = 0xff
+	socksConnect      = 1
+	socksIPv4         = 1
+	socksDomain       = 3
+	socksIPv6         = 4
+)
+
+var socksReplies = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// socksReplyKinds are the dial error kinds of the replies, the others are
+// failures
+var socksReplyKinds = map[byte]string{
+	2: protocol.KindDenied,
+	3: protocol.KindUnreachable,
+	4: protocol.KindUnreachable,
+	5: protocol.KindRefused,
+	6: protocol.KindTimeout,
+}
+
+// validateUpstream parses Upstream, a socks5:// url with optional user and
+// password
+func (proxy *Proxy) validateUpstream() error {
+	if proxy.Upstream == "" {
+		return nil
+	}
+	u, err := url.Parse(proxy.Upstream)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" || u.Host == "" {
+		return fmt.Errorf("invalid upstream, %s", proxy.Upstream)
+	}
+	proxy.upstream = u
+	return nil
+}
+
+var (
+	errUDPUpstream  = errors.New("udp streams don't go through the upstream")
+	errUnixUpstream = errors.New("unix sockets aren't dialed through the upstream")
+)
+
+// dialOutbound dials raddr for the proxy from its bind, through the
+// upstream if any but for the unix sockets, opts are of the dial request
+func (proxy *Proxy) dialOutbound(ctx context.Context, raddr string, opts map[string]string) (net.Conn, error) {
+	if proxy.Dial != nil {
+		return proxy.Dial(ctx, raddr, opts)
+	}
+	if command, ok := protocol.ExecCommand(raddr); ok {
+		return proxy.dialExec(command)
+	}
+	if network, path := protocol.SplitNetwork(raddr); network == "unix" {
+		if proxy.upstream != nil {
+			return nil, errUnixUpstream
+		}
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, path)
+	}
+	if opts[protocol.NetOption] == protocol.NetUDP {
+		if proxy.upstream != nil {
+			return nil, errUDPUpstream
+		}
+		conn, err := proxy.Resolver.DialFrom(ctx, proxy.Bind.Dialer("udp"), "udp", raddr)
+		if err != nil {
+			return nil, err
+		}
+		return protocol.UDPStream(conn), nil
+	}
+	if proxy.upstream == nil {
+		return proxy.Resolver.DialFrom(ctx, proxy.Bind.Dialer("tcp"), "tcp", raddr)
+	}
+	return proxy.dialSOCKS5(ctx, proxy.upstream, raddr)
+}
+
+// dialSOCKS5 connects to addr through the socks5 server at u, the host name
+// is resolved by the server so it works with Tor
+func (proxy *Proxy) dialSOCKS5(ctx context.Context, u *url.URL, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port, %s", addr)
+	}
+	conn, err := proxy.Bind.Dialer("tcp").DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, protocol.NewDialError(protocol.HopUpstream, err)
+	}
+	conn.SetDeadline(time.Now().Add(proxy.HandshakeTimeout))
+	// cancelling ctx aborts the handshake
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	err = socksHandshake(conn, u.User, host, uint16(port))
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, protocol.NewDialError(protocol.HopUpstream, fmt.Errorf("socks5 %s: %w", u.Host, err))
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func socksHandshake(conn net.Conn, user *url.Userinfo, host string, port uint16) error {
+	method := byte(socksAuthNone)
+	if user != nil {
+		method = socksAuthPassword
+	}
+	if _, err := conn.Write([]byte{socksVersion, 1, method}); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion {
+		return fmt.Errorf("invalid version %d", reply[0])
+	}
+	switch reply[1] {
+	case socksAuthNone:
+	case socksAuthPassword:
+		if user == nil {
+			return errors.New("server wants a password")
+		}
+		if err := socksPassword(conn, user); err != nil {
+			return err
+		}
+	case socksAuthRefused:
+		return errors.New("auth method refused")
+	default:
+		return fmt.Errorf("unsupported auth method %d", reply[1])
+	}
+
+	req := []byte{socksVersion, socksConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long, %s", host)
+		}
+		req = append(req, socksDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socksIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socksIPv6)
+		req = append(req, ip...)
+	}
+	req = binary.BigEndian.AppendUint16(req, port)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return err
+	}
+	if header[1] != 0 {
+		msg, ok := socksReplies[header[1]]
+		if !ok {
+			msg = fmt.Sprintf("reply %d", header[1])
+		}
+		kind, ok := socksReplyKinds[header[1]]
+		if !ok {
+			kind = protocol.KindFailed
+		}
+		// the server was reached, the remote failed beyond it
+		return &protocol.DialError{Hop: protocol.HopRemote, Kind: kind, Msg: msg}
+	}
+	// skip the bound address
+	var size int
+	switch header[3] {
+	case socksIPv4:
+		size = net.IPv4len
+	case socksIPv6:
+		size = net.IPv6len
+	case socksDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return err
+		}
+		size = int(n[0])
+	default:
+		return fmt.Errorf("invalid address type %d", header[3])
+	}
+	_, err := io.ReadFull(conn, make([]byte, size+2))
+	return err
+}
+
+// socksPassword runs the username/password auth of RFC 1929
+func socksPassword(conn net.Conn, user *url.Userinfo) error {
+	name := user.Username()
+	password, _ := user.Password()
+	if len(name) > 255 || len(password) > 255 {
+		return errors.New("user or password too long")
+	}
+	req := []byte{1, byte(len(name))}
+	req = append(req, name...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return errors.New("auth failed")
+	}
+	return nil
+}
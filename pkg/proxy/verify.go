@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/dworld/channel/pkg/protocol"
+)
+
+// verifyIdle is how long a verify stream waits for more of the pattern, a
+// truncated one is reported once it passed
+const verifyIdle = 5 * time.Second
+
+// verifyRemote answers a verify stream, nothing is dialed, the pattern the
+// client sent is compared and the result replied before the pattern is sent
+// back
+func (proxy *Proxy) verifyRemote(w *protocol.ControlWriter, size int, opts map[string]string, pool *dataPool) {
+	stream := proxy.replyStream(w, opts, pool)
+	if stream == nil {
+		return
+	}
+	defer protocol.CloseConn("PROXY", stream)
+	want := protocol.VerifyPattern(size)
+	got := readVerify(stream, size)
+	result := protocol.CompareVerify(want, got)
+	if result.Offset >= 0 {
+		log.Printf("verify: got %d bytes of %d, differs at %d, %s\n", len(got), size, result.Offset, result.Suspect)
+	}
+	stream.SetWriteDeadline(time.Now().Add(verifyIdle))
+	if _, err := stream.Write([]byte(protocol.FormatLine("verify", result.Options()))); err != nil {
+		log.Printf("Write: %s\n", err)
+		return
+	}
+	stream.SetWriteDeadline(time.Time{})
+	if _, err := stream.Write(want); err != nil {
+		log.Printf("Write: %s\n", err)
+	}
+}
+
+// readVerify reads up to size bytes of conn, until it's idle for verifyIdle
+func readVerify(conn net.Conn, size int) []byte {
+	buf := make([]byte, size)
+	n := 0
+	for n < size {
+		conn.SetReadDeadline(time.Now().Add(verifyIdle))
+		m, err := conn.Read(buf[n:])
+		n += m
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("verify: %s\n", err)
+			}
+			break
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+	return buf[:n]
+}
@@ -0,0 +1,198 @@
+package relay
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dworld/channel/pkg/protocol"
+)
+
+// Quota caps the streams of the clients matching Client, a path.Match
+// pattern of the names, the first quota matching a client applies
+type Quota struct {
+	Client string `json:"client"`
+	// MaxStreams caps the streams of the client open at once, none when 0
+	MaxStreams int `json:"max_streams,omitempty"`
+	// DialRate is the streams the client may dial a second, in bursts of
+	// DialBurst, none when 0
+	DialRate  float64 `json:"dial_rate,omitempty"`
+	DialBurst int     `json:"dial_burst,omitempty"`
+}
+
+// ValidateQuotas checks the patterns and the caps of quotas
+func ValidateQuotas(quotas []Quota) error {
+	for _, quota := range quotas {
+		if _, err := path.Match(quota.Client, ""); err != nil || quota.Client == "" {
+			return fmt.Errorf("invalid quota client %q", quota.Client)
+		}
+		if quota.MaxStreams < 0 || quota.DialRate < 0 || quota.DialBurst < 0 {
+			return fmt.Errorf("invalid quota of %s, negative caps", quota.Client)
+		}
+	}
+	return nil
+}
+
+// ClientUsage is what a client uses of its quota
+type ClientUsage struct {
+	Client  string `json:"client"`
+	Quota   *Quota `json:"quota,omitempty"`
+	Streams int    `json:"streams"`
+	Refused int64  `json:"refused"`
+}
+
+// usage counts the streams and the dials of a client against its quota
+type usage struct {
+	open    int
+	refused int64
+	tokens  float64
+	last    time.Time
+}
+
+// SetQuotas replaces the quotas of the clients, the streams open are kept
+// and the next dials take the new caps
+func (relay *Relay) SetQuotas(quotas []Quota) error {
+	if err := ValidateQuotas(quotas); err != nil {
+		return err
+	}
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+	relay.Quotas = quotas
+	return nil
+}
+
+// CurrentQuotas are the quotas of the clients, as SetQuotas replaced them
+func (relay *Relay) CurrentQuotas() []Quota {
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+	return relay.Quotas
+}
+
+// Usage lists the quotas the clients seen use, by name
+func (relay *Relay) Usage() []ClientUsage {
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+	var list []ClientUsage
+	for name, u := range relay.usage {
+		list = append(list, ClientUsage{Client: name, Quota: relay.quotaLocked(name), Streams: u.open, Refused: u.refused})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Client < list[j].Client })
+	return list
+}
+
+func (relay *Relay) quotaLocked(name string) *Quota {
+	for i, quota := range relay.Quotas {
+		if ok, _ := path.Match(quota.Client, name); ok {
+			return &relay.Quotas[i]
+		}
+	}
+	return nil
+}
+
+// admit takes a stream of the client name against its quota, release gives
+// it back once the stream is closed
+func (relay *Relay) admit(name string) (func(), error) {
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+	now := time.Now()
+	relay.pruneLocked(now)
+	if relay.usage == nil {
+		relay.usage = map[string]*usage{}
+	}
+	u := relay.usage[name]
+	if u == nil {
+		u = &usage{}
+		relay.usage[name] = u
+	}
+	quota := relay.quotaLocked(name)
+	if quota == nil {
+		quota = &Quota{}
+	}
+	// refused past MaxStreams before a dial token is spent
+	if quota.MaxStreams > 0 && u.open >= quota.MaxStreams {
+		u.refused++
+		return nil, protocol.LimitError("client "+name, quota.MaxStreams)
+	}
+	if quota.DialRate > 0 {
+		u.refill(quota, now)
+		if u.tokens < 1 {
+			u.refused++
+			return nil, &protocol.DialError{Hop: protocol.HopPolicy, Kind: protocol.KindLimit,
+				Msg: fmt.Sprintf("too many dials, client %s may dial %g a second", name, quota.DialRate)}
+		}
+		u.tokens--
+	}
+	u.open++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			relay.lock.Lock()
+			defer relay.lock.Unlock()
+			u.open--
+			if relay.usage[name] == u && u.idle(relay.quotaLocked(name), time.Now()) {
+				delete(relay.usage, name)
+			}
+		})
+	}, nil
+}
+
+// pruneLocked forgets the usage of the clients idle, so the clients gone
+// aren't kept
+func (relay *Relay) pruneLocked(now time.Time) {
+	for name, u := range relay.usage {
+		if u.idle(relay.quotaLocked(name), now) {
+			delete(relay.usage, name)
+		}
+	}
+}
+
+// burst is the dial tokens the bucket of quota holds
+func (quota *Quota) burst() float64 {
+	return max(float64(quota.DialBurst), 1)
+}
+
+// refill adds the dial tokens of quota earned since the last dial, a new
+// bucket is full
+func (u *usage) refill(quota *Quota, now time.Time) {
+	if u.last.IsZero() {
+		u.tokens = quota.burst()
+	} else {
+		u.tokens = min(u.tokens+now.Sub(u.last).Seconds()*quota.DialRate, quota.burst())
+	}
+	u.last = now
+}
+
+// idle tells whether u has no stream open and its bucket of quota would be
+// full again, forgetting it changes nothing
+func (u *usage) idle(quota *Quota, now time.Time) bool {
+	if u.open > 0 {
+		return false
+	}
+	if quota == nil || quota.DialRate <= 0 || u.last.IsZero() {
+		return true
+	}
+	return u.tokens+now.Sub(u.last).Seconds()*quota.DialRate >= quota.burst()
+}
+
+// quotaConn is a stream of a client, its close gives it back to the quota
+type quotaConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *quotaConn) Close() error {
+	defer c.release()
+	return c.Conn.Close()
+}
+
+func (c *quotaConn) String() string {
+	return fmt.Sprint(c.Conn)
+}
+
+// NetConn is the wrapped connection
+func (c *quotaConn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,128 @@
+package relay
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dworld/channel/pkg/protocol"
+)
+
+// admitN admits n streams of name, it fails the test on a refusal
+func admitN(t *testing.T, relay *Relay, name string, n int) []func() {
+	t.Helper()
+	var releases []func()
+	for i := 0; i < n; i++ {
+		release, err := relay.admit(name)
+		if err != nil {
+			t.Fatalf("stream %d refused: %s", i, err)
+		}
+		releases = append(releases, release)
+	}
+	return releases
+}
+
+// refused checks the next stream of name is refused with a limit error
+func refused(t *testing.T, relay *Relay, name string) {
+	t.Helper()
+	_, err := relay.admit(name)
+	var dialErr *protocol.DialError
+	if !errors.As(err, &dialErr) || dialErr.Kind != protocol.KindLimit {
+		t.Fatalf("admitted past the quota, err %v", err)
+	}
+}
+
+// rewind moves the last dial of name back by d, as if d passed
+func rewind(relay *Relay, name string, d time.Duration) {
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+	relay.usage[name].last = relay.usage[name].last.Add(-d)
+}
+
+func TestQuotaDialBurst(t *testing.T) {
+	relay := &Relay{Quotas: []Quota{{Client: "c*", DialRate: 10, DialBurst: 3}}}
+	admitN(t, relay, "c1", 3)
+	refused(t, relay, "c1")
+	// a tenth of a second earns a token
+	rewind(relay, "c1", 100*time.Millisecond)
+	admitN(t, relay, "c1", 1)
+	refused(t, relay, "c1")
+	// the bucket holds the burst at most
+	rewind(relay, "c1", time.Hour)
+	admitN(t, relay, "c1", 3)
+	refused(t, relay, "c1")
+	// the other clients have their buckets
+	admitN(t, relay, "c2", 3)
+}
+
+func TestQuotaMaxStreams(t *testing.T) {
+	relay := &Relay{Quotas: []Quota{{Client: "c1", MaxStreams: 2, DialRate: 0.001, DialBurst: 2}}}
+	releases := admitN(t, relay, "c1", 1)
+	releases = append(releases, admitN(t, relay, "c1", 1)...)
+	refused(t, relay, "c1")
+	releases[0]()
+	// twice gives it back once
+	releases[0]()
+	if got := relay.Usage(); len(got) != 1 || got[0].Streams != 1 || got[0].Refused != 1 {
+		t.Fatalf("usage %+v, want 1 stream and 1 refused", got)
+	}
+	// the refusal past MaxStreams spent no token, the second one is left
+	refused(t, relay, "c1")
+	releases[1]()
+	refused(t, relay, "c1")
+	// the clients without a quota aren't capped
+	admitN(t, relay, "c2", 10)
+}
+
+func TestQuotaMaxStreamsToken(t *testing.T) {
+	relay := &Relay{Quotas: []Quota{{Client: "c1", MaxStreams: 1, DialRate: 0.001, DialBurst: 2}}}
+	release := admitN(t, relay, "c1", 1)[0]
+	refused(t, relay, "c1")
+	release()
+	admitN(t, relay, "c1", 1)
+}
+
+func TestSetQuotasOpen(t *testing.T) {
+	relay := &Relay{}
+	releases := admitN(t, relay, "c1", 3)
+	if err := relay.SetQuotas([]Quota{{Client: "c1", MaxStreams: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	// the streams open are kept and count against the new cap
+	if got := relay.Usage(); len(got) != 1 || got[0].Streams != 3 {
+		t.Fatalf("usage %+v, want 3 streams", got)
+	}
+	refused(t, relay, "c1")
+	releases[0]()
+	refused(t, relay, "c1")
+	releases[1]()
+	releases = append(releases[2:], admitN(t, relay, "c1", 1)...)
+	refused(t, relay, "c1")
+	if err := relay.SetQuotas([]Quota{{Client: "[", MaxStreams: 2}}); err == nil {
+		t.Fatal("invalid quota set")
+	}
+	for _, release := range releases {
+		release()
+	}
+}
+
+func TestQuotaUsagePruned(t *testing.T) {
+	relay := &Relay{Quotas: []Quota{{Client: "c1", DialRate: 10, DialBurst: 2}}}
+	for _, release := range admitN(t, relay, "c2", 2) {
+		release()
+	}
+	// no stream open and no bucket to refill
+	if got := relay.Usage(); len(got) != 0 {
+		t.Fatalf("usage %+v, want none", got)
+	}
+	admitN(t, relay, "c1", 1)[0]()
+	// the bucket is refilling
+	if got := relay.Usage(); len(got) != 1 {
+		t.Fatalf("usage %+v, want c1", got)
+	}
+	rewind(relay, "c1", time.Second)
+	admitN(t, relay, "c2", 1)[0]()
+	if got := relay.Usage(); len(got) != 0 {
+		t.Fatalf("usage %+v, want none once full", got)
+	}
+}
@@ -0,0 +1,414 @@
+// Package relay is the hub of the channel, the agents and the clients both
+// connect to it and it dials the streams of the clients through the agents
+// the policy allows them
+package relay
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dworld/channel/pkg/client"
+	"github.com/dworld/channel/pkg/protocol"
+	"github.com/dworld/channel/pkg/proxy"
+	"github.com/dworld/channel/pkg/transport"
+)
+
+// Rule allows the clients matching Client to dial through the agents
+// matching Agent, both are path.Match patterns of the names
+type Rule struct {
+	Client string
+	Agent  string
+}
+
+// ParseRule parses client=agent
+func ParseRule(s string) (Rule, error) {
+	c, a, ok := strings.Cut(s, "=")
+	if !ok || c == "" || a == "" {
+		return Rule{}, fmt.Errorf("invalid relay rule %q, want client=agent", s)
+	}
+	for _, pattern := range []string{c, a} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return Rule{}, fmt.Errorf("invalid relay rule %q, %s", s, err)
+		}
+	}
+	return Rule{Client: c, Agent: a}, nil
+}
+
+// Relay listens Channel for the agents, the proxies with mux and a name, and
+// for the clients with Relay set, the remotes of the clients are
+// agent/host:port
+type Relay struct {
+	// Channel is where the agents and the clients connect to
+	Channel *transport.Channel
+	// Allow is the pairs of clients and agents the streams may go through,
+	// any pair when empty
+	Allow []Rule
+	// HandshakeTimeout is how long a connection to the channel has to
+	// identify itself
+	HandshakeTimeout time.Duration
+	// Auth validates the control connections of the agents and the
+	// clients, any is accepted when nil
+	Auth protocol.Authenticator
+	// Admission admits the control connections of the agents and the
+	// clients, all when nil
+	Admission *protocol.Admission
+	// Bans bans the IPs failing the handshake or the auth, none when nil
+	Bans *protocol.Bans
+	// AcceptRate caps the connections accepted from each IP, none when nil
+	AcceptRate *protocol.AcceptRate
+	// Compress is the codecs accepted for the streams of the clients
+	Compress []string
+	// Hooks are called on the streams of the clients, the control
+	// connections and the failed dials
+	Hooks protocol.Hooks
+	// Quotas cap the streams and the dials of the clients, SetQuotas
+	// replaces them while the relay runs
+	Quotas []Quota
+	protocol.Options
+
+	lock    sync.Mutex
+	agents  map[string]*agentConn
+	clients map[string]int
+	errors  protocol.ErrorLog
+	// usage is of the quotas, by client name
+	usage map[string]*usage
+	// listening tracks the listener of the channel
+	listening protocol.Listeners
+}
+
+// Run serves the agents and the clients until ctx is done
+func (relay *Relay) Run(ctx context.Context) error {
+	relay.Options = relay.Options.WithDefaults()
+	if err := ValidateQuotas(relay.Quotas); err != nil {
+		return err
+	}
+	if relay.HandshakeTimeout <= 0 {
+		relay.HandshakeTimeout = 10 * time.Second
+	}
+	if err := relay.Channel.Init(true); err != nil {
+		return err
+	}
+	log.Printf("Listen RELAY at %s with %s\n", relay.Channel.Addr, relay.Channel.Transport)
+	relay.listening.Expect(relay.Channel.Addr)
+	ln, err := relay.Channel.Listen()
+	if err != nil {
+		return err
+	}
+	ln = protocol.LimitAccepts(ln, relay.AcceptRate)
+	relay.listening.Up(relay.Channel.Addr)
+	defer relay.listening.Expect(relay.Channel.Addr)
+	stop := context.AfterFunc(ctx, func() { ln.Close() })
+	defer stop()
+	closeAgents := context.AfterFunc(ctx, relay.closeAgents)
+	defer closeAgents()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			log.Printf("Accept: %s\n", err)
+			continue
+		}
+		go relay.handle(ctx, conn)
+	}
+}
+
+// Control is empty, a relay has a control connection per agent and client
+func (relay *Relay) Control() protocol.ControlInfo {
+	return protocol.ControlInfo{}
+}
+
+// Healthy tells whether the listener of the channel is up
+func (relay *Relay) Healthy() error {
+	return relay.listening.Err()
+}
+
+// Ready is Healthy, a relay is ready for the agents and clients once it
+// listens, whichever already connected
+func (relay *Relay) Ready() error {
+	return relay.Healthy()
+}
+
+// LastErrors lists the last errors of the agents and the clients
+func (relay *Relay) LastErrors() []protocol.ErrorEntry {
+	return relay.errors.List()
+}
+
+// Agents lists the names of the agents connected
+func (relay *Relay) Agents() []string {
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+	var names []string
+	for name, agent := range relay.agents {
+		if agent.dialer.Connected() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Clients lists the names of the clients connected
+func (relay *Relay) Clients() []string {
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+	var names []string
+	for name := range relay.clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// handle tells an agent from a client by the first line of conn, the hello
+// of a proxy or the relay line of a client
+func (relay *Relay) handle(ctx context.Context, conn net.Conn) {
+	if relay.Bans.Banned(conn.RemoteAddr()) {
+		conn.Close()
+		return
+	}
+	log.Printf("handle RELAY conn %v\n", conn)
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(relay.HandshakeTimeout))
+	line, err := r.ReadString('\n')
+	if err != nil {
+		log.Printf("ReadString from %v: %s, got %s\n", conn.RemoteAddr(), err, protocol.HexPrefix([]byte(line)))
+		relay.Bans.Fail(conn.RemoteAddr())
+		protocol.CloseConn("RELAY", conn)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	head, opts := protocol.ParseLine(line)
+	if head == "ctrl" || head == "relay" {
+		if err := protocol.Challenge(conn, r, opts, relay.HandshakeTimeout); err != nil {
+			log.Printf("Challenge %v: %s\n", conn.RemoteAddr(), err)
+			relay.Bans.Fail(conn.RemoteAddr())
+			protocol.CloseConn("RELAY", conn)
+			return
+		}
+	}
+	if relay.Auth != nil && (head == "ctrl" || head == "relay") {
+		if err := relay.Auth.ValidateControl(conn, opts); err != nil {
+			log.Printf("Auth %v: %s\n", conn.RemoteAddr(), err)
+			relay.errors.Add("auth "+conn.RemoteAddr().String(), err)
+			relay.Bans.Fail(conn.RemoteAddr())
+			protocol.CloseConn("RELAY", conn)
+			return
+		}
+		relay.Bans.Succeed(conn.RemoteAddr())
+	}
+	if relay.Admission != nil && (head == "ctrl" || head == "relay") {
+		if ok, retry := relay.Admission.Admit(); !ok {
+			log.Printf("Busy %v, retry in %s\n", conn.RemoteAddr(), retry)
+			conn.SetWriteDeadline(time.Now().Add(relay.HandshakeTimeout))
+			io.WriteString(conn, protocol.BusyLine(retry))
+			protocol.CloseConn("RELAY", conn)
+			return
+		}
+	}
+	switch {
+	case head == "ctrl" && opts["name"] != "" && opts["mux"] != "":
+		relay.addAgent(ctx, opts["name"], conn, r, opts)
+	case head == "relay" && opts["name"] != "":
+		relay.serveClient(ctx, opts["name"], &bufferedConn{Conn: conn, r: r})
+	case head == "ctrl":
+		relay.refuse(conn, "agents need -mux and -name")
+	case head == "relay":
+		relay.refuse(conn, "clients need -name")
+	default:
+		relay.Bans.Fail(conn.RemoteAddr())
+		relay.refuse(conn, "not an agent nor a client, "+strings.TrimSpace(line))
+	}
+}
+
+func (relay *Relay) refuse(conn net.Conn, msg string) {
+	log.Printf("Refused %v: %s\n", conn.RemoteAddr(), msg)
+	conn.SetWriteDeadline(time.Now().Add(relay.HandshakeTimeout))
+	io.WriteString(conn, protocol.FormatLine("err", map[string]string{"msg": msg}))
+	protocol.CloseConn("RELAY", conn)
+}
+
+// agentConn is the control connection of an agent and the dialer of its
+// streams
+type agentConn struct {
+	dialer *client.Dialer
+	conn   net.Conn
+}
+
+// addAgent dials the streams for name through conn until ctx is done, an
+// agent connecting again under the same name replaces and closes the former
+// connection, opts are its hello
+func (relay *Relay) addAgent(ctx context.Context, name string, conn net.Conn, r *bufio.Reader, opts map[string]string) {
+	log.Printf("Agent %s at %v\n", name, conn.RemoteAddr())
+	session := protocol.NewSession(conn, r)
+	peer := protocol.ParseCapabilities(opts)
+	protocol.CheckVersion("AGENT", peer)
+	if peer.Has("reset") {
+		session.AllowReset()
+	}
+	if peer.Has("halfclose") {
+		session.AllowHalfClose()
+	}
+	if peer.Has("window") {
+		session.AllowWindow()
+	}
+	// the agent turns the same features on once it knows the relay has them,
+	// before the dialer writes its requests
+	if _, err := io.WriteString(session.ControlConn(), protocol.FormatLine("caps", protocol.LocalCapabilities().Options())); err != nil {
+		log.Printf("Write: %s\n", err)
+	}
+	dialer := client.NewSessionDialer(session, relay.Options)
+	dialer.SetPeer(peer)
+	relay.Hooks.ControlConnect(conn)
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+	// closeAgents ran already
+	if ctx.Err() != nil {
+		protocol.CloseConn("AGENT", conn)
+		return
+	}
+	if relay.agents == nil {
+		relay.agents = map[string]*agentConn{}
+	}
+	if former := relay.agents[name]; former != nil {
+		log.Printf("Agent %s replaced\n", name)
+		protocol.CloseConn("AGENT", former.conn)
+	}
+	relay.agents[name] = &agentConn{dialer: dialer, conn: conn}
+}
+
+// closeAgents closes the control connections of all the agents
+func (relay *Relay) closeAgents() {
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+	for _, agent := range relay.agents {
+		protocol.CloseConn("AGENT", agent.conn)
+	}
+	relay.agents = nil
+}
+
+// serveClient serves the control connection of the client name as a proxy
+// with mux whose remotes are dialed through the agents
+func (relay *Relay) serveClient(ctx context.Context, name string, conn net.Conn) {
+	log.Printf("Client %s at %v\n", name, conn.RemoteAddr())
+	relay.lock.Lock()
+	if relay.clients == nil {
+		relay.clients = map[string]int{}
+	}
+	relay.clients[name]++
+	relay.lock.Unlock()
+	defer func() {
+		relay.lock.Lock()
+		if relay.clients[name]--; relay.clients[name] <= 0 {
+			delete(relay.clients, name)
+		}
+		relay.lock.Unlock()
+	}()
+	p := &proxy.Proxy{
+		Mux:              true,
+		Compress:         relay.Compress,
+		HandshakeTimeout: relay.HandshakeTimeout,
+		Hooks:            relay.Hooks,
+		Options:          relay.Options,
+		Dial: func(ctx context.Context, raddr string, opts map[string]string) (net.Conn, error) {
+			return relay.dial(ctx, name, raddr, opts)
+		},
+	}
+	if err := p.Serve(ctx, conn); err != nil && ctx.Err() == nil {
+		log.Printf("Serve %s: %s\n", name, err)
+	}
+}
+
+// dial dials raddr, agent/host:port, for the client from, the e2e and flush
+// options of the stream are forwarded to the agent
+func (relay *Relay) dial(ctx context.Context, from, raddr string, opts map[string]string) (net.Conn, error) {
+	agent, addr, err := splitAddr(raddr)
+	if err != nil {
+		return nil, &protocol.DialError{Hop: protocol.HopChannel, Kind: protocol.KindHost, Msg: err.Error()}
+	}
+	if !relay.allowed(from, agent) {
+		err := fmt.Errorf("%s may not dial through %s", from, agent)
+		relay.errors.Add("dial "+raddr, err)
+		return nil, protocol.PolicyError(err)
+	}
+	relay.lock.Lock()
+	ac := relay.agents[agent]
+	relay.lock.Unlock()
+	if ac == nil || !ac.dialer.Connected() {
+		err := &protocol.DialError{Hop: protocol.HopChannel, Kind: protocol.KindUnreachable, Msg: "agent " + agent + " is not connected"}
+		relay.errors.Add("dial "+raddr, err)
+		return nil, err
+	}
+	release, err := relay.admit(from)
+	if err != nil {
+		log.Printf("Refused %s: %s\n", raddr, err)
+		relay.errors.Add("dial "+raddr, err)
+		return nil, err
+	}
+	conn, err := ac.dialer.DialOptions(ctx, addr, map[string]string{"e2e": opts["e2e"], "chain": opts["chain"], "from": opts["from"], protocol.FlushOption: opts[protocol.FlushOption]})
+	if err != nil {
+		release()
+		relay.errors.Add("dial "+raddr, err)
+		return nil, err
+	}
+	return &quotaConn{Conn: conn, release: release}, nil
+}
+
+func (relay *Relay) allowed(from, agent string) bool {
+	if len(relay.Allow) == 0 {
+		return true
+	}
+	for _, rule := range relay.Allow {
+		c, _ := path.Match(rule.Client, from)
+		a, _ := path.Match(rule.Agent, agent)
+		if c && a {
+			return true
+		}
+	}
+	return false
+}
+
+// splitAddr splits agent/host:port
+func splitAddr(raddr string) (string, string, error) {
+	agent, addr, ok := strings.Cut(raddr, "/")
+	if !ok || agent == "" {
+		return "", "", fmt.Errorf("no agent in %s, want agent/host:port", raddr)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return "", "", err
+	}
+	return agent, addr, nil
+}
+
+// bufferedConn reads what the relay buffered before the connection
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) String() string {
+	return fmt.Sprint(c.Conn)
+}
+
+// NetConn is the wrapped connection
+func (c *bufferedConn) NetConn() net.Conn {
+	return c.Conn
+}
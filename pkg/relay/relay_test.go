@@ -0,0 +1,340 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/dworld/channel/pkg/client"
+	"github.com/dworld/channel/pkg/protocol"
+	"github.com/dworld/channel/pkg/proxy"
+	"github.com/dworld/channel/pkg/transport"
+)
+
+// testRelay is a relay serving the connections of the listener it returns,
+// without Run
+func testRelay(t *testing.T, ctx context.Context) (*Relay, net.Listener) {
+	t.Helper()
+	relay := &Relay{HandshakeTimeout: time.Second}
+	relay.Options = relay.Options.WithDefaults()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go relay.handle(ctx, conn)
+		}
+	}()
+	return relay, ln
+}
+
+// runAgent runs the agent name connected to the relay at ln until ctx is
+// done, and waits for the relay to have it
+func runAgent(t *testing.T, ctx context.Context, relay *Relay, ln net.Listener, name string) {
+	t.Helper()
+	agent := &proxy.Proxy{
+		Channel: &transport.Channel{Addr: ln.Addr().String(), HandshakeTimeout: time.Second},
+		Mux:     true,
+		Name:    name,
+	}
+	go agent.Run(ctx)
+	waitAgent(t, relay, name)
+}
+
+// waitAgent waits for the relay to have the agent name connected
+func waitAgent(t *testing.T, relay *Relay, name string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !slices.Contains(relay.Agents(), name); {
+		if time.Now().After(deadline) {
+			t.Fatalf("agent %s not connected", name)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// runClient runs the client name connected to the relay at ln until ctx is
+// done, and returns its dialer once the relay has it
+func runClient(t *testing.T, ctx context.Context, ln net.Listener, name string) *client.Dialer {
+	t.Helper()
+	c := &client.Client{
+		Channel:          &transport.Channel{Addr: ln.Addr().String(), HandshakeTimeout: time.Second},
+		Relay:            true,
+		Name:             name,
+		HandshakeTimeout: time.Second,
+	}
+	go c.Run(ctx)
+	for deadline := time.Now().Add(5 * time.Second); c.Ready() != nil; {
+		if time.Now().After(deadline) {
+			t.Fatalf("client %s not connected", name)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return c.Dialer()
+}
+
+// helloAgent connects to the relay at ln as the agent name, without serving
+// its streams
+func helloAgent(t *testing.T, ln net.Listener, name string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if _, err := io.WriteString(conn, protocol.FormatLine("ctrl", map[string]string{"name": name, "mux": "1"})); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// waitClosed reads conn until the relay closes it
+func waitClosed(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, conn); err != nil {
+		t.Fatalf("not closed: %s", err)
+	}
+}
+
+// echoServer echoes the connections until they half close, and half closes
+// them back
+func echoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+				conn.(*net.TCPConn).CloseWrite()
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// echoHalfClosed writes data to conn, half closes it and reads the echo
+// until the peer closes
+func echoHalfClosed(t *testing.T, conn net.Conn, data []byte) {
+	t.Helper()
+	// the mux streams take no deadlines
+	timer := time.AfterFunc(5*time.Second, func() { conn.Close() })
+	defer timer.Stop()
+	errs := make(chan error, 1)
+	go func() {
+		if _, err := conn.Write(data); err != nil {
+			errs <- err
+			return
+		}
+		errs <- protocol.CloseWrite(conn)
+	}()
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("echoed %d bytes, want %d", len(got), len(data))
+	}
+}
+
+func TestRelayHalfClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	relay, ln := testRelay(t, ctx)
+	runAgent(t, ctx, relay, ln, "a1")
+	echo := echoServer(t)
+	for _, size := range []int{10, 100 << 10} {
+		conn, err := relay.dial(ctx, "c1", "a1/"+echo, map[string]string{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		echoHalfClosed(t, conn, bytes.Repeat([]byte{'x'}, size))
+		conn.Close()
+	}
+}
+
+func TestRelayWindows(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	relay, ln := testRelay(t, ctx)
+	runAgent(t, ctx, relay, ln, "a1")
+	dialer := runClient(t, ctx, ln, "c1")
+	// more than a stream buffers, sent past a reader slower than both legs,
+	// a leg without windows resets the stream
+	data := bytes.Repeat([]byte{'x'}, 3*64*protocol.MuxMaxPayload)
+	src, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	go func() {
+		conn, err := src.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write(data)
+	}()
+	conn, err := dialer.Dial("a1/" + src.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	timer := time.AfterFunc(10*time.Second, func() { conn.Close() })
+	defer timer.Stop()
+	time.Sleep(200 * time.Millisecond)
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	if len(got) != len(data) {
+		t.Fatalf("read %d bytes, want %d", len(got), len(data))
+	}
+}
+
+func TestRelayReplaceAgent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	relay, ln := testRelay(t, ctx)
+	former := helloAgent(t, ln, "a1")
+	waitAgent(t, relay, "a1")
+	relay.lock.Lock()
+	first := relay.agents["a1"]
+	relay.lock.Unlock()
+	latter := helloAgent(t, ln, "a1")
+	waitClosed(t, former)
+	relay.lock.Lock()
+	replaced := relay.agents["a1"] != first
+	relay.lock.Unlock()
+	if !replaced {
+		t.Fatal("agent not replaced")
+	}
+	if got := relay.Agents(); !slices.Equal(got, []string{"a1"}) {
+		t.Fatalf("agents %v, want [a1]", got)
+	}
+	relay.closeAgents()
+	waitClosed(t, latter)
+	if got := relay.Agents(); len(got) != 0 {
+		t.Fatalf("agents %v after close, want none", got)
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want Rule
+		ok   bool
+	}{
+		{"c1=a1", Rule{Client: "c1", Agent: "a1"}, true},
+		{"ops-*=db?", Rule{Client: "ops-*", Agent: "db?"}, true},
+		{"*=*", Rule{Client: "*", Agent: "*"}, true},
+		{"c1", Rule{}, false},
+		{"=a1", Rule{}, false},
+		{"c1=", Rule{}, false},
+		{"[c=a1", Rule{}, false},
+		{"c1=a[", Rule{}, false},
+	} {
+		t.Run(tc.s, func(t *testing.T) {
+			got, err := ParseRule(tc.s)
+			if (err == nil) != tc.ok {
+				t.Fatalf("err %v, want ok %v", err, tc.ok)
+			}
+			if got != tc.want {
+				t.Errorf("rule %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	rules := []Rule{{Client: "c1", Agent: "a*"}, {Client: "ops-*", Agent: "*"}}
+	for _, tc := range []struct {
+		name  string
+		allow []Rule
+		from  string
+		agent string
+		want  bool
+	}{
+		{"no rules", nil, "c1", "a1", true},
+		{"matching", rules, "c1", "a1", true},
+		{"agent pattern", rules, "c1", "b1", false},
+		{"client pattern", rules, "ops-1", "b1", true},
+		{"no client", rules, "c2", "a1", false},
+		{"pattern separator", rules, "ops-/x", "a1", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			relay := &Relay{Allow: tc.allow}
+			if got := relay.allowed(tc.from, tc.agent); got != tc.want {
+				t.Errorf("allowed %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSplitAddr(t *testing.T) {
+	for _, tc := range []struct {
+		raddr string
+		agent string
+		addr  string
+		ok    bool
+	}{
+		{"a1/example.com:80", "a1", "example.com:80", true},
+		{"a1/[::1]:22", "a1", "[::1]:22", true},
+		{"example.com:80", "", "", false},
+		{"/example.com:80", "", "", false},
+		{"a1/example.com", "", "", false},
+		{"a1/", "", "", false},
+	} {
+		t.Run(tc.raddr, func(t *testing.T) {
+			agent, addr, err := splitAddr(tc.raddr)
+			if (err == nil) != tc.ok {
+				t.Fatalf("err %v, want ok %v", err, tc.ok)
+			}
+			if agent != tc.agent || addr != tc.addr {
+				t.Errorf("split %q %q, want %q %q", agent, addr, tc.agent, tc.addr)
+			}
+		})
+	}
+}
+
+func TestRelayClientStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	relay, ln := testRelay(t, ctx)
+	runAgent(t, ctx, relay, ln, "a1")
+	dialer := runClient(t, ctx, ln, "c1")
+	if got := relay.Clients(); !slices.Equal(got, []string{"c1"}) {
+		t.Fatalf("clients %v, want [c1]", got)
+	}
+	echo := echoServer(t)
+	conn, err := dialer.Dial("a1/" + echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoHalfClosed(t, conn, []byte("hello through the relay"))
+	conn.Close()
+	if _, err := dialer.Dial("a2/" + echo); err == nil {
+		t.Fatal("dialed through an agent not connected")
+	}
+}
@@ -0,0 +1,60 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// Bind is where the outbound connections originate from, on a host with
+// several egress addresses routed by policy
+type Bind struct {
+	// IP is the local address of the connections, the one of the route when
+	// nil
+	IP net.IP
+	// Interface is the device the sockets are bound to, SO_BINDTODEVICE,
+	// linux only, none when empty
+	Interface string
+
+	control func(network, address string, c syscall.RawConn) error
+}
+
+// ParseBind is the bind of the local IP addr and the interface iface, nil
+// when both are empty
+func ParseBind(addr, iface string) (*Bind, error) {
+	if addr == "" && iface == "" {
+		return nil, nil
+	}
+	b := &Bind{Interface: iface}
+	if addr != "" {
+		if b.IP = net.ParseIP(addr); b.IP == nil {
+			return nil, fmt.Errorf("invalid bind address, %s", addr)
+		}
+	}
+	if iface != "" {
+		control, err := bindDevice(iface)
+		if err != nil {
+			return nil, err
+		}
+		b.control = control
+	}
+	return b, nil
+}
+
+// Dialer is the dialer of network from b, a plain one when b is nil
+func (b *Bind) Dialer(network string) *net.Dialer {
+	if b == nil {
+		return &net.Dialer{}
+	}
+	dialer := &net.Dialer{Control: b.control}
+	if b.IP != nil {
+		switch {
+		case strings.HasPrefix(network, "tcp"):
+			dialer.LocalAddr = &net.TCPAddr{IP: b.IP}
+		case strings.HasPrefix(network, "udp"):
+			dialer.LocalAddr = &net.UDPAddr{IP: b.IP}
+		}
+	}
+	return dialer
+}
@@ -0,0 +1,24 @@
+package transport
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// bindDevice is the control binding the sockets to iface before they
+// connect, it needs CAP_NET_RAW
+func bindDevice(iface string) (func(network, address string, c syscall.RawConn) error, error) {
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = syscall.BindToDevice(int(fd), iface)
+		})
+		if err == nil {
+			err = serr
+		}
+		if err != nil {
+			return fmt.Errorf("bind to %s: %w", iface, err)
+		}
+		return nil
+	}, nil
+}
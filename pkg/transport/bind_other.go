@@ -0,0 +1,13 @@
+//go:build !linux
+
+package transport
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+func bindDevice(iface string) (func(network, address string, c syscall.RawConn) error, error) {
+	return nil, fmt.Errorf("binding to the interface %s needs linux, not %s", iface, runtime.GOOS)
+}
@@ -0,0 +1,86 @@
+package transport
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// certPoll is how often at most the handshakes check the certificate files
+const certPoll = time.Second
+
+// certReloader is the certificate of certFile and keyFile, loaded anew once
+// either file changes, so a renewed certificate is served without a restart
+// dropping the tunnels. A renewal which fails to load, e.g. written half
+// yet, keeps the certificate before
+type certReloader struct {
+	certFile, keyFile string
+
+	lock    sync.Mutex
+	cert    *tls.Certificate
+	mod     time.Time
+	checked time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	mod, err := r.modTime()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	r.cert, r.mod, r.checked = &cert, mod, time.Now()
+	return r, nil
+}
+
+// modTime is the latest modification of the files, of the targets of the
+// symlinks of the certbot live directory
+func (r *certReloader) modTime() (time.Time, error) {
+	var mod time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(mod) {
+			mod = info.ModTime()
+		}
+	}
+	return mod, nil
+}
+
+func (r *certReloader) get() *tls.Certificate {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if time.Since(r.checked) < certPoll {
+		return r.cert
+	}
+	r.checked = time.Now()
+	mod, err := r.modTime()
+	if err != nil || mod.Equal(r.mod) {
+		return r.cert
+	}
+	// tried once per change, the other file changing tries again
+	r.mod = mod
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		log.Printf("Reload %s: %s\n", r.certFile, err)
+		return r.cert
+	}
+	log.Printf("Reloaded %s\n", r.certFile)
+	r.cert = &cert
+	return r.cert
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.get(), nil
+}
+
+func (r *certReloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.get(), nil
+}
@@ -0,0 +1,124 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// validateHTTPProxy checks HTTPProxy, an http:// url with optional user
+// and password
+func (ch *Channel) validateHTTPProxy() error {
+	if ch.HTTPProxy == "" {
+		return nil
+	}
+	u, err := url.Parse(ch.HTTPProxy)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" || u.Host == "" {
+		return fmt.Errorf("invalid http-proxy, %s", ch.HTTPProxy)
+	}
+	return nil
+}
+
+// httpProxy is the HTTP proxy for addr, HTTPProxy or else HTTPS_PROXY and
+// NO_PROXY of the environment
+func (ch *Channel) httpProxy(addr string) (*url.URL, error) {
+	if ch.HTTPProxy != "" {
+		return url.Parse(ch.HTTPProxy)
+	}
+	return http.ProxyFromEnvironment(&http.Request{URL: &url.URL{Scheme: "https", Host: addr}})
+}
+
+// dialer dials the tcp connections of the channel with its keepalive, from
+// its bind
+func (ch *Channel) dialer() *net.Dialer {
+	dialer := ch.Bind.Dialer("tcp")
+	dialer.KeepAliveConfig = ch.KeepAlive
+	return dialer
+}
+
+// listenTCP listens addr for the channel, the connections accepted get its
+// keepalive
+func (ch *Channel) listenTCP(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{KeepAliveConfig: ch.KeepAlive}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// dialTCP dials addr for the channel, through an HTTP CONNECT proxy if one
+// is configured
+func (ch *Channel) dialTCP(addr string) (net.Conn, error) {
+	proxy, err := ch.httpProxy(addr)
+	if err != nil {
+		return nil, err
+	}
+	if proxy == nil {
+		return ch.dialer().Dial("tcp", addr)
+	}
+	host := proxy.Host
+	if proxy.Port() == "" {
+		host = net.JoinHostPort(proxy.Hostname(), "80")
+	}
+	conn, err := ch.dialer().Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(ch.HandshakeTimeout))
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	rsp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy %s refused CONNECT %s, %s", host, addr, rsp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	if r.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: r}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn reads what the proxy sent past its response before the rest
+// of conn
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) String() string {
+	return fmt.Sprint(c.Conn)
+}
+
+// NetConn is the wrapped connection
+func (c *bufferedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,184 @@
+package transport
+
+import (
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// CryptPSK encrypts the channel with chacha20-poly1305 under a pre-shared
+// key, each direction starts with a random salt the subkey is derived from
+const CryptPSK = "psk"
+
+const (
+	cryptSaltSize  = 32
+	cryptMaxChunk  = 0x3fff
+	cryptSubkeyTag = "channel psk subkey"
+)
+
+var errCryptKey = errors.New("psk decryption failed, check -key")
+
+// validateCrypt checks Crypt and Key
+func (ch *Channel) validateCrypt() error {
+	switch ch.Crypt {
+	case "", "none":
+		ch.Crypt = ""
+		return nil
+	case CryptPSK:
+	default:
+		return fmt.Errorf("invalid crypt %s", ch.Crypt)
+	}
+	if ch.Key == "" {
+		return errors.New("crypt psk needs -key")
+	}
+	if ch.NoiseKey != "" {
+		return errors.New("crypt psk and noise-key are exclusive")
+	}
+	return nil
+}
+
+func cryptAEAD(key string, salt []byte) (cipher.AEAD, error) {
+	subkey, err := hkdf.Key(sha256.New, []byte(key), salt, cryptSubkeyTag, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(subkey)
+}
+
+// cryptConn frames each write in chunks of a sealed length and a sealed
+// payload, the nonces count up from zero per direction
+type cryptConn struct {
+	net.Conn
+	key string
+
+	readLock  sync.Mutex
+	recv      cipher.AEAD
+	recvNonce []byte
+	frame     []byte
+	pending   []byte
+
+	writeLock sync.Mutex
+	send      cipher.AEAD
+	sendNonce []byte
+}
+
+// cryptWrap encrypts conn, it needs no round trip and never blocks
+func (ch *Channel) cryptWrap(conn net.Conn) net.Conn {
+	return &cryptConn{Conn: conn, key: ch.Key}
+}
+
+func (c *cryptConn) String() string {
+	return fmt.Sprint(c.Conn)
+}
+
+// NetConn is the wrapped connection
+func (c *cryptConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func increment(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+// open reads and decrypts a sealed chunk of size in place in frame
+func (c *cryptConn) open(size int) ([]byte, error) {
+	buf := c.frame[:size+c.recv.Overhead()]
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return nil, err
+	}
+	plain, err := c.recv.Open(buf[:0], c.recvNonce, buf, nil)
+	if err != nil {
+		return nil, errCryptKey
+	}
+	increment(c.recvNonce)
+	return plain, nil
+}
+
+func (c *cryptConn) Read(p []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	if c.recv == nil {
+		salt := make([]byte, cryptSaltSize)
+		if _, err := io.ReadFull(c.Conn, salt); err != nil {
+			return 0, err
+		}
+		aead, err := cryptAEAD(c.key, salt)
+		if err != nil {
+			return 0, err
+		}
+		c.recv = aead
+		c.recvNonce = make([]byte, aead.NonceSize())
+		c.frame = make([]byte, cryptMaxChunk+aead.Overhead())
+	}
+	for len(c.pending) == 0 {
+		size, err := c.open(2)
+		if err != nil {
+			return 0, err
+		}
+		c.pending, err = c.open(int(binary.BigEndian.Uint16(size)) & cryptMaxChunk)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *cryptConn) Write(p []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	var out []byte
+	if c.send == nil {
+		salt := make([]byte, cryptSaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return 0, err
+		}
+		aead, err := cryptAEAD(c.key, salt)
+		if err != nil {
+			return 0, err
+		}
+		c.send = aead
+		c.sendNonce = make([]byte, aead.NonceSize())
+		out = salt
+		// an empty first write still sends the salt, the peer reads it first
+		if len(p) == 0 {
+			_, err := c.Conn.Write(out)
+			return 0, err
+		}
+	}
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > cryptMaxChunk {
+			chunk = chunk[:cryptMaxChunk]
+		}
+		var size [2]byte
+		binary.BigEndian.PutUint16(size[:], uint16(len(chunk)))
+		out = c.send.Seal(out, c.sendNonce, size[:], nil)
+		increment(c.sendNonce)
+		out = c.send.Seal(out, c.sendNonce, chunk, nil)
+		increment(c.sendNonce)
+		if _, err := c.Conn.Write(out); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+		out = out[:0]
+	}
+	return written, nil
+}
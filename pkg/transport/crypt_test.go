@@ -0,0 +1,84 @@
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// sealPSK is the wire of the chunks written to a psk conn of key
+func sealPSK(t *testing.T, key string, chunks ...[]byte) []byte {
+	t.Helper()
+	conn := &scriptConn{}
+	c := (&Channel{Key: key}).cryptWrap(conn)
+	for _, chunk := range chunks {
+		if _, err := c.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return conn.out.Bytes()
+}
+
+// openPSK reads all of wire through a psk conn of key
+func openPSK(key string, wire []byte) ([]byte, error) {
+	c := (&Channel{Key: key}).cryptWrap(&scriptConn{in: bytes.NewReader(wire)})
+	return io.ReadAll(c)
+}
+
+func TestCryptRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		chunks [][]byte
+	}{
+		{"one byte", [][]byte{{'x'}}},
+		{"empty first write", [][]byte{{}, []byte("after")}},
+		{"chunks", [][]byte{[]byte("hello "), []byte("world")}},
+		{"max chunk", [][]byte{bytes.Repeat([]byte{'a'}, cryptMaxChunk)}},
+		{"split write", [][]byte{bytes.Repeat([]byte{'b'}, 3*cryptMaxChunk+7)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := openPSK("secret", sealPSK(t, "secret", tc.chunks...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := bytes.Join(tc.chunks, nil); !bytes.Equal(got, want) {
+				t.Errorf("read %d bytes, want %d", len(got), len(want))
+			}
+		})
+	}
+}
+
+func TestCryptRejects(t *testing.T) {
+	const overhead = 16
+	first, second := []byte("first chunk"), []byte("second chunk")
+	wire := sealPSK(t, "secret", first, second)
+	// the salt, then each chunk is its sealed length and its sealed payload
+	chunk1 := wire[cryptSaltSize : cryptSaltSize+2+overhead+len(first)+overhead]
+	flip := func(i int) []byte {
+		b := append([]byte(nil), wire...)
+		b[i] ^= 1
+		return b
+	}
+	for _, tc := range []struct {
+		name string
+		key  string
+		wire []byte
+		err  error
+	}{
+		{"wrong key", "other", wire, errCryptKey},
+		{"tampered salt", "secret", flip(0), errCryptKey},
+		{"tampered length", "secret", flip(cryptSaltSize), errCryptKey},
+		{"tampered payload", "secret", flip(len(wire) - overhead - 1), errCryptKey},
+		{"tampered tag", "secret", flip(len(wire) - 1), errCryptKey},
+		{"replayed chunk", "secret", bytes.Join([][]byte{wire[:cryptSaltSize], chunk1, chunk1}, nil), errCryptKey},
+		{"truncated", "secret", wire[:len(wire)-1], io.ErrUnexpectedEOF},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := openPSK(tc.key, tc.wire)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("read error %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package transport
+
+import (
+	"errors"
+	"net"
+)
+
+// The streams a relay brokers are plaintext to it: the channel encryption
+// ends at the relay on both sides. E2E seals a stream between its client and
+// the agent dialing it so the relay only ever carries ciphertext.
+//
+// Each stream runs its own Noise_IK handshake inside the stream, the client
+// is the initiator and knows the static key of the agent from its config,
+// never from the relay, so a relay can't stand in for the agent. The
+// prologue is the path of the stream, agent/host:port, and binds the keys to
+// it: a relay sending the stream to another agent or remote fails the
+// handshake. The agent accepts the client keys listed, or any when none is,
+// which keeps the streams secret from the relay but leaves telling the
+// clients apart to the relay.
+//
+// A relay can still refuse, delay or drop the streams and sees their sizes
+// and timing, and the remote sees the agent, E2E doesn't change that.
+
+// E2EKeys are the static key of a node and the peers it accepts for the end
+// to end streams
+type E2EKeys struct {
+	keys *noiseKeys
+}
+
+var errE2EPath = errors.New("e2e needs the path of the stream")
+
+// LoadE2EKeys loads the static private key of file, as made by -noise-genkey,
+// and the comma separated public keys of the clients accepted, any when empty
+func LoadE2EKeys(file, peers string) (*E2EKeys, error) {
+	keys, err := loadNoiseKeys(file, peers)
+	if err != nil {
+		return nil, err
+	}
+	keys.anyPeer = len(keys.peers) == 0
+	return &E2EKeys{keys: keys}, nil
+}
+
+// Client runs the initiator handshake on conn for the stream of path with the
+// agent of public key peer
+func (k *E2EKeys) Client(conn net.Conn, peer, path string) (net.Conn, error) {
+	if path == "" {
+		return nil, errE2EPath
+	}
+	rs, err := parseNoisePublic(peer)
+	if err != nil {
+		return nil, err
+	}
+	return k.keys.initiate(conn, rs, []byte(path))
+}
+
+// Server runs the responder handshake on conn for the stream of path
+func (k *E2EKeys) Server(conn net.Conn, path string) (net.Conn, error) {
+	c := k.keys.respond(conn, []byte(path))
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,31 @@
+package transport
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestE2ERejectsLowOrder(t *testing.T) {
+	lowOrder := make([]byte, noiseKeySize)
+	t.Run("server", func(t *testing.T) {
+		k := &E2EKeys{keys: &noiseKeys{key: vectorKey(t, vectorRespStatic), anyPeer: true}}
+		conn := &scriptConn{in: bytes.NewReader(append([]byte{0, 96}, append(lowOrder, make([]byte, 64)...)...))}
+		if _, err := k.Server(conn, "agent/db:5432"); err != errNoiseHandshake {
+			t.Fatalf("server: %v, want %v", err, errNoiseHandshake)
+		}
+		if conn.out.Len() != 0 {
+			t.Errorf("replied %d bytes", conn.out.Len())
+		}
+	})
+	t.Run("client", func(t *testing.T) {
+		k := &E2EKeys{keys: &noiseKeys{key: vectorKey(t, vectorInitStatic)}}
+		peer := "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+		conn := &scriptConn{in: bytes.NewReader(nil)}
+		if _, err := k.Client(conn, peer, "agent/db:5432"); err != errNoiseHandshake {
+			t.Fatalf("client: %v, want %v", err, errNoiseHandshake)
+		}
+		if conn.out.Len() != 0 {
+			t.Errorf("sent %d bytes", conn.out.Len())
+		}
+	})
+}
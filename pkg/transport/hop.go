@@ -0,0 +1,94 @@
+package transport
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// The chain of a multi-hop stream is sealed in layers, one for each hop with
+// its e2e static key, the layer of a hop holds the address of the next hop,
+// or of the remote for the last one, and the layers of the hops after it. A
+// hop only reads its own layer so it only learns the address it dials, the
+// hop before it and where the stream goes next. The layers are sealed to an
+// ephemeral X25519 key each, AES-GCM with a key hashed from the shared secret
+// and both public keys.
+//
+// The bytes of the stream aren't sealed by the chain, the hops see them as
+// the proxies do.
+
+var errHopLayer = errors.New("invalid hop layer")
+
+// SealHop seals the layer of the hop of public key peer, next is the address
+// it dials and chain the layers of the hops after it, empty for the last
+func SealHop(peer, next, chain string) (string, error) {
+	rs, err := parseNoisePublic(peer)
+	if err != nil {
+		return "", err
+	}
+	e, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	shared, err := e.ECDH(rs)
+	if err != nil {
+		return "", err
+	}
+	aead, err := hopAEAD(shared, e.PublicKey(), rs)
+	if err != nil {
+		return "", err
+	}
+	plain := []byte(next + "\n" + chain)
+	sealed := aead.Seal(e.PublicKey().Bytes(), make([]byte, aead.NonceSize()), plain, nil)
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// OpenHop opens the layer of chain sealed for k, it returns the address to
+// dial and the layers of the hops after
+func (k *E2EKeys) OpenHop(chain string) (next, rest string, err error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(chain)
+	if err != nil || len(sealed) < noiseKeySize {
+		return "", "", errHopLayer
+	}
+	re, err := ecdh.X25519().NewPublicKey(sealed[:noiseKeySize])
+	if err != nil {
+		return "", "", errHopLayer
+	}
+	shared, err := k.keys.key.ECDH(re)
+	if err != nil {
+		return "", "", errHopLayer
+	}
+	aead, err := hopAEAD(shared, re, k.keys.key.PublicKey())
+	if err != nil {
+		return "", "", err
+	}
+	plain, err := aead.Open(nil, make([]byte, aead.NonceSize()), sealed[noiseKeySize:], nil)
+	if err != nil {
+		return "", "", errHopLayer
+	}
+	next, rest, ok := strings.Cut(string(plain), "\n")
+	if !ok || next == "" {
+		return "", "", errHopLayer
+	}
+	return next, rest, nil
+}
+
+// hopAEAD is the cipher of a layer of ephemeral key e sealed for the static
+// key static, the key is used for a single layer so the nonce is zero
+func hopAEAD(shared []byte, e, static *ecdh.PublicKey) (cipher.AEAD, error) {
+	h := sha256.New()
+	h.Write([]byte("channel hop"))
+	h.Write(shared)
+	h.Write(e.Bytes())
+	h.Write(static.Bytes())
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,483 @@
+package transport
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the proxy is the initiator and knows the static key of the client, the
+// client accepts the proxies whose static keys are listed
+const noiseProtocol = "Noise_IK_25519_AESGCM_SHA256"
+
+const (
+	noiseKeySize  = 32
+	noiseTagSize  = 16
+	noiseMaxFrame = 0xffff
+)
+
+// noiseKeys are the static key and the peer keys of a channel
+type noiseKeys struct {
+	key   *ecdh.PrivateKey
+	peers []*ecdh.PublicKey
+	// anyPeer accepts the initiators of any static key
+	anyPeer bool
+}
+
+var (
+	errNoiseHandshake = errors.New("noise handshake failed")
+	errNoiseTimeout   = errors.New("noise handshake timed out")
+)
+
+// noiseEphemeral generates the ephemeral key of a handshake
+var noiseEphemeral = func() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// loadNoise loads NoiseKey and NoisePeers, the proxy needs exactly one peer
+func (ch *Channel) loadNoise() error {
+	if ch.NoiseKey == "" {
+		if ch.NoisePeers != "" {
+			return errors.New("noise-peers needs noise-key")
+		}
+		return nil
+	}
+	keys, err := loadNoiseKeys(ch.NoiseKey, ch.NoisePeers)
+	if err != nil {
+		return err
+	}
+	if !ch.listener && len(keys.peers) != 1 {
+		return errors.New("proxy needs the noise public key of the client in noise-peers")
+	}
+	if len(keys.peers) == 0 {
+		return errors.New("client needs the noise public keys of the proxies in noise-peers")
+	}
+	ch.noise = keys
+	return nil
+}
+
+// loadNoiseKeys loads the static private key of file and the comma separated
+// public keys of peers
+func loadNoiseKeys(file, peers string) (*noiseKeys, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid noise key, %s", err)
+	}
+	keys := &noiseKeys{}
+	keys.key, err = ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	for _, peer := range strings.Split(peers, ",") {
+		if peer == "" {
+			continue
+		}
+		pub, err := parseNoisePublic(peer)
+		if err != nil {
+			return nil, err
+		}
+		keys.peers = append(keys.peers, pub)
+	}
+	return keys, nil
+}
+
+func parseNoisePublic(s string) (*ecdh.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid noise public key, %s", err)
+	}
+	return ecdh.X25519().NewPublicKey(raw)
+}
+
+// GenNoiseKey generates a new static key pair, in base64 as the key files and
+// the public keys are read
+func GenNoiseKey() (private, public string, err error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(key.Bytes()), base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+// noiseCipher is a CipherState, the nonce is a counter
+type noiseCipher struct {
+	aead cipher.AEAD
+	n    uint64
+}
+
+func newNoiseCipher(k []byte) *noiseCipher {
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return &noiseCipher{aead: aead}
+}
+
+func (c *noiseCipher) nonce() []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], c.n)
+	c.n++
+	return nonce
+}
+
+func (c *noiseCipher) seal(dst, ad, plaintext []byte) []byte {
+	return c.aead.Seal(dst, c.nonce(), plaintext, ad)
+}
+
+func (c *noiseCipher) open(dst, ad, ciphertext []byte) ([]byte, error) {
+	return c.aead.Open(dst, c.nonce(), ciphertext, ad)
+}
+
+// noiseState is the SymmetricState of the handshake
+type noiseState struct {
+	ck, h []byte
+	c     *noiseCipher
+}
+
+// newNoiseState starts a handshake, both sides must have the same prologue,
+// the channel's is empty
+func newNoiseState(prologue []byte) *noiseState {
+	h := make([]byte, sha256.Size)
+	copy(h, noiseProtocol)
+	state := &noiseState{ck: append([]byte(nil), h...), h: h}
+	state.mixHash(prologue)
+	return state
+}
+
+func (state *noiseState) mixHash(data []byte) {
+	sum := sha256.Sum256(append(append([]byte(nil), state.h...), data...))
+	state.h = sum[:]
+}
+
+func (state *noiseState) mixKey(ikm []byte) {
+	var k []byte
+	state.ck, k = noiseHKDF(state.ck, ikm)
+	state.c = newNoiseCipher(k)
+}
+
+func (state *noiseState) encryptAndHash(plaintext []byte) []byte {
+	ciphertext := state.c.seal(nil, state.h, plaintext)
+	state.mixHash(ciphertext)
+	return ciphertext
+}
+
+func (state *noiseState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext, err := state.c.open(nil, state.h, ciphertext)
+	if err != nil {
+		return nil, errNoiseHandshake
+	}
+	state.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// split returns the ciphers of the initiator to responder and the responder
+// to initiator directions
+func (state *noiseState) split() (*noiseCipher, *noiseCipher) {
+	k1, k2 := noiseHKDF(state.ck, nil)
+	return newNoiseCipher(k1), newNoiseCipher(k2)
+}
+
+func noiseHMAC(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+func noiseHKDF(ck, ikm []byte) ([]byte, []byte) {
+	tempKey := noiseHMAC(ck, ikm)
+	out1 := noiseHMAC(tempKey, []byte{1})
+	out2 := noiseHMAC(tempKey, out1, []byte{2})
+	return out1, out2
+}
+
+// mixDH mixes the DH of key and pub in the key, a low order pub of the peer
+// fails the handshake
+func (state *noiseState) mixDH(key *ecdh.PrivateKey, pub *ecdh.PublicKey) error {
+	shared, err := key.ECDH(pub)
+	if err != nil {
+		return errNoiseHandshake
+	}
+	state.mixKey(shared)
+	return nil
+}
+
+// noiseConn carries the stream in length prefixed AEAD frames
+type noiseConn struct {
+	net.Conn
+	once      sync.Once
+	handshake func() error
+	err       error
+
+	readLock sync.Mutex
+	recv     *noiseCipher
+	frame    []byte
+	pending  []byte
+
+	writeLock sync.Mutex
+	send      *noiseCipher
+}
+
+func (c *noiseConn) String() string {
+	return fmt.Sprint(c.Conn)
+}
+
+// NetConn is the wrapped connection
+func (c *noiseConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *noiseConn) init() error {
+	c.once.Do(func() { c.err = c.handshake() })
+	return c.err
+}
+
+// client runs the initiator handshake with the client key, the only peer
+func (keys *noiseKeys) client(conn net.Conn) (net.Conn, error) {
+	return keys.initiate(conn, keys.peers[0], nil)
+}
+
+// initiate runs the initiator handshake with the responder of static key rs
+func (keys *noiseKeys) initiate(conn net.Conn, rs *ecdh.PublicKey, prologue []byte) (net.Conn, error) {
+	state := newNoiseState(prologue)
+	state.mixHash(rs.Bytes())
+	e, err := noiseEphemeral()
+	if err != nil {
+		return nil, err
+	}
+	msg := e.PublicKey().Bytes()
+	state.mixHash(msg)
+	if err := state.mixDH(e, rs); err != nil {
+		return nil, err
+	}
+	msg = append(msg, state.encryptAndHash(keys.key.PublicKey().Bytes())...)
+	if err := state.mixDH(keys.key, rs); err != nil {
+		return nil, err
+	}
+	msg = append(msg, state.encryptAndHash(nil)...)
+	if err := writeNoiseMessage(conn, msg); err != nil {
+		return nil, err
+	}
+	msg, err = readNoiseMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) != noiseKeySize+noiseTagSize {
+		return nil, errNoiseHandshake
+	}
+	re, err := ecdh.X25519().NewPublicKey(msg[:noiseKeySize])
+	if err != nil {
+		return nil, errNoiseHandshake
+	}
+	state.mixHash(msg[:noiseKeySize])
+	if err := state.mixDH(e, re); err != nil {
+		return nil, err
+	}
+	if err := state.mixDH(keys.key, re); err != nil {
+		return nil, err
+	}
+	if _, err := state.decryptAndHash(msg[noiseKeySize:]); err != nil {
+		return nil, err
+	}
+	send, recv := state.split()
+	c := &noiseConn{Conn: conn, send: send, recv: recv}
+	c.once.Do(func() {})
+	return c, nil
+}
+
+// noiseClient runs client on conn, closing conn once ctx is done or
+// HandshakeTimeout runs out as not every transport takes deadlines
+func (ch *Channel) noiseClient(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	var timer *time.Timer
+	if ch.HandshakeTimeout > 0 {
+		timer = time.AfterFunc(ch.HandshakeTimeout, func() { conn.Close() })
+	}
+	noiseConn, err := ch.noise.client(conn)
+	if timer != nil && !timer.Stop() {
+		return nil, errNoiseTimeout
+	}
+	if !stop() {
+		return nil, ctx.Err()
+	}
+	return noiseConn, err
+}
+
+// server runs the responder handshake on first use, the initiator must
+// hold one of the peer keys
+func (keys *noiseKeys) server(conn net.Conn) net.Conn {
+	return keys.respond(conn, nil)
+}
+
+// respond is server with the prologue of the handshake
+func (keys *noiseKeys) respond(conn net.Conn, prologue []byte) *noiseConn {
+	c := &noiseConn{Conn: conn}
+	c.handshake = func() error {
+		msg, err := readNoiseMessage(conn)
+		if err != nil {
+			return err
+		}
+		if len(msg) != noiseKeySize+noiseKeySize+noiseTagSize+noiseTagSize {
+			return errNoiseHandshake
+		}
+		state := newNoiseState(prologue)
+		state.mixHash(keys.key.PublicKey().Bytes())
+		re, err := ecdh.X25519().NewPublicKey(msg[:noiseKeySize])
+		if err != nil {
+			return errNoiseHandshake
+		}
+		state.mixHash(msg[:noiseKeySize])
+		if err := state.mixDH(keys.key, re); err != nil {
+			return err
+		}
+		raw, err := state.decryptAndHash(msg[noiseKeySize : 2*noiseKeySize+noiseTagSize])
+		if err != nil {
+			return err
+		}
+		rs, err := ecdh.X25519().NewPublicKey(raw)
+		if err != nil {
+			return errNoiseHandshake
+		}
+		if !keys.allowed(rs) {
+			log.Printf("noise peer not allowed, %s\n", base64.StdEncoding.EncodeToString(raw))
+			return errNoiseHandshake
+		}
+		if err := state.mixDH(keys.key, rs); err != nil {
+			return err
+		}
+		if _, err := state.decryptAndHash(msg[2*noiseKeySize+noiseTagSize:]); err != nil {
+			return err
+		}
+		e, err := noiseEphemeral()
+		if err != nil {
+			return err
+		}
+		reply := e.PublicKey().Bytes()
+		state.mixHash(reply)
+		if err := state.mixDH(e, re); err != nil {
+			return err
+		}
+		if err := state.mixDH(e, rs); err != nil {
+			return err
+		}
+		reply = append(reply, state.encryptAndHash(nil)...)
+		if err := writeNoiseMessage(conn, reply); err != nil {
+			return err
+		}
+		c.recv, c.send = state.split()
+		return nil
+	}
+	return c
+}
+
+func (keys *noiseKeys) allowed(pub *ecdh.PublicKey) bool {
+	if keys.anyPeer {
+		return true
+	}
+	for _, peer := range keys.peers {
+		if peer.Equal(pub) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeNoiseMessage(w io.Writer, msg []byte) error {
+	frame := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(frame, uint16(len(msg)))
+	_, err := w.Write(append(frame, msg...))
+	return err
+}
+
+func readNoiseMessage(r io.Reader) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (c *noiseConn) Read(p []byte) (int, error) {
+	if err := c.init(); err != nil {
+		return 0, err
+	}
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	for len(c.pending) == 0 {
+		var size [2]byte
+		if _, err := io.ReadFull(c.Conn, size[:]); err != nil {
+			return 0, err
+		}
+		n := int(binary.BigEndian.Uint16(size[:]))
+		if n < noiseTagSize {
+			return 0, errNoiseHandshake
+		}
+		if cap(c.frame) < n {
+			c.frame = make([]byte, noiseMaxFrame)
+		}
+		frame := c.frame[:n]
+		if _, err := io.ReadFull(c.Conn, frame); err != nil {
+			return 0, err
+		}
+		plaintext, err := c.recv.open(frame[:0], nil, frame)
+		if err != nil {
+			return 0, err
+		}
+		c.pending = plaintext
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *noiseConn) Write(p []byte) (int, error) {
+	if err := c.init(); err != nil {
+		return 0, err
+	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > noiseMaxFrame-noiseTagSize {
+			chunk = chunk[:noiseMaxFrame-noiseTagSize]
+		}
+		frame := make([]byte, 2, 2+len(chunk)+noiseTagSize)
+		frame = c.send.seal(frame, nil, chunk)
+		binary.BigEndian.PutUint16(frame, uint16(len(frame)-2))
+		if _, err := c.Conn.Write(frame); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
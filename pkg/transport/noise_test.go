@@ -0,0 +1,244 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"encoding/hex"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// the keys of the cacophony vectors of Noise_IK, the messages were computed
+// apart from this package with the HKDF, X25519 and AES-GCM of RFC 5869, RFC
+// 7748 and SP 800-38D
+const (
+	vectorInitStatic    = "e61ef9919cde45dd5f82166404bd08e38bceb5dfdfded0a34c8df7ed542214d1"
+	vectorInitEphemeral = "893e28b9dc6ca8d611ab664754b8ceb7bac5117349a4439a6b0569da977c464a"
+	vectorRespStatic    = "4a3acbfdb163dec651dfa3194dece676d437029c62a408b4c5ea9114246e4893"
+	vectorRespEphemeral = "bbdb4cdbd309f1a1f2e1456967fe288cadd6f712d65dc7b7793d5e63da6b375b"
+	// the transport messages are the same for any prologue, it's mixed in h
+	// and not in the chaining key
+	vectorInitPayload   = "Ludwig von Mises"
+	vectorInitTransport = "00206cf7b8a4a45e15f6708bd55cec1d3ed695fb4f5ce5297fe043bf846c50e36256"
+	vectorRespPayload   = "Murray Rothbard"
+	vectorRespTransport = "001f7fec9ab8120e28db03193c0ab720868bfe0f173ef754f03d49a0c8329e2050"
+)
+
+var noiseVectors = []struct {
+	name     string
+	prologue string
+	msg1     string
+	msg2     string
+}{
+	{
+		name: "empty prologue",
+		msg1: "0060ca35def5ae56cec33dc2036731ab14896bc4c75dbb07a61f879f8e3afa4c79444e417bc55c7a8166c993356c1be41ef6" +
+			"7818a292426f301556c7f26b21d25ddb426d4b55c2fe341ed40b949af4e6d89f106bf5530797721329e27c7b5bd53104",
+		msg2: "003095ebc60d2b1fa672c1f46a8aa265ef51bfe38e7ccb39ec5be34069f144808843ed062653443dcc9ad09629dcacfeae86",
+	},
+	{
+		name:     "prologue",
+		prologue: "John Galt",
+		msg1: "0060ca35def5ae56cec33dc2036731ab14896bc4c75dbb07a61f879f8e3afa4c79444e417bc55c7a8166c993356c1be41ef6" +
+			"7818a292426f301556c7f26b21d25ddb097153891a9a956cff47b83e63ad8d70111fd4074e08bace1055df2cbb29688b",
+		msg2: "003095ebc60d2b1fa672c1f46a8aa265ef51bfe38e7ccb39ec5be34069f1448088430dc4bf37cd639b178a7da5842e4528cd",
+	},
+}
+
+// scriptConn reads what it's given and records what's written
+type scriptConn struct {
+	net.Conn
+	in  io.Reader
+	out bytes.Buffer
+}
+
+func (c *scriptConn) Read(p []byte) (int, error)  { return c.in.Read(p) }
+func (c *scriptConn) Write(p []byte) (int, error) { return c.out.Write(p) }
+
+func vectorKey(t *testing.T, s string) *ecdh.PrivateKey {
+	t.Helper()
+	raw, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func vectorBytes(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// withEphemeral makes key the ephemeral key of the handshakes of the test
+func withEphemeral(t *testing.T, key *ecdh.PrivateKey) {
+	t.Helper()
+	saved := noiseEphemeral
+	noiseEphemeral = func() (*ecdh.PrivateKey, error) { return key, nil }
+	t.Cleanup(func() { noiseEphemeral = saved })
+}
+
+func TestNoiseInitiatorVectors(t *testing.T) {
+	for _, v := range noiseVectors {
+		t.Run(v.name, func(t *testing.T) {
+			withEphemeral(t, vectorKey(t, vectorInitEphemeral))
+			keys := &noiseKeys{key: vectorKey(t, vectorInitStatic)}
+			rs := vectorKey(t, vectorRespStatic).PublicKey()
+			msg2 := vectorBytes(t, v.msg2)
+			conn := &scriptConn{in: io.MultiReader(bytes.NewReader(msg2), bytes.NewReader(vectorBytes(t, vectorRespTransport)))}
+			c, err := keys.initiate(conn, rs, []byte(v.prologue))
+			if err != nil {
+				t.Fatalf("initiate: %s", err)
+			}
+			if got := hex.EncodeToString(conn.out.Bytes()); got != v.msg1 {
+				t.Errorf("message 1\n got %s\nwant %s", got, v.msg1)
+			}
+			conn.out.Reset()
+			if _, err := c.Write([]byte(vectorInitPayload)); err != nil {
+				t.Fatal(err)
+			}
+			if got := hex.EncodeToString(conn.out.Bytes()); got != vectorInitTransport {
+				t.Errorf("transport message\n got %s\nwant %s", got, vectorInitTransport)
+			}
+			buf := make([]byte, 64)
+			n, err := c.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(buf[:n]); got != vectorRespPayload {
+				t.Errorf("read %q, want %q", got, vectorRespPayload)
+			}
+		})
+	}
+}
+
+func TestNoiseResponderVectors(t *testing.T) {
+	for _, v := range noiseVectors {
+		t.Run(v.name, func(t *testing.T) {
+			withEphemeral(t, vectorKey(t, vectorRespEphemeral))
+			keys := &noiseKeys{key: vectorKey(t, vectorRespStatic), anyPeer: true}
+			msg1 := vectorBytes(t, v.msg1)
+			conn := &scriptConn{in: io.MultiReader(bytes.NewReader(msg1), bytes.NewReader(vectorBytes(t, vectorInitTransport)))}
+			c := keys.respond(conn, []byte(v.prologue))
+			buf := make([]byte, 64)
+			n, err := c.Read(buf)
+			if err != nil {
+				t.Fatalf("respond: %s", err)
+			}
+			if got := string(buf[:n]); got != vectorInitPayload {
+				t.Errorf("read %q, want %q", got, vectorInitPayload)
+			}
+			if got := hex.EncodeToString(conn.out.Bytes()); got != v.msg2 {
+				t.Errorf("message 2\n got %s\nwant %s", got, v.msg2)
+			}
+			conn.out.Reset()
+			if _, err := c.Write([]byte(vectorRespPayload)); err != nil {
+				t.Fatal(err)
+			}
+			if got := hex.EncodeToString(conn.out.Bytes()); got != vectorRespTransport {
+				t.Errorf("transport message\n got %s\nwant %s", got, vectorRespTransport)
+			}
+		})
+	}
+}
+
+func TestNoiseResponderRejects(t *testing.T) {
+	msg1 := vectorBytes(t, noiseVectors[0].msg1)
+	other := vectorKey(t, vectorRespEphemeral).PublicKey()
+	for _, tc := range []struct {
+		name  string
+		keys  *noiseKeys
+		input []byte
+	}{
+		{"peer not listed", &noiseKeys{peers: []*ecdh.PublicKey{other}}, msg1},
+		{"tampered", &noiseKeys{anyPeer: true}, append(append([]byte(nil), msg1[:40]...), append([]byte{msg1[40] ^ 1}, msg1[41:]...)...)},
+		{"short", &noiseKeys{anyPeer: true}, append([]byte{0, 64}, msg1[2:66]...)},
+		{"truncated", &noiseKeys{anyPeer: true}, msg1[:50]},
+		{"low order ephemeral", &noiseKeys{anyPeer: true}, append([]byte{0, 96}, make([]byte, 96)...)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			withEphemeral(t, vectorKey(t, vectorRespEphemeral))
+			tc.keys.key = vectorKey(t, vectorRespStatic)
+			conn := &scriptConn{in: bytes.NewReader(tc.input)}
+			if _, err := tc.keys.respond(conn, nil).Read(make([]byte, 64)); err == nil {
+				t.Fatal("handshake passed")
+			}
+			if conn.out.Len() != 0 {
+				t.Errorf("replied %d bytes", conn.out.Len())
+			}
+		})
+	}
+}
+
+func TestNoiseInitiatorRejectsLowOrder(t *testing.T) {
+	withEphemeral(t, vectorKey(t, vectorInitEphemeral))
+	keys := &noiseKeys{key: vectorKey(t, vectorInitStatic)}
+	rs := vectorKey(t, vectorRespStatic).PublicKey()
+	conn := &scriptConn{in: bytes.NewReader(append([]byte{0, 48}, make([]byte, 48)...))}
+	if _, err := keys.initiate(conn, rs, nil); err != errNoiseHandshake {
+		t.Fatalf("initiate: %v, want %v", err, errNoiseHandshake)
+	}
+}
+
+func TestNoiseClientSilentPeer(t *testing.T) {
+	keys := &noiseKeys{key: vectorKey(t, vectorInitStatic), peers: []*ecdh.PublicKey{vectorKey(t, vectorRespStatic).PublicKey()}}
+	for _, tc := range []struct {
+		name    string
+		timeout time.Duration
+		cancel  bool
+		err     error
+	}{
+		{"timeout", 20 * time.Millisecond, false, errNoiseTimeout},
+		{"cancelled", 0, true, context.Canceled},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, peer := net.Pipe()
+			defer peer.Close()
+			// the peer reads the first message and never replies
+			go io.Copy(io.Discard, peer)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tc.cancel {
+				time.AfterFunc(20*time.Millisecond, cancel)
+			}
+			ch := &Channel{HandshakeTimeout: tc.timeout, noise: keys}
+			if _, err := ch.noiseClient(ctx, conn); err != tc.err {
+				t.Fatalf("handshake error %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestGenNoiseKey(t *testing.T) {
+	private, public, err := GenNoiseKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "noise.key")
+	if err := os.WriteFile(file, []byte(private+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// the pair loads as the key file and the public key of a peer
+	keys, err := loadNoiseKeys(file, public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keys.key.PublicKey().Equal(keys.peers[0]) {
+		t.Fatal("public key not of the private key")
+	}
+	if again, _, _ := GenNoiseKey(); again == private {
+		t.Fatal("same key generated twice")
+	}
+}
@@ -0,0 +1,149 @@
+package transport
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Obfuscator disguises the connections of the channel so middleboxes can't
+// tell them apart by their first bytes
+type Obfuscator interface {
+	// Name selects the obfuscator with -obfs
+	Name() string
+	// Client wraps a connection dialed by the proxy, host is the host it
+	// pretends to talk to
+	Client(conn net.Conn, host string) (net.Conn, error)
+	// Server wraps a connection accepted by the client, it must not block,
+	// handshakes run on the first Read or Write like tls.Server
+	Server(conn net.Conn) net.Conn
+}
+
+var (
+	obfuscatorsLock sync.RWMutex
+	obfuscators     = map[string]Obfuscator{}
+)
+
+func init() {
+	RegisterObfuscator(httpObfuscator{})
+}
+
+// RegisterObfuscator makes an obfuscator selectable by its name
+func RegisterObfuscator(obfs Obfuscator) {
+	obfuscatorsLock.Lock()
+	defer obfuscatorsLock.Unlock()
+	obfuscators[obfs.Name()] = obfs
+}
+
+func getObfuscator(name string) Obfuscator {
+	obfuscatorsLock.RLock()
+	defer obfuscatorsLock.RUnlock()
+	return obfuscators[name]
+}
+
+// ObfuscatorNames lists the registered obfuscators
+func ObfuscatorNames() []string {
+	obfuscatorsLock.RLock()
+	defer obfuscatorsLock.RUnlock()
+	var names []string
+	for name := range obfuscators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lazyConn runs its handshake on the first Read or Write
+type lazyConn struct {
+	net.Conn
+	r         io.Reader
+	once      sync.Once
+	handshake func() error
+	err       error
+}
+
+func (c *lazyConn) String() string {
+	return fmt.Sprint(c.Conn)
+}
+
+// NetConn is the wrapped connection
+func (c *lazyConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *lazyConn) init() error {
+	c.once.Do(func() { c.err = c.handshake() })
+	return c.err
+}
+
+func (c *lazyConn) Read(p []byte) (int, error) {
+	if err := c.init(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+func (c *lazyConn) Write(p []byte) (int, error) {
+	if err := c.init(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(p)
+}
+
+var errObfsHandshake = errors.New("obfs handshake failed")
+
+// httpObfuscator makes the channel look like a websocket upgrade to a host,
+// the stream goes raw after the headers like simple-obfs
+type httpObfuscator struct{}
+
+func (httpObfuscator) Name() string {
+	return "http"
+}
+
+func (httpObfuscator) Client(conn net.Conn, host string) (net.Conn, error) {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	req := fmt.Sprintf("GET / HTTP/1.1\r\nHost: %s\r\nUser-Agent: curl/8.5.0\r\nUpgrade: websocket\r\n"+
+		"Connection: Upgrade\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n",
+		host, base64.StdEncoding.EncodeToString(nonce))
+	if _, err := io.WriteString(conn, req); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	rsp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, errObfsHandshake
+	}
+	c := &lazyConn{Conn: conn, r: r, handshake: func() error { return nil }}
+	return c, nil
+}
+
+func (httpObfuscator) Server(conn net.Conn) net.Conn {
+	r := bufio.NewReader(conn)
+	c := &lazyConn{Conn: conn, r: r}
+	c.handshake = func() error {
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			return err
+		}
+		if req.Method != "GET" || req.Header.Get("Upgrade") != "websocket" {
+			io.WriteString(conn, "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n")
+			return errObfsHandshake
+		}
+		rsp := "HTTP/1.1 101 Switching Protocols\r\nServer: nginx\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + wsAccept(req.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n"
+		_, err = io.WriteString(conn, rsp)
+		return err
+	}
+	return c
+}
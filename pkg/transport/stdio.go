@@ -0,0 +1,126 @@
+package transport
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stdio is the transport of a proxy the client runs as its child with exec,
+// the channel is the stdin and stdout of the proxy so no port is opened, the
+// streams are carried by mux on it
+const Stdio = "stdio"
+
+var (
+	errStdioListen = errors.New("the stdio transport is of the proxy the client runs with -exec")
+	errStdioUsed   = errors.New("stdio dialed already, the pipes don't reconnect")
+)
+
+var stdioOnce sync.Once
+
+func init() {
+	Register(Stdio, funcs{
+		validate: validateStdio,
+		dial:     dialStdio,
+		listen:   func(ch *Channel) (net.Listener, error) { return nil, errStdioListen },
+	})
+}
+
+func validateStdio(ch *Channel) error {
+	if ch.listener {
+		return errStdioListen
+	}
+	return nil
+}
+
+// dialStdio is the connection over stdin and stdout, once
+func dialStdio(ch *Channel) (net.Conn, error) {
+	err := errStdioUsed
+	var conn net.Conn
+	stdioOnce.Do(func() {
+		conn, err = NewPipeConn(os.Stdin, os.Stdout, Stdio), nil
+	})
+	return conn, err
+}
+
+// pipeConn is a connection over a pair of pipes
+type pipeConn struct {
+	r    io.ReadCloser
+	w    io.WriteCloser
+	addr pipeAddr
+}
+
+// NewPipeConn is a connection reading r and writing w, as the pipes of a
+// child process, name is its address. The deadlines are those of r and w,
+// none when they're not files
+func NewPipeConn(r io.ReadCloser, w io.WriteCloser, name string) net.Conn {
+	return &pipeConn{r: r, w: w, addr: pipeAddr(name)}
+}
+
+func (c *pipeConn) String() string {
+	return "pipe " + string(c.addr)
+}
+
+func (c *pipeConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *pipeConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+func (c *pipeConn) Close() error {
+	err := c.w.Close()
+	if rerr := c.r.Close(); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// CloseWrite closes the pipe written, the reads go on
+func (c *pipeConn) CloseWrite() error {
+	return c.w.Close()
+}
+
+func (c *pipeConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	if f, ok := c.r.(*os.File); ok {
+		return f.SetReadDeadline(t)
+	}
+	return os.ErrNoDeadline
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	if f, ok := c.w.(*os.File); ok {
+		return f.SetWriteDeadline(t)
+	}
+	return os.ErrNoDeadline
+}
+
+// pipeAddr is the address of a pipeConn
+type pipeAddr string
+
+func (addr pipeAddr) Network() string {
+	return "pipe"
+}
+
+func (addr pipeAddr) String() string {
+	return string(addr)
+}
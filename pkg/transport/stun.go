@@ -0,0 +1,193 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// NAT types told by DiscoverNAT
+const (
+	// NATNone is a public address of the host
+	NATNone = "none"
+	// NATCone maps the host to the same public address for any server, so
+	// hole punching works
+	NATCone = "cone"
+	// NATSymmetric maps the host to another public address for each server
+	NATSymmetric = "symmetric"
+	// NATUnknown is a single server answering
+	NATUnknown = "unknown"
+)
+
+// NATInfo is the public address of the host as STUN servers see it
+type NATInfo struct {
+	Public string `json:"public"`
+	NAT    string `json:"nat"`
+}
+
+const (
+	stunMagic           = 0x2112a442
+	stunBindingRequest  = 0x0001
+	stunBindingResponse = 0x0101
+	stunMappedAddress   = 0x0001
+	stunXORMappedAddr   = 0x0020
+	stunHeaderLen       = 20
+)
+
+var errNoMappedAddress = errors.New("stun response without mapped address")
+
+// DiscoverNAT asks the STUN servers for the public address of one UDP socket,
+// the first two answering tell the NAT type by the addresses they see
+func DiscoverNAT(servers []string, timeout time.Duration) (NATInfo, error) {
+	if len(servers) == 0 {
+		return NATInfo{}, errors.New("no stun server")
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return NATInfo{}, err
+	}
+	defer conn.Close()
+	var mapped []*net.UDPAddr
+	var lastErr error
+	for _, server := range servers {
+		addr, err := stunBinding(conn, server, timeout)
+		if err != nil {
+			lastErr = fmt.Errorf("stun %s: %w", server, err)
+			continue
+		}
+		if mapped = append(mapped, addr); len(mapped) == 2 {
+			break
+		}
+	}
+	if len(mapped) == 0 {
+		return NATInfo{}, lastErr
+	}
+	info := NATInfo{Public: mapped[0].String(), NAT: NATUnknown}
+	switch {
+	case isLocalIP(mapped[0].IP):
+		info.NAT = NATNone
+	case len(mapped) == 2 && mapped[0].String() != mapped[1].String():
+		info.NAT = NATSymmetric
+	case len(mapped) == 2:
+		info.NAT = NATCone
+	}
+	return info, nil
+}
+
+// stunBinding sends a binding request to server and returns the address of
+// its response
+func stunBinding(conn *net.UDPConn, server string, timeout time.Duration) (*net.UDPAddr, error) {
+	raddr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return nil, err
+	}
+	req := make([]byte, stunHeaderLen)
+	binary.BigEndian.PutUint16(req[0:], stunBindingRequest)
+	binary.BigEndian.PutUint32(req[4:], stunMagic)
+	txID := req[8:stunHeaderLen]
+	if _, err := rand.Read(txID); err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteToUDP(req, raddr); err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil, err
+		}
+		rsp := buf[:n]
+		// the answers of former servers, or of anything else, are skipped
+		if n < stunHeaderLen || binary.BigEndian.Uint16(rsp) != stunBindingResponse || !bytes.Equal(rsp[8:stunHeaderLen], txID) {
+			continue
+		}
+		return parseMappedAddress(rsp)
+	}
+}
+
+// parseMappedAddress reads the XOR-MAPPED-ADDRESS of a binding response, or
+// the MAPPED-ADDRESS of the older servers
+func parseMappedAddress(rsp []byte) (*net.UDPAddr, error) {
+	length := int(binary.BigEndian.Uint16(rsp[2:]))
+	if stunHeaderLen+length > len(rsp) {
+		return nil, errors.New("truncated stun response")
+	}
+	var mapped *net.UDPAddr
+	attrs := rsp[stunHeaderLen : stunHeaderLen+length]
+	for len(attrs) >= 4 {
+		typ := binary.BigEndian.Uint16(attrs)
+		alen := int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+alen > len(attrs) {
+			break
+		}
+		value := attrs[4 : 4+alen]
+		switch typ {
+		case stunXORMappedAddr:
+			if addr := stunAddress(value, rsp[4:stunHeaderLen]); addr != nil {
+				return addr, nil
+			}
+		case stunMappedAddress:
+			mapped = stunAddress(value, nil)
+		}
+		// the attributes are padded to 4 bytes
+		next := 4 + (alen+3)&^3
+		if next > len(attrs) {
+			break
+		}
+		attrs = attrs[next:]
+	}
+	if mapped == nil {
+		return nil, errNoMappedAddress
+	}
+	return mapped, nil
+}
+
+// stunAddress decodes an address attribute, xor is the magic cookie and the
+// transaction id the XOR-MAPPED-ADDRESS is masked with, nil for MAPPED-ADDRESS
+func stunAddress(value, xor []byte) *net.UDPAddr {
+	if len(value) < 4 {
+		return nil
+	}
+	var ip net.IP
+	switch value[1] {
+	case 1:
+		ip = make(net.IP, net.IPv4len)
+	case 2:
+		ip = make(net.IP, net.IPv6len)
+	default:
+		return nil
+	}
+	if len(value) < 4+len(ip) {
+		return nil
+	}
+	port := binary.BigEndian.Uint16(value[2:])
+	copy(ip, value[4:])
+	if xor != nil {
+		port ^= uint16(stunMagic >> 16)
+		for i := range ip {
+			ip[i] ^= xor[i]
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: int(port)}
+}
+
+// isLocalIP tells whether ip is an address of the host
+func isLocalIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
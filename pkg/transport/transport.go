@@ -0,0 +1,380 @@
+// Package transport makes the connections of the channel between the proxy
+// and the client, over a transport wrapped by the obfuscator and encryption
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// transports of the channel between the proxy and the client
+const (
+	TCP       = "tcp"
+	WebSocket = "websocket"
+	HTTP2     = "http2"
+)
+
+// Transport makes the raw connections of the channel at ch.Addr, the
+// obfuscator and the encryption wrap them. The built in transports and the
+// ones of other packages are registered by name, Channel.Transport selects one
+type Transport interface {
+	// Dial dials a connection to the client
+	Dial(ch *Channel) (net.Conn, error)
+	// Listen listens for the connections of the proxy
+	Listen(ch *Channel) (net.Listener, error)
+}
+
+// Validator is implemented by the transports which check the channel once it's
+// initialized
+type Validator interface {
+	Validate(ch *Channel) error
+}
+
+// Securer is implemented by the transports which encrypt the connections
+// themselves, as TLS does
+type Securer interface {
+	Secure() bool
+}
+
+// funcs is a Transport of funcs, validate may be nil
+type funcs struct {
+	secure   bool
+	validate func(ch *Channel) error
+	dial     func(ch *Channel) (net.Conn, error)
+	listen   func(ch *Channel) (net.Listener, error)
+}
+
+func (t funcs) Dial(ch *Channel) (net.Conn, error) {
+	return t.dial(ch)
+}
+
+func (t funcs) Listen(ch *Channel) (net.Listener, error) {
+	return t.listen(ch)
+}
+
+func (t funcs) Secure() bool {
+	return t.secure
+}
+
+func (t funcs) Validate(ch *Channel) error {
+	if t.validate == nil {
+		return nil
+	}
+	return t.validate(ch)
+}
+
+var (
+	transportsLock sync.RWMutex
+	transports     = map[string]Transport{}
+)
+
+// Register makes t the transport called name, usually from init, it panics
+// if name is taken
+func Register(name string, t Transport) {
+	transportsLock.Lock()
+	defer transportsLock.Unlock()
+	if _, ok := transports[name]; ok {
+		panic("transport " + name + " registered twice")
+	}
+	transports[name] = t
+}
+
+func getTransport(name string) Transport {
+	transportsLock.RLock()
+	defer transportsLock.RUnlock()
+	return transports[name]
+}
+
+func init() {
+	Register(TCP, funcs{
+		dial: func(ch *Channel) (net.Conn, error) {
+			return ch.dialTCP(ch.Addr)
+		},
+		listen: func(ch *Channel) (net.Listener, error) {
+			return ch.listenTCP(ch.Addr)
+		},
+	})
+	Register(WebSocket, funcs{
+		validate: func(ch *Channel) error {
+			return ch.validateURL("ws", "wss")
+		},
+		dial: func(ch *Channel) (net.Conn, error) {
+			u, err := ch.URL("ws", "wss")
+			if err != nil {
+				return nil, err
+			}
+			return ch.dialWebSocket(u)
+		},
+		listen: func(ch *Channel) (net.Listener, error) {
+			u, err := ch.URL("ws", "wss")
+			if err != nil {
+				return nil, err
+			}
+			return ch.listenWebSocket(u.Host, u.Path)
+		},
+	})
+	Register(HTTP2, funcs{
+		validate: func(ch *Channel) error {
+			return ch.validateURL("http", "https")
+		},
+		dial: func(ch *Channel) (net.Conn, error) {
+			u, err := ch.URL("http", "https")
+			if err != nil {
+				return nil, err
+			}
+			return ch.dialHTTP2(u)
+		},
+		listen: func(ch *Channel) (net.Listener, error) {
+			u, err := ch.URL("http", "https")
+			if err != nil {
+				return nil, err
+			}
+			return ch.listenHTTP2(u.Host, u.Path)
+		},
+	})
+}
+
+// Names lists the transports registered
+func Names() []string {
+	transportsLock.RLock()
+	defer transportsLock.RUnlock()
+	var names []string
+	for name := range transports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Channel is the config of the channel at Addr, the proxy dials it and the
+// client listens it
+type Channel struct {
+	// Addr is the proxy address, a host:port or a URL for the URL based
+	// transports
+	Addr string
+	// Transport is tcp, tls, websocket, http2, kcp or quic when built with
+	// them, or a transport registered by another package
+	Transport string
+	// Obfs is the obfuscator of the channel
+	Obfs string
+	// ObfsHost is the host the obfuscator pretends to talk to
+	ObfsHost string
+	// Crypt is the lightweight encryption of the channel, psk
+	Crypt string
+	// Key is the pre-shared key of the psk crypt
+	Key string
+	// NoiseKey is the file of the noise static private key
+	NoiseKey string
+	// NoisePeers is the comma separated noise static public keys of the peers
+	NoisePeers string
+	// TLSCert and TLSKey are the certificate of the tls transport, the
+	// client's or the client certificate of the proxy
+	TLSCert string
+	TLSKey  string
+	// TLSCA is the certificate authority verifying the peers of the tls
+	// transport
+	TLSCA string
+	// HTTPProxy is the HTTP proxy the proxy connects to Addr through,
+	// HTTPS_PROXY of the environment when empty
+	HTTPProxy string
+	// HandshakeTimeout bounds the handshakes with the HTTP proxy and the
+	// noise handshake
+	HandshakeTimeout time.Duration
+	// KeepAlive is the TCP keepalive of the connections dialed and accepted
+	// by the tcp based transports, those of Go when not enabled
+	KeepAlive net.KeepAliveConfig
+	// Bind is where the connections dialed to Addr originate from, those of
+	// the routes when nil, the tcp based transports only
+	Bind *Bind
+
+	listener bool
+	noise    *noiseKeys
+
+	h2Once   sync.Once
+	h2Client *http.Client
+}
+
+// Init validates the channel and loads its keys, listener is true for the
+// client which listens Addr
+func (ch *Channel) Init(listener bool) error {
+	ch.listener = listener
+	if ch.Transport == "" {
+		ch.Transport = TCP
+	}
+	t := getTransport(ch.Transport)
+	if t == nil {
+		return fmt.Errorf("invalid transport, %s", ch.Transport)
+	}
+	if v, ok := t.(Validator); ok {
+		if err := v.Validate(ch); err != nil {
+			return err
+		}
+	}
+	switch ch.Transport {
+	case TCP, TLS, WebSocket, HTTP2, Stdio:
+	default:
+		if ch.Bind != nil {
+			return fmt.Errorf("the %s transport isn't bound, only the tcp based ones", ch.Transport)
+		}
+	}
+	if ch.Obfs != "" && getObfuscator(ch.Obfs) == nil {
+		return fmt.Errorf("invalid obfs, %s", ch.Obfs)
+	}
+	if err := ch.validateCrypt(); err != nil {
+		return err
+	}
+	if err := ch.loadNoise(); err != nil {
+		return err
+	}
+	return ch.validateHTTPProxy()
+}
+
+// Encrypted tells whether the channel is encrypted, by psk or noise
+func (ch *Channel) Encrypted() bool {
+	return ch.Crypt == CryptPSK || ch.noise != nil
+}
+
+// Secured tells whether the channel is encrypted or authenticated
+func (ch *Channel) Secured() bool {
+	if ch.Encrypted() {
+		return true
+	}
+	if s, ok := getTransport(ch.Transport).(Securer); ok && s.Secure() {
+		return true
+	}
+	if u, err := url.Parse(ch.Addr); err == nil && (u.Scheme == "wss" || u.Scheme == "https") {
+		return true
+	}
+	return false
+}
+
+// validateURL checks Addr for the URL based transports, the client listens
+// the plain scheme only and is expected to be fronted for the secure one
+func (ch *Channel) validateURL(plain, secure string) error {
+	u, err := ch.URL(plain, secure)
+	if err != nil {
+		return err
+	}
+	if ch.listener && u.Scheme != plain {
+		return fmt.Errorf("client listens %s only, front it for %s", plain, u.Scheme)
+	}
+	return nil
+}
+
+// URL is the URL of Addr for the URL based transports, Addr is either a
+// host:port or a URL of the plain or secure scheme
+func (ch *Channel) URL(plain, secure string) (*url.URL, error) {
+	addr := ch.Addr
+	if !strings.Contains(addr, "://") {
+		addr = plain + "://" + addr + "/"
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != plain && u.Scheme != secure {
+		return nil, fmt.Errorf("invalid %s url, %s", ch.Transport, ch.Addr)
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	return u, nil
+}
+
+// DialObfuscated dials the transport to Addr wrapped by the obfuscator
+func (ch *Channel) DialObfuscated() (net.Conn, error) {
+	conn, err := getTransport(ch.Transport).Dial(ch)
+	if err != nil {
+		return nil, err
+	}
+	if ch.Obfs != "" {
+		obfsConn, err := getObfuscator(ch.Obfs).Client(conn, ch.ObfsHost)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = obfsConn
+	}
+	return conn, nil
+}
+
+// Dial dials a control or data connection to Addr, the obfuscator wraps the
+// transport and the encryption goes inside
+func (ch *Channel) Dial() (net.Conn, error) {
+	return ch.DialContext(context.Background())
+}
+
+// DialContext is Dial failing the noise handshake once ctx is done or
+// HandshakeTimeout runs out
+func (ch *Channel) DialContext(ctx context.Context) (net.Conn, error) {
+	conn, err := ch.DialObfuscated()
+	if err != nil {
+		return nil, err
+	}
+	if ch.Crypt == CryptPSK {
+		conn = ch.cryptWrap(conn)
+	}
+	if ch.noise != nil {
+		noiseConn, err := ch.noiseClient(ctx, conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = noiseConn
+	}
+	return conn, nil
+}
+
+// Listen listens for the control and data connections at Addr
+func (ch *Channel) Listen() (net.Listener, error) {
+	ln, err := getTransport(ch.Transport).Listen(ch)
+	if err != nil {
+		return nil, err
+	}
+	if ch.Obfs != "" {
+		ln = wrapListener{Listener: ln, wrap: getObfuscator(ch.Obfs).Server}
+	}
+	if ch.Crypt == CryptPSK {
+		ln = wrapListener{Listener: ln, wrap: ch.cryptWrap}
+	}
+	if ch.noise != nil {
+		ln = wrapListener{Listener: ln, wrap: ch.noise.server}
+	}
+	return ln, nil
+}
+
+// http2 is the HTTP/2 client of the channel, it multiplexes the streams
+// dialed by the proxy on a shared connection, with prior knowledge for
+// http:// and ALPN for https://
+func (ch *Channel) http2() *http.Client {
+	ch.h2Once.Do(func() {
+		ch.h2Client = &http.Client{Transport: &http.Transport{
+			Protocols: h2Protocols(),
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return ch.dialTCP(addr)
+			},
+		}}
+	})
+	return ch.h2Client
+}
+
+// wrapListener wraps the accepted connections, wrap must not block
+type wrapListener struct {
+	net.Listener
+	wrap func(net.Conn) net.Conn
+}
+
+func (ln wrapListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return ln.wrap(conn), nil
+}
@@ -0,0 +1,220 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var errDeadlineNotSupported = errors.New("deadline not supported")
+
+func h2Protocols() *http.Protocols {
+	p := &http.Protocols{}
+	p.SetHTTP2(true)
+	p.SetUnencryptedHTTP2(true)
+	return p
+}
+
+// h2Addr is the address of an HTTP/2 stream
+type h2Addr string
+
+func (addr h2Addr) Network() string {
+	return "http2"
+}
+
+func (addr h2Addr) String() string {
+	return string(addr)
+}
+
+// h2Conn is an HTTP/2 stream, reading the body from the peer and writing the
+// body to it, flushed on each write
+type h2Conn struct {
+	io.Reader
+	w       io.Writer
+	flush   func() error
+	close   func()
+	local   net.Addr
+	remote  net.Addr
+	control *http.ResponseController
+
+	once sync.Once
+	done chan struct{}
+}
+
+func (c *h2Conn) String() string {
+	return "http2 stream " + c.remote.String()
+}
+
+func (c *h2Conn) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if c.flush != nil {
+		err = c.flush()
+	}
+	return n, err
+}
+
+func (c *h2Conn) Close() error {
+	c.once.Do(func() {
+		c.close()
+		close(c.done)
+	})
+	return nil
+}
+
+func (c *h2Conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *h2Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *h2Conn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline is supported for the streams accepted by the client only
+func (c *h2Conn) SetReadDeadline(t time.Time) error {
+	if c.control == nil {
+		return errDeadlineNotSupported
+	}
+	return c.control.SetReadDeadline(t)
+}
+
+// SetWriteDeadline is supported for the streams accepted by the client only
+func (c *h2Conn) SetWriteDeadline(t time.Time) error {
+	if c.control == nil {
+		return errDeadlineNotSupported
+	}
+	return c.control.SetWriteDeadline(t)
+}
+
+// dialHTTP2 opens a stream with a POST whose request and response bodies
+// carry the connection
+func (ch *Channel) dialHTTP2(u *url.URL) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	pr, pw := io.Pipe()
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), pr)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	rsp, err := ch.http2().Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if rsp.StatusCode != http.StatusOK || rsp.ProtoMajor != 2 {
+		rsp.Body.Close()
+		cancel()
+		return nil, errors.New("http2 stream refused, " + rsp.Status)
+	}
+	return &h2Conn{
+		Reader: rsp.Body,
+		w:      pw,
+		close: func() {
+			pw.Close()
+			rsp.Body.Close()
+			cancel()
+		},
+		local:  h2Addr("proxy"),
+		remote: h2Addr(u.Host),
+		done:   make(chan struct{}),
+	}, nil
+}
+
+// h2Listener accepts the streams posted at path
+type h2Listener struct {
+	ln    net.Listener
+	path  string
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (ch *Channel) listenHTTP2(addr, path string) (net.Listener, error) {
+	ln, err := ch.listenTCP(addr)
+	if err != nil {
+		return nil, err
+	}
+	h2ln := &h2Listener{
+		ln:    ln,
+		path:  path,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	srv := &http.Server{Handler: h2ln, Protocols: h2Protocols()}
+	go func() {
+		err := srv.Serve(ln)
+		log.Printf("Serve: %s\n", err)
+		h2ln.Close()
+	}()
+	return h2ln, nil
+}
+
+// ServeHTTP hands the stream over to Accept and holds it until it's closed
+func (h2ln *h2Listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != h2ln.path {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" || r.ProtoMajor != 2 {
+		http.Error(w, "http2 only", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	control := http.NewResponseController(w)
+	w.WriteHeader(http.StatusOK)
+	if err := control.Flush(); err != nil {
+		log.Printf("Flush: %s\n", err)
+		return
+	}
+	conn := &h2Conn{
+		Reader:  r.Body,
+		w:       w,
+		flush:   control.Flush,
+		close:   func() {},
+		local:   h2ln.ln.Addr(),
+		remote:  h2Addr(r.RemoteAddr),
+		control: control,
+		done:    make(chan struct{}),
+	}
+	select {
+	case h2ln.conns <- conn:
+	case <-h2ln.done:
+		return
+	}
+	select {
+	case <-conn.done:
+	case <-r.Context().Done():
+	}
+}
+
+func (h2ln *h2Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-h2ln.conns:
+		return conn, nil
+	case <-h2ln.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (h2ln *h2Listener) Close() error {
+	h2ln.once.Do(func() { close(h2ln.done) })
+	return h2ln.ln.Close()
+}
+
+func (h2ln *h2Listener) Addr() net.Addr {
+	return h2ln.ln.Addr()
+}
@@ -0,0 +1,110 @@
+//go:build kcp
+// +build kcp
+
+package transport
+
+import (
+	"errors"
+	"net"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+// KCP is the kcp transport, over UDP
+const KCP = "kcp"
+
+// KCPConfig tunes the kcp sessions
+type KCPConfig struct {
+	// DataShards is the FEC data shards, 0 disables FEC
+	DataShards int
+	// ParityShards is the FEC parity shards
+	ParityShards int
+	// SendWindow is the send window in packets
+	SendWindow int
+	// RecvWindow is the receive window in packets
+	RecvWindow int
+	// MTU is the MTU of the packets
+	MTU int
+	// NoDelay retransmits early and doesn't back off, for lossy links
+	NoDelay bool
+	// Interval is the internal update interval in milliseconds
+	Interval int
+	// Resend resends after this many duplicated acks, 0 waits the timeout
+	Resend int
+}
+
+// KCPOptions tunes the kcp sessions of all channels
+var KCPOptions = KCPConfig{
+	DataShards:   10,
+	ParityShards: 3,
+	SendWindow:   1024,
+	RecvWindow:   1024,
+	MTU:          1350,
+	NoDelay:      true,
+	Interval:     20,
+	Resend:       2,
+}
+
+func init() {
+	Register(KCP, funcs{
+		validate: validateKCP,
+		dial:     dialKCP,
+		listen:   listenKCP,
+	})
+}
+
+func validateKCP(ch *Channel) error {
+	if KCPOptions.DataShards < 0 || KCPOptions.ParityShards < 0 {
+		return errors.New("invalid kcp shards")
+	}
+	if KCPOptions.SendWindow <= 0 || KCPOptions.RecvWindow <= 0 {
+		return errors.New("invalid kcp window")
+	}
+	return nil
+}
+
+// tuneKCP applies KCPOptions to a session, the stream mode carries the
+// channel byte stream rather than messages
+func tuneKCP(sess *kcp.UDPSession) {
+	sess.SetStreamMode(true)
+	sess.SetWriteDelay(false)
+	sess.SetWindowSize(KCPOptions.SendWindow, KCPOptions.RecvWindow)
+	sess.SetMtu(KCPOptions.MTU)
+	sess.SetACKNoDelay(true)
+	noDelay, noCongestion := 0, 0
+	if KCPOptions.NoDelay {
+		noDelay, noCongestion = 1, 1
+	}
+	sess.SetNoDelay(noDelay, KCPOptions.Interval, KCPOptions.Resend, noCongestion)
+}
+
+func dialKCP(ch *Channel) (net.Conn, error) {
+	sess, err := kcp.DialWithOptions(ch.Addr, nil, KCPOptions.DataShards, KCPOptions.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	tuneKCP(sess)
+	return sess, nil
+}
+
+// kcpListener tunes the sessions it accepts
+type kcpListener struct {
+	*kcp.Listener
+}
+
+func listenKCP(ch *Channel) (net.Listener, error) {
+	ln, err := kcp.ListenWithOptions(ch.Addr, nil, KCPOptions.DataShards, KCPOptions.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	return kcpListener{ln}, nil
+}
+
+func (ln kcpListener) Accept() (net.Conn, error) {
+	sess, err := ln.AcceptKCP()
+	if err != nil {
+		return nil, err
+	}
+	tuneKCP(sess)
+	return sess, nil
+}
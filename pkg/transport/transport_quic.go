@@ -0,0 +1,172 @@
+//go:build quic
+// +build quic
+
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// QUIC is the quic transport, the connections of the channel are the streams
+// of a QUIC connection the proxy shares, in TLS configured as for the tls
+// transport
+const QUIC = "quic"
+
+// quicALPN is the application protocol of the QUIC connections
+const quicALPN = "channel"
+
+var quicConfig = &quic.Config{KeepAlivePeriod: 15 * time.Second}
+
+func init() {
+	Register(QUIC, &quicTransport{conns: map[*Channel]*quic.Conn{}})
+}
+
+// quicTransport keeps the QUIC connection of each channel dialed
+type quicTransport struct {
+	sync.Mutex
+	conns map[*Channel]*quic.Conn
+}
+
+func (t *quicTransport) Secure() bool {
+	return true
+}
+
+func (t *quicTransport) Validate(ch *Channel) error {
+	return validateTLS(ch)
+}
+
+func (t *quicTransport) Dial(ch *Channel) (net.Conn, error) {
+	conn, err := t.conn(ch)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &quicConn{Stream: stream, conn: conn}, nil
+}
+
+// conn is the QUIC connection of ch, dialed again once it's closed
+func (t *quicTransport) conn(ch *Channel) (*quic.Conn, error) {
+	t.Lock()
+	defer t.Unlock()
+	if conn := t.conns[ch]; conn != nil && conn.Context().Err() == nil {
+		return conn, nil
+	}
+	config, err := ch.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	config.NextProtos = []string{quicALPN}
+	conn, err := quic.DialAddr(context.Background(), ch.Addr, config, quicConfig)
+	if err != nil {
+		return nil, err
+	}
+	t.conns[ch] = conn
+	return conn, nil
+}
+
+func (t *quicTransport) Listen(ch *Channel) (net.Listener, error) {
+	config, err := ch.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	config.NextProtos = []string{quicALPN}
+	ln, err := quic.ListenAddr(ch.Addr, config, quicConfig)
+	if err != nil {
+		return nil, err
+	}
+	l := &quicListener{ln: ln, streams: make(chan net.Conn), done: make(chan struct{})}
+	go l.acceptConns()
+	return l, nil
+}
+
+// quicListener accepts the streams of the QUIC connections of the proxies
+type quicListener struct {
+	ln      *quic.Listener
+	streams chan net.Conn
+	once    sync.Once
+	done    chan struct{}
+}
+
+func (l *quicListener) acceptConns() {
+	for {
+		conn, err := l.ln.Accept(context.Background())
+		if err != nil {
+			l.Close()
+			return
+		}
+		go l.acceptStreams(conn)
+	}
+}
+
+func (l *quicListener) acceptStreams(conn *quic.Conn) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		select {
+		case l.streams <- &quicConn{Stream: stream, conn: conn}:
+		case <-l.done:
+			stream.CancelRead(0)
+			stream.Close()
+			return
+		}
+	}
+}
+
+func (l *quicListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.streams:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *quicListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.ln.Close()
+}
+
+func (l *quicListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// quicConn is a stream of a QUIC connection
+type quicConn struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+func (c *quicConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *quicConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// ConnectionState is the TLS state of the QUIC connection, for the mtls auth
+func (c *quicConn) ConnectionState() tls.ConnectionState {
+	return c.conn.ConnectionState().TLS
+}
+
+// Close closes both directions, closing a QUIC stream only ends the writes
+func (c *quicConn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
+
+func (c *quicConn) String() string {
+	return fmt.Sprintf("quic stream %d %s", c.Stream.StreamID(), c.conn.RemoteAddr())
+}
@@ -0,0 +1,102 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+)
+
+// TLS is the tcp transport in TLS, the client verifies the certificates of
+// the proxies against TLSCA so they can be authenticated by them
+const TLS = "tls"
+
+func init() {
+	Register(TLS, funcs{
+		secure:   true,
+		validate: validateTLS,
+		dial:     dialTLS,
+		listen:   listenTLS,
+	})
+}
+
+func validateTLS(ch *Channel) error {
+	if ch.listener && (ch.TLSCert == "" || ch.TLSKey == "") {
+		return fmt.Errorf("%s transport needs -tls-cert and -tls-key on the client", ch.Transport)
+	}
+	_, err := ch.TLSConfig()
+	return err
+}
+
+func dialTLS(ch *Channel) (net.Conn, error) {
+	config, err := ch.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := ch.dialTCP(ch.Addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func listenTLS(ch *Channel) (net.Listener, error) {
+	config, err := ch.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	ln, err := ch.listenTCP(ch.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(ln, config), nil
+}
+
+// TLSConfig is the TLS config of the side of ch, TLSCert is the certificate
+// of the client or the client certificate of the proxy, reloaded once its
+// files change, and TLSCA verifies the peers, the system roots verify the
+// client when empty
+func (ch *Channel) TLSConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if ch.TLSCert != "" || ch.TLSKey != "" {
+		certs, err := newCertReloader(ch.TLSCert, ch.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		// the renewals are picked up by the handshakes, the listener's
+		// config lives as long as the process
+		config.GetCertificate = certs.getCertificate
+		config.GetClientCertificate = certs.getClientCertificate
+	}
+	var pool *x509.CertPool
+	if ch.TLSCA != "" {
+		pem, err := os.ReadFile(ch.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", ch.TLSCA)
+		}
+	}
+	if ch.listener {
+		// the certificates are optional here, the authenticator tells
+		// whether the proxy needs one
+		config.ClientCAs = pool
+		if pool != nil {
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+		return config, nil
+	}
+	config.RootCAs = pool
+	if host, _, err := net.SplitHostPort(ch.Addr); err == nil {
+		config.ServerName = host
+	}
+	return config, nil
+}
@@ -0,0 +1,325 @@
+package transport
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// websocket opcodes
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// wsMaxControl is the max payload of control frames
+const wsMaxControl = 125
+
+var errWebSocketHandshake = errors.New("websocket handshake failed")
+
+func wsAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// dialWebSocket dials u and upgrades the connection to a websocket
+func (ch *Channel) dialWebSocket(u *url.URL) (net.Conn, error) {
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "wss" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	conn, err := ch.dialTCP(host)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "wss" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", u.RequestURI(), u.Host, key)
+	if _, err := io.WriteString(conn, req); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	rsp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusSwitchingProtocols || rsp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		conn.Close()
+		return nil, fmt.Errorf("%s, %s", errWebSocketHandshake, rsp.Status)
+	}
+	return newWSConn(conn, r, true), nil
+}
+
+// wsListener accepts the websockets upgraded at path
+type wsListener struct {
+	ln    net.Listener
+	path  string
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (ch *Channel) listenWebSocket(addr, path string) (net.Listener, error) {
+	ln, err := ch.listenTCP(addr)
+	if err != nil {
+		return nil, err
+	}
+	wsln := &wsListener{
+		ln:    ln,
+		path:  path,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	go func() {
+		err := http.Serve(ln, wsln)
+		log.Printf("Serve: %s\n", err)
+		wsln.Close()
+	}()
+	return wsln, nil
+}
+
+func (wsln *wsListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != wsln.path {
+		http.NotFound(w, r)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != "GET" || r.Header.Get("Upgrade") != "websocket" || key == "" {
+		http.Error(w, "websocket only", http.StatusBadRequest)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "can't hijack", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("Hijack: %s\n", err)
+		return
+	}
+	rsp := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAccept(key) + "\r\n\r\n"
+	if _, err := io.WriteString(conn, rsp); err != nil {
+		conn.Close()
+		return
+	}
+	select {
+	case wsln.conns <- newWSConn(conn, rw.Reader, false):
+	case <-wsln.done:
+		conn.Close()
+	}
+}
+
+func (wsln *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-wsln.conns:
+		return conn, nil
+	case <-wsln.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (wsln *wsListener) Close() error {
+	wsln.once.Do(func() { close(wsln.done) })
+	return wsln.ln.Close()
+}
+
+func (wsln *wsListener) Addr() net.Addr {
+	return wsln.ln.Addr()
+}
+
+// wsConn carries a stream in binary messages, control frames are handled
+// while reading
+type wsConn struct {
+	net.Conn
+	reader *bufio.Reader
+	client bool
+
+	writeLock sync.Mutex
+	remain    int64
+	mask      [4]byte
+	masked    bool
+	maskPos   int
+	closed    bool
+}
+
+func newWSConn(conn net.Conn, r *bufio.Reader, client bool) *wsConn {
+	return &wsConn{Conn: conn, reader: r, client: client}
+}
+
+// String keeps logs showing the underlying connection
+func (c *wsConn) String() string {
+	return fmt.Sprint(c.Conn)
+}
+
+// NetConn is the wrapped connection
+func (c *wsConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for c.remain == 0 {
+		if c.closed {
+			return 0, io.EOF
+		}
+		if err := c.readHeader(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > c.remain {
+		p = p[:c.remain]
+	}
+	n, err := c.reader.Read(p)
+	if c.masked {
+		for i := 0; i < n; i++ {
+			p[i] ^= c.mask[c.maskPos&3]
+			c.maskPos++
+		}
+	}
+	c.remain -= int64(n)
+	return n, err
+}
+
+// readHeader reads frame headers until a data frame, handling control frames
+func (c *wsConn) readHeader() error {
+	var header [2]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return err
+	}
+	opcode := header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	size := int64(header[1] & 0x7f)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return err
+		}
+		size = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return err
+		}
+		size = int64(binary.BigEndian.Uint64(ext[:]))
+	}
+	if size < 0 {
+		return errors.New("invalid websocket frame size")
+	}
+	c.masked = masked
+	c.maskPos = 0
+	if masked {
+		if _, err := io.ReadFull(c.reader, c.mask[:]); err != nil {
+			return err
+		}
+	}
+	switch opcode {
+	case wsContinuation, wsText, wsBinary:
+		c.remain = size
+		return nil
+	}
+	if size > wsMaxControl {
+		return errors.New("invalid websocket control frame")
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= c.mask[i&3]
+		}
+	}
+	switch opcode {
+	case wsPing:
+		return c.writeFrame(wsPong, payload)
+	case wsClose:
+		c.closed = true
+		c.writeFrame(wsClose, payload)
+	}
+	return nil
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, maskBit|126, byte(len(payload)>>8), byte(len(payload)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	if !c.client {
+		frame = append(frame, payload...)
+		_, err := c.Conn.Write(frame)
+		return err
+	}
+	// clients mask every frame
+	var mask [4]byte
+	rand.Read(mask[:])
+	frame = append(frame, mask[:]...)
+	start := len(frame)
+	frame = append(frame, payload...)
+	for i := range payload {
+		frame[start+i] ^= mask[i&3]
+	}
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+func (c *wsConn) Close() error {
+	c.writeFrame(wsClose, nil)
+	return c.Conn.Close()
+}